@@ -51,3 +51,13 @@ app.kubernetes.io/name: {{ include "database-operator.name" . }}
 app.kubernetes.io/instance: {{ .Release.Name }}
 {{- end }}
 
+{{/*
+Create the name of the service account to use
+*/}}
+{{- define "database-operator.serviceAccountName" -}}
+{{- if .Values.serviceAccount.create }}
+{{- default (include "database-operator.fullname" .) .Values.serviceAccount.name }}
+{{- else }}
+{{- default "default" .Values.serviceAccount.name }}
+{{- end }}
+{{- end }}
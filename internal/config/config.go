@@ -8,6 +8,10 @@ import (
 
 var defaultConfig = `
 {
+	"auth": {
+		"tokenReview": true,
+		"accessReview": true
+	}
 }`
 
 var currentListenPort string
@@ -46,6 +50,11 @@ func GetNodePort() string {
 	return currentListenPort
 }
 
+// IsNamespaceScope operator仅拥有所在命名空间的Role权限，无法访问集群级资源
+func IsNamespaceScope() bool {
+	return os.Getenv("RBAC_SCOPE") == "namespace"
+}
+
 func GetConfigFile() string {
 	return cfgFile
 }
@@ -61,5 +70,104 @@ func ReloadConfig() *CfgItem {
 	return configItem
 }
 
+func GetAuthConfig() *AuthConfig {
+	if configItem == nil || configItem.Auth == nil {
+		return &AuthConfig{TokenReview: true, AccessReview: true}
+	}
+
+	return configItem.Auth
+}
+
+func GetAuditFile() string {
+	if configItem == nil {
+		return ""
+	}
+
+	return configItem.AuditFile
+}
+
+func GetNetworkPolicyConfig() *NetworkPolicyConfig {
+	if configItem == nil || configItem.NetworkPolicy == nil {
+		return &defaultNetworkPolicyConfig
+	}
+
+	return configItem.NetworkPolicy
+}
+
+func GetPostgreSQLConfig() *PostgreSQLConfig {
+	if configItem == nil || configItem.PostgreSQL == nil {
+		return &defaultPostgreSQLConfig
+	}
+
+	return configItem.PostgreSQL
+}
+
+func GetBackupConfig() *BackupConfig {
+	if configItem == nil || configItem.Backup == nil {
+		return &defaultBackupConfig
+	}
+
+	return configItem.Backup
+}
+
 type CfgItem struct {
+	Auth          *AuthConfig          `json:"auth"`
+	AuditFile     string               `json:"auditFile"`
+	NetworkPolicy *NetworkPolicyConfig `json:"networkPolicy"`
+	Backup        *BackupConfig        `json:"backup"`
+	PostgreSQL    *PostgreSQLConfig    `json:"postgresql"`
+}
+
+// PostgreSQLConfig 实例配置
+// SuperuserCIDRs 允许以超级用户通过网络连接实例的来源地址，应设置为集群的Pod网段，备节点、备份与恢复任务均从Pod网络连接
+type PostgreSQLConfig struct {
+	SuperuserCIDRs []string `json:"superuserCIDRs"`
+}
+
+var defaultPostgreSQLConfig = PostgreSQLConfig{
+	SuperuserCIDRs: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+}
+
+// BackupConfig 备份任务配置
+// UploaderImage 上传S3兼容存储使用的镜像，需包含sh与mc
+// JobTTL 备份任务完成后保留的秒数
+type BackupConfig struct {
+	UploaderImage string `json:"uploaderImage"`
+	JobTTL        int32  `json:"jobTTL"`
+}
+
+var defaultBackupConfig = BackupConfig{
+	UploaderImage: "minio/mc:RELEASE.2024-10-08T09-37-26Z",
+	JobTTL:        86400,
+}
+
+// NetworkPolicyConfig 生成NetworkPolicy时始终允许访问数据库的operator与监控采集端
+// OperatorLabels operator Pod标签，operator所在命名空间由NAMESPACE环境变量指定
+// ScraperNamespace/ScraperLabels 监控采集端所在命名空间及Pod标签
+type NetworkPolicyConfig struct {
+	OperatorLabels   map[string]string `json:"operatorLabels"`
+	ScraperNamespace string            `json:"scraperNamespace"`
+	ScraperLabels    map[string]string `json:"scraperLabels"`
+}
+
+var defaultNetworkPolicyConfig = NetworkPolicyConfig{
+	OperatorLabels:   map[string]string{"app.kubernetes.io/name": "database-operator"},
+	ScraperNamespace: "monitoring",
+	ScraperLabels:    map[string]string{"app.kubernetes.io/name": "prometheus"},
+}
+
+// AuthConfig REST接口认证与鉴权配置
+// Disable 关闭认证与鉴权，仅用于本地调试
+// TokenSecret 保存静态API Token的Secret名称，data中key为用户名，value为token
+// TokenReview 使用Kubernetes TokenReview校验Bearer Token
+// ClientCA/TLSCert/TLSKey 配置后以HTTPS方式监听，并使用ClientCA校验客户端证书
+// AccessReview 使用SubjectAccessReview对每个操作进行鉴权
+type AuthConfig struct {
+	Disable      bool   `json:"disable"`
+	TokenSecret  string `json:"tokenSecret"`
+	TokenReview  bool   `json:"tokenReview"`
+	ClientCA     string `json:"clientCA"`
+	TLSCert      string `json:"tlsCert"`
+	TLSKey       string `json:"tlsKey"`
+	AccessReview bool   `json:"accessReview"`
 }
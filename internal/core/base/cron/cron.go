@@ -0,0 +1,165 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule 标准5段cron表达式：分 时 日 月 周
+// 支持*、数字、范围a-b、列表a,b与步长*/n、a-b/n、a/n，a/n等同于a-最大值/n，周取值0-7，0与7均表示周日
+type Schedule struct {
+	minute  map[int]bool
+	hour    map[int]bool
+	day     map[int]bool
+	month   map[int]bool
+	weekday map[int]bool
+
+	// anyDay/anyWeekday 日或周以*开头（含*/n）时两者同时满足，日与周均被限定时满足其一即可
+	anyDay     bool
+	anyWeekday bool
+}
+
+type fieldRange struct {
+	min int
+	max int
+}
+
+var fieldRanges = []fieldRange{
+	{min: 0, max: 59},
+	{min: 0, max: 23},
+	{min: 1, max: 31},
+	{min: 1, max: 12},
+	{min: 0, max: 7},
+}
+
+// sunday 周字段中7与0同为周日
+const sunday = 7
+
+// maxSearch 查找下一次执行时间的上限，覆盖闰年2月29日
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+func Parse(expr string) (ret *Schedule, err error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(fieldRanges) {
+		err = fmt.Errorf("illegal cron expression %q, expect 5 fields", expr)
+		return
+	}
+
+	values := make([]map[int]bool, len(fields))
+	for idx, val := range fields {
+		values[idx], err = parseField(val, fieldRanges[idx])
+		if err != nil {
+			err = fmt.Errorf("illegal cron expression %q, %s", expr, err.Error())
+			return
+		}
+	}
+
+	ret = &Schedule{
+		minute:     values[0],
+		hour:       values[1],
+		day:        values[2],
+		month:      values[3],
+		weekday:    values[4],
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}
+	if ret.weekday[sunday] {
+		delete(ret.weekday, sunday)
+		ret.weekday[0] = true
+	}
+	return
+}
+
+func parseField(field string, valueRange fieldRange) (ret map[int]bool, err error) {
+	ret = map[int]bool{}
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		stepOK := false
+		if idx := strings.Index(item, "/"); idx >= 0 {
+			step, err = strconv.Atoi(item[idx+1:])
+			if err != nil || step <= 0 {
+				err = fmt.Errorf("illegal step %q", item)
+				return
+			}
+			item = item[:idx]
+			stepOK = true
+		}
+
+		start, end := valueRange.min, valueRange.max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			items := strings.SplitN(item, "-", 2)
+			start, err = strconv.Atoi(items[0])
+			if err != nil {
+				err = fmt.Errorf("illegal range %q", item)
+				return
+			}
+			end, err = strconv.Atoi(items[1])
+			if err != nil {
+				err = fmt.Errorf("illegal range %q", item)
+				return
+			}
+		default:
+			start, err = strconv.Atoi(item)
+			if err != nil {
+				err = fmt.Errorf("illegal value %q", item)
+				return
+			}
+			// a/n从a开始按步长取到最大值
+			if !stepOK {
+				end = start
+			}
+		}
+
+		if start < valueRange.min || end > valueRange.max || start > end {
+			err = fmt.Errorf("value %q out of range %d-%d", item, valueRange.min, valueRange.max)
+			return
+		}
+		for val := start; val <= end; val += step {
+			ret[val] = true
+		}
+	}
+
+	return
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dayOK := s.day[t.Day()]
+	weekdayOK := s.weekday[int(t.Weekday())]
+	if s.anyDay || s.anyWeekday {
+		return dayOK && weekdayOK
+	}
+
+	return dayOK || weekdayOK
+}
+
+// Next 返回晚于t的下一次执行时间，不存在时返回零值
+func (s *Schedule) Next(t time.Time) time.Time {
+	cur := t.Truncate(time.Minute).Add(time.Minute)
+	deadline := t.Add(maxSearch)
+	for cur.Before(deadline) {
+		if !s.month[int(cur.Month())] {
+			cur = time.Date(cur.Year(), cur.Month()+1, 1, 0, 0, 0, 0, cur.Location())
+			continue
+		}
+		if !s.matchDay(cur) {
+			cur = time.Date(cur.Year(), cur.Month(), cur.Day()+1, 0, 0, 0, 0, cur.Location())
+			continue
+		}
+		if !s.hour[cur.Hour()] {
+			cur = time.Date(cur.Year(), cur.Month(), cur.Day(), cur.Hour()+1, 0, 0, 0, cur.Location())
+			continue
+		}
+		if !s.minute[cur.Minute()] {
+			cur = cur.Add(time.Minute)
+			continue
+		}
+
+		return cur
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,120 @@
+package cron
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func keys(values map[int]bool) (ret []int) {
+	for k := range values {
+		ret = append(ret, k)
+	}
+	sort.Ints(ret)
+	return
+}
+
+func TestParseField(t *testing.T) {
+	minuteRange, weekdayRange := fieldRanges[0], fieldRanges[4]
+	cases := []struct {
+		field      string
+		valueRange fieldRange
+		expect     []int
+		expectErr  bool
+	}{
+		{field: "5", valueRange: minuteRange, expect: []int{5}},
+		{field: "1,3,5", valueRange: minuteRange, expect: []int{1, 3, 5}},
+		{field: "10-12", valueRange: minuteRange, expect: []int{10, 11, 12}},
+		{field: "*/15", valueRange: minuteRange, expect: []int{0, 15, 30, 45}},
+		{field: "5/15", valueRange: minuteRange, expect: []int{5, 20, 35, 50}},
+		{field: "10-30/10", valueRange: minuteRange, expect: []int{10, 20, 30}},
+		{field: "1-5,58/1", valueRange: minuteRange, expect: []int{1, 2, 3, 4, 5, 58, 59}},
+		{field: "5-7", valueRange: weekdayRange, expect: []int{5, 6, 7}},
+		{field: "60", valueRange: minuteRange, expectErr: true},
+		{field: "30-10", valueRange: minuteRange, expectErr: true},
+		{field: "*/0", valueRange: minuteRange, expectErr: true},
+		{field: "5/x", valueRange: minuteRange, expectErr: true},
+		{field: "a-b", valueRange: minuteRange, expectErr: true},
+		{field: "8", valueRange: weekdayRange, expectErr: true},
+		{field: "", valueRange: minuteRange, expectErr: true},
+	}
+	for _, c := range cases {
+		ret, err := parseField(c.field, c.valueRange)
+		if c.expectErr {
+			if err == nil {
+				t.Errorf("parseField(%q) = %v, expect error", c.field, keys(ret))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseField(%q) failed, error:%s", c.field, err.Error())
+			continue
+		}
+		values := keys(ret)
+		if len(values) != len(c.expect) {
+			t.Errorf("parseField(%q) = %v, expect %v", c.field, values, c.expect)
+			continue
+		}
+		for idx := range values {
+			if values[idx] != c.expect[idx] {
+				t.Errorf("parseField(%q) = %v, expect %v", c.field, values, c.expect)
+				break
+			}
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		expr      string
+		expectErr bool
+	}{
+		{expr: "0 2 * * *"},
+		{expr: "*/5 * * * 1-5"},
+		{expr: "0 0 1 1 7"},
+		{expr: "0 0 * *", expectErr: true},
+		{expr: "0 0 * * * *", expectErr: true},
+		{expr: "0 24 * * *", expectErr: true},
+		{expr: "0 0 0 * *", expectErr: true},
+		{expr: "0 0 * 13 *", expectErr: true},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.expr)
+		if (err != nil) != c.expectErr {
+			t.Errorf("Parse(%q) error %v, expect error %v", c.expr, err, c.expectErr)
+		}
+	}
+}
+
+// TestNext 2024-01-01为周一
+func TestNext(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	cases := []struct {
+		expr   string
+		expect time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2024, 1, 1, 10, 20, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 6-7", time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)},
+		// 日与周均被限定时满足其一即可
+		{"0 0 15 * 5", time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		// 日或周以*开头时两者同时满足
+		{"0 0 */10 * 5", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * */2", time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		schedulePtr, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) failed, error:%s", c.expr, err.Error())
+			continue
+		}
+		if ret := schedulePtr.Next(base); !ret.Equal(c.expect) {
+			t.Errorf("Next(%q) = %s, expect %s", c.expr, ret, c.expect)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package record
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/muidea/magicCommon/foundation/log"
+)
+
+// Component 事件的来源组件
+const Component = "database-operator"
+
+// NewReference 自定义资源的对象引用
+func NewReference(apiVersion, kind string, objPtr metav1.Object) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  objPtr.GetNamespace(),
+		Name:       objPtr.GetName(),
+		UID:        objPtr.GetUID(),
+	}
+}
+
+// Event 为对象创建k8s事件，失败时只记录日志，不影响调用方的处理
+func Event(clientSet kubernetes.Interface, refPtr *corev1.ObjectReference, eventType, reason, message string) {
+	if clientSet == nil {
+		return
+	}
+
+	now := metav1.Now()
+	eventPtr := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: refPtr.Name + "-",
+			Namespace:    refPtr.Namespace,
+		},
+		InvolvedObject: *refPtr,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: Component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := clientSet.CoreV1().Events(refPtr.Namespace).Create(context.TODO(), eventPtr, metav1.CreateOptions{})
+	if err != nil {
+		log.Errorf("record event failed, object:%s/%s, reason:%s, error:%s", refPtr.Kind, refPtr.Name, reason, err.Error())
+	}
+}
@@ -1,18 +1,26 @@
 package core
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
 	"sync"
 	"time"
 
 	cd "github.com/muidea/magicCommon/def"
 	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
 	"github.com/muidea/magicCommon/module"
 	"github.com/muidea/magicCommon/task"
 
 	engine "github.com/muidea/magicEngine/http"
 
+	"supos.ai/operator/database/internal/config"
 	"supos.ai/operator/database/pkg/common"
 
+	_ "supos.ai/operator/database/internal/core/module/backup"
 	_ "supos.ai/operator/database/internal/core/module/k8s"
 	_ "supos.ai/operator/database/internal/core/module/postgresql"
 )
@@ -78,7 +86,7 @@ func (s *Core) Run() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		s.httpServer.Run()
+		s.runServer()
 	}()
 
 	wg.Add(1)
@@ -100,6 +108,41 @@ func (s *Core) Run() {
 	wg.Wait()
 }
 
+// runServer 配置了证书时以HTTPS方式监听，并校验客户端证书
+func (s *Core) runServer() {
+	authCfg := config.GetAuthConfig()
+	if authCfg.TLSCert == "" || authCfg.TLSKey == "" {
+		s.httpServer.Run()
+		return
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if authCfg.ClientCA != "" {
+		caData, caErr := os.ReadFile(authCfg.ClientCA)
+		if caErr != nil {
+			log.Criticalf("run httpserver fatal, read client ca %s error:%s", authCfg.ClientCA, caErr.Error())
+			return
+		}
+
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caData) {
+			log.Criticalf("run httpserver fatal, illegal client ca %s", authCfg.ClientCA)
+			return
+		}
+
+		tlsConfig.ClientCAs = caPool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%s", s.listenPort),
+		Handler:   s.httpServer.(http.Handler),
+		TLSConfig: tlsConfig,
+	}
+	err := server.ListenAndServeTLS(authCfg.TLSCert, authCfg.TLSKey)
+	log.Criticalf("run httpserver fatal, err:%s", err.Error())
+}
+
 // Shutdown 销毁
 func (s *Core) Shutdown() {
 	modules := module.GetModules()
@@ -0,0 +1,192 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/base/cron"
+	"supos.ai/operator/database/internal/core/module/backup/pkg/job"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	defaultArchiveSchedule  = "0 0 * * *"
+	defaultArchiveRetention = 7
+)
+
+// reconcileArchives 为开启WAL归档的实例定时创建基础备份，并按保留数量清理基础备份与WAL
+func (s *Backup) reconcileArchives() {
+	var pgList pgv1.PostgreSQLList
+	listErr := s.listResource(pgv1.Postgresql, s.getNamespace(), &pgList)
+	if listErr != nil {
+		return
+	}
+
+	archived := []*pgv1.PostgreSQL{}
+	for idx := range pgList.Items {
+		pgPtr := &pgList.Items[idx]
+		if pgPtr.DeletionTimestamp == nil && pgPtr.Spec.Archive != nil {
+			archived = append(archived, pgPtr)
+		}
+	}
+	if len(archived) == 0 {
+		return
+	}
+
+	var backupList pgv1.PostgreSQLBackupList
+	listErr = s.listResource(pgv1.Backup, s.getNamespace(), &backupList)
+	if listErr != nil {
+		return
+	}
+
+	for _, pgPtr := range archived {
+		baseBackups := []*pgv1.PostgreSQLBackup{}
+		for idx := range backupList.Items {
+			backupPtr := &backupList.Items[idx]
+			if backupPtr.Labels[common.ArchiveLabel] == pgPtr.Name && backupPtr.DeletionTimestamp == nil {
+				baseBackups = append(baseBackups, backupPtr)
+			}
+		}
+		sort.Slice(baseBackups, func(i, j int) bool {
+			return baseBackups[i].CreationTimestamp.Before(&baseBackups[j].CreationTimestamp)
+		})
+
+		s.pruneArchive(pgPtr, baseBackups)
+		s.checkBaseBackup(pgPtr, baseBackups)
+	}
+}
+
+// checkBaseBackup 实例运行中且没有进行中的基础备份时按计划创建，首次开启归档时立即创建
+func (s *Backup) checkBaseBackup(pgPtr *pgv1.PostgreSQL, baseBackups []*pgv1.PostgreSQLBackup) {
+	if pgPtr.Status.Phase != pgv1.InstancePhaseRunning {
+		return
+	}
+
+	schedule := pgPtr.Spec.Archive.Schedule
+	if schedule == "" {
+		schedule = defaultArchiveSchedule
+	}
+	cronPtr, cronErr := cron.Parse(schedule)
+	if cronErr != nil {
+		log.Errorf("checkBaseBackup %s failed, illegal schedule %s, error:%s", pgPtr.Name, schedule, cronErr.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	if len(baseBackups) > 0 {
+		latest := baseBackups[len(baseBackups)-1]
+		if !isBackupFinished(latest) {
+			return
+		}
+
+		nextTime := cronPtr.Next(latest.CreationTimestamp.UTC())
+		if nextTime.IsZero() || nextTime.After(now) {
+			return
+		}
+	}
+
+	backupPtr := &pgv1.PostgreSQLBackup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: pgv1.Group + "/" + pgv1.Version,
+			Kind:       job.BackupKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-base-%d", pgPtr.Name, now.Unix()),
+			Namespace: pgPtr.Namespace,
+			Labels:    map[string]string{common.ArchiveLabel: pgPtr.Name},
+		},
+		Spec: pgv1.BackupSpec{
+			Instance: pgPtr.Name,
+			Method:   pgv1.BackupMethodBase,
+			Storage:  pgPtr.Spec.Archive.Storage,
+		},
+	}
+	createErr := s.createResource(pgv1.Backup, pgPtr.Namespace, backupPtr)
+	if createErr != nil {
+		return
+	}
+
+	log.Infof("checkBaseBackup %s, base backup %s created", pgPtr.Name, backupPtr.Name)
+}
+
+// pruneArchive 超出保留数量时由清理任务删除过期基础备份文件及最早保留基础备份之前的WAL，任务成功后删除备份资源
+func (s *Backup) pruneArchive(pgPtr *pgv1.PostgreSQL, baseBackups []*pgv1.PostgreSQLBackup) {
+	retention := int(pgPtr.Spec.Archive.Retention)
+	if retention <= 0 {
+		retention = defaultArchiveRetention
+	}
+
+	succeeded := []*pgv1.PostgreSQLBackup{}
+	for _, val := range baseBackups {
+		if val.Status.Phase == pgv1.BackupPhaseSucceeded {
+			succeeded = append(succeeded, val)
+		}
+	}
+	if len(succeeded) <= retention {
+		return
+	}
+
+	oldest := succeeded[len(succeeded)-retention]
+	expired := append([]*pgv1.PostgreSQLBackup{}, succeeded[:len(succeeded)-retention]...)
+	for _, val := range baseBackups {
+		if val.Status.Phase == pgv1.PhaseFailed && val.CreationTimestamp.Before(&oldest.CreationTimestamp) {
+			expired = append(expired, val)
+		}
+	}
+
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		return
+	}
+
+	jobName := job.GetPruneJobName(pgPtr.Name)
+	jobClient := clientSet.BatchV1().Jobs(pgPtr.Namespace)
+	jobPtr, jobErr := jobClient.Get(context.TODO(), jobName, metav1.GetOptions{})
+	if jobErr != nil {
+		if !errors.IsNotFound(jobErr) {
+			log.Errorf("pruneArchive %s failed, get job error:%s", pgPtr.Name, jobErr.Error())
+			return
+		}
+
+		image := pgPtr.Spec.Image
+		if image == "" {
+			image = common.DefaultPostgreSQLImage
+		}
+		_, createErr := jobClient.Create(context.TODO(), job.GetPruneJob(pgPtr, image, oldest.Status.StartWAL, expired), metav1.CreateOptions{})
+		if createErr != nil && !errors.IsAlreadyExists(createErr) {
+			log.Errorf("pruneArchive %s failed, create job error:%s", pgPtr.Name, createErr.Error())
+			return
+		}
+
+		log.Infof("pruneArchive %s, expired base backups:%d, keep wal from:%s", pgPtr.Name, len(expired), oldest.Status.StartWAL)
+		return
+	}
+
+	switch {
+	case jobPtr.Status.Succeeded > 0:
+		for _, name := range strings.Split(jobPtr.Annotations[job.PruneBackupsAnnotation], ",") {
+			if name != "" {
+				_ = s.deleteResource(pgv1.Backup, pgPtr.Namespace, name)
+			}
+		}
+	case jobPtr.Status.Failed > 0:
+		log.Errorf("pruneArchive %s failed, error:%s", pgPtr.Name, s.getJobMessage(jobPtr, ""))
+	default:
+		return
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	deleteErr := jobClient.Delete(context.TODO(), jobName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+		log.Errorf("pruneArchive %s failed, delete job error:%s", pgPtr.Name, deleteErr.Error())
+	}
+}
@@ -0,0 +1,208 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/module/backup/pkg/job"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func isBackupFinished(backupPtr *pgv1.PostgreSQLBackup) bool {
+	return backupPtr.Status.Phase == pgv1.BackupPhaseSucceeded || backupPtr.Status.Phase == pgv1.PhaseFailed
+}
+
+func (s *Backup) reconcileBackups() {
+	var backupList pgv1.PostgreSQLBackupList
+	listErr := s.listResource(pgv1.Backup, s.getNamespace(), &backupList)
+	if listErr != nil {
+		return
+	}
+
+	for idx := range backupList.Items {
+		backupPtr := &backupList.Items[idx]
+		if backupPtr.DeletionTimestamp != nil || isBackupFinished(backupPtr) {
+			continue
+		}
+
+		var err *cd.Result
+		switch {
+		case backupPtr.Spec.IsSnapshot():
+			err = s.reconcileSnapshot(backupPtr)
+		case backupPtr.Status.Phase == pgv1.BackupPhaseRunning:
+			err = s.checkBackupJob(backupPtr)
+		default:
+			err = s.startBackupJob(backupPtr)
+		}
+		if err != nil {
+			if err.Fail() {
+				backupPtr.Status.Phase = pgv1.PhaseFailed
+			} else {
+				backupPtr.Status.Phase = pgv1.PhasePending
+			}
+			backupPtr.Status.Message = err.Reason
+		}
+
+		_ = s.updateStatus(pgv1.Backup, backupPtr.Namespace, backupPtr)
+	}
+}
+
+// getInstanceImage 备份任务使用实例镜像，保证pg_dump与服务端版本一致
+func (s *Backup) getInstanceImage(namespace, instance string) (ret string, err *cd.Result) {
+	pgPtr := &pgv1.PostgreSQL{}
+	err = s.getResource(pgv1.Postgresql, namespace, instance, pgPtr)
+	if err != nil {
+		if !err.Fail() {
+			err = cd.NewWarn(cd.NoExist, fmt.Sprintf("instance %s not found", instance))
+		}
+		return
+	}
+
+	ret = pgPtr.Spec.Image
+	if ret == "" {
+		ret = common.DefaultPostgreSQLImage
+	}
+	return
+}
+
+func (s *Backup) startBackupJob(backupPtr *pgv1.PostgreSQLBackup) (err *cd.Result) {
+	if validErr := job.Validate(backupPtr); validErr != nil {
+		err = cd.NewError(cd.IllegalParam, validErr.Error())
+		return
+	}
+
+	image, imageErr := s.getInstanceImage(backupPtr.Namespace, backupPtr.Spec.Instance)
+	if imageErr != nil {
+		err = imageErr
+		return
+	}
+
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	jobPtr := job.GetBackupJob(backupPtr, image)
+	_, jobErr := clientSet.BatchV1().Jobs(backupPtr.Namespace).Create(context.TODO(), jobPtr, metav1.CreateOptions{})
+	if jobErr != nil && !errors.IsAlreadyExists(jobErr) {
+		err = cd.NewError(cd.UnExpected, jobErr.Error())
+		log.Errorf("startBackupJob %s failed, create job error:%s", backupPtr.Name, jobErr.Error())
+		return
+	}
+
+	now := metav1.Now()
+	backupPtr.Status.Phase = pgv1.BackupPhaseRunning
+	backupPtr.Status.Message = ""
+	backupPtr.Status.JobName = jobPtr.Name
+	backupPtr.Status.StartTime = &now
+	log.Infof("startBackupJob %s, instance:%s, job:%s", backupPtr.Name, backupPtr.Spec.Instance, jobPtr.Name)
+	return
+}
+
+func (s *Backup) checkBackupJob(backupPtr *pgv1.PostgreSQLBackup) (err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewWarn(cd.Warned, "illegal k8s client")
+		return
+	}
+
+	jobPtr, jobErr := clientSet.BatchV1().Jobs(backupPtr.Namespace).Get(context.TODO(), backupPtr.Status.JobName, metav1.GetOptions{})
+	if jobErr != nil {
+		if errors.IsNotFound(jobErr) {
+			err = cd.NewError(cd.UnExpected, fmt.Sprintf("backup job %s not found", backupPtr.Status.JobName))
+			return
+		}
+
+		err = cd.NewWarn(cd.Warned, jobErr.Error())
+		return
+	}
+
+	switch {
+	case jobPtr.Status.Succeeded > 0:
+		err = s.completeBackup(backupPtr, jobPtr)
+	case jobPtr.Status.Failed > 0:
+		message := s.getJobMessage(jobPtr, "")
+		if message == "" {
+			message = "backup job failed"
+		}
+		err = cd.NewError(cd.UnExpected, message)
+		s.setCompletion(backupPtr)
+		log.Errorf("checkBackupJob %s failed, error:%s", backupPtr.Name, message)
+	}
+
+	return
+}
+
+func (s *Backup) setCompletion(backupPtr *pgv1.PostgreSQLBackup) {
+	now := metav1.Now()
+	backupPtr.Status.CompletionTime = &now
+}
+
+func (s *Backup) completeBackup(backupPtr *pgv1.PostgreSQLBackup, jobPtr *batchv1.Job) (err *cd.Result) {
+	message := s.getJobMessage(jobPtr, job.GetContainerName(backupPtr))
+	result, resultErr := job.ParseResult(message)
+	if resultErr != nil {
+		err = cd.NewError(cd.UnExpected, fmt.Sprintf("illegal backup result, %s", resultErr.Error()))
+		s.setCompletion(backupPtr)
+		return
+	}
+
+	s.setCompletion(backupPtr)
+	backupPtr.Status.Phase = pgv1.BackupPhaseSucceeded
+	backupPtr.Status.Message = ""
+	backupPtr.Status.Location = job.GetLocation(backupPtr, result.File)
+	backupPtr.Status.Size = result.Size
+	backupPtr.Status.Checksum = result.Checksum
+	backupPtr.Status.Duration = (time.Duration(result.Duration) * time.Second).String()
+	backupPtr.Status.StartWAL = result.StartWAL
+	backupPtr.Status.StartLSN = result.StartLSN
+	backupPtr.Status.StopLSN = result.StopLSN
+	log.Infof("completeBackup %s, location:%s, size:%d", backupPtr.Name, backupPtr.Status.Location, result.Size)
+	return
+}
+
+// getJobMessage 读取任务Pod中容器的终止信息，container为空时返回第一个失败容器的信息
+func (s *Backup) getJobMessage(jobPtr *batchv1.Job, container string) (ret string) {
+	podList, podErr := s.getClientSet().CoreV1().Pods(jobPtr.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("job-name=%s", jobPtr.Name),
+	})
+	if podErr != nil {
+		log.Errorf("getJobMessage %s failed, list pods error:%s", jobPtr.Name, podErr.Error())
+		return
+	}
+
+	for _, pod := range podList.Items {
+		statusList := append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+		statusList = append(statusList, pod.Status.ContainerStatuses...)
+		for _, val := range statusList {
+			terminated := val.State.Terminated
+			if terminated == nil {
+				continue
+			}
+			if container != "" && val.Name == container {
+				return terminated.Message
+			}
+			if container == "" && terminated.ExitCode != 0 {
+				ret = strings.TrimSpace(terminated.Message)
+				if ret == "" {
+					ret = fmt.Sprintf("container %s exited with code %d, reason:%s", val.Name, terminated.ExitCode, terminated.Reason)
+				}
+				return
+			}
+		}
+	}
+
+	return
+}
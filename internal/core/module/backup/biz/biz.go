@@ -0,0 +1,124 @@
+package biz
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+	"github.com/muidea/magicCommon/task"
+
+	"supos.ai/operator/database/internal/core/base/biz"
+	"supos.ai/operator/database/pkg/common"
+)
+
+// reconcileInterval 备份与定时备份的同步周期
+const reconcileInterval = 10 * time.Second
+
+type Backup struct {
+	biz.Base
+
+	client    dynamic.Interface
+	clientSet kubernetes.Interface
+
+	// verifySessions 进行中的恢复校验，备份名称到校验
+	verifySessions map[string]*verifySession
+	sessionLock    sync.RWMutex
+}
+
+func New(
+	eventHub event.Hub,
+	backgroundRoutine task.BackgroundRoutine,
+) *Backup {
+	ptr := &Backup{
+		Base:           biz.New(common.BackupModule, eventHub, backgroundRoutine),
+		verifySessions: map[string]*verifySession{},
+	}
+
+	ptr.SubscribeFunc(common.StartRestore, ptr.startRestore)
+	ptr.SubscribeFunc(common.QueryRestore, ptr.queryRestore)
+	return ptr
+}
+
+func (s *Backup) Run() {
+	s.Timer(reconcileInterval, 0, s.reconcile)
+}
+
+// reconcile 先按计划创建备份与基础备份，再驱动备份任务执行，最后校验已成功的备份
+func (s *Backup) reconcile() {
+	s.reconcileSchedules()
+	s.reconcileArchives()
+	s.reconcileBackups()
+	s.reconcileVerifications()
+}
+
+func (s *Backup) getNamespace() string {
+	namespace, found := os.LookupEnv("NAMESPACE")
+	if !found {
+		namespace = corev1.NamespaceDefault
+	}
+	return namespace
+}
+
+func (s *Backup) getK8sConfig() (ret *rest.Config) {
+	ev := event.NewEvent(common.GetK8sConfig, s.ID(), common.K8sModule, nil, nil)
+	result := s.SendEvent(ev)
+	cfgVal, cfgErr := result.Get()
+	if cfgErr != nil {
+		log.Errorf("getK8sConfig failed, error:%s", cfgErr.Error())
+		return
+	}
+
+	ret = cfgVal.(*rest.Config)
+	return
+}
+
+func (s *Backup) getK8sClient() (ret dynamic.Interface) {
+	if s.client != nil {
+		ret = s.client
+		return
+	}
+
+	cfgPtr := s.getK8sConfig()
+	if cfgPtr == nil {
+		return
+	}
+
+	dynamicClient, dynamicErr := dynamic.NewForConfig(cfgPtr)
+	if dynamicErr != nil {
+		log.Errorf("getK8sClient failed, dynamic.NewForConfig error:%s", dynamicErr.Error())
+		return
+	}
+
+	s.client = dynamicClient
+	ret = s.client
+	return
+}
+
+func (s *Backup) getClientSet() (ret kubernetes.Interface) {
+	if s.clientSet != nil {
+		ret = s.clientSet
+		return
+	}
+
+	cfgPtr := s.getK8sConfig()
+	if cfgPtr == nil {
+		return
+	}
+
+	clientSet, clientErr := kubernetes.NewForConfig(cfgPtr)
+	if clientErr != nil {
+		log.Errorf("getClientSet failed, kubernetes.NewForConfig error:%s", clientErr.Error())
+		return
+	}
+
+	s.clientSet = clientSet
+	ret = s.clientSet
+	return
+}
@@ -0,0 +1,157 @@
+package biz
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func (s *Backup) getResourceGVR(resource string) schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: pgv1.Group, Version: pgv1.Version, Resource: resource}
+}
+
+func (s *Backup) getResourceClient(resource, namespace string) (ret dynamic.ResourceInterface, err *cd.Result) {
+	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	ret = client.Resource(s.getResourceGVR(resource)).Namespace(namespace)
+	return
+}
+
+// listResource 查询命名空间下的自定义资源，listPtr为对应的List类型
+func (s *Backup) listResource(resource, namespace string, listPtr interface{}) (err *cd.Result) {
+	resClient, resErr := s.getResourceClient(resource, namespace)
+	if resErr != nil {
+		err = resErr
+		return
+	}
+
+	resList, listErr := resClient.List(context.TODO(), metav1.ListOptions{})
+	if listErr != nil {
+		err = cd.NewError(cd.UnExpected, listErr.Error())
+		log.Errorf("listResource %s failed, namespace:%s, error:%s", resource, namespace, listErr.Error())
+		return
+	}
+
+	convertErr := runtime.DefaultUnstructuredConverter.FromUnstructured(resList.UnstructuredContent(), listPtr)
+	if convertErr != nil {
+		err = cd.NewError(cd.UnExpected, convertErr.Error())
+		log.Errorf("listResource %s failed, runtime.DefaultUnstructuredConverter.FromUnstructured error:%s", resource, convertErr.Error())
+		return
+	}
+
+	return
+}
+
+// getResource 查询自定义资源，不存在时返回NoExist
+func (s *Backup) getResource(resource, namespace, name string, objPtr interface{}) (err *cd.Result) {
+	resClient, resErr := s.getResourceClient(resource, namespace)
+	if resErr != nil {
+		err = resErr
+		return
+	}
+
+	resVal, getErr := resClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if getErr != nil {
+		if errors.IsNotFound(getErr) {
+			err = cd.NewError(cd.NoExist, getErr.Error())
+			return
+		}
+
+		err = cd.NewError(cd.UnExpected, getErr.Error())
+		log.Errorf("getResource %s failed, namespace:%s, name:%s, error:%s", resource, namespace, name, getErr.Error())
+		return
+	}
+
+	convertErr := runtime.DefaultUnstructuredConverter.FromUnstructured(resVal.UnstructuredContent(), objPtr)
+	if convertErr != nil {
+		err = cd.NewError(cd.UnExpected, convertErr.Error())
+		return
+	}
+
+	return
+}
+
+// createResource 创建自定义资源，已存在时返回Duplicated
+func (s *Backup) createResource(resource, namespace string, objPtr interface{}) (err *cd.Result) {
+	resClient, resErr := s.getResourceClient(resource, namespace)
+	if resErr != nil {
+		err = resErr
+		return
+	}
+
+	objVal, objErr := runtime.DefaultUnstructuredConverter.ToUnstructured(objPtr)
+	if objErr != nil {
+		err = cd.NewError(cd.UnExpected, objErr.Error())
+		return
+	}
+
+	_, createErr := resClient.Create(context.TODO(), &unstructured.Unstructured{Object: objVal}, metav1.CreateOptions{})
+	if createErr != nil {
+		if errors.IsAlreadyExists(createErr) {
+			err = cd.NewError(cd.Duplicated, createErr.Error())
+			return
+		}
+
+		err = cd.NewError(cd.UnExpected, createErr.Error())
+		log.Errorf("createResource %s failed, namespace:%s, error:%s", resource, namespace, createErr.Error())
+		return
+	}
+
+	return
+}
+
+func (s *Backup) deleteResource(resource, namespace, name string) (err *cd.Result) {
+	resClient, resErr := s.getResourceClient(resource, namespace)
+	if resErr != nil {
+		err = resErr
+		return
+	}
+
+	deleteErr := resClient.Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+		err = cd.NewError(cd.UnExpected, deleteErr.Error())
+		log.Errorf("deleteResource %s failed, namespace:%s, name:%s, error:%s", resource, namespace, name, deleteErr.Error())
+		return
+	}
+
+	return
+}
+
+// updateStatus 更新自定义资源的status子资源
+func (s *Backup) updateStatus(resource, namespace string, objPtr interface{}) (err *cd.Result) {
+	resClient, resErr := s.getResourceClient(resource, namespace)
+	if resErr != nil {
+		err = resErr
+		return
+	}
+
+	objVal, objErr := runtime.DefaultUnstructuredConverter.ToUnstructured(objPtr)
+	if objErr != nil {
+		err = cd.NewError(cd.UnExpected, objErr.Error())
+		return
+	}
+
+	unstructuredPtr := &unstructured.Unstructured{Object: objVal}
+	_, updateErr := resClient.UpdateStatus(context.TODO(), unstructuredPtr, metav1.UpdateOptions{})
+	if updateErr != nil {
+		err = cd.NewError(cd.UnExpected, updateErr.Error())
+		log.Errorf("updateStatus %s failed, namespace:%s, name:%s, error:%s", resource, namespace, unstructuredPtr.GetName(), updateErr.Error())
+		return
+	}
+
+	return
+}
@@ -0,0 +1,147 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/module/backup/pkg/job"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func (s *Backup) startRestore(ev event.Event, re event.Result) {
+	infoPtr, infoOK := ev.Data().(*common.RestoreInfo)
+	if !infoOK {
+		log.Warnf("startRestore failed, illegal param")
+		if re != nil {
+			re.Set(nil, cd.NewError(cd.IllegalParam, "illegal restore param"))
+		}
+		return
+	}
+
+	ret, err := s.StartRestore(infoPtr)
+	if re != nil {
+		re.Set(ret, err)
+	}
+}
+
+func (s *Backup) queryRestore(ev event.Event, re event.Result) {
+	infoPtr, infoOK := ev.Data().(*common.RestoreInfo)
+	if !infoOK {
+		log.Warnf("queryRestore failed, illegal param")
+		if re != nil {
+			re.Set(nil, cd.NewError(cd.IllegalParam, "illegal restore param"))
+		}
+		return
+	}
+
+	ret, err := s.QueryRestore(infoPtr)
+	if re != nil {
+		re.Set(ret, err)
+	}
+}
+
+// StartRestore 创建恢复任务，备份未完成时返回告警等待
+func (s *Backup) StartRestore(infoPtr *common.RestoreInfo) (ret *common.RestoreResult, err *cd.Result) {
+	backupPtr := &pgv1.PostgreSQLBackup{}
+	err = s.getResource(pgv1.Backup, infoPtr.Namespace, infoPtr.Backup, backupPtr)
+	if err != nil {
+		if !err.Fail() {
+			err = cd.NewWarn(cd.NoExist, fmt.Sprintf("backup %s not found", infoPtr.Backup))
+		}
+		return
+	}
+
+	switch backupPtr.Status.Phase {
+	case pgv1.BackupPhaseSucceeded:
+	case pgv1.PhaseFailed:
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("backup %s failed, can not restore from it", infoPtr.Backup))
+		return
+	default:
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("waiting for backup %s to succeed", infoPtr.Backup))
+		return
+	}
+	if validErr := job.ValidateRestore(backupPtr); validErr != nil {
+		err = cd.NewError(cd.IllegalParam, validErr.Error())
+		return
+	}
+
+	image, imageErr := s.getInstanceImage(infoPtr.Namespace, infoPtr.Instance)
+	if imageErr != nil {
+		err = imageErr
+		return
+	}
+
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewWarn(cd.Warned, "illegal k8s client")
+		return
+	}
+
+	jobPtr := job.GetRestoreJob(backupPtr, infoPtr, image)
+	_, jobErr := clientSet.BatchV1().Jobs(infoPtr.Namespace).Create(context.TODO(), jobPtr, metav1.CreateOptions{})
+	if jobErr != nil && !errors.IsAlreadyExists(jobErr) {
+		err = cd.NewError(cd.UnExpected, jobErr.Error())
+		log.Errorf("StartRestore %s failed, create job error:%s", infoPtr.Instance, jobErr.Error())
+		return
+	}
+
+	log.Infof("StartRestore %s, backup:%s, job:%s", infoPtr.Instance, infoPtr.Backup, jobPtr.Name)
+	ret = &common.RestoreResult{Phase: common.RestoreRunning, JobName: jobPtr.Name}
+	return
+}
+
+// QueryRestore 查询恢复任务进度，任务失败时返回失败原因
+func (s *Backup) QueryRestore(infoPtr *common.RestoreInfo) (ret *common.RestoreResult, err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewWarn(cd.Warned, "illegal k8s client")
+		return
+	}
+
+	jobName := job.GetRestoreJobName(infoPtr.Instance)
+	jobPtr, jobErr := clientSet.BatchV1().Jobs(infoPtr.Namespace).Get(context.TODO(), jobName, metav1.GetOptions{})
+	if jobErr != nil {
+		if errors.IsNotFound(jobErr) {
+			err = cd.NewError(cd.UnExpected, fmt.Sprintf("restore job %s not found", jobName))
+			return
+		}
+
+		err = cd.NewWarn(cd.Warned, jobErr.Error())
+		return
+	}
+
+	ret = &common.RestoreResult{Phase: common.RestoreRunning, JobName: jobName}
+	switch {
+	case jobPtr.Status.Succeeded > 0:
+		message := s.getJobMessage(jobPtr, job.GetRestoreContainerName())
+		result, resultErr := job.ParseRestoreResult(message)
+		if resultErr != nil {
+			ret.Phase = common.RestoreFailed
+			ret.Message = fmt.Sprintf("illegal restore result, %s", resultErr.Error())
+			return
+		}
+
+		ret.Phase = common.RestoreSucceeded
+		ret.Checksum = result.Checksum
+		ret.Tables = result.Tables
+		ret.Rows = result.Rows
+		log.Infof("QueryRestore %s succeeded, tables:%d, rows:%d", infoPtr.Instance, result.Tables, result.Rows)
+	case jobPtr.Status.Failed > 0:
+		ret.Phase = common.RestoreFailed
+		ret.Message = s.getJobMessage(jobPtr, "")
+		if ret.Message == "" {
+			ret.Message = "restore job failed"
+		}
+		log.Errorf("QueryRestore %s failed, error:%s", infoPtr.Instance, ret.Message)
+	}
+
+	return
+}
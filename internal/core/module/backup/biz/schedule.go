@@ -0,0 +1,128 @@
+package biz
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/base/cron"
+	"supos.ai/operator/database/internal/core/module/backup/pkg/job"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// ScheduleLabel 标识由定时备份创建的备份
+const ScheduleLabel = "database.supos.ai/backup-schedule"
+
+const defaultHistoryLimit = 7
+
+func (s *Backup) reconcileSchedules() {
+	var scheduleList pgv1.PostgreSQLBackupScheduleList
+	listErr := s.listResource(pgv1.BackupSchedule, s.getNamespace(), &scheduleList)
+	if listErr != nil {
+		return
+	}
+
+	if len(scheduleList.Items) == 0 {
+		return
+	}
+
+	var backupList pgv1.PostgreSQLBackupList
+	listErr = s.listResource(pgv1.Backup, s.getNamespace(), &backupList)
+	if listErr != nil {
+		return
+	}
+
+	for idx := range scheduleList.Items {
+		schedulePtr := &scheduleList.Items[idx]
+		if schedulePtr.DeletionTimestamp != nil {
+			continue
+		}
+
+		s.cleanupHistory(schedulePtr, backupList.Items)
+		if schedulePtr.Spec.Suspend {
+			continue
+		}
+
+		s.checkVerifySchedule(schedulePtr, backupList.Items)
+		s.checkSchedule(schedulePtr)
+	}
+}
+
+// checkSchedule 到达计划时间时创建备份，operator停止期间错过的计划只补执行一次
+func (s *Backup) checkSchedule(schedulePtr *pgv1.PostgreSQLBackupSchedule) {
+	cronPtr, cronErr := cron.Parse(schedulePtr.Spec.Schedule)
+	if cronErr != nil {
+		if schedulePtr.Status.Message != cronErr.Error() {
+			schedulePtr.Status.Message = cronErr.Error()
+			_ = s.updateStatus(pgv1.BackupSchedule, schedulePtr.Namespace, schedulePtr)
+		}
+		return
+	}
+
+	lastTime := schedulePtr.CreationTimestamp.Time
+	if schedulePtr.Status.LastScheduleTime != nil {
+		lastTime = schedulePtr.Status.LastScheduleTime.Time
+	}
+
+	now := time.Now().UTC()
+	nextTime := cronPtr.Next(lastTime.UTC())
+	if nextTime.IsZero() || nextTime.After(now) {
+		return
+	}
+
+	backupPtr := &pgv1.PostgreSQLBackup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: pgv1.Group + "/" + pgv1.Version,
+			Kind:       job.BackupKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", schedulePtr.Name, nextTime.Unix()),
+			Namespace: schedulePtr.Namespace,
+			Labels:    map[string]string{ScheduleLabel: schedulePtr.Name},
+		},
+		Spec: schedulePtr.Spec.Template,
+	}
+	createErr := s.createResource(pgv1.Backup, schedulePtr.Namespace, backupPtr)
+	if createErr != nil {
+		schedulePtr.Status.Message = createErr.Reason
+		_ = s.updateStatus(pgv1.BackupSchedule, schedulePtr.Namespace, schedulePtr)
+		return
+	}
+
+	scheduleTime := metav1.NewTime(now)
+	schedulePtr.Status.LastScheduleTime = &scheduleTime
+	schedulePtr.Status.LastBackup = backupPtr.Name
+	schedulePtr.Status.Message = ""
+	_ = s.updateStatus(pgv1.BackupSchedule, schedulePtr.Namespace, schedulePtr)
+	log.Infof("checkSchedule %s, backup %s created", schedulePtr.Name, backupPtr.Name)
+}
+
+// cleanupHistory 删除超出保留数量的已完成备份资源，校验中的备份在校验完成后再删除
+func (s *Backup) cleanupHistory(schedulePtr *pgv1.PostgreSQLBackupSchedule, backups []pgv1.PostgreSQLBackup) {
+	historyLimit := int(schedulePtr.Spec.HistoryLimit)
+	if historyLimit <= 0 {
+		historyLimit = defaultHistoryLimit
+	}
+
+	finished := []*pgv1.PostgreSQLBackup{}
+	for idx := range backups {
+		backupPtr := &backups[idx]
+		if backupPtr.Labels[ScheduleLabel] == schedulePtr.Name && isBackupFinished(backupPtr) && !backupPtr.IsVerifying() {
+			finished = append(finished, backupPtr)
+		}
+	}
+	if len(finished) <= historyLimit {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreationTimestamp.Before(&finished[j].CreationTimestamp)
+	})
+	for _, val := range finished[:len(finished)-historyLimit] {
+		_ = s.deleteResource(pgv1.Backup, val.Namespace, val.Name)
+	}
+}
@@ -0,0 +1,382 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/module/backup/pkg/job"
+	"supos.ai/operator/database/internal/core/module/backup/pkg/snapshot"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	// snapshotStartTimeout 等待备份会话开始备份的最长时间
+	snapshotStartTimeout = 10 * time.Minute
+	// snapshotStopTimeout 写入结束标记后等待备份会话结束的最长时间
+	snapshotStopTimeout = 10 * time.Minute
+)
+
+// snapshotResult 备份会话结束后的退出码与输出，正常结束时Output依次为开始与结束的LSN
+type snapshotResult struct {
+	done   bool
+	status string
+	output string
+}
+
+func (s *Backup) executeCommand(instance, operation string, args []string) (ret string, err *cd.Result) {
+	ret, err = s.sendCommand(&common.CmdInfo{
+		Service:   instance,
+		Catalog:   common.PostgreSQL,
+		Type:      common.AdminCommand,
+		Operation: operation,
+		Args:      args,
+	})
+	return
+}
+
+// sendCommand 通过k8s模块在实例中执行目录中的命令
+func (s *Backup) sendCommand(cmdInfo *common.CmdInfo) (ret string, err *cd.Result) {
+	ev := event.NewEvent(common.ExecuteCommand, s.ID(), common.K8sModule, nil, cmdInfo)
+	result := s.SendEvent(ev)
+	resultVal, resultErr := result.Get()
+	if resultErr != nil {
+		err = resultErr
+		return
+	}
+
+	if byteVal, byteOK := resultVal.([]byte); byteOK {
+		ret = strings.TrimSpace(string(byteVal))
+	}
+	return
+}
+
+// reconcileSnapshot 快照备份不使用任务，由operator在备份会话期间创建VolumeSnapshot
+func (s *Backup) reconcileSnapshot(backupPtr *pgv1.PostgreSQLBackup) (err *cd.Result) {
+	if backupPtr.Status.Phase == pgv1.BackupPhaseRunning {
+		err = s.checkSnapshot(backupPtr)
+		return
+	}
+
+	err = s.startSnapshot(backupPtr)
+	return
+}
+
+// startSnapshot 实例运行中且数据卷使用CSI存储类时，异步开启持有pg_backup_start的会话
+func (s *Backup) startSnapshot(backupPtr *pgv1.PostgreSQLBackup) (err *cd.Result) {
+	if validErr := job.Validate(backupPtr); validErr != nil {
+		err = cd.NewError(cd.IllegalParam, validErr.Error())
+		return
+	}
+
+	instance := backupPtr.Spec.Instance
+	pgPtr := &pgv1.PostgreSQL{}
+	err = s.getResource(pgv1.Postgresql, backupPtr.Namespace, instance, pgPtr)
+	if err != nil {
+		if !err.Fail() {
+			err = cd.NewWarn(cd.NoExist, fmt.Sprintf("instance %s not found", instance))
+		}
+		return
+	}
+	if pgPtr.Status.Phase != pgv1.InstancePhaseRunning {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("instance %s not running", instance))
+		return
+	}
+
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewWarn(cd.Warned, "illegal k8s client")
+		return
+	}
+	// 快照取自主节点的数据卷，数据卷与成员同名，local-path存储不支持快照
+	volume := pgPtr.GetPrimary()
+	pvcPtr, pvcErr := clientSet.CoreV1().PersistentVolumeClaims(backupPtr.Namespace).Get(context.TODO(), volume, metav1.GetOptions{})
+	if pvcErr != nil {
+		err = cd.NewWarn(cd.Warned, pvcErr.Error())
+		return
+	}
+	if pvcPtr.Spec.StorageClassName == nil || *pvcPtr.Spec.StorageClassName == common.LocalPath {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("instance %s storage does not support volume snapshot", instance))
+		return
+	}
+
+	name := backupPtr.Name
+	label := snapshot.GetLabel(backupPtr)
+	// 会话在实例中后台运行，状态保存到备份资源，operator重启后据此继续
+	_, err = s.executeCommand(instance, "backup-start", []string{label})
+	if err != nil {
+		if err.Fail() {
+			log.Errorf("startSnapshot %s failed, error:%s", name, err.Error())
+		}
+		return
+	}
+
+	now := metav1.Now()
+	backupPtr.Status.Phase = pgv1.BackupPhaseRunning
+	backupPtr.Status.Message = ""
+	backupPtr.Status.StartTime = &now
+	backupPtr.Status.Session = &pgv1.SnapshotSession{Instance: instance, Volume: volume, Label: label}
+	log.Infof("startSnapshot %s, instance:%s, label:%s", name, instance, label)
+	return
+}
+
+// checkSnapshot 备份开始后创建快照，快照完成切点后结束备份，会话结束且快照可用后备份成功
+func (s *Backup) checkSnapshot(backupPtr *pgv1.PostgreSQLBackup) (err *cd.Result) {
+	session := backupPtr.Status.Session
+	if session == nil {
+		// 未保存会话的备份无法继续，结束可能仍在等待的备份会话
+		_, _ = s.executeCommand(backupPtr.Spec.Instance, "backup-stop", []string{snapshot.GetLabel(backupPtr)})
+		err = cd.NewError(cd.UnExpected, "snapshot backup session lost")
+		s.setCompletion(backupPtr)
+		return
+	}
+
+	result, resultErr := s.getSnapshotResult(session)
+	if resultErr != nil {
+		backupPtr.Status.Message = resultErr.Reason
+		return
+	}
+
+	if backupPtr.Status.Snapshot == "" {
+		if result.done {
+			err = s.failSnapshot(backupPtr, result, fmt.Sprintf("snapshot backup session exited before snapshot, %s", result.output))
+			return
+		}
+
+		startedOK, startedErr := s.isBackupStarted(session)
+		if startedErr != nil || !startedOK {
+			if backupPtr.Status.StartTime != nil && time.Since(backupPtr.Status.StartTime.Time) > snapshotStartTimeout {
+				err = s.failSnapshot(backupPtr, result, "timeout waiting for pg_backup_start")
+				return
+			}
+
+			backupPtr.Status.Message = "waiting for pg_backup_start"
+			return
+		}
+
+		err = s.createVolumeSnapshot(backupPtr, session.Volume)
+		if err != nil {
+			err = s.failSnapshot(backupPtr, result, err.Reason)
+			return
+		}
+
+		backupPtr.Status.Snapshot = backupPtr.Name
+		backupPtr.Status.Location = snapshot.GetLocation(backupPtr.Name)
+		backupPtr.Status.Message = ""
+		return
+	}
+
+	snapshotPtr, snapshotErr := s.getVolumeSnapshot(backupPtr.Namespace, backupPtr.Status.Snapshot)
+	if snapshotErr != nil {
+		if snapshotErr.Fail() {
+			err = s.failSnapshot(backupPtr, result, snapshotErr.Reason)
+		}
+		return
+	}
+	if message := snapshotPtr.GetError(); message != "" {
+		err = s.failSnapshot(backupPtr, result, message)
+		return
+	}
+	if !snapshotPtr.IsCreated() {
+		backupPtr.Status.Message = "waiting for volume snapshot"
+		return
+	}
+
+	if !session.Stopped {
+		// 快照完成切点前会话必须一直持有备份，实例重启等导致会话中断时备份不一致
+		if result.done {
+			err = s.failSnapshot(backupPtr, result, fmt.Sprintf("snapshot backup session exited before stop, %s", result.output))
+			return
+		}
+		startedOK, startedErr := s.isBackupStarted(session)
+		if startedErr != nil {
+			backupPtr.Status.Message = startedErr.Reason
+			return
+		}
+		if !startedOK {
+			err = s.failSnapshot(backupPtr, result, "snapshot backup session lost")
+			return
+		}
+
+		_, stopErr := s.executeCommand(session.Instance, "backup-stop", []string{session.Label})
+		if stopErr != nil {
+			backupPtr.Status.Message = stopErr.Reason
+			return
+		}
+
+		now := metav1.Now()
+		session.Stopped = true
+		session.StopTime = &now
+		return
+	}
+
+	if !result.done {
+		if session.StopTime != nil && time.Since(session.StopTime.Time) > snapshotStopTimeout {
+			err = s.failSnapshot(backupPtr, result, "timeout waiting for pg_backup_stop")
+			return
+		}
+
+		backupPtr.Status.Message = "waiting for pg_backup_stop"
+		return
+	}
+	if result.status != "0" {
+		err = s.failSnapshot(backupPtr, result, fmt.Sprintf("snapshot backup session failed, %s", result.output))
+		return
+	}
+	if !snapshotPtr.IsReady() {
+		backupPtr.Status.Message = "waiting for volume snapshot ready"
+		return
+	}
+
+	s.completeSnapshot(backupPtr, snapshotPtr, result)
+	return
+}
+
+func (s *Backup) completeSnapshot(backupPtr *pgv1.PostgreSQLBackup, snapshotPtr *snapshot.VolumeSnapshot, result snapshotResult) {
+	s.cleanSnapshotSession(backupPtr)
+	s.setCompletion(backupPtr)
+
+	lsnList := strings.Fields(result.output)
+	if len(lsnList) == 2 {
+		backupPtr.Status.StartLSN = lsnList[0]
+		backupPtr.Status.StopLSN = lsnList[1]
+	}
+	if sizeVal, sizeErr := resource.ParseQuantity(snapshotPtr.Status.RestoreSize); sizeErr == nil {
+		backupPtr.Status.Size = sizeVal.Value()
+	}
+	if backupPtr.Status.StartTime != nil {
+		backupPtr.Status.Duration = backupPtr.Status.CompletionTime.Sub(backupPtr.Status.StartTime.Time).Round(time.Second).String()
+	}
+	backupPtr.Status.Phase = pgv1.BackupPhaseSucceeded
+	backupPtr.Status.Message = ""
+	log.Infof("completeSnapshot %s, snapshot:%s, size:%d", backupPtr.Name, backupPtr.Status.Snapshot, backupPtr.Status.Size)
+}
+
+// failSnapshot 结束仍在等待的备份会话，已创建的快照随备份资源一同删除
+func (s *Backup) failSnapshot(backupPtr *pgv1.PostgreSQLBackup, result snapshotResult, message string) (err *cd.Result) {
+	session := backupPtr.Status.Session
+	if !result.done && !session.Stopped {
+		_, _ = s.executeCommand(session.Instance, "backup-stop", []string{session.Label})
+	}
+	s.cleanSnapshotSession(backupPtr)
+	s.setCompletion(backupPtr)
+
+	err = cd.NewError(cd.UnExpected, message)
+	log.Errorf("checkSnapshot %s failed, error:%s", backupPtr.Name, message)
+	return
+}
+
+// cleanSnapshotSession 删除已结束会话的文件，仍在等待结束标记的会话在超时后自行结束
+func (s *Backup) cleanSnapshotSession(backupPtr *pgv1.PostgreSQLBackup) {
+	session := backupPtr.Status.Session
+	if session == nil {
+		return
+	}
+
+	_, cleanErr := s.executeCommand(session.Instance, "backup-clean", []string{session.Label})
+	if cleanErr != nil {
+		log.Warnf("cleanSnapshotSession %s failed, error:%s", backupPtr.Name, cleanErr.Error())
+	}
+	backupPtr.Status.Session = nil
+}
+
+// getSnapshotResult 读取备份会话的退出码与输出，会话未结束时done为false
+func (s *Backup) getSnapshotResult(session *pgv1.SnapshotSession) (ret snapshotResult, err *cd.Result) {
+	output, outputErr := s.executeCommand(session.Instance, "backup-result", []string{session.Label})
+	if outputErr != nil {
+		err = outputErr
+		return
+	}
+	if output == "" {
+		return
+	}
+
+	ret.done = true
+	ret.status, ret.output, _ = strings.Cut(output, "\n")
+	ret.output = strings.TrimSpace(ret.output)
+	return
+}
+
+// isBackupStarted 备份会话执行完开始备份的语句后处于idle状态并等待结束标记
+func (s *Backup) isBackupStarted(session *pgv1.SnapshotSession) (ret bool, err *cd.Result) {
+	countVal, countErr := s.sendCommand(&common.CmdInfo{
+		Service:   session.Instance,
+		Catalog:   common.PostgreSQL,
+		Type:      common.DiagnosticCommand,
+		Operation: "backup-session",
+		Args:      []string{session.Label},
+	})
+	if countErr != nil {
+		err = countErr
+		return
+	}
+
+	ret = countVal == "1"
+	return
+}
+
+func (s *Backup) createVolumeSnapshot(backupPtr *pgv1.PostgreSQLBackup, volume string) (err *cd.Result) {
+	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	objVal, objErr := runtime.DefaultUnstructuredConverter.ToUnstructured(snapshot.GetVolumeSnapshot(backupPtr, volume))
+	if objErr != nil {
+		err = cd.NewError(cd.UnExpected, objErr.Error())
+		return
+	}
+
+	_, createErr := client.Resource(snapshot.GetGVR()).Namespace(backupPtr.Namespace).Create(context.TODO(),
+		&unstructured.Unstructured{Object: objVal}, metav1.CreateOptions{})
+	if createErr != nil && !errors.IsAlreadyExists(createErr) {
+		err = cd.NewError(cd.UnExpected, createErr.Error())
+		log.Errorf("createVolumeSnapshot %s failed, error:%s", backupPtr.Name, createErr.Error())
+		return
+	}
+
+	log.Infof("createVolumeSnapshot %s, instance:%s, volume:%s", backupPtr.Name, backupPtr.Spec.Instance, volume)
+	return
+}
+
+func (s *Backup) getVolumeSnapshot(namespace, name string) (ret *snapshot.VolumeSnapshot, err *cd.Result) {
+	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewWarn(cd.Warned, "illegal k8s client")
+		return
+	}
+
+	resVal, resErr := client.Resource(snapshot.GetGVR()).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if resErr != nil {
+		if errors.IsNotFound(resErr) {
+			err = cd.NewError(cd.UnExpected, fmt.Sprintf("volume snapshot %s not found", name))
+			return
+		}
+
+		err = cd.NewWarn(cd.Warned, resErr.Error())
+		return
+	}
+
+	snapshotPtr := &snapshot.VolumeSnapshot{}
+	convertErr := runtime.DefaultUnstructuredConverter.FromUnstructured(resVal.UnstructuredContent(), snapshotPtr)
+	if convertErr != nil {
+		err = cd.NewError(cd.UnExpected, convertErr.Error())
+		return
+	}
+
+	ret = snapshotPtr
+	return
+}
@@ -0,0 +1,346 @@
+package biz
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/base/cron"
+	"supos.ai/operator/database/internal/core/base/record"
+	"supos.ai/operator/database/internal/core/module/backup/pkg/verify"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	// maxVerifications 同时进行的恢复校验数量，避免临时实例占用过多资源
+	maxVerifications = 1
+	// verifyTimeout 临时实例恢复与校验的最长时间
+	verifyTimeout = 2 * time.Hour
+)
+
+// verifySession 在临时实例中执行的校验，完成后记录数据库与表数量
+type verifySession struct {
+	done      bool
+	databases int64
+	tables    int64
+	err       *cd.Result
+}
+
+func (s *Backup) getVerifySession(name string) (ret verifySession, ok bool) {
+	s.sessionLock.RLock()
+	defer s.sessionLock.RUnlock()
+
+	sessionPtr, sessionOK := s.verifySessions[name]
+	if sessionOK {
+		ret = *sessionPtr
+		ok = true
+	}
+	return
+}
+
+func (s *Backup) removeVerifySession(name string) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+
+	delete(s.verifySessions, name)
+}
+
+func getVerificationHash(backupPtr *pgv1.PostgreSQLBackup) string {
+	byteVal, _ := json.Marshal(backupPtr.Status.Verification)
+	return string(byteVal)
+}
+
+// reconcileVerifications 成功的备份按校验策略恢复到临时实例并校验，同时只进行有限数量的校验
+func (s *Backup) reconcileVerifications() {
+	var backupList pgv1.PostgreSQLBackupList
+	listErr := s.listResource(pgv1.Backup, s.getNamespace(), &backupList)
+	if listErr != nil {
+		return
+	}
+
+	running := 0
+	for idx := range backupList.Items {
+		verificationPtr := backupList.Items[idx].Status.Verification
+		if verificationPtr != nil && verificationPtr.Phase == pgv1.VerifyPhaseRunning {
+			running++
+		}
+	}
+
+	for idx := range backupList.Items {
+		backupPtr := &backupList.Items[idx]
+		if backupPtr.DeletionTimestamp != nil || backupPtr.Status.Phase != pgv1.BackupPhaseSucceeded {
+			continue
+		}
+
+		verificationHash := getVerificationHash(backupPtr)
+		verificationPtr := backupPtr.Status.Verification
+		switch {
+		case verificationPtr != nil && verificationPtr.Phase == pgv1.VerifyPhaseRunning:
+			s.checkVerification(backupPtr)
+		case running >= maxVerifications:
+			continue
+		case verificationPtr != nil && verificationPtr.Phase == pgv1.VerifyPhasePending,
+			verificationPtr == nil && backupPtr.Spec.Verify != nil && backupPtr.Spec.Verify.Schedule == "":
+			s.startVerification(backupPtr)
+			if backupPtr.Status.Verification.Phase == pgv1.VerifyPhaseRunning {
+				running++
+			}
+		default:
+			continue
+		}
+		if getVerificationHash(backupPtr) == verificationHash {
+			continue
+		}
+
+		_ = s.updateStatus(pgv1.Backup, backupPtr.Namespace, backupPtr)
+	}
+}
+
+// startVerification 以源实例的镜像创建临时实例，由PostgreSQL模块从备份恢复
+func (s *Backup) startVerification(backupPtr *pgv1.PostgreSQLBackup) {
+	if backupPtr.Status.Verification == nil {
+		backupPtr.Status.Verification = &pgv1.VerificationStatus{Phase: pgv1.VerifyPhasePending}
+	}
+
+	image, imageErr := s.getInstanceImage(backupPtr.Namespace, backupPtr.Spec.Instance)
+	if imageErr != nil {
+		// 源实例已删除时仍可校验备份
+		image = common.DefaultPostgreSQLImage
+	}
+
+	pgPtr, pgErr := verify.GetInstance(backupPtr, image)
+	if pgErr != nil {
+		s.completeVerification(backupPtr, pgv1.VerifyPhaseFailed, pgErr.Error())
+		return
+	}
+
+	createErr := s.createResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr)
+	if createErr != nil && createErr.ErrorCode != cd.Duplicated {
+		backupPtr.Status.Verification.Message = createErr.Reason
+		return
+	}
+
+	now := metav1.Now()
+	backupPtr.Status.Verification = &pgv1.VerificationStatus{
+		Phase:     pgv1.VerifyPhaseRunning,
+		Instance:  pgPtr.Name,
+		StartTime: &now,
+	}
+	log.Infof("startVerification %s, instance:%s", backupPtr.Name, pgPtr.Name)
+}
+
+// checkVerification 临时实例恢复完成后异步执行校验，校验完成或超时后删除临时实例
+func (s *Backup) checkVerification(backupPtr *pgv1.PostgreSQLBackup) {
+	verificationPtr := backupPtr.Status.Verification
+	if verificationPtr.StartTime != nil && time.Since(verificationPtr.StartTime.Time) > verifyTimeout {
+		s.removeVerifySession(backupPtr.Name)
+		s.completeVerification(backupPtr, pgv1.VerifyPhaseFailed, fmt.Sprintf("verification not finished in %s", verifyTimeout))
+		return
+	}
+
+	pgPtr := &pgv1.PostgreSQL{}
+	getErr := s.getResource(pgv1.Postgresql, backupPtr.Namespace, verificationPtr.Instance, pgPtr)
+	if getErr != nil {
+		if getErr.ErrorCode == cd.NoExist {
+			s.completeVerification(backupPtr, pgv1.VerifyPhaseFailed, fmt.Sprintf("instance %s not found", verificationPtr.Instance))
+			return
+		}
+
+		verificationPtr.Message = getErr.Reason
+		return
+	}
+	switch pgPtr.Status.Phase {
+	case pgv1.PhaseFailed:
+		message := pgPtr.Status.Message
+		if pgPtr.Status.Restore != nil && pgPtr.Status.Restore.Message != "" {
+			message = pgPtr.Status.Restore.Message
+		}
+		s.completeVerification(backupPtr, pgv1.VerifyPhaseFailed, fmt.Sprintf("restore failed, %s", message))
+		return
+	case pgv1.InstancePhaseRunning:
+	default:
+		verificationPtr.Message = "waiting for instance restore"
+		return
+	}
+
+	name := backupPtr.Name
+	session, sessionOK := s.getVerifySession(name)
+	if !sessionOK {
+		s.sessionLock.Lock()
+		s.verifySessions[name] = &verifySession{}
+		s.sessionLock.Unlock()
+
+		instance := verificationPtr.Instance
+		s.AsyncTask(func() {
+			databases, tables, checkErr := s.checkInstance(instance)
+			s.sessionLock.Lock()
+			defer s.sessionLock.Unlock()
+			if sessionPtr, ok := s.verifySessions[name]; ok {
+				sessionPtr.done = true
+				sessionPtr.databases = databases
+				sessionPtr.tables = tables
+				sessionPtr.err = checkErr
+			}
+		})
+		verificationPtr.Message = "checking restored instance"
+		return
+	}
+	if !session.done {
+		return
+	}
+
+	s.removeVerifySession(name)
+	if session.err != nil {
+		s.completeVerification(backupPtr, pgv1.VerifyPhaseFailed, session.err.Reason)
+		return
+	}
+
+	verificationPtr.Databases = session.databases
+	verificationPtr.Tables = session.tables
+	s.completeVerification(backupPtr, pgv1.VerifyPhaseSucceeded, "")
+}
+
+// checkInstance 统计各数据库的表数量，并使用pg_amcheck校验表与索引
+func (s *Backup) checkInstance(instance string) (databases, tables int64, err *cd.Result) {
+	output, outputErr := s.sendCommand(&common.CmdInfo{
+		Service:   instance,
+		Catalog:   common.PostgreSQL,
+		Type:      common.DiagnosticCommand,
+		Operation: "database-size",
+	})
+	if outputErr != nil {
+		err = outputErr
+		return
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		database := strings.SplitN(strings.TrimSpace(line), "|", 2)[0]
+		if database == "" || database == "template1" {
+			continue
+		}
+
+		countVal, countErr := s.sendCommand(&common.CmdInfo{
+			Service:   instance,
+			Catalog:   common.PostgreSQL,
+			Type:      common.DiagnosticCommand,
+			Operation: "table-count",
+			Database:  database,
+		})
+		if countErr != nil {
+			err = countErr
+			return
+		}
+
+		count, parseErr := strconv.ParseInt(countVal, 10, 64)
+		if parseErr != nil {
+			err = cd.NewError(cd.UnExpected, fmt.Sprintf("illegal table count of database %s, %s", database, countVal))
+			return
+		}
+		databases++
+		tables += count
+	}
+
+	_, err = s.executeCommand(instance, "amcheck", nil)
+	return
+}
+
+// completeVerification 记录校验结果并发出事件，删除临时实例定义及其k8s资源
+func (s *Backup) completeVerification(backupPtr *pgv1.PostgreSQLBackup, phase, message string) {
+	now := metav1.Now()
+	verificationPtr := backupPtr.Status.Verification
+	verificationPtr.Phase = phase
+	verificationPtr.Message = message
+	verificationPtr.CompletionTime = &now
+
+	if verificationPtr.Instance != "" {
+		_ = s.deleteResource(pgv1.Postgresql, backupPtr.Namespace, verificationPtr.Instance)
+
+		ev := event.NewEvent(common.DestroyService, s.ID(), common.K8sModule, nil, common.NewPostgreSQLService(verificationPtr.Instance, backupPtr.Namespace))
+		result := s.SendEvent(ev)
+		if result.Error() != nil {
+			log.Errorf("completeVerification %s failed, destroy instance %s error:%s", backupPtr.Name, verificationPtr.Instance, result.Error().Error())
+		}
+	}
+
+	refPtr := record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.BackupKind, backupPtr)
+	if phase == pgv1.VerifyPhaseSucceeded {
+		record.Event(s.getClientSet(), refPtr, corev1.EventTypeNormal, "VerificationSucceeded",
+			fmt.Sprintf("backup restored and checked, databases:%d, tables:%d", verificationPtr.Databases, verificationPtr.Tables))
+		log.Infof("completeVerification %s succeeded, databases:%d, tables:%d", backupPtr.Name, verificationPtr.Databases, verificationPtr.Tables)
+		return
+	}
+
+	record.Event(s.getClientSet(), refPtr, corev1.EventTypeWarning, "VerificationFailed", message)
+	log.Errorf("completeVerification %s failed, error:%s", backupPtr.Name, message)
+}
+
+// checkVerifySchedule 定时备份模板指定校验计划时，到达计划时间后选中最近一个成功且未校验的备份
+func (s *Backup) checkVerifySchedule(schedulePtr *pgv1.PostgreSQLBackupSchedule, backups []pgv1.PostgreSQLBackup) {
+	verifyPtr := schedulePtr.Spec.Template.Verify
+	if verifyPtr == nil || verifyPtr.Schedule == "" {
+		return
+	}
+
+	cronPtr, cronErr := cron.Parse(verifyPtr.Schedule)
+	if cronErr != nil {
+		log.Errorf("checkVerifySchedule %s failed, illegal schedule %s, error:%s", schedulePtr.Name, verifyPtr.Schedule, cronErr.Error())
+		return
+	}
+
+	lastTime := schedulePtr.CreationTimestamp.Time
+	candidates := []*pgv1.PostgreSQLBackup{}
+	for idx := range backups {
+		backupPtr := &backups[idx]
+		if backupPtr.Labels[ScheduleLabel] != schedulePtr.Name || backupPtr.DeletionTimestamp != nil {
+			continue
+		}
+
+		verificationPtr := backupPtr.Status.Verification
+		if verificationPtr == nil {
+			if backupPtr.Status.Phase == pgv1.BackupPhaseSucceeded {
+				candidates = append(candidates, backupPtr)
+			}
+			continue
+		}
+		if backupPtr.IsVerifying() {
+			return
+		}
+		if verificationPtr.StartTime != nil && verificationPtr.StartTime.After(lastTime) {
+			lastTime = verificationPtr.StartTime.Time
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	nextTime := cronPtr.Next(lastTime.UTC())
+	if nextTime.IsZero() || nextTime.After(time.Now().UTC()) {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].CreationTimestamp.Before(&candidates[j].CreationTimestamp)
+	})
+	backupPtr := candidates[len(candidates)-1]
+	now := metav1.Now()
+	backupPtr.Status.Verification = &pgv1.VerificationStatus{
+		Phase:     pgv1.VerifyPhasePending,
+		StartTime: &now,
+	}
+	if updateErr := s.updateStatus(pgv1.Backup, backupPtr.Namespace, backupPtr); updateErr != nil {
+		return
+	}
+
+	log.Infof("checkVerifySchedule %s, backup %s selected", schedulePtr.Name, backupPtr.Name)
+}
@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/module"
+	"github.com/muidea/magicCommon/task"
+
+	engine "github.com/muidea/magicEngine/http"
+
+	"supos.ai/operator/database/internal/core/module/backup/biz"
+	"supos.ai/operator/database/pkg/common"
+)
+
+func init() {
+	module.Register(New())
+}
+
+type Backup struct {
+	routeRegistry engine.RouteRegistry
+
+	biz *biz.Backup
+}
+
+func New() *Backup {
+	return &Backup{}
+}
+
+func (s *Backup) ID() string {
+	return common.BackupModule
+}
+
+func (s *Backup) BindRegistry(routeRegistry engine.RouteRegistry) {
+
+	s.routeRegistry = routeRegistry
+}
+
+func (s *Backup) Setup(endpointName string, eventHub event.Hub, backgroundRoutine task.BackgroundRoutine) {
+	s.biz = biz.New(eventHub, backgroundRoutine)
+}
+
+func (s *Backup) Run() {
+	if s.biz != nil {
+		s.biz.Run()
+	}
+}
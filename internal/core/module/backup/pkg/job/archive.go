@@ -0,0 +1,167 @@
+package job
+
+import (
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const pruneContainer = "prune"
+
+// PruneBackupsAnnotation 记录清理任务删除文件的基础备份资源，任务成功后删除这些资源
+const PruneBackupsAnnotation = "database.supos.ai/prune-backups"
+
+// pruneScript 删除过期的基础备份文件与早于KEEP_SEGMENT的WAL，时间线历史文件始终保留
+// WAL文件名前8位为时间线，之后16位为日志与段序号，按序号比较
+const pruneScript = `set -eu
+is_expired() {
+  case "$1" in
+    *.history) return 1 ;;
+  esac
+  seg=$(echo "$1" | cut -c9-24)
+  [ -n "$KEEP_SEGMENT" ] && expr "x$seg" \< "x$KEEP_SEGMENT" > /dev/null
+}
+if [ -n "$S3_BUCKET" ]; then
+  mc_opts="--config-dir /tmp/mc"
+  if [ "$S3_INSECURE" = "true" ]; then
+    mc_opts="$mc_opts --insecure"
+  fi
+  mc $mc_opts alias set target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" > /dev/null
+  mc $mc_opts ls "target/$S3_BUCKET/$WAL_PATH" | while read -r line; do
+    f="${line##* }"
+    if is_expired "$f"; then
+      mc $mc_opts rm "target/$S3_BUCKET/$WAL_PATH$f" > /dev/null
+    fi
+  done
+  for f in $BASE_FILES; do
+    mc $mc_opts rm "target/$S3_BUCKET/$f" > /dev/null || true
+  done
+else
+  if [ -d "$ROOT_DIR/$WAL_PATH" ]; then
+    for p in "$ROOT_DIR/$WAL_PATH"/*; do
+      [ -f "$p" ] || continue
+      if is_expired "$(basename "$p")"; then
+        rm -f "$p"
+      fi
+    done
+  fi
+  for f in $BASE_FILES; do
+    rm -f "$ROOT_DIR/$f"
+  done
+fi
+`
+
+func GetPruneJobName(instance string) string {
+	return getJobName(instance, "-archive-prune")
+}
+
+// GetPruneJob 清理过期基础备份及其之前的WAL，keepWAL为最早保留基础备份开始时的WAL文件
+func GetPruneJob(pgPtr *pgv1.PostgreSQL, image, keepWAL string, expired []*pgv1.PostgreSQLBackup) (ret *batchv1.Job) {
+	backupCfg := config.GetBackupConfig()
+	labels := common.NewBackupLabels(pgPtr.Name)
+	storage := pgPtr.Spec.Archive.Storage
+	archivePtr := &common.Archive{PVC: storage.PVC, S3: storage.S3}
+
+	names := []string{}
+	files := []string{}
+	for _, val := range expired {
+		names = append(names, val.Name)
+		if key := val.GetLocationKey(); key != "" {
+			files = append(files, key)
+		}
+	}
+
+	keepSegment := ""
+	if len(keepWAL) >= 24 {
+		keepSegment = keepWAL[8:24]
+	}
+
+	prune := corev1.Container{
+		Name:            pruneContainer,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", pruneScript},
+		Env: []corev1.EnvVar{
+			{Name: "WAL_PATH", Value: archivePtr.GetWALPath(pgPtr.Name)},
+			{Name: "KEEP_SEGMENT", Value: keepSegment},
+			{Name: "BASE_FILES", Value: strings.Join(files, " ")},
+		},
+		SecurityContext: getSecurityContext(),
+	}
+
+	podSpec := corev1.PodSpec{
+		RestartPolicy:                corev1.RestartPolicyNever,
+		AutomountServiceAccountToken: boolPtr(false),
+		SecurityContext: &corev1.PodSecurityContext{
+			RunAsNonRoot: boolPtr(true),
+			RunAsUser:    int64Ptr(common.DefaultPostgreSQLUID),
+			RunAsGroup:   int64Ptr(common.DefaultPostgreSQLUID),
+			FSGroup:      int64Ptr(common.DefaultPostgreSQLUID),
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			},
+		},
+	}
+	if storage.S3 != nil {
+		prune.Image = backupCfg.UploaderImage
+		prune.Env = append(prune.Env,
+			corev1.EnvVar{Name: "S3_ENDPOINT", Value: storage.S3.Endpoint},
+			corev1.EnvVar{Name: "S3_BUCKET", Value: storage.S3.Bucket},
+			corev1.EnvVar{Name: "S3_INSECURE", Value: strconv.FormatBool(storage.S3.Insecure)},
+			secretEnv("S3_ACCESS_KEY", storage.S3.Secret, "accessKey"),
+			secretEnv("S3_SECRET_KEY", storage.S3.Secret, "secretKey"),
+		)
+	} else {
+		prune.Image = image
+		prune.Env = append(prune.Env,
+			corev1.EnvVar{Name: "S3_BUCKET", Value: ""},
+			corev1.EnvVar{Name: "ROOT_DIR", Value: backupMountPath},
+		)
+		prune.VolumeMounts = []corev1.VolumeMount{{Name: pvcVolumeName, MountPath: backupMountPath}}
+		podSpec.Volumes = []corev1.Volume{
+			{
+				Name: pvcVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: storage.PVC.ClaimName},
+				},
+			},
+		}
+	}
+	podSpec.Containers = []corev1.Container{prune}
+
+	ret = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      GetPruneJobName(pgPtr.Name),
+			Namespace: pgPtr.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				PruneBackupsAnnotation: strings.Join(names, ","),
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: pgv1.Group + "/" + pgv1.Version,
+					Kind:       pgv1.PostgreSQLKind,
+					Name:       pgPtr.Name,
+					UID:        pgPtr.UID,
+				},
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            int32Ptr(0),
+			TTLSecondsAfterFinished: int32Ptr(backupCfg.JobTTL),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+	return
+}
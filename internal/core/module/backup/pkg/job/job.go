@@ -0,0 +1,356 @@
+package job
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	backupMountPath = "/backup"
+	workMountPath   = "/work"
+	workVolumeName  = "work"
+	pvcVolumeName   = "backup"
+	dumpContainer   = "dump"
+	uploadContainer = "upload"
+
+	terminationLog = "/dev/termination-log"
+
+	// BackupKind 备份资源类型，Job随备份资源一同删除
+	BackupKind = pgv1.BackupKind
+)
+
+// dumpScript 导出并压缩备份，结果以JSON写入RESULT_FILE
+// 物理备份不包含WAL，恢复时从归档获取，开始前记录WAL位置用于清理更早的归档
+// dash不支持pipefail，导出命令的退出码写入临时文件后检查
+const dumpScript = `set -eu
+start=$(date +%s)
+case "$COMPRESSION" in
+  zstd) ext=zst; compress="zstd -q -c" ;;
+  *) ext=gz; compress="gzip -c" ;;
+esac
+if [ "$METHOD" = "basebackup" ]; then
+  file="$FILE_DIR$BACKUP_NAME.tar.$ext"
+else
+  file="$FILE_DIR$BACKUP_NAME.sql.$ext"
+fi
+out="$OUTPUT_DIR/$file"
+mkdir -p "$(dirname "$out")"
+rc_file="$(mktemp)"
+start_wal=""
+start_lsn=""
+stop_lsn=""
+if [ "$METHOD" = "basebackup" ]; then
+  start_wal=$(psql -X -A -t -d postgres -c "SELECT pg_walfile_name(pg_current_wal_lsn())")
+  start_lsn=$(psql -X -A -t -d postgres -c "SELECT pg_current_wal_lsn()")
+  { pg_basebackup -D - -F tar -X none -c fast --no-manifest; echo $? > "$rc_file"; } | $compress > "$out"
+  stop_lsn=$(psql -X -A -t -d postgres -c "SELECT pg_current_wal_lsn()")
+elif [ -n "$DATABASE" ]; then
+  { pg_dump -d "$DATABASE"; echo $? > "$rc_file"; } | $compress > "$out"
+else
+  { pg_dumpall; echo $? > "$rc_file"; } | $compress > "$out"
+fi
+rc=$(cat "$rc_file")
+if [ "$rc" != "0" ]; then
+  rm -f "$out"
+  echo "dump failed, exit code $rc" > /dev/termination-log
+  exit 1
+fi
+size=$(wc -c < "$out" | tr -d ' ')
+checksum=$(sha256sum "$out" | cut -d' ' -f1)
+duration=$(( $(date +%s) - start ))
+printf '{"file":"%s","size":%s,"checksum":"%s","duration":%s,"startWal":"%s","startLsn":"%s","stopLsn":"%s"}' \
+  "$file" "$size" "$checksum" "$duration" "$start_wal" "$start_lsn" "$stop_lsn" > "$RESULT_FILE"
+`
+
+// uploadScript 上传备份文件到S3兼容存储，上传完成后输出导出结果
+const uploadScript = `set -eu
+file=$(sed -n 's/.*"file":"\([^"]*\)".*/\1/p' /work/result.json)
+mc_opts="--config-dir /tmp/mc"
+if [ "$S3_INSECURE" = "true" ]; then
+  mc_opts="$mc_opts --insecure"
+fi
+mc $mc_opts alias set target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" > /dev/null
+mc $mc_opts cp "/work/$file" "target/$S3_BUCKET/$S3_PREFIX$file" > /dev/null
+cat /work/result.json > /dev/termination-log
+`
+
+// Result 备份任务输出的结果
+type Result struct {
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Duration int64  `json:"duration"`
+	StartWAL string `json:"startWal"`
+	StartLSN string `json:"startLsn"`
+	StopLSN  string `json:"stopLsn"`
+}
+
+func ParseResult(message string) (ret *Result, err error) {
+	ret = &Result{}
+	err = json.Unmarshal([]byte(strings.TrimSpace(message)), ret)
+	if err != nil {
+		ret = nil
+		return
+	}
+	if ret.File == "" {
+		err = fmt.Errorf("illegal backup result %s", message)
+		ret = nil
+	}
+	return
+}
+
+// maxJobNameLength Job名称会作为Pod的job-name标签值，不能超过标签值的长度上限
+const maxJobNameLength = 63
+
+// getJobName 名称加后缀超过长度上限时截断名称并加上名称的摘要，同一名称始终得到同一Job名称
+func getJobName(name, suffix string) string {
+	if len(name)+len(suffix) <= maxJobNameLength {
+		return name + suffix
+	}
+
+	hashVal := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(hashVal[:4])
+	prefix := strings.TrimRight(name[:maxJobNameLength-len(suffix)-len(hash)-1], "-.")
+	return prefix + "-" + hash + suffix
+}
+
+func GetJobName(backupPtr *pgv1.PostgreSQLBackup) string {
+	return getJobName(backupPtr.Name, "-backup")
+}
+
+func getOutputDir(storage *pgv1.PVCStorage, instance string) string {
+	return path.Join(backupMountPath, storage.Path, instance)
+}
+
+// getFileDir 物理备份位于实例目录下的base目录，S3对象名称同样包含实例名称
+func getFileDir(backupPtr *pgv1.PostgreSQLBackup) string {
+	if !backupPtr.Spec.IsBaseBackup() {
+		return ""
+	}
+	if backupPtr.Spec.Storage.S3 != nil {
+		return backupPtr.Spec.Instance + "/base/"
+	}
+
+	return "base/"
+}
+
+// GetLocation 备份文件位置，PVC为pvc://<claim>/<path>，S3为s3://<bucket>/<key>
+func GetLocation(backupPtr *pgv1.PostgreSQLBackup, file string) string {
+	storage := backupPtr.Spec.Storage
+	if storage.S3 != nil {
+		return fmt.Sprintf("s3://%s/%s%s", storage.S3.Bucket, storage.S3.Prefix, file)
+	}
+
+	return fmt.Sprintf("pvc://%s/%s", storage.PVC.ClaimName,
+		strings.TrimPrefix(path.Join(storage.PVC.Path, backupPtr.Spec.Instance, file), "/"))
+}
+
+// GetContainerName 输出备份结果的容器
+func GetContainerName(backupPtr *pgv1.PostgreSQLBackup) string {
+	if backupPtr.Spec.Storage.S3 != nil {
+		return uploadContainer
+	}
+
+	return dumpContainer
+}
+
+func Validate(backupPtr *pgv1.PostgreSQLBackup) error {
+	spec := &backupPtr.Spec
+	if spec.Instance == "" {
+		return fmt.Errorf("instance is required")
+	}
+	switch spec.Method {
+	case "", pgv1.BackupMethodLogical:
+	case pgv1.BackupMethodBase:
+		if spec.Database != "" {
+			return fmt.Errorf("base backup can not specify database")
+		}
+	case pgv1.BackupMethodSnapshot:
+		if spec.Database != "" {
+			return fmt.Errorf("snapshot backup can not specify database")
+		}
+		return nil
+	default:
+		return fmt.Errorf("illegal method %s", spec.Method)
+	}
+	if (spec.Storage.PVC == nil) == (spec.Storage.S3 == nil) {
+		return fmt.Errorf("exactly one of pvc and s3 storage must be specified")
+	}
+	if spec.Storage.PVC != nil && spec.Storage.PVC.ClaimName == "" {
+		return fmt.Errorf("pvc claimName is required")
+	}
+	if spec.Storage.S3 != nil && (spec.Storage.S3.Endpoint == "" || spec.Storage.S3.Bucket == "" || spec.Storage.S3.Secret == "") {
+		return fmt.Errorf("s3 endpoint, bucket and secret are required")
+	}
+	switch spec.Compression {
+	case "", pgv1.CompressionGzip, pgv1.CompressionZstd:
+	default:
+		return fmt.Errorf("illegal compression %s", spec.Compression)
+	}
+
+	return nil
+}
+
+func int32Ptr(val int32) *int32 {
+	return &val
+}
+
+func int64Ptr(val int64) *int64 {
+	return &val
+}
+
+func boolPtr(val bool) *bool {
+	return &val
+}
+
+func getSecurityContext() *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: boolPtr(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+func getDumpEnv(backupPtr *pgv1.PostgreSQLBackup, outputDir, resultFile string) []corev1.EnvVar {
+	compression := backupPtr.Spec.Compression
+	if compression == "" {
+		compression = pgv1.CompressionGzip
+	}
+
+	return []corev1.EnvVar{
+		{Name: "PGHOST", Value: backupPtr.Spec.Instance},
+		{Name: "PGPORT", Value: strconv.Itoa(common.DefaultPostgreSQLPort)},
+		{Name: "PGUSER", Value: common.DefaultPostgreSQLRoot},
+		secretEnv("PGPASSWORD", common.GetSuperuserSecretName(backupPtr.Spec.Instance), common.SuperuserPasswordKey),
+		{Name: "BACKUP_NAME", Value: backupPtr.Name},
+		{Name: "DATABASE", Value: backupPtr.Spec.Database},
+		{Name: "METHOD", Value: backupPtr.Spec.Method},
+		{Name: "FILE_DIR", Value: getFileDir(backupPtr)},
+		{Name: "COMPRESSION", Value: compression},
+		{Name: "OUTPUT_DIR", Value: outputDir},
+		{Name: "RESULT_FILE", Value: resultFile},
+	}
+}
+
+func secretEnv(name, secret, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// GetBackupJob PVC存储时直接写入PVC；S3存储时先导出到临时目录，再由上传容器上传
+func GetBackupJob(backupPtr *pgv1.PostgreSQLBackup, image string) (ret *batchv1.Job) {
+	backupCfg := config.GetBackupConfig()
+	labels := common.NewBackupLabels(backupPtr.Spec.Instance)
+
+	podSpec := corev1.PodSpec{
+		RestartPolicy:                corev1.RestartPolicyNever,
+		AutomountServiceAccountToken: boolPtr(false),
+		SecurityContext: &corev1.PodSecurityContext{
+			RunAsNonRoot: boolPtr(true),
+			RunAsUser:    int64Ptr(common.DefaultPostgreSQLUID),
+			RunAsGroup:   int64Ptr(common.DefaultPostgreSQLUID),
+			FSGroup:      int64Ptr(common.DefaultPostgreSQLUID),
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			},
+		},
+	}
+
+	dump := corev1.Container{
+		Name:            dumpContainer,
+		Image:           image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", dumpScript},
+		SecurityContext: getSecurityContext(),
+	}
+
+	storage := backupPtr.Spec.Storage
+	if storage.S3 != nil {
+		dump.Env = getDumpEnv(backupPtr, workMountPath, path.Join(workMountPath, "result.json"))
+		dump.VolumeMounts = []corev1.VolumeMount{{Name: workVolumeName, MountPath: workMountPath}}
+
+		upload := corev1.Container{
+			Name:            uploadContainer,
+			Image:           backupCfg.UploaderImage,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"sh", "-c", uploadScript},
+			Env: []corev1.EnvVar{
+				{Name: "S3_ENDPOINT", Value: storage.S3.Endpoint},
+				{Name: "S3_BUCKET", Value: storage.S3.Bucket},
+				{Name: "S3_PREFIX", Value: storage.S3.Prefix},
+				{Name: "S3_INSECURE", Value: strconv.FormatBool(storage.S3.Insecure)},
+				secretEnv("S3_ACCESS_KEY", storage.S3.Secret, "accessKey"),
+				secretEnv("S3_SECRET_KEY", storage.S3.Secret, "secretKey"),
+			},
+			VolumeMounts:    []corev1.VolumeMount{{Name: workVolumeName, MountPath: workMountPath}},
+			SecurityContext: getSecurityContext(),
+		}
+
+		podSpec.InitContainers = []corev1.Container{dump}
+		podSpec.Containers = []corev1.Container{upload}
+		podSpec.Volumes = []corev1.Volume{
+			{Name: workVolumeName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		}
+	} else {
+		dump.Env = getDumpEnv(backupPtr, getOutputDir(storage.PVC, backupPtr.Spec.Instance), terminationLog)
+		dump.VolumeMounts = []corev1.VolumeMount{{Name: pvcVolumeName, MountPath: backupMountPath}}
+
+		podSpec.Containers = []corev1.Container{dump}
+		podSpec.Volumes = []corev1.Volume{
+			{
+				Name: pvcVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: storage.PVC.ClaimName},
+				},
+			},
+		}
+	}
+
+	ret = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      GetJobName(backupPtr),
+			Namespace: backupPtr.Namespace,
+			Labels:    labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: pgv1.Group + "/" + pgv1.Version,
+					Kind:       BackupKind,
+					Name:       backupPtr.Name,
+					UID:        backupPtr.UID,
+				},
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            int32Ptr(0),
+			TTLSecondsAfterFinished: int32Ptr(backupCfg.JobTTL),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+	return
+}
@@ -0,0 +1,42 @@
+package job
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetJobName(t *testing.T) {
+	longName := strings.Repeat("a", 60)
+	// 截断位置落在"-."之后，前缀末尾的分隔符被去掉
+	dotName := strings.Repeat("b", 45) + "-." + strings.Repeat("c", 20)
+	cases := []struct {
+		name   string
+		suffix string
+		expect string
+	}{
+		{"db-20240101", "-backup", "db-20240101-backup"},
+		{strings.Repeat("a", 56), "-backup", strings.Repeat("a", 56) + "-backup"},
+		{longName, "-backup", strings.Repeat("a", 47) + "-11ee3912-backup"},
+		{dotName, "-backup", strings.Repeat("b", 45) + "-214bdc94-backup"},
+	}
+	for _, c := range cases {
+		ret := getJobName(c.name, c.suffix)
+		if ret != c.expect {
+			t.Errorf("getJobName(%s, %s) = %s, expect %s", c.name, c.suffix, ret, c.expect)
+		}
+		if len(ret) > maxJobNameLength {
+			t.Errorf("getJobName(%s, %s) = %s, longer than %d", c.name, c.suffix, ret, maxJobNameLength)
+		}
+		if !strings.HasSuffix(ret, c.suffix) {
+			t.Errorf("getJobName(%s, %s) = %s, suffix lost", c.name, c.suffix, ret)
+		}
+	}
+
+	// 截断后的名称只由原名称决定，前缀相同的不同名称得到不同Job名称
+	if getJobName(longName, "-backup") != getJobName(longName, "-backup") {
+		t.Fatalf("job name not deterministic")
+	}
+	if getJobName(longName+"x", "-backup") == getJobName(longName+"y", "-backup") {
+		t.Fatalf("job name collided for different names")
+	}
+}
@@ -0,0 +1,267 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	downloadContainer = "download"
+	restoreContainer  = "restore"
+)
+
+// countScript 统计备份中每个表COPY的行数，输出"数据库\t表\t行数"
+// pg_dumpall通过\connect切换数据库，名称含特殊字符时为"dbname='xxx'"形式
+const countScript = `BEGIN { cur = db }
+incopy {
+  if ($0 == "\\.") { printf "%s\t%s\t%d\n", cur, table, n; incopy = 0 } else { n++ }
+  next
+}
+/^\\connect / {
+  if (match($0, /dbname='[^']*'/)) { cur = substr($0, RSTART + 8, RLENGTH - 9) } else { cur = $2; gsub(/"/, "", cur) }
+  next
+}
+/^COPY .* FROM stdin;$/ {
+  table = $0
+  sub(/^COPY /, "", table)
+  sub(/ FROM stdin;$/, "", table)
+  sub(/ \(.*\)$/, "", table)
+  sub(/ +$/, "", table)
+  incopy = 1
+  n = 0
+}
+`
+
+// restoreScript 校验备份文件摘要后导入，导入完成后逐表比对行数，结果以JSON写入终止信息
+// 导入时不中断于单条语句错误，pg_dumpall中已存在的角色等会报错，数据完整性以行数校验为准
+const restoreScript = `set -eu
+fail() {
+  echo "$1" > /dev/termination-log
+  exit 1
+}
+checksum=$(sha256sum "$BACKUP_FILE" | cut -d' ' -f1)
+if [ "$checksum" != "$BACKUP_CHECKSUM" ]; then
+  fail "checksum mismatch, expected $BACKUP_CHECKSUM, actual $checksum"
+fi
+case "$BACKUP_FILE" in
+  *.zst) decompress="zstd -q -d -c" ;;
+  *) decompress="gzip -d -c" ;;
+esac
+target="${DATABASE:-postgres}"
+$decompress "$BACKUP_FILE" | awk -v db="$target" "$COUNT_SCRIPT" > /tmp/expected
+if [ -n "$DATABASE" ]; then
+  createdb "$DATABASE" 2> /dev/null || true
+fi
+$decompress "$BACKUP_FILE" | psql -X -q -d "$target" > /dev/null || fail "restore failed, psql exit code $?"
+tab=$(printf '\t')
+tables=0
+rows=0
+while IFS="$tab" read -r db table expected; do
+  actual=$(psql -X -A -t -d "$db" -c "SELECT count(*) FROM $table") || fail "count rows of $db.$table failed"
+  if [ "$actual" != "$expected" ]; then
+    fail "row count mismatch for $db.$table, expected $expected, actual $actual"
+  fi
+  tables=$((tables + 1))
+  rows=$((rows + expected))
+done < /tmp/expected
+printf '{"checksum":"%s","tables":%s,"rows":%s}' "$checksum" "$tables" "$rows" > /dev/termination-log
+`
+
+// downloadScript 从S3兼容存储下载备份文件
+const downloadScript = `set -eu
+mc_opts="--config-dir /tmp/mc"
+if [ "$S3_INSECURE" = "true" ]; then
+  mc_opts="$mc_opts --insecure"
+fi
+mc $mc_opts alias set target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" > /dev/null
+mc $mc_opts cp "target/$S3_BUCKET/$S3_KEY" "$BACKUP_FILE" > /dev/null
+`
+
+// RestoreResult 恢复任务输出的结果
+type RestoreResult struct {
+	Checksum string `json:"checksum"`
+	Tables   int64  `json:"tables"`
+	Rows     int64  `json:"rows"`
+}
+
+func ParseRestoreResult(message string) (ret *RestoreResult, err error) {
+	ret = &RestoreResult{}
+	err = json.Unmarshal([]byte(strings.TrimSpace(message)), ret)
+	if err != nil {
+		ret = nil
+		return
+	}
+	if ret.Checksum == "" {
+		err = fmt.Errorf("illegal restore result %s", message)
+		ret = nil
+	}
+	return
+}
+
+func GetRestoreJobName(instance string) string {
+	return getJobName(instance, "-restore")
+}
+
+// GetRestoreContainerName 输出恢复结果的容器
+func GetRestoreContainerName() string {
+	return restoreContainer
+}
+
+// ValidateRestore 只能从已成功且包含位置与摘要的逻辑备份恢复
+func ValidateRestore(backupPtr *pgv1.PostgreSQLBackup) error {
+	if backupPtr.Spec.IsBaseBackup() {
+		return fmt.Errorf("backup %s is a base backup, use fromArchive to recover from it", backupPtr.Name)
+	}
+	if backupPtr.Spec.IsSnapshot() {
+		return fmt.Errorf("backup %s is a snapshot backup, use fromSnapshot to create instance from it", backupPtr.Name)
+	}
+	if backupPtr.Status.Location == "" || backupPtr.Status.Checksum == "" {
+		return fmt.Errorf("backup %s has no location or checksum", backupPtr.Name)
+	}
+
+	storage := backupPtr.Spec.Storage
+	switch {
+	case storage.S3 != nil:
+		if !strings.HasPrefix(backupPtr.Status.Location, getS3Prefix(storage.S3)) {
+			return fmt.Errorf("illegal backup location %s", backupPtr.Status.Location)
+		}
+	case storage.PVC != nil:
+		if !strings.HasPrefix(backupPtr.Status.Location, getPVCPrefix(storage.PVC)) {
+			return fmt.Errorf("illegal backup location %s", backupPtr.Status.Location)
+		}
+	default:
+		return fmt.Errorf("backup %s has no storage", backupPtr.Name)
+	}
+
+	return nil
+}
+
+func getS3Prefix(storage *pgv1.S3Storage) string {
+	return fmt.Sprintf("s3://%s/", storage.Bucket)
+}
+
+func getPVCPrefix(storage *pgv1.PVCStorage) string {
+	return fmt.Sprintf("pvc://%s/", storage.ClaimName)
+}
+
+// GetRestoreJob PVC存储时只读挂载备份所在PVC；S3存储时先由下载容器下载到临时目录
+func GetRestoreJob(backupPtr *pgv1.PostgreSQLBackup, infoPtr *common.RestoreInfo, image string) (ret *batchv1.Job) {
+	backupCfg := config.GetBackupConfig()
+	labels := common.NewBackupLabels(infoPtr.Instance)
+
+	podSpec := corev1.PodSpec{
+		RestartPolicy:                corev1.RestartPolicyNever,
+		AutomountServiceAccountToken: boolPtr(false),
+		SecurityContext: &corev1.PodSecurityContext{
+			RunAsNonRoot: boolPtr(true),
+			RunAsUser:    int64Ptr(common.DefaultPostgreSQLUID),
+			RunAsGroup:   int64Ptr(common.DefaultPostgreSQLUID),
+			FSGroup:      int64Ptr(common.DefaultPostgreSQLUID),
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			},
+		},
+	}
+
+	restore := corev1.Container{
+		Name:            restoreContainer,
+		Image:           image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", restoreScript},
+		Env: []corev1.EnvVar{
+			{Name: "PGHOST", Value: infoPtr.Instance},
+			{Name: "PGPORT", Value: strconv.Itoa(common.DefaultPostgreSQLPort)},
+			{Name: "PGUSER", Value: common.DefaultPostgreSQLRoot},
+			secretEnv("PGPASSWORD", common.GetSuperuserSecretName(infoPtr.Instance), common.SuperuserPasswordKey),
+			{Name: "PGAPPNAME", Value: "database-operator-restore"},
+			{Name: "DATABASE", Value: backupPtr.Spec.Database},
+			{Name: "BACKUP_CHECKSUM", Value: backupPtr.Status.Checksum},
+			{Name: "COUNT_SCRIPT", Value: countScript},
+		},
+		SecurityContext: getSecurityContext(),
+	}
+
+	storage := backupPtr.Spec.Storage
+	if storage.S3 != nil {
+		key := backupPtr.GetLocationKey()
+		backupFile := path.Join(workMountPath, path.Base(key))
+		restore.Env = append(restore.Env, corev1.EnvVar{Name: "BACKUP_FILE", Value: backupFile})
+		restore.VolumeMounts = []corev1.VolumeMount{{Name: workVolumeName, MountPath: workMountPath}}
+
+		download := corev1.Container{
+			Name:            downloadContainer,
+			Image:           backupCfg.UploaderImage,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"sh", "-c", downloadScript},
+			Env: []corev1.EnvVar{
+				{Name: "S3_ENDPOINT", Value: storage.S3.Endpoint},
+				{Name: "S3_BUCKET", Value: storage.S3.Bucket},
+				{Name: "S3_KEY", Value: key},
+				{Name: "S3_INSECURE", Value: strconv.FormatBool(storage.S3.Insecure)},
+				{Name: "BACKUP_FILE", Value: backupFile},
+				secretEnv("S3_ACCESS_KEY", storage.S3.Secret, "accessKey"),
+				secretEnv("S3_SECRET_KEY", storage.S3.Secret, "secretKey"),
+			},
+			VolumeMounts:    []corev1.VolumeMount{{Name: workVolumeName, MountPath: workMountPath}},
+			SecurityContext: getSecurityContext(),
+		}
+
+		podSpec.InitContainers = []corev1.Container{download}
+		podSpec.Volumes = []corev1.Volume{
+			{Name: workVolumeName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		}
+	} else {
+		backupFile := path.Join(backupMountPath, backupPtr.GetLocationKey())
+		restore.Env = append(restore.Env, corev1.EnvVar{Name: "BACKUP_FILE", Value: backupFile})
+		restore.VolumeMounts = []corev1.VolumeMount{{Name: pvcVolumeName, MountPath: backupMountPath, ReadOnly: true}}
+
+		podSpec.Volumes = []corev1.Volume{
+			{
+				Name: pvcVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: storage.PVC.ClaimName, ReadOnly: true},
+				},
+			},
+		}
+	}
+	podSpec.Containers = []corev1.Container{restore}
+
+	ret = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      GetRestoreJobName(infoPtr.Instance),
+			Namespace: infoPtr.Namespace,
+			Labels:    labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: pgv1.Group + "/" + pgv1.Version,
+					Kind:       pgv1.PostgreSQLKind,
+					Name:       infoPtr.Instance,
+					UID:        types.UID(infoPtr.UID),
+				},
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            int32Ptr(0),
+			TTLSecondsAfterFinished: int32Ptr(backupCfg.JobTTL),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package snapshot
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"supos.ai/operator/database/internal/core/module/backup/pkg/job"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	Group   = "snapshot.storage.k8s.io"
+	Version = "v1"
+	Kind    = "VolumeSnapshot"
+
+	Resource = "volumesnapshots"
+)
+
+// VolumeSnapshotSource 快照的数据来源PVC
+type VolumeSnapshotSource struct {
+	PersistentVolumeClaimName string `json:"persistentVolumeClaimName,omitempty"`
+}
+
+type VolumeSnapshotSpec struct {
+	Source                  VolumeSnapshotSource `json:"source"`
+	VolumeSnapshotClassName *string              `json:"volumeSnapshotClassName,omitempty"`
+}
+
+type VolumeSnapshotError struct {
+	Message string `json:"message,omitempty"`
+}
+
+// VolumeSnapshotStatus CreationTime不为空时数据卷已完成快照切点，ReadyToUse为true时可用于创建数据卷
+type VolumeSnapshotStatus struct {
+	CreationTime *metav1.Time         `json:"creationTime,omitempty"`
+	ReadyToUse   *bool                `json:"readyToUse,omitempty"`
+	RestoreSize  string               `json:"restoreSize,omitempty"`
+	Error        *VolumeSnapshotError `json:"error,omitempty"`
+}
+
+// VolumeSnapshot snapshot.storage.k8s.io/v1 VolumeSnapshot中operator使用的字段
+type VolumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeSnapshotSpec    `json:"spec"`
+	Status *VolumeSnapshotStatus `json:"status,omitempty"`
+}
+
+func GetGVR() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+}
+
+// GetLabel pg_backup_start使用的备份标签
+func GetLabel(backupPtr *pgv1.PostgreSQLBackup) string {
+	return fmt.Sprintf("snapshot-%s", backupPtr.UID)
+}
+
+// GetLocation 快照备份的位置
+func GetLocation(name string) string {
+	return fmt.Sprintf("snapshot://%s", name)
+}
+
+func (s *VolumeSnapshot) IsCreated() bool {
+	return s.Status != nil && s.Status.CreationTime != nil
+}
+
+func (s *VolumeSnapshot) IsReady() bool {
+	return s.Status != nil && s.Status.ReadyToUse != nil && *s.Status.ReadyToUse
+}
+
+func (s *VolumeSnapshot) GetError() string {
+	if s.Status == nil || s.Status.Error == nil {
+		return ""
+	}
+
+	return s.Status.Error.Message
+}
+
+// GetVolumeSnapshot 以实例主节点的数据卷创建快照，快照随备份资源一同删除
+func GetVolumeSnapshot(backupPtr *pgv1.PostgreSQLBackup, volume string) (ret *VolumeSnapshot) {
+	ret = &VolumeSnapshot{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: Group + "/" + Version,
+			Kind:       Kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backupPtr.Name,
+			Namespace: backupPtr.Namespace,
+			Labels:    common.NewBackupLabels(backupPtr.Spec.Instance),
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: pgv1.Group + "/" + pgv1.Version,
+					Kind:       job.BackupKind,
+					Name:       backupPtr.Name,
+					UID:        backupPtr.UID,
+				},
+			},
+		},
+		Spec: VolumeSnapshotSpec{
+			Source: VolumeSnapshotSource{PersistentVolumeClaimName: volume},
+		},
+	}
+	if backupPtr.Spec.SnapshotClass != "" {
+		className := backupPtr.Spec.SnapshotClass
+		ret.Spec.VolumeSnapshotClassName = &className
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package verify
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// Label 标识恢复校验使用的临时实例
+const Label = "database.supos.ai/verify-of"
+
+// GetInstanceName 临时实例名称，备份名称可能超出实例名称的长度限制，使用备份UID
+func GetInstanceName(backupPtr *pgv1.PostgreSQLBackup) string {
+	uid := string(backupPtr.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+
+	return fmt.Sprintf("verify-%s", uid)
+}
+
+// GetBootstrap 按备份方式选择临时实例的初始化方式，基础备份恢复到备份结束时的LSN
+func GetBootstrap(backupPtr *pgv1.PostgreSQLBackup) (ret *common.Bootstrap, err error) {
+	switch backupPtr.Spec.Method {
+	case pgv1.BackupMethodSnapshot:
+		ret = &common.Bootstrap{FromSnapshot: &common.SnapshotSource{Backup: backupPtr.Name}}
+	case pgv1.BackupMethodBase:
+		if backupPtr.Labels[common.ArchiveLabel] != backupPtr.Spec.Instance || backupPtr.Status.StopLSN == "" {
+			err = fmt.Errorf("base backup %s is not part of the wal archive of instance %s", backupPtr.Name, backupPtr.Spec.Instance)
+			return
+		}
+		ret = &common.Bootstrap{FromArchive: &common.ArchiveSource{Instance: backupPtr.Spec.Instance, TargetLSN: backupPtr.Status.StopLSN}}
+	default:
+		ret = &common.Bootstrap{FromBackup: &common.BackupSource{Backup: backupPtr.Name}}
+	}
+
+	return
+}
+
+// GetInstance 恢复校验使用的临时实例，实例定义随备份资源一同删除
+func GetInstance(backupPtr *pgv1.PostgreSQLBackup, image string) (ret *pgv1.PostgreSQL, err error) {
+	bootstrap, bootstrapErr := GetBootstrap(backupPtr)
+	if bootstrapErr != nil {
+		err = bootstrapErr
+		return
+	}
+
+	ret = &pgv1.PostgreSQL{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: pgv1.Group + "/" + pgv1.Version,
+			Kind:       pgv1.PostgreSQLKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      GetInstanceName(backupPtr),
+			Namespace: backupPtr.Namespace,
+			Labels:    map[string]string{Label: backupPtr.Name},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: pgv1.Group + "/" + pgv1.Version,
+					Kind:       pgv1.BackupKind,
+					Name:       backupPtr.Name,
+					UID:        backupPtr.UID,
+				},
+			},
+		},
+		Spec: pgv1.Spec{
+			Image:     image,
+			Bootstrap: bootstrap,
+		},
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package biz
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+)
+
+// AuditRecord 命令执行审计记录
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`
+	Catalog   string    `json:"catalog"`
+	Service   string    `json:"service"`
+	Type      string    `json:"type"`
+	Operation string    `json:"operation"`
+	Database  string    `json:"database,omitempty"`
+	Statement string    `json:"statement,omitempty"`
+	Args      []string  `json:"args,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+	Elapsed   string    `json:"elapsed"`
+	Succeeded bool      `json:"succeeded"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+var auditLock sync.Mutex
+
+const redactedValue = "<redacted>"
+
+func newAuditRecord(source string, cmdInfo *common.CmdInfo) *AuditRecord {
+	statement, args := cmdInfo.Statement, cmdInfo.Args
+	if cmdInfo.Sensitive {
+		if statement != "" {
+			statement = redactedValue
+		}
+		if len(args) > 0 {
+			args = []string{redactedValue}
+		}
+	}
+
+	return &AuditRecord{
+		Time:      time.Now(),
+		Source:    source,
+		Catalog:   cmdInfo.Catalog,
+		Service:   cmdInfo.Service,
+		Type:      cmdInfo.Type,
+		Operation: cmdInfo.Operation,
+		Database:  cmdInfo.Database,
+		Statement: statement,
+		Args:      args,
+	}
+}
+
+// writeAudit 审计记录输出到日志，配置了auditFile时同时追加到文件
+func (s *K8s) writeAudit(record *AuditRecord) {
+	record.Elapsed = time.Since(record.Time).String()
+	byteVal, byteErr := json.Marshal(record)
+	if byteErr != nil {
+		log.Errorf("writeAudit failed, json.Marshal error:%s", byteErr.Error())
+		return
+	}
+
+	log.Infof("audit:%s", string(byteVal))
+
+	auditFile := config.GetAuditFile()
+	if auditFile == "" {
+		return
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	filePtr, fileErr := os.OpenFile(auditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if fileErr != nil {
+		log.Errorf("writeAudit failed, open %s error:%s", auditFile, fileErr.Error())
+		return
+	}
+	defer filePtr.Close()
+
+	_, _ = filePtr.Write(append(byteVal, '\n'))
+}
@@ -0,0 +1,280 @@
+package biz
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/cache"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const anonymousUser = "system:anonymous"
+
+// staticTokenMaxAge 静态Token Secret缓存时间，单位minute
+const staticTokenMaxAge = 1.0
+
+type accessAttributes struct {
+	verb        string
+	subresource string
+}
+
+var action2Attributes = map[string]accessAttributes{
+	common.CreateService:  {verb: "create"},
+	common.DestroyService: {verb: "delete"},
+	common.StartService:   {verb: "update", subresource: "start"},
+	common.StopService:    {verb: "update", subresource: "stop"},
+	common.QueryService:   {verb: "get"},
+	// 切换主节点需要实例switchover子资源的update权限
+	common.SwitchoverService: {verb: "update", subresource: "switchover"},
+	// 临时保持运行需要实例keeprunning子资源的update权限
+	common.KeepRunningService: {verb: "update", subresource: "keeprunning"},
+	// 调整CPU与内存需要实例resize子资源的update权限
+	common.ResizeService: {verb: "update", subresource: "resize"},
+}
+
+var catalog2Resource = map[string]string{
+	common.PostgreSQL: pgv1.Postgresql,
+}
+
+// authenticator 认证器，不支持当前请求的认证方式时返回nil, nil
+type authenticator interface {
+	Authenticate(req *http.Request) (ret *common.UserInfo, err *cd.Result)
+}
+
+func getBearerToken(req *http.Request) string {
+	authVal := req.Header.Get("Authorization")
+	if len(authVal) < 7 || !strings.EqualFold(authVal[:7], "bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(authVal[7:])
+}
+
+type certAuthenticator struct {
+}
+
+func (s *certAuthenticator) Authenticate(req *http.Request) (ret *common.UserInfo, err *cd.Result) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+
+	certPtr := req.TLS.VerifiedChains[0][0]
+	if certPtr.Subject.CommonName == "" {
+		err = cd.NewError(cd.InvalidAuthority, "client certificate without common name")
+		return
+	}
+
+	ret = &common.UserInfo{
+		Name:   certPtr.Subject.CommonName,
+		Groups: certPtr.Subject.Organization,
+	}
+	return
+}
+
+type staticTokenAuthenticator struct {
+	k8sPtr     *K8s
+	secretName string
+	tokenCache cache.KVCache
+}
+
+func (s *staticTokenAuthenticator) getTokens() (ret map[string][]byte, err *cd.Result) {
+	tokenVal := s.tokenCache.Fetch(s.secretName)
+	if tokenVal != nil {
+		ret = tokenVal.(map[string][]byte)
+		return
+	}
+
+	secretPtr, secretErr := s.k8sPtr.clientSet.CoreV1().Secrets(s.k8sPtr.getNamespace()).Get(context.TODO(), s.secretName, metav1.GetOptions{})
+	if secretErr != nil {
+		err = cd.NewError(cd.UnExpected, secretErr.Error())
+		log.Errorf("getTokens failed, get secret %s error:%s", s.secretName, secretErr.Error())
+		return
+	}
+
+	s.tokenCache.Put(s.secretName, secretPtr.Data, staticTokenMaxAge)
+	ret = secretPtr.Data
+	return
+}
+
+func (s *staticTokenAuthenticator) Authenticate(req *http.Request) (ret *common.UserInfo, err *cd.Result) {
+	token := getBearerToken(req)
+	if token == "" {
+		return
+	}
+
+	// Secret读取失败时视为本方式未认证，继续使用其他认证方式
+	tokens, tokensErr := s.getTokens()
+	if tokensErr != nil {
+		return
+	}
+
+	for userName, val := range tokens {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(string(val))), []byte(token)) == 1 {
+			ret = &common.UserInfo{Name: userName}
+			return
+		}
+	}
+
+	return
+}
+
+type tokenReviewAuthenticator struct {
+	k8sPtr *K8s
+}
+
+func (s *tokenReviewAuthenticator) Authenticate(req *http.Request) (ret *common.UserInfo, err *cd.Result) {
+	token := getBearerToken(req)
+	if token == "" {
+		return
+	}
+
+	reviewPtr, reviewErr := s.k8sPtr.clientSet.AuthenticationV1().TokenReviews().Create(context.TODO(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token: token,
+		},
+	}, metav1.CreateOptions{})
+	if reviewErr != nil {
+		err = cd.NewError(cd.UnExpected, reviewErr.Error())
+		log.Errorf("Authenticate failed, create token review error:%s", reviewErr.Error())
+		return
+	}
+	if !reviewPtr.Status.Authenticated {
+		return
+	}
+
+	ret = &common.UserInfo{
+		Name:   reviewPtr.Status.User.Username,
+		UID:    reviewPtr.Status.User.UID,
+		Groups: reviewPtr.Status.User.Groups,
+		Extra:  map[string][]string{},
+	}
+	for k, v := range reviewPtr.Status.User.Extra {
+		ret.Extra[k] = v
+	}
+	return
+}
+
+func (s *K8s) newAuthenticators() (ret []authenticator) {
+	authCfg := config.GetAuthConfig()
+	if authCfg.Disable {
+		return
+	}
+
+	ret = append(ret, &certAuthenticator{})
+	if authCfg.TokenSecret != "" {
+		ret = append(ret, &staticTokenAuthenticator{
+			k8sPtr:     s,
+			secretName: authCfg.TokenSecret,
+			tokenCache: cache.NewKVCache(nil),
+		})
+	}
+	if authCfg.TokenReview {
+		ret = append(ret, &tokenReviewAuthenticator{k8sPtr: s})
+	}
+
+	return
+}
+
+// Authenticate 依次使用客户端证书、静态Token、TokenReview认证请求
+func (s *K8s) Authenticate(req *http.Request) (ret *common.UserInfo, err *cd.Result) {
+	if config.GetAuthConfig().Disable {
+		ret = &common.UserInfo{Name: anonymousUser}
+		return
+	}
+
+	for _, val := range s.authenticators {
+		userInfo, userErr := val.Authenticate(req)
+		if userErr != nil {
+			err = userErr
+			return
+		}
+		if userInfo != nil {
+			ret = userInfo
+			return
+		}
+	}
+
+	err = cd.NewError(cd.InvalidAuthority, "unauthorized")
+	return
+}
+
+// getInstanceNamespace 实例只能位于operator所在的命名空间，未指定时使用该命名空间
+func (s *K8s) getInstanceNamespace(namespace string) (ret string, err *cd.Result) {
+	ret = s.getNamespace()
+	if namespace != "" && namespace != ret {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("namespace %s is not managed, instances are managed in namespace %s", namespace, ret))
+	}
+
+	return
+}
+
+// Authorize 使用SubjectAccessReview校验用户是否允许对实例所在命名空间下的指定实例执行action
+func (s *K8s) Authorize(userInfo *common.UserInfo, action, catalog, namespace, name string) (err *cd.Result) {
+	namespace, err = s.getInstanceNamespace(namespace)
+	if err != nil {
+		return
+	}
+
+	authCfg := config.GetAuthConfig()
+	if authCfg.Disable || !authCfg.AccessReview {
+		return
+	}
+
+	if userInfo == nil {
+		err = cd.NewError(cd.InvalidAuthority, "unauthorized")
+		return
+	}
+
+	attributes, attributesOK := action2Attributes[action]
+	resource, resourceOK := catalog2Resource[catalog]
+	if !attributesOK || !resourceOK {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("illegal action %s or catalog %s", action, catalog))
+		return
+	}
+
+	reviewPtr := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        attributes.verb,
+				Group:       pgv1.Group,
+				Resource:    resource,
+				Subresource: attributes.subresource,
+				Name:        name,
+			},
+			User:   userInfo.Name,
+			UID:    userInfo.UID,
+			Groups: userInfo.Groups,
+			Extra:  map[string]authorizationv1.ExtraValue{},
+		},
+	}
+	for k, v := range userInfo.Extra {
+		reviewPtr.Spec.Extra[k] = v
+	}
+
+	reviewPtr, reviewErr := s.clientSet.AuthorizationV1().SubjectAccessReviews().Create(context.TODO(), reviewPtr, metav1.CreateOptions{})
+	if reviewErr != nil {
+		err = cd.NewError(cd.UnExpected, reviewErr.Error())
+		log.Errorf("Authorize failed, create subject access review error:%s", reviewErr.Error())
+		return
+	}
+	if !reviewPtr.Status.Allowed {
+		err = cd.NewError(cd.InvalidAuthority, fmt.Sprintf("%s is not allowed to %s %s/%s in namespace %s", userInfo.Name, attributes.verb, resource, name, namespace))
+		log.Warnf("Authorize denied, user:%s, action:%s, name:%s, reason:%s", userInfo.Name, action, name, reviewPtr.Status.Reason)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,160 @@
+package biz
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/cache"
+)
+
+// fakeAuthServer 提供静态Token Secret与TokenReview，secretMissing时Secret不存在
+type fakeAuthServer struct {
+	secretMissing bool
+}
+
+func (s *fakeAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/default/secrets/tokens" && !s.secretMissing:
+		_ = json.NewEncoder(w).Encode(&corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "tokens", Namespace: "default"},
+			Data:       map[string][]byte{"ops": []byte("static-token\n")},
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/apis/authentication.k8s.io/v1/tokenreviews":
+		reviewPtr := &authenticationv1.TokenReview{}
+		_ = json.NewDecoder(r.Body).Decode(reviewPtr)
+		switch reviewPtr.Spec.Token {
+		case "review-token":
+			reviewPtr.Status.Authenticated = true
+			reviewPtr.Status.User = authenticationv1.UserInfo{
+				Username: "system:serviceaccount:default:app",
+				UID:      "uid-1",
+				Groups:   []string{"system:serviceaccounts"},
+			}
+		case "broken-token":
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Code:     http.StatusInternalServerError,
+			})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(reviewPtr)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}
+}
+
+func newTLSState(commonName string) *tls.ConnectionState {
+	certPtr := &x509.Certificate{Subject: pkix.Name{CommonName: commonName, Organization: []string{"ops"}}}
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certPtr}}}
+}
+
+// TestAuthenticate 客户端证书、静态Token、TokenReview依次认证，第一个给出结论的认证器决定结果
+func TestAuthenticate(t *testing.T) {
+	cases := []struct {
+		name          string
+		token         string
+		tlsState      *tls.ConnectionState
+		secretMissing bool
+		expectUser    string
+		expectErr     bool
+	}{
+		{name: "cert", tlsState: newTLSState("admin"), token: "review-token", expectUser: "admin"},
+		{name: "cert without common name", tlsState: newTLSState(""), token: "review-token", expectErr: true},
+		{name: "static token", token: "static-token", expectUser: "ops"},
+		{name: "token review", token: "review-token", expectUser: "system:serviceaccount:default:app"},
+		{name: "secret missing", token: "review-token", secretMissing: true, expectUser: "system:serviceaccount:default:app"},
+		{name: "token review failed", token: "broken-token", expectErr: true},
+		{name: "token not authenticated", token: "unknown-token", expectErr: true},
+		{name: "without credential", expectErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			httpServer := httptest.NewServer(&fakeAuthServer{secretMissing: c.secretMissing})
+			defer httpServer.Close()
+
+			clientSet, clientErr := kubernetes.NewForConfig(&rest.Config{Host: httpServer.URL})
+			if clientErr != nil {
+				t.Fatalf("new clientset failed, error:%s", clientErr.Error())
+			}
+
+			k8sPtr := &K8s{clientSet: clientSet}
+			k8sPtr.authenticators = []authenticator{
+				&certAuthenticator{},
+				&staticTokenAuthenticator{k8sPtr: k8sPtr, secretName: "tokens", tokenCache: cache.NewKVCache(nil)},
+				&tokenReviewAuthenticator{k8sPtr: k8sPtr},
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/postgresql/db", nil)
+			req.TLS = c.tlsState
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+
+			userInfo, userErr := k8sPtr.Authenticate(req)
+			if c.expectErr {
+				if userErr == nil || userInfo != nil {
+					t.Fatalf("expect error, user:%+v", userInfo)
+				}
+				return
+			}
+			if userErr != nil {
+				t.Fatalf("Authenticate failed, error:%s", userErr.Error())
+			}
+			if userInfo.Name != c.expectUser {
+				t.Fatalf("user %s, expect %s", userInfo.Name, c.expectUser)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUnauthorized(t *testing.T) {
+	k8sPtr := &K8s{}
+	_, userErr := k8sPtr.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+	if userErr == nil || userErr.ErrorCode != cd.InvalidAuthority {
+		t.Fatalf("expect unauthorized, error:%v", userErr)
+	}
+}
+
+func TestGetBearerToken(t *testing.T) {
+	cases := []struct {
+		header string
+		expect string
+	}{
+		{"Bearer abc", "abc"},
+		{"bearer  abc ", "abc"},
+		{"BEARER abc", "abc"},
+		{"Basic abc", ""},
+		{"Bearer", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", c.header)
+		if ret := getBearerToken(req); ret != c.expect {
+			t.Errorf("getBearerToken(%q) = %q, expect %q", c.header, ret, c.expect)
+		}
+	}
+}
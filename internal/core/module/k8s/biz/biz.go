@@ -21,7 +21,9 @@ import (
 	"github.com/muidea/magicCommon/foundation/log"
 	"github.com/muidea/magicCommon/task"
 
+	"supos.ai/operator/database/internal/config"
 	"supos.ai/operator/database/internal/core/base/biz"
+	"supos.ai/operator/database/internal/core/module/k8s/pkg/database"
 	"supos.ai/operator/database/pkg/common"
 )
 
@@ -39,6 +41,11 @@ func getClusterConfig() (config *rest.Config, err error) {
 	} else {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
+	// 集群内运行且不存在kubeconfig时，使用ServiceAccount的集群内配置
+	if _, statErr := os.Stat(*kubeconfig); statErr != nil && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return rest.InClusterConfig()
+	}
+
 	config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	return
 	/*
@@ -61,11 +68,14 @@ func getClusterConfig() (config *rest.Config, err error) {
 
 type K8s struct {
 	biz.Base
+	permissionChecker
 
 	serviceCache cache.KVCache
 
 	clientSet    *kubernetes.Clientset
 	clientConfig *rest.Config
+
+	authenticators []authenticator
 }
 
 func New(
@@ -88,6 +98,7 @@ func New(
 		clientConfig: clusterConfig,
 		clientSet:    clusterClient,
 	}
+	ptr.authenticators = ptr.newAuthenticators()
 
 	ptr.SubscribeFunc(common.ExecuteCommand, ptr.ExecuteCommand)
 	ptr.SubscribeFunc(common.GetK8sConfig, ptr.GetConfig)
@@ -96,6 +107,7 @@ func New(
 	ptr.SubscribeFunc(common.ListService, ptr.ListService)
 	ptr.SubscribeFunc(common.QueryService, ptr.QueryService)
 	ptr.SubscribeFunc(common.CreateService, ptr.CreateService)
+	ptr.SubscribeFunc(common.UpdateService, ptr.UpdateService)
 	ptr.SubscribeFunc(common.DestroyService, ptr.DestroyService)
 	return ptr
 }
@@ -109,6 +121,8 @@ func (s *K8s) getNamespace() string {
 }
 
 func (s *K8s) Run() {
+	s.AsyncTask(s.checkPermissions)
+
 	s.AsyncTask(func() {
 		// 创建一个Watcher来监视Deployment资源变化
 		watcher, err := s.clientSet.AppsV1().Deployments(s.getNamespace()).Watch(context.TODO(), metav1.ListOptions{
@@ -131,6 +145,7 @@ func (s *K8s) Run() {
 			switch event.Type {
 			case watch.Added, watch.Modified:
 				s.addService(deployment)
+				s.labelMemberPods(deployment)
 			case watch.Deleted:
 				s.delService(deployment)
 			case watch.Error:
@@ -161,9 +176,22 @@ func (s *K8s) addService(deploymentPtr *appv1.Deployment) {
 	s.serviceCache.Put(serviceInfo.Name, serviceInfo, cache.ForeverAgeValue)
 }
 
+// labelMemberPods 成员重启后新建的Pod没有角色标签，按Deployment记录的角色补充
+func (s *K8s) labelMemberPods(deploymentPtr *appv1.Deployment) {
+	role := deploymentPtr.Annotations[database.RoleAnnotation]
+	if role == "" || deploymentPtr.Spec.Selector == nil {
+		return
+	}
+
+	_ = s.reconcileRoleLabels(deploymentPtr.Name, deploymentPtr.Spec.Selector.MatchLabels, role)
+}
+
 func (s *K8s) delService(deploymentPtr *appv1.Deployment) {
 	serviceName := s.getServiceName(deploymentPtr)
 	serviceVal := s.serviceCache.Fetch(serviceName)
+	if serviceVal == nil {
+		return
+	}
 
 	values := event.NewValues()
 	values.Set(event.Action, event.Del)
@@ -175,7 +203,113 @@ func (s *K8s) delService(deploymentPtr *appv1.Deployment) {
 func (s *K8s) getServiceName(deploymentPtr *appv1.Deployment) (name string) {
 	return deploymentPtr.ObjectMeta.GetName()
 }
-func (s *K8s) Create(serviceName, catalog string) (err *cd.Result) {
+
+// getMemberOwner 名称为已有实例的成员名称时返回该实例，成员与实例共用Deployment与数据卷名称
+func (s *K8s) getMemberOwner(name, catalog string) string {
+	instance, _, ok := common.SplitMemberName(name)
+	if !ok {
+		return ""
+	}
+
+	serviceInfo, serviceErr := s.Query(instance, catalog)
+	if serviceErr != nil {
+		return ""
+	}
+	for _, member := range serviceInfo.GetMembers() {
+		if member == name {
+			return instance
+		}
+	}
+	return ""
+}
+
+// Create 由对应数据库模块创建实例定义，k8s资源在实例定义同步后部署
+func (s *K8s) Create(param *common.ServiceParam) (err *cd.Result) {
+	if param.Catalog != common.PostgreSQL {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("unsupported catalog %s", param.Catalog))
+		return
+	}
+	if owner := s.getMemberOwner(param.Name, param.Catalog); owner != "" {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("illegal name %s, the name is used by a standby member of instance %s", param.Name, owner))
+		return
+	}
+	if param.Bootstrap != nil && param.Bootstrap.FromBackup != nil && param.Bootstrap.FromBackup.Backup == "" {
+		err = cd.NewError(cd.IllegalParam, "bootstrap fromBackup requires backup name")
+		return
+	}
+	if param.Bootstrap != nil && param.Bootstrap.FromSnapshot != nil && param.Bootstrap.FromSnapshot.Backup == "" {
+		err = cd.NewError(cd.IllegalParam, "bootstrap fromSnapshot requires backup name")
+		return
+	}
+	if param.Bootstrap != nil && param.Bootstrap.CloneFrom != nil &&
+		(param.Bootstrap.CloneFrom.Instance == "" || param.Bootstrap.CloneFrom.Instance == param.Name) {
+		err = cd.NewError(cd.IllegalParam, "bootstrap cloneFrom requires another source instance")
+		return
+	}
+
+	ev := event.NewEvent(common.CreateInstance, s.ID(), common.PostgreSQLModule, nil, param)
+	result := s.SendEvent(ev)
+	err = result.Error()
+	return
+}
+
+// Clone 以同命名空间下运行中的实例为源创建新实例，源实例不存在时创建失败
+func (s *K8s) Clone(param *common.CloneParam) (err *cd.Result) {
+	_, sourceErr := s.Query(param.Source.Instance, param.Catalog)
+	if sourceErr != nil {
+		err = sourceErr
+		return
+	}
+
+	sourcePtr := param.Source
+	err = s.Create(&common.ServiceParam{
+		Name:      param.Name,
+		Catalog:   param.Catalog,
+		Bootstrap: &common.Bootstrap{CloneFrom: &sourcePtr},
+	})
+	return
+}
+
+// Switchover 将实例的主节点切换到指定的备节点，由数据库模块异步执行，进度记录在实例status中
+func (s *K8s) Switchover(param *common.SwitchoverParam) (err *cd.Result) {
+	if param.Catalog != common.PostgreSQL {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("unsupported catalog %s", param.Catalog))
+		return
+	}
+	if param.Target == "" {
+		err = cd.NewError(cd.IllegalParam, "switchover requires target member")
+		return
+	}
+
+	ev := event.NewEvent(common.SwitchoverInstance, s.ID(), common.PostgreSQLModule, nil, param)
+	result := s.SendEvent(ev)
+	err = result.Error()
+	return
+}
+
+// KeepRunning 配置了运行时段的实例在指定时长内保持运行，休眠中的实例随之恢复，时长为0时取消
+func (s *K8s) KeepRunning(param *common.KeepRunningParam) (err *cd.Result) {
+	if param.Catalog != common.PostgreSQL {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("unsupported catalog %s", param.Catalog))
+		return
+	}
+
+	ev := event.NewEvent(common.KeepRunningInstance, s.ID(), common.PostgreSQLModule, nil, param)
+	result := s.SendEvent(ev)
+	err = result.Error()
+	return
+}
+
+// Resize 修改实例的CPU与内存，成员Pod由数据库模块按新的资源定义滚动重建
+func (s *K8s) Resize(param *common.ResizeParam) (err *cd.Result) {
+	if param.Catalog != common.PostgreSQL {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("unsupported catalog %s", param.Catalog))
+		return
+	}
+
+	ev := event.NewEvent(common.ResizeInstance, s.ID(), common.PostgreSQLModule, nil, param)
+	result := s.SendEvent(ev)
+	err = result.Error()
 	return
 }
 
@@ -229,14 +363,22 @@ func (s *K8s) Query(serviceName, catalog string) (ret *common.ServiceInfo, err *
 }
 
 func (s *K8s) getServiceInfoFromDeployment(deploymentPtr *appv1.Deployment, clientSet *kubernetes.Clientset) (ret *common.ServiceInfo, err *cd.Result) {
+	// 备节点成员由所属实例管理，不作为独立的服务
+	instance, instanceOK := deploymentPtr.ObjectMeta.Labels[common.InstanceLabel]
+	if instanceOK && instance != deploymentPtr.ObjectMeta.GetName() {
+		return
+	}
+
 	ptr := &common.ServiceInfo{
 		Name:      deploymentPtr.ObjectMeta.GetName(),
 		Namespace: deploymentPtr.ObjectMeta.GetNamespace(),
 		Image:     deploymentPtr.Spec.Template.Spec.Containers[0].Image,
 		Labels:    deploymentPtr.ObjectMeta.Labels,
 		Spec: &common.Spec{
-			CPU:    deploymentPtr.Spec.Template.Spec.Containers[0].Resources.Limits.Cpu().String(),
-			Memory: deploymentPtr.Spec.Template.Spec.Containers[0].Resources.Limits.Memory().String(),
+			CPU:           deploymentPtr.Spec.Template.Spec.Containers[0].Resources.Limits.Cpu().String(),
+			Memory:        deploymentPtr.Spec.Template.Spec.Containers[0].Resources.Limits.Memory().String(),
+			RequestCPU:    deploymentPtr.Spec.Template.Spec.Containers[0].Resources.Requests.Cpu().String(),
+			RequestMemory: deploymentPtr.Spec.Template.Spec.Containers[0].Resources.Requests.Memory().String(),
 		},
 		Volumes:  &common.Volumes{},
 		Replicas: *deploymentPtr.Spec.Replicas,
@@ -281,6 +423,16 @@ func (s *K8s) getServiceDataPath(deploymentPtr *appv1.Deployment, clientSet *kub
 		return
 	}
 
+	// 命名空间模式下无法查询PV，动态创建的PV没有主机路径，均使用容器内的挂载路径
+	if config.IsNamespaceScope() || pvcInfo.Spec.StorageClassName == nil || *pvcInfo.Spec.StorageClassName != common.LocalPath {
+		ret = &common.Path{
+			Name:  dataVolumes.Name,
+			Value: s.getDataMountPath(deploymentPtr),
+			Type:  common.LocalPath,
+		}
+		return
+	}
+
 	pvInfo, pvErr := clientSet.CoreV1().PersistentVolumes().Get(context.TODO(), pvcInfo.Spec.VolumeName, metav1.GetOptions{})
 	if pvErr != nil {
 		err = cd.NewError(cd.UnExpected, pvErr.Error())
@@ -2,11 +2,14 @@ package biz
 
 import (
 	"context"
+	"fmt"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
 	"github.com/muidea/magicCommon/foundation/log"
 
 	"supos.ai/operator/database/internal/core/module/k8s/pkg/database"
@@ -21,7 +24,7 @@ func (s *K8s) createDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
 
 	// 1、Create pvc
 	_, pvcErr := s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace()).Create(context.TODO(),
-		database.GetPersistentVolumeClaims(serviceInfo),
+		database.GetPersistentVolumeClaims(serviceInfo, serviceInfo.Name),
 		metav1.CreateOptions{})
 	if pvcErr != nil {
 		err = cd.NewError(cd.UnExpected, pvcErr.Error())
@@ -30,9 +33,16 @@ func (s *K8s) createDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
 		return
 	}
 
-	// 2、Create Deployment
+	// 2、Create ConfigMap
+	err = s.reconcileConfigMap(serviceInfo)
+	if err != nil {
+		s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+		return
+	}
+
+	// 3、Create Deployment
 	_, deploymentErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).Create(context.TODO(),
-		database.GetDeployment(serviceInfo),
+		database.GetDeployment(serviceInfo, serviceInfo.Name),
 		metav1.CreateOptions{})
 	if deploymentErr != nil {
 		err = cd.NewError(cd.UnExpected, deploymentErr.Error())
@@ -40,10 +50,11 @@ func (s *K8s) createDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
 			serviceInfo, deploymentErr.Error())
 
 		s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+		s.clientSet.CoreV1().ConfigMaps(s.getNamespace()).Delete(context.TODO(), serviceInfo.GetConfigName(), metav1.DeleteOptions{})
 		return
 	}
 
-	// 3、Create Service
+	// 4、Create Service
 	_, serviceErr := s.clientSet.CoreV1().Services(s.getNamespace()).Create(context.TODO(),
 		database.GetService(serviceInfo),
 		metav1.CreateOptions{})
@@ -54,64 +65,281 @@ func (s *K8s) createDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
 
 		s.clientSet.AppsV1().Deployments(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
 		s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+		s.clientSet.CoreV1().ConfigMaps(s.getNamespace()).Delete(context.TODO(), serviceInfo.GetConfigName(), metav1.DeleteOptions{})
+		return
+	}
+
+	// 5、Create NetworkPolicy
+	err = s.reconcileNetworkPolicy(serviceInfo)
+	if err != nil {
+		return
+	}
+
+	// 6、Create standby members
+	_, _, err = s.reconcileMembers(serviceInfo)
+	if err != nil {
+		return
+	}
+
+	// 7、Create PodDisruptionBudget
+	err = s.reconcilePodDisruptionBudget(serviceInfo)
+	if err != nil {
 		return
 	}
 
+	// 8、Create pooler
+	err = s.reconcilePooler(serviceInfo)
 	return
 }
 
-func (s *K8s) destroyDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
-	_ = s.clientSet.CoreV1().Services(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
-	_ = s.clientSet.AppsV1().Deployments(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
-	_ = s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+// updateDatabase 主节点等待备节点滚动或等待切换时返回告警，数据库模块在下一周期重新同步
+func (s *K8s) updateDatabase(serviceInfo *common.ServiceInfo) (ret *common.UpdateResult, err *cd.Result) {
+	// 配置先于Pod模板更新，保证重启后挂载的是最新配置
+	err = s.reconcileConfigMap(serviceInfo)
+	if err != nil {
+		return
+	}
+
+	err = s.reconcileNetworkPolicy(serviceInfo)
+	if err != nil {
+		return
+	}
+
+	rolling, switchoverTo, err := s.reconcileMembers(serviceInfo)
+	if err != nil {
+		return
+	}
+
+	err = s.reconcilePodDisruptionBudget(serviceInfo)
+	if err != nil {
+		return
+	}
+
+	err = s.reconcilePooler(serviceInfo)
+	if err != nil {
+		return
+	}
 
+	switch {
+	case rolling:
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("%v is rolling, primary waiting for standbys ready", serviceInfo))
+	case switchoverTo != "":
+		ret = &common.UpdateResult{SwitchoverTo: switchoverTo}
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("%v is resizing, primary waiting for switchover to %s", serviceInfo, switchoverTo))
+	}
 	return
 }
 
-func (s *K8s) startDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
-	scalePtr, scaleErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).GetScale(context.TODO(), serviceInfo.Name, metav1.GetOptions{})
-	if scaleErr != nil {
-		err = cd.NewError(cd.UnExpected, scaleErr.Error())
-		log.Errorf("startDatabase %v failed, get service scale error:%s", serviceInfo, scaleErr.Error())
+// reconcileDeployment 成员的Pod模板、角色或副本数变化时更新Deployment，模板更新后Pod按Recreate策略重启
+// 副本数由实例是否休眠及成员是否被隔离决定，holdTemplate为true时暂不更新模板
+func (s *K8s) reconcileDeployment(serviceInfo *common.ServiceInfo, member string, holdTemplate bool) (err *cd.Result) {
+	deploymentClient := s.clientSet.AppsV1().Deployments(s.getNamespace())
+	curDeployment, curErr := deploymentClient.Get(context.TODO(), member, metav1.GetOptions{})
+	if curErr != nil {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcileDeployment %v failed, get deployment %s error:%s", serviceInfo, member, curErr.Error())
+		return
+	}
+
+	deploymentPtr := database.GetDeployment(serviceInfo, member)
+	templateHash := deploymentPtr.Annotations[database.TemplateHashAnnotation]
+	role := deploymentPtr.Annotations[database.RoleAnnotation]
+	replicas := *deploymentPtr.Spec.Replicas
+	templateSynced := curDeployment.Annotations[database.TemplateHashAnnotation] == templateHash
+	if (templateSynced || holdTemplate) && curDeployment.Annotations[database.RoleAnnotation] == role &&
+		curDeployment.Spec.Replicas != nil && *curDeployment.Spec.Replicas == replicas {
 		return
 	}
 
-	scalePtr.Status.Replicas = serviceInfo.Replicas
-	_, scaleErr = s.clientSet.AppsV1().Deployments(s.getNamespace()).UpdateScale(
-		context.TODO(),
-		serviceInfo.Name,
-		scalePtr,
-		metav1.UpdateOptions{},
-	)
-	if scaleErr != nil {
-		err = cd.NewError(cd.UnExpected, scaleErr.Error())
-		log.Errorf("startDatabase %v failed, set service scale error:%s", serviceInfo, scaleErr.Error())
+	if curDeployment.Annotations == nil {
+		curDeployment.Annotations = map[string]string{}
+	}
+	// 角色只记录在Deployment与运行中的Pod上，更新角色不会重启Pod
+	curDeployment.Annotations[database.RoleAnnotation] = role
+	if !holdTemplate {
+		curDeployment.Annotations[database.TemplateHashAnnotation] = templateHash
+		curDeployment.Spec.Template = deploymentPtr.Spec.Template
+	}
+	curDeployment.Spec.Replicas = &replicas
+	_, updateErr := deploymentClient.Update(context.TODO(), curDeployment, metav1.UpdateOptions{})
+	if updateErr != nil {
+		err = cd.NewError(cd.UnExpected, updateErr.Error())
+		log.Errorf("reconcileDeployment %v failed, update deployment %s error:%s", serviceInfo, member, updateErr.Error())
 		return
 	}
 
+	log.Infof("reconcileDeployment %v, member:%s, deployment updated, role:%s, replicas:%d, hash:%s",
+		serviceInfo, member, role, replicas, curDeployment.Annotations[database.TemplateHashAnnotation])
 	return
 }
 
-func (s *K8s) stopDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
-	scalePtr, scaleErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).GetScale(context.TODO(), serviceInfo.Name, metav1.GetOptions{})
-	if scaleErr != nil {
-		err = cd.NewError(cd.UnExpected, scaleErr.Error())
-		log.Errorf("stopDatabase %v failed, get service scale error:%s", serviceInfo, scaleErr.Error())
+// reconcileConfigMap 配置内容变化时仅更新ConfigMap，由数据库模块决定何时reload
+// 开启流复制时同时同步记录主节点的复制配置，成员重启时据此确认角色
+func (s *K8s) reconcileConfigMap(serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	err = s.applyConfigMap(serviceInfo, serviceInfo.GetConfigName(), database.GetConfigMap(serviceInfo))
+	if err != nil {
+		return
+	}
+
+	err = s.applyConfigMap(serviceInfo, database.GetReplicationConfigName(serviceInfo), database.GetReplicationConfigMap(serviceInfo))
+	return
+}
+
+// applyConfigMap 创建或更新ConfigMap，configPtr为nil时删除已有的ConfigMap
+func (s *K8s) applyConfigMap(serviceInfo *common.ServiceInfo, name string, configPtr *corev1.ConfigMap) (err *cd.Result) {
+	configClient := s.clientSet.CoreV1().ConfigMaps(s.getNamespace())
+	curConfig, curErr := configClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if curErr != nil && !errors.IsNotFound(curErr) {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcileConfigMap %v failed, get configmap %s error:%s", serviceInfo, name, curErr.Error())
+		return
+	}
+
+	if configPtr == nil {
+		if curErr == nil {
+			deleteErr := configClient.Delete(context.TODO(), name, metav1.DeleteOptions{})
+			if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+				err = cd.NewError(cd.UnExpected, deleteErr.Error())
+				log.Errorf("reconcileConfigMap %v failed, delete configmap %s error:%s", serviceInfo, name, deleteErr.Error())
+			}
+		}
 		return
 	}
 
-	scalePtr.Status.Replicas = 0
-	_, scaleErr = s.clientSet.AppsV1().Deployments(s.getNamespace()).UpdateScale(
-		context.TODO(),
-		serviceInfo.Name,
-		scalePtr,
-		metav1.UpdateOptions{},
-	)
-	if scaleErr != nil {
-		err = cd.NewError(cd.UnExpected, scaleErr.Error())
-		log.Errorf("stopDatabase %v failed, set service scale error:%s", serviceInfo, scaleErr.Error())
+	if curErr != nil {
+		_, createErr := configClient.Create(context.TODO(), configPtr, metav1.CreateOptions{})
+		if createErr != nil {
+			err = cd.NewError(cd.UnExpected, createErr.Error())
+			log.Errorf("reconcileConfigMap %v failed, create configmap %s error:%s", serviceInfo, name, createErr.Error())
+		}
 		return
 	}
 
+	curConfig.Labels = configPtr.Labels
+	curConfig.Data = configPtr.Data
+	_, updateErr := configClient.Update(context.TODO(), curConfig, metav1.UpdateOptions{})
+	if updateErr != nil {
+		err = cd.NewError(cd.UnExpected, updateErr.Error())
+		log.Errorf("reconcileConfigMap %v failed, update configmap %s error:%s", serviceInfo, name, updateErr.Error())
+	}
+	return
+}
+
+func (s *K8s) reconcileNetworkPolicy(serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	policyClient := s.clientSet.NetworkingV1().NetworkPolicies(s.getNamespace())
+	policyPtr := database.GetNetworkPolicy(serviceInfo, s.getNamespace())
+	curPolicy, curErr := policyClient.Get(context.TODO(), serviceInfo.Name, metav1.GetOptions{})
+	if curErr != nil && !errors.IsNotFound(curErr) {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcileNetworkPolicy %v failed, get networkpolicy error:%s", serviceInfo, curErr.Error())
+		return
+	}
+
+	if policyPtr == nil {
+		if curErr == nil {
+			deleteErr := policyClient.Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+			if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+				err = cd.NewError(cd.UnExpected, deleteErr.Error())
+				log.Errorf("reconcileNetworkPolicy %v failed, delete networkpolicy error:%s", serviceInfo, deleteErr.Error())
+			}
+		}
+		return
+	}
+
+	if curErr != nil {
+		_, createErr := policyClient.Create(context.TODO(), policyPtr, metav1.CreateOptions{})
+		if createErr != nil {
+			err = cd.NewError(cd.UnExpected, createErr.Error())
+			log.Errorf("reconcileNetworkPolicy %v failed, create networkpolicy error:%s", serviceInfo, createErr.Error())
+		}
+		return
+	}
+
+	curPolicy.Labels = policyPtr.Labels
+	curPolicy.Spec = policyPtr.Spec
+	_, updateErr := policyClient.Update(context.TODO(), curPolicy, metav1.UpdateOptions{})
+	if updateErr != nil {
+		err = cd.NewError(cd.UnExpected, updateErr.Error())
+		log.Errorf("reconcileNetworkPolicy %v failed, update networkpolicy error:%s", serviceInfo, updateErr.Error())
+	}
+	return
+}
+
+// reconcilePodDisruptionBudget 备节点数量变化时同步驱逐策略，实例允许驱逐时删除驱逐策略
+func (s *K8s) reconcilePodDisruptionBudget(serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	pdbClient := s.clientSet.PolicyV1().PodDisruptionBudgets(s.getNamespace())
+	pdbPtr := database.GetPodDisruptionBudget(serviceInfo)
+	if pdbPtr == nil {
+		deleteErr := pdbClient.Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+		if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+			err = cd.NewError(cd.UnExpected, deleteErr.Error())
+			log.Errorf("reconcilePodDisruptionBudget %v failed, delete poddisruptionbudget error:%s", serviceInfo, deleteErr.Error())
+		}
+		return
+	}
+
+	curPDB, curErr := pdbClient.Get(context.TODO(), pdbPtr.Name, metav1.GetOptions{})
+	if curErr != nil && !errors.IsNotFound(curErr) {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcilePodDisruptionBudget %v failed, get poddisruptionbudget error:%s", serviceInfo, curErr.Error())
+		return
+	}
+
+	if curErr != nil {
+		_, createErr := pdbClient.Create(context.TODO(), pdbPtr, metav1.CreateOptions{})
+		if createErr != nil {
+			err = cd.NewError(cd.UnExpected, createErr.Error())
+			log.Errorf("reconcilePodDisruptionBudget %v failed, create poddisruptionbudget error:%s", serviceInfo, createErr.Error())
+		}
+		return
+	}
+
+	curPDB.Labels = pdbPtr.Labels
+	curPDB.Spec = pdbPtr.Spec
+	_, updateErr := pdbClient.Update(context.TODO(), curPDB, metav1.UpdateOptions{})
+	if updateErr != nil {
+		err = cd.NewError(cd.UnExpected, updateErr.Error())
+		log.Errorf("reconcilePodDisruptionBudget %v failed, update poddisruptionbudget error:%s", serviceInfo, updateErr.Error())
+	}
+	return
+}
+
+func (s *K8s) destroyDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	s.deletePooler(serviceInfo)
+	s.deleteMembers(serviceInfo, nil)
+	_ = s.clientSet.CoreV1().Services(s.getNamespace()).Delete(context.TODO(), database.GetReadWriteName(serviceInfo), metav1.DeleteOptions{})
+	_ = s.clientSet.CoreV1().Services(s.getNamespace()).Delete(context.TODO(), database.GetReadOnlyName(serviceInfo), metav1.DeleteOptions{})
+	_ = s.clientSet.NetworkingV1().NetworkPolicies(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+	_ = s.clientSet.PolicyV1().PodDisruptionBudgets(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+	_ = s.clientSet.CoreV1().Services(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+	_ = s.clientSet.AppsV1().Deployments(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+	_ = s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace()).Delete(context.TODO(), serviceInfo.Name, metav1.DeleteOptions{})
+	_ = s.clientSet.CoreV1().ConfigMaps(s.getNamespace()).Delete(context.TODO(), serviceInfo.GetConfigName(), metav1.DeleteOptions{})
+	_ = s.clientSet.CoreV1().ConfigMaps(s.getNamespace()).Delete(context.TODO(), database.GetReplicationConfigName(serviceInfo), metav1.DeleteOptions{})
+
+	return
+}
+
+// startDatabase 恢复休眠的实例，由数据库模块按实例定义恢复各成员与连接池
+func (s *K8s) startDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	err = s.hibernateDatabase(serviceInfo, false)
+	return
+}
+
+// stopDatabase 休眠实例，由数据库模块执行checkpoint后停止各成员与连接池
+func (s *K8s) stopDatabase(serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	err = s.hibernateDatabase(serviceInfo, true)
+	return
+}
+
+// hibernateDatabase 休眠状态保存在实例定义中，实例Deployment的副本数不再作为期望状态
+func (s *K8s) hibernateDatabase(serviceInfo *common.ServiceInfo, hibernate bool) (err *cd.Result) {
+	param := &common.HibernateParam{Name: serviceInfo.Name, Catalog: serviceInfo.Catalog, Hibernate: hibernate}
+	ev := event.NewEvent(common.HibernateInstance, s.ID(), common.PostgreSQLModule, nil, param)
+	result := s.SendEvent(ev)
+	err = result.Error()
+	if err != nil {
+		log.Errorf("hibernateDatabase %v failed, hibernate:%v, error:%s", serviceInfo, hibernate, err.Error())
+	}
 	return
 }
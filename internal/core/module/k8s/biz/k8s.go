@@ -4,36 +4,34 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"strings"
+
+	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
-	"strings"
 
 	cd "github.com/muidea/magicCommon/def"
 	"github.com/muidea/magicCommon/event"
 	"github.com/muidea/magicCommon/foundation/log"
 
+	"supos.ai/operator/database/internal/core/module/k8s/pkg/command"
+	"supos.ai/operator/database/internal/core/module/k8s/pkg/database"
 	"supos.ai/operator/database/pkg/common"
 )
 
-func (s *K8s) execInPod(clientSet *kubernetes.Clientset, clientConfig *rest.Config, namespace, podName, containerName, command string) (stdout []byte, stderr []byte, err *cd.Result) {
-	cmd := []string{
-		"sh",
-		"-c",
-		command,
-	}
-
-	req := clientSet.CoreV1().RESTClient().Post().
+// execInPod 在容器中执行命令，input不为空时通过标准输入传递
+func (s *K8s) execInPod(ctx context.Context, namespace, podName, containerName string, cmd []string, input string) (stdout []byte, stderr []byte, err *cd.Result) {
+	req := s.clientSet.CoreV1().RESTClient().Post().
 		Resource("pods").
 		Name(podName).
 		Namespace(namespace).SubResource("exec").Param("container", containerName)
 	req.VersionedParams(
 		&corev1.PodExecOptions{
 			Command: cmd,
-			Stdin:   false,
+			Stdin:   input != "",
 			Stdout:  true,
 			Stderr:  true,
 			TTY:     false,
@@ -41,81 +39,174 @@ func (s *K8s) execInPod(clientSet *kubernetes.Clientset, clientConfig *rest.Conf
 		scheme.ParameterCodec,
 	)
 
+	var stdinReader io.Reader
+	if input != "" {
+		stdinReader = strings.NewReader(input)
+	}
+
 	var stdoutBuff, stderrBuff bytes.Buffer
-	execPtr, execErr := remotecommand.NewSPDYExecutor(clientConfig, "POST", req.URL())
+	execPtr, execErr := remotecommand.NewSPDYExecutor(s.clientConfig, "POST", req.URL())
 	if execErr != nil {
 		err = cd.NewError(cd.UnExpected, execErr.Error())
 		log.Errorf("execInPod failed, remotecommand.NewSPDYExecutor error:%s", err.Error())
 		return
 	}
 
-	execErr = execPtr.Stream(remotecommand.StreamOptions{
-		Stdin:  nil,
+	execErr = execPtr.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdinReader,
 		Stdout: &stdoutBuff,
 		Stderr: &stderrBuff,
 	})
+	stdout = stdoutBuff.Bytes()
+	stderr = stderrBuff.Bytes()
 	if execErr != nil {
-		err = cd.NewError(cd.UnExpected, execErr.Error())
+		if ctx.Err() != nil {
+			execErr = ctx.Err()
+		}
+
+		err = cd.NewError(cd.UnExpected, fmt.Sprintf("%s, %s", execErr.Error(), strings.TrimSpace(string(stderr))))
 		log.Errorf("execInPod failed, execPtr.Stream error:%s", err.Error())
 		return
 	}
 
-	stdout = stdoutBuff.Bytes()
-	stderr = stderrBuff.Bytes()
 	return
 }
 
-func (s *K8s) ExecuteCommand(ev event.Event, re event.Result) {
-	param := ev.Data()
-	if param == nil {
-		log.Warnf("ExecuteCommand failed, nil param")
+func (s *K8s) isManaged(objectMeta metav1.ObjectMeta) bool {
+	for k, v := range common.DefaultLabels {
+		if objectMeta.Labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getRunningPod 查询实例中指定成员的运行Pod，未指定成员时查询主节点
+// 指定成员没有未终止的Pod时使用终止中的Pod，计划内切换据此停止已隔离的原主节点
+func (s *K8s) getRunningPod(serviceInfo *common.ServiceInfo, member string) (ret *corev1.Pod, err *cd.Result) {
+	labels := database.GetRoleSelector(serviceInfo, common.RolePrimary)
+	if member != "" {
+		labels = database.GetMemberLabels(serviceInfo, member)
+	}
+
+	podList, podsErr := s.clientSet.CoreV1().Pods(s.getNamespace()).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.String(),
+	})
+	if podsErr != nil {
+		err = cd.NewError(cd.UnExpected, podsErr.Error())
+		log.Errorf("getRunningPod failed, s.clientSet.CoreV1().Pods(s.getNamespace()).List error:%s", podsErr.Error())
 		return
 	}
 
-	cmdInfoPtr, cmdInfoOK := param.(*common.CmdInfo)
-	if !cmdInfoOK || cmdInfoPtr == nil {
-		log.Warnf("ExecuteCommand failed, illegal param")
+	for idx := range podList.Items {
+		podPtr := &podList.Items[idx]
+		if podPtr.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		if podPtr.DeletionTimestamp == nil {
+			ret = podPtr
+			return
+		}
+		if member != "" && ret == nil {
+			ret = podPtr
+		}
+	}
+	if ret != nil {
 		return
 	}
 
-	deploymentPtr, deploymentErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).Get(context.TODO(), cmdInfoPtr.ServiceInfo.Name, metav1.GetOptions{})
-	if deploymentErr != nil {
-		log.Errorf("ExecuteCommand failed, s.clientSet.AppsV1().Deployments(s.getNamespace()).Get error:%s", deploymentErr.Error())
-		if re != nil {
-			re.Set(nil, cd.NewError(cd.UnExpected, deploymentErr.Error()))
+	err = cd.NewError(cd.NoExist, fmt.Sprintf("not exist %s running pods", serviceInfo.Name))
+	return
+}
+
+func (s *K8s) getDataMountPath(deploymentPtr *appv1.Deployment) string {
+	for _, val := range deploymentPtr.Spec.Template.Spec.Containers[0].VolumeMounts {
+		if val.Name == deploymentPtr.ObjectMeta.GetName() {
+			return val.MountPath
+		}
+	}
+
+	return ""
+}
+
+// executeCommand 在实例的运行Pod中执行操作目录中的命令，每次执行都会记录审计
+func (s *K8s) executeCommand(source string, cmdInfo *common.CmdInfo) (stdout []byte, stderr []byte, err *cd.Result) {
+	record := newAuditRecord(source, cmdInfo)
+	defer func() {
+		record.Succeeded = err == nil
+		if err != nil {
+			record.Reason = err.Error()
 		}
 
+		s.writeAudit(record)
+	}()
+
+	operationPtr, operationErr := command.Lookup(cmdInfo)
+	if operationErr != nil {
+		err = cd.NewError(cd.IllegalParam, operationErr.Error())
+		log.Warnf("executeCommand failed, %s error:%s", cmdInfo, operationErr.Error())
+		return
+	}
+	if !operationPtr.IsAllowed(cmdInfo) {
+		err = cd.NewError(cd.InvalidAuthority, fmt.Sprintf("%s is not allowed to execute %s", source, cmdInfo))
+		log.Warnf("executeCommand failed, %s is not allowed to execute %s", source, cmdInfo)
 		return
 	}
 
-	selectorPtr, selectorErr := metav1.LabelSelectorAsSelector(deploymentPtr.Spec.Selector)
-	if selectorErr != nil {
-		log.Errorf("ExecuteCommand failed, metav1.LabelSelectorAsSelector error:%s", selectorErr.Error())
-		if re != nil {
-			re.Set(nil, cd.NewError(cd.UnExpected, selectorErr.Error()))
-		}
+	serviceInfo, serviceErr := s.Query(cmdInfo.Service, cmdInfo.Catalog)
+	if serviceErr != nil {
+		err = serviceErr
+		return
+	}
 
+	deploymentPtr, deploymentErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).Get(context.TODO(), serviceInfo.Name, metav1.GetOptions{})
+	if deploymentErr != nil {
+		err = cd.NewError(cd.UnExpected, deploymentErr.Error())
+		log.Errorf("executeCommand failed, s.clientSet.AppsV1().Deployments(s.getNamespace()).Get error:%s", deploymentErr.Error())
+		return
+	}
+	if !s.isManaged(deploymentPtr.ObjectMeta) {
+		err = cd.NewError(cd.InvalidAuthority, fmt.Sprintf("%s is not managed by operator", serviceInfo.Name))
+		log.Warnf("executeCommand failed, %s is not managed by operator", serviceInfo.Name)
 		return
 	}
-	podList, podsErr := s.clientSet.CoreV1().Pods(s.getNamespace()).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: selectorPtr.String(),
-	})
-	if podsErr != nil || len(podList.Items) == 0 {
-		if podsErr == nil {
-			podsErr = fmt.Errorf("not exist %s pods", cmdInfoPtr.ServiceInfo.Name)
-		}
 
-		log.Errorf("ExecuteCommand failed, s.clientSet.CoreV1().Pods(s.getNamespace()).List error:%s", podsErr.Error())
-		if re != nil {
-			re.Set(nil, cd.NewError(cd.UnExpected, podsErr.Error()))
-		}
+	cmd, cmdErr := operationPtr.Build(cmdInfo, &command.Context{DataPath: s.getDataMountPath(deploymentPtr)})
+	if cmdErr != nil {
+		err = cd.NewError(cd.IllegalParam, cmdErr.Error())
+		log.Warnf("executeCommand failed, %s build error:%s", cmdInfo, cmdErr.Error())
+		return
+	}
+
+	podPtr, podErr := s.getRunningPod(serviceInfo, cmdInfo.Member)
+	if podErr != nil {
+		err = podErr
+		return
+	}
+
+	record.Pod = podPtr.Name
+	ctx, cancel := context.WithTimeout(context.Background(), operationPtr.GetTimeout(cmdInfo))
+	defer cancel()
+
+	stdout, stderr, err = s.execInPod(ctx, s.getNamespace(), podPtr.Name, podPtr.Spec.Containers[0].Name, cmd, operationPtr.Input(cmdInfo))
+	return
+}
+
+func (s *K8s) ExecuteCommand(ev event.Event, re event.Result) {
+	param := ev.Data()
+	if param == nil {
+		log.Warnf("ExecuteCommand failed, nil param")
+		return
+	}
+
+	cmdInfoPtr, cmdInfoOK := param.(*common.CmdInfo)
+	if !cmdInfoOK || cmdInfoPtr == nil {
+		log.Warnf("ExecuteCommand failed, illegal param")
 		return
 	}
 
-	podName := podList.Items[0].Name
-	containerName := podList.Items[0].Spec.Containers[0].Name
-	commandVal := strings.Join(cmdInfoPtr.Command, " ")
-	resultData, errorData, resultErr := s.execInPod(s.clientSet, s.clientConfig, s.getNamespace(), podName, containerName, commandVal)
+	resultData, errorData, resultErr := s.executeCommand(ev.Source(), cmdInfoPtr)
 	if re != nil {
 		re.Set(resultData, resultErr)
 		re.SetVal("stderr", errorData)
@@ -146,6 +237,24 @@ func (s *K8s) CreateService(ev event.Event, re event.Result) {
 	}
 }
 
+func (s *K8s) UpdateService(ev event.Event, re event.Result) {
+	param := ev.Data()
+	if param == nil {
+		log.Warnf("UpdateService failed, nil param")
+		return
+	}
+
+	serviceInfoPtr, serviceInfoOK := param.(*common.ServiceInfo)
+	if !serviceInfoOK {
+		log.Warnf("UpdateService failed, nil param")
+		return
+	}
+	ret, err := s.updateService(serviceInfoPtr)
+	if re != nil {
+		re.Set(ret, err)
+	}
+}
+
 func (s *K8s) DestroyService(ev event.Event, re event.Result) {
 	param := ev.Data()
 	if param == nil {
@@ -286,6 +395,15 @@ func (s *K8s) createService(serviceInfo *common.ServiceInfo) (err *cd.Result) {
 	return
 }
 
+func (s *K8s) updateService(serviceInfo *common.ServiceInfo) (ret *common.UpdateResult, err *cd.Result) {
+	switch serviceInfo.Catalog {
+	case common.PostgreSQL:
+		ret, err = s.updateDatabase(serviceInfo)
+	}
+
+	return
+}
+
 func (s *K8s) destroyService(serviceInfo *common.ServiceInfo) (err *cd.Result) {
 	switch serviceInfo.Catalog {
 	case common.PostgreSQL:
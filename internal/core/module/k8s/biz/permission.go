@@ -0,0 +1,142 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/config"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// permission operator运行所需的API权限，需要与helm中的ClusterRole/Role保持一致
+// delegated 认证与鉴权委托权限，命名空间模式下由system:auth-delegator授予
+type permission struct {
+	group         string
+	resource      string
+	subresource   string
+	verbs         []string
+	clusterScoped bool
+	delegated     bool
+}
+
+func (s *permission) String(verb string) string {
+	resource := s.resource
+	if s.subresource != "" {
+		resource = fmt.Sprintf("%s/%s", resource, s.subresource)
+	}
+	if s.group != "" {
+		resource = fmt.Sprintf("%s.%s", resource, s.group)
+	}
+
+	return fmt.Sprintf("%s %s", verb, resource)
+}
+
+var requiredPermissions = []permission{
+	{group: "apps", resource: "deployments", verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+	{resource: "persistentvolumeclaims", verbs: []string{"get", "list", "create", "update", "delete"}},
+	{resource: "services", verbs: []string{"get", "create", "update", "delete"}},
+	{resource: "configmaps", verbs: []string{"get", "create", "update", "delete"}},
+	{resource: "pods", verbs: []string{"list", "patch", "delete"}},
+	{resource: "pods", subresource: "exec", verbs: []string{"create"}},
+	{resource: "events", verbs: []string{"create"}},
+	{group: "networking.k8s.io", resource: "networkpolicies", verbs: []string{"get", "create", "update", "delete"}},
+	{group: "policy", resource: "poddisruptionbudgets", verbs: []string{"get", "create", "update", "delete"}},
+	{resource: "persistentvolumes", verbs: []string{"get"}, clusterScoped: true},
+	{resource: "nodes", verbs: []string{"get"}, clusterScoped: true},
+	{resource: "secrets", verbs: []string{"get", "list", "create", "update", "delete"}},
+	{group: pgv1.Group, resource: pgv1.Postgresql, verbs: []string{"get", "list", "create", "update", "delete"}},
+	{group: pgv1.Group, resource: pgv1.Postgresql, subresource: "status", verbs: []string{"update"}},
+	{group: pgv1.Group, resource: pgv1.PostgresqlDatabase, verbs: []string{"list", "update"}},
+	{group: pgv1.Group, resource: pgv1.PostgresqlDatabase, subresource: "status", verbs: []string{"update"}},
+	{group: pgv1.Group, resource: pgv1.PostgresqlRole, verbs: []string{"list", "update"}},
+	{group: pgv1.Group, resource: pgv1.PostgresqlRole, subresource: "status", verbs: []string{"update"}},
+	{group: pgv1.Group, resource: pgv1.Migration, verbs: []string{"list"}},
+	{group: pgv1.Group, resource: pgv1.Migration, subresource: "status", verbs: []string{"update"}},
+	{group: pgv1.Group, resource: pgv1.Backup, verbs: []string{"get", "list", "create", "delete"}},
+	{group: pgv1.Group, resource: pgv1.Backup, subresource: "status", verbs: []string{"update"}},
+	{group: pgv1.Group, resource: pgv1.BackupSchedule, verbs: []string{"list"}},
+	{group: pgv1.Group, resource: pgv1.BackupSchedule, subresource: "status", verbs: []string{"update"}},
+	{group: "batch", resource: "jobs", verbs: []string{"get", "create", "delete"}},
+	{group: "snapshot.storage.k8s.io", resource: "volumesnapshots", verbs: []string{"get", "create"}},
+}
+
+type permissionChecker struct {
+	missingPermissions []string
+	checkLock          sync.RWMutex
+}
+
+func (s *K8s) getRequiredPermissions() (ret []permission) {
+	ret = append(ret, requiredPermissions...)
+
+	authCfg := config.GetAuthConfig()
+	if authCfg.Disable {
+		return
+	}
+	if authCfg.TokenReview {
+		ret = append(ret, permission{group: "authentication.k8s.io", resource: "tokenreviews", verbs: []string{"create"}, clusterScoped: true, delegated: true})
+	}
+	if authCfg.AccessReview {
+		ret = append(ret, permission{group: "authorization.k8s.io", resource: "subjectaccessreviews", verbs: []string{"create"}, clusterScoped: true, delegated: true})
+	}
+
+	return
+}
+
+// checkPermissions 使用SelfSubjectAccessReview检查operator所需权限，记录缺失的权限
+func (s *K8s) checkPermissions() {
+	missingPermissions := []string{}
+	for _, val := range s.getRequiredPermissions() {
+		// 命名空间模式下不访问集群级资源
+		if val.clusterScoped && !val.delegated && config.IsNamespaceScope() {
+			continue
+		}
+
+		for _, verb := range val.verbs {
+			attributes := &authorizationv1.ResourceAttributes{
+				Verb:        verb,
+				Group:       val.group,
+				Resource:    val.resource,
+				Subresource: val.subresource,
+			}
+			if !val.clusterScoped {
+				attributes.Namespace = s.getNamespace()
+			}
+
+			reviewPtr, reviewErr := s.clientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: attributes,
+				},
+			}, metav1.CreateOptions{})
+			if reviewErr != nil {
+				log.Errorf("checkPermissions failed, create self subject access review error:%s", reviewErr.Error())
+				missingPermissions = append(missingPermissions, val.String(verb))
+				continue
+			}
+			if !reviewPtr.Status.Allowed {
+				missingPermissions = append(missingPermissions, val.String(verb))
+			}
+		}
+	}
+
+	if len(missingPermissions) > 0 {
+		log.Warnf("checkPermissions, missing permissions:%v", missingPermissions)
+	}
+
+	s.checkLock.Lock()
+	defer s.checkLock.Unlock()
+	s.missingPermissions = missingPermissions
+}
+
+// GetMissingPermissions 查询缺失的权限
+func (s *K8s) GetMissingPermissions() []string {
+	s.checkLock.RLock()
+	defer s.checkLock.RUnlock()
+
+	return s.missingPermissions
+}
@@ -0,0 +1,100 @@
+package biz
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/module/k8s/pkg/database"
+	"supos.ai/operator/database/pkg/common"
+)
+
+// reconcilePooler 同步连接池的配置、Deployment与Service，未配置连接池时删除
+// 副本数由数据库模块决定，实例休眠期间为0，用户列表Secret由数据库模块维护
+func (s *K8s) reconcilePooler(serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	if serviceInfo.Pooler == nil {
+		s.deletePooler(serviceInfo)
+		return
+	}
+
+	configClient := s.clientSet.CoreV1().ConfigMaps(s.getNamespace())
+	configPtr := database.GetPoolerConfigMap(serviceInfo)
+	curConfig, curErr := configClient.Get(context.TODO(), configPtr.Name, metav1.GetOptions{})
+	if curErr != nil && !errors.IsNotFound(curErr) {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcilePooler %v failed, get configmap error:%s", serviceInfo, curErr.Error())
+		return
+	}
+	if curErr != nil {
+		_, curErr = configClient.Create(context.TODO(), configPtr, metav1.CreateOptions{})
+	} else {
+		curConfig.Labels = configPtr.Labels
+		curConfig.Data = configPtr.Data
+		_, curErr = configClient.Update(context.TODO(), curConfig, metav1.UpdateOptions{})
+	}
+	if curErr != nil {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcilePooler %v failed, save configmap error:%s", serviceInfo, curErr.Error())
+		return
+	}
+
+	deploymentClient := s.clientSet.AppsV1().Deployments(s.getNamespace())
+	deploymentPtr := database.GetPoolerDeployment(serviceInfo)
+	curDeployment, curErr := deploymentClient.Get(context.TODO(), deploymentPtr.Name, metav1.GetOptions{})
+	if curErr != nil && !errors.IsNotFound(curErr) {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcilePooler %v failed, get deployment error:%s", serviceInfo, curErr.Error())
+		return
+	}
+	if curErr != nil {
+		_, curErr = deploymentClient.Create(context.TODO(), deploymentPtr, metav1.CreateOptions{})
+		if curErr != nil {
+			err = cd.NewError(cd.UnExpected, curErr.Error())
+			log.Errorf("reconcilePooler %v failed, create deployment error:%s", serviceInfo, curErr.Error())
+			return
+		}
+	} else {
+		replicas := *deploymentPtr.Spec.Replicas
+		templateHash := deploymentPtr.Annotations[database.TemplateHashAnnotation]
+		if curDeployment.Annotations[database.TemplateHashAnnotation] != templateHash ||
+			curDeployment.Spec.Replicas == nil || *curDeployment.Spec.Replicas != replicas {
+			if curDeployment.Annotations == nil {
+				curDeployment.Annotations = map[string]string{}
+			}
+			curDeployment.Annotations[database.TemplateHashAnnotation] = templateHash
+			curDeployment.Spec.Replicas = &replicas
+			curDeployment.Spec.Template = deploymentPtr.Spec.Template
+			_, curErr = deploymentClient.Update(context.TODO(), curDeployment, metav1.UpdateOptions{})
+			if curErr != nil {
+				err = cd.NewError(cd.UnExpected, curErr.Error())
+				log.Errorf("reconcilePooler %v failed, update deployment error:%s", serviceInfo, curErr.Error())
+				return
+			}
+			log.Infof("reconcilePooler %v, deployment updated, replicas:%d, hash:%s", serviceInfo, replicas, templateHash)
+		}
+	}
+
+	err = s.reconcileService(database.GetPoolerService(serviceInfo))
+	return
+}
+
+// deletePooler 删除连接池资源，用户列表Secret一并删除
+func (s *K8s) deletePooler(serviceInfo *common.ServiceInfo) {
+	poolerName := serviceInfo.GetPoolerName()
+	deleteErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).Delete(context.TODO(), poolerName, metav1.DeleteOptions{})
+	if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+		log.Errorf("deletePooler %v failed, delete deployment error:%s", serviceInfo, deleteErr.Error())
+		return
+	}
+	if deleteErr == nil {
+		log.Infof("deletePooler %v, pooler deleted", serviceInfo)
+	}
+
+	s.deleteService(poolerName)
+	_ = s.clientSet.CoreV1().ConfigMaps(s.getNamespace()).Delete(context.TODO(), poolerName, metav1.DeleteOptions{})
+	_ = s.clientSet.CoreV1().Secrets(s.getNamespace()).Delete(context.TODO(), poolerName, metav1.DeleteOptions{})
+}
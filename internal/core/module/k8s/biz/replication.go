@@ -0,0 +1,402 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/module/k8s/pkg/database"
+	"supos.ai/operator/database/pkg/common"
+)
+
+// reconcileMembers 创建或更新各成员并删除多余的备节点，再按角色同步实例Service
+// 先同步备节点，备节点未全部按新模板就绪前主节点保持原Pod模板，rolling为true时需再次同步
+// 主节点需调整资源时保持原Pod模板，switchoverTo为已按新资源就绪的备节点，切换后原主节点以备节点身份重建
+func (s *K8s) reconcileMembers(serviceInfo *common.ServiceInfo) (rolling bool, switchoverTo string, err *cd.Result) {
+	primary := serviceInfo.GetPrimary()
+	members := map[string]bool{}
+	for _, member := range serviceInfo.GetMembers() {
+		members[member] = true
+		if member == primary {
+			continue
+		}
+
+		err = s.reconcileMember(serviceInfo, member, false)
+		if err != nil {
+			return
+		}
+		if !rolling && !s.isRolledOut(serviceInfo, member) {
+			rolling = true
+			log.Infof("reconcileMembers %v, waiting for member %s rolled out", serviceInfo, member)
+		}
+	}
+
+	// 当前主节点不随备节点数量减少而删除
+	members[primary] = true
+	if !rolling {
+		switchoverTo = s.getResizedStandby(serviceInfo, primary)
+	}
+	err = s.reconcileMember(serviceInfo, primary, rolling || switchoverTo != "")
+	if err != nil {
+		return
+	}
+	// 主节点的模板无需更新时不再等待备节点
+	if rolling {
+		curDeployment, curErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).Get(context.TODO(), primary, metav1.GetOptions{})
+		rolling = curErr == nil && !isTemplateSynced(serviceInfo, primary, curDeployment)
+	}
+	s.deleteMembers(serviceInfo, members)
+
+	services := append([]*corev1.Service{database.GetService(serviceInfo)}, database.GetReplicationServices(serviceInfo)...)
+	for _, val := range services {
+		err = s.reconcileService(val)
+		if err != nil {
+			return
+		}
+	}
+	if len(services) == 1 {
+		s.deleteService(database.GetReadWriteName(serviceInfo))
+		s.deleteService(database.GetReadOnlyName(serviceInfo))
+	}
+
+	return
+}
+
+// reconcileMember 各成员使用独立的数据卷与Deployment，已有的Deployment同步Pod模板与隔离状态
+// holdTemplate 为true时已有的Deployment暂不更新Pod模板
+func (s *K8s) reconcileMember(serviceInfo *common.ServiceInfo, member string, holdTemplate bool) (err *cd.Result) {
+	pvcClient := s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace())
+	curPVC, pvcErr := pvcClient.Get(context.TODO(), member, metav1.GetOptions{})
+	if pvcErr == nil {
+		// 扩容失败不影响其余资源的同步，由数据库模块发出告警
+		_ = s.expandPersistentVolumeClaim(serviceInfo, curPVC)
+	} else {
+		if !errors.IsNotFound(pvcErr) {
+			err = cd.NewError(cd.UnExpected, pvcErr.Error())
+			log.Errorf("reconcileMember %v failed, get pvc %s error:%s", serviceInfo, member, pvcErr.Error())
+			return
+		}
+
+		_, pvcErr = pvcClient.Create(context.TODO(), database.GetPersistentVolumeClaims(serviceInfo, member), metav1.CreateOptions{})
+		if pvcErr != nil {
+			err = cd.NewError(cd.UnExpected, pvcErr.Error())
+			log.Errorf("reconcileMember %v failed, create pvc %s error:%s", serviceInfo, member, pvcErr.Error())
+			return
+		}
+	}
+
+	deploymentClient := s.clientSet.AppsV1().Deployments(s.getNamespace())
+	_, deploymentErr := deploymentClient.Get(context.TODO(), member, metav1.GetOptions{})
+	if deploymentErr == nil {
+		err = s.reconcileDeployment(serviceInfo, member, holdTemplate)
+		if err != nil {
+			return
+		}
+
+		err = s.reconcileFence(serviceInfo, member)
+		if err != nil {
+			return
+		}
+
+		err = s.reconcileRoleLabels(member, database.GetMemberLabels(serviceInfo, member), serviceInfo.GetRole(member))
+		return
+	}
+	if !errors.IsNotFound(deploymentErr) {
+		err = cd.NewError(cd.UnExpected, deploymentErr.Error())
+		log.Errorf("reconcileMember %v failed, get deployment %s error:%s", serviceInfo, member, deploymentErr.Error())
+		return
+	}
+
+	_, deploymentErr = deploymentClient.Create(context.TODO(), database.GetDeployment(serviceInfo, member), metav1.CreateOptions{})
+	if deploymentErr != nil {
+		err = cd.NewError(cd.UnExpected, deploymentErr.Error())
+		log.Errorf("reconcileMember %v failed, create deployment %s error:%s", serviceInfo, member, deploymentErr.Error())
+		return
+	}
+
+	log.Infof("reconcileMember %v, member %s created", serviceInfo, member)
+	return
+}
+
+// expandPersistentVolumeClaim 数据卷容量只增不减，由存储类完成扩容，存储类不支持扩容时更新失败
+func (s *K8s) expandPersistentVolumeClaim(serviceInfo *common.ServiceInfo, curPVC *corev1.PersistentVolumeClaim) (err *cd.Result) {
+	pvcPtr := database.GetPersistentVolumeClaims(serviceInfo, curPVC.Name)
+	size := pvcPtr.Spec.Resources.Requests[corev1.ResourceStorage]
+	curSize := curPVC.Spec.Resources.Requests[corev1.ResourceStorage]
+	if size.Cmp(curSize) <= 0 {
+		return
+	}
+
+	if curPVC.Spec.Resources.Requests == nil {
+		curPVC.Spec.Resources.Requests = corev1.ResourceList{}
+	}
+	curPVC.Spec.Resources.Requests[corev1.ResourceStorage] = size
+	_, updateErr := s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace()).Update(context.TODO(), curPVC, metav1.UpdateOptions{})
+	if updateErr != nil {
+		err = cd.NewError(cd.UnExpected, updateErr.Error())
+		log.Errorf("expandPersistentVolumeClaim %v failed, update pvc %s error:%s", serviceInfo, curPVC.Name, updateErr.Error())
+		return
+	}
+
+	log.Infof("expandPersistentVolumeClaim %v, pvc %s expanded from %s to %s", serviceInfo, curPVC.Name, curSize.String(), size.String())
+	return
+}
+
+// getResizedStandby 运行中的主节点资源与定义不同时，返回已按当前Pod模板就绪的备节点，无需切换时返回空
+func (s *K8s) getResizedStandby(serviceInfo *common.ServiceInfo, primary string) string {
+	if serviceInfo.Replication == nil || serviceInfo.Replication.Standbys == 0 || serviceInfo.Replicas == 0 {
+		return ""
+	}
+
+	deploymentClient := s.clientSet.AppsV1().Deployments(s.getNamespace())
+	curDeployment, curErr := deploymentClient.Get(context.TODO(), primary, metav1.GetOptions{})
+	if curErr != nil || curDeployment.Spec.Replicas == nil || *curDeployment.Spec.Replicas == 0 ||
+		equality.Semantic.DeepEqual(curDeployment.Spec.Template.Spec.Containers[0].Resources, database.GetResources(serviceInfo)) {
+		return ""
+	}
+
+	for _, member := range serviceInfo.GetMembers() {
+		if member == primary || database.IsFencedMember(serviceInfo, member) {
+			continue
+		}
+
+		standbyDeployment, standbyErr := deploymentClient.Get(context.TODO(), member, metav1.GetOptions{})
+		if standbyErr != nil || standbyDeployment.Spec.Replicas == nil || *standbyDeployment.Spec.Replicas == 0 {
+			continue
+		}
+		if s.isRolledOut(serviceInfo, member) {
+			return member
+		}
+	}
+	return ""
+}
+
+// isTemplateSynced 成员的Deployment已使用当前的Pod模板
+func isTemplateSynced(serviceInfo *common.ServiceInfo, member string, curDeployment *appv1.Deployment) bool {
+	templateHash := database.GetDeployment(serviceInfo, member).Annotations[database.TemplateHashAnnotation]
+	return curDeployment.Annotations[database.TemplateHashAnnotation] == templateHash
+}
+
+// isRolledOut 成员的Deployment已按当前Pod模板完成滚动且Pod可用，副本数为0的成员视为已完成
+func (s *K8s) isRolledOut(serviceInfo *common.ServiceInfo, member string) bool {
+	curDeployment, curErr := s.clientSet.AppsV1().Deployments(s.getNamespace()).Get(context.TODO(), member, metav1.GetOptions{})
+	if curErr != nil {
+		log.Errorf("isRolledOut %v failed, get deployment %s error:%s", serviceInfo, member, curErr.Error())
+		return false
+	}
+
+	if !isTemplateSynced(serviceInfo, member, curDeployment) {
+		return false
+	}
+
+	replicas := int32(1)
+	if curDeployment.Spec.Replicas != nil {
+		replicas = *curDeployment.Spec.Replicas
+	}
+	statusPtr := &curDeployment.Status
+	return statusPtr.ObservedGeneration >= curDeployment.Generation &&
+		statusPtr.Replicas == replicas && statusPtr.UpdatedReplicas == replicas && statusPtr.AvailableReplicas == replicas
+}
+
+// reconcileFence 隔离成员时停止其Deployment，超过终止期限仍未退出的Pod强制删除，避免节点失联时原主节点继续接受写入
+// 解除隔离时恢复副本数，原主节点以备节点身份重新加入
+func (s *K8s) reconcileFence(serviceInfo *common.ServiceInfo, member string) (err *cd.Result) {
+	deploymentClient := s.clientSet.AppsV1().Deployments(s.getNamespace())
+	curDeployment, curErr := deploymentClient.Get(context.TODO(), member, metav1.GetOptions{})
+	if curErr != nil {
+		err = cd.NewError(cd.UnExpected, curErr.Error())
+		log.Errorf("reconcileFence %v failed, get deployment %s error:%s", serviceInfo, member, curErr.Error())
+		return
+	}
+
+	fenced := database.IsFencedMember(serviceInfo, member)
+	_, annotated := curDeployment.Annotations[database.FencedAnnotation]
+	if fenced != annotated {
+		replicas := int32(0)
+		if fenced {
+			if curDeployment.Annotations == nil {
+				curDeployment.Annotations = map[string]string{}
+			}
+			curDeployment.Annotations[database.FencedAnnotation] = "true"
+		} else {
+			delete(curDeployment.Annotations, database.FencedAnnotation)
+			replicas = *database.GetDeployment(serviceInfo, member).Spec.Replicas
+		}
+
+		curDeployment.Spec.Replicas = &replicas
+		_, updateErr := deploymentClient.Update(context.TODO(), curDeployment, metav1.UpdateOptions{})
+		if updateErr != nil {
+			err = cd.NewError(cd.UnExpected, updateErr.Error())
+			log.Errorf("reconcileFence %v failed, update deployment %s error:%s", serviceInfo, member, updateErr.Error())
+			return
+		}
+		log.Warnf("reconcileFence %v, member:%s, fenced:%v", serviceInfo, member, fenced)
+	}
+	if !fenced {
+		return
+	}
+
+	// Pod按终止期限正常退出，计划内切换时原主节点可以写入关闭检查点
+	// 失联节点上的Pod不会自行终止，超过终止期限后强制删除
+	podClient := s.clientSet.CoreV1().Pods(s.getNamespace())
+	listOptions := metav1.ListOptions{LabelSelector: database.GetMemberLabels(serviceInfo, member).String()}
+	podList, podErr := podClient.List(context.TODO(), listOptions)
+	if podErr != nil {
+		err = cd.NewError(cd.UnExpected, podErr.Error())
+		log.Errorf("reconcileFence %v failed, list pod error:%s", serviceInfo, podErr.Error())
+		return
+	}
+
+	for _, val := range podList.Items {
+		deleteOptions := metav1.DeleteOptions{}
+		if val.DeletionTimestamp != nil {
+			// DeletionTimestamp为终止期限到期的时间
+			if time.Now().Before(val.DeletionTimestamp.Time) {
+				continue
+			}
+
+			gracePeriod := int64(0)
+			deleteOptions.GracePeriodSeconds = &gracePeriod
+		}
+		deleteErr := podClient.Delete(context.TODO(), val.Name, deleteOptions)
+		if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+			err = cd.NewError(cd.UnExpected, deleteErr.Error())
+			log.Errorf("reconcileFence %v failed, delete pod %s error:%s", serviceInfo, val.Name, deleteErr.Error())
+			return
+		}
+	}
+	return
+}
+
+// reconcileRoleLabels 按成员当前的角色更新运行中Pod的角色标签，实例Service据此选择Pod，更新标签不会重启Pod
+// 仍标记为主节点的Pod在成员降为备节点后删除，重新启动时以备节点身份加入
+func (s *K8s) reconcileRoleLabels(member string, selector common.Labels, role string) (err *cd.Result) {
+	podClient := s.clientSet.CoreV1().Pods(s.getNamespace())
+	podList, podErr := podClient.List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if podErr != nil {
+		err = cd.NewError(cd.UnExpected, podErr.Error())
+		log.Errorf("reconcileRoleLabels %s failed, list pod error:%s", member, podErr.Error())
+		return
+	}
+
+	patchVal, _ := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"labels": map[string]string{common.RoleLabel: role},
+		},
+	})
+	for _, val := range podList.Items {
+		curRole := val.Labels[common.RoleLabel]
+		if val.DeletionTimestamp != nil || curRole == role {
+			continue
+		}
+
+		if curRole == common.RolePrimary {
+			deleteErr := podClient.Delete(context.TODO(), val.Name, metav1.DeleteOptions{})
+			if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+				err = cd.NewError(cd.UnExpected, deleteErr.Error())
+				log.Errorf("reconcileRoleLabels %s failed, delete pod %s error:%s", member, val.Name, deleteErr.Error())
+				return
+			}
+
+			log.Warnf("reconcileRoleLabels %s, demoted primary pod %s deleted", member, val.Name)
+			continue
+		}
+
+		_, patchErr := podClient.Patch(context.TODO(), val.Name, types.MergePatchType, patchVal, metav1.PatchOptions{})
+		if patchErr != nil && !errors.IsNotFound(patchErr) {
+			err = cd.NewError(cd.UnExpected, patchErr.Error())
+			log.Errorf("reconcileRoleLabels %s failed, patch pod %s error:%s", member, val.Name, patchErr.Error())
+			return
+		}
+
+		log.Infof("reconcileRoleLabels %s, pod:%s, role:%s", member, val.Name, role)
+	}
+	return
+}
+
+// deleteMembers 删除不在keep中的备节点成员及其数据卷，实例同名成员由实例本身管理
+func (s *K8s) deleteMembers(serviceInfo *common.ServiceInfo, keep map[string]bool) {
+	listOptions := metav1.ListOptions{LabelSelector: common.NewInstanceLabels(serviceInfo.Name).String()}
+	deploymentClient := s.clientSet.AppsV1().Deployments(s.getNamespace())
+	deploymentList, deploymentErr := deploymentClient.List(context.TODO(), listOptions)
+	if deploymentErr != nil {
+		log.Errorf("deleteMembers %v failed, list deployment error:%s", serviceInfo, deploymentErr.Error())
+		return
+	}
+	for _, val := range deploymentList.Items {
+		if !database.IsStandbyMember(serviceInfo, val.Name) || keep[val.Name] {
+			continue
+		}
+
+		deleteErr := deploymentClient.Delete(context.TODO(), val.Name, metav1.DeleteOptions{})
+		if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+			log.Errorf("deleteMembers %v failed, delete deployment %s error:%s", serviceInfo, val.Name, deleteErr.Error())
+			continue
+		}
+		log.Infof("deleteMembers %v, member %s deleted", serviceInfo, val.Name)
+	}
+
+	pvcClient := s.clientSet.CoreV1().PersistentVolumeClaims(s.getNamespace())
+	pvcList, pvcErr := pvcClient.List(context.TODO(), listOptions)
+	if pvcErr != nil {
+		log.Errorf("deleteMembers %v failed, list pvc error:%s", serviceInfo, pvcErr.Error())
+		return
+	}
+	for _, val := range pvcList.Items {
+		if !database.IsStandbyMember(serviceInfo, val.Name) || keep[val.Name] {
+			continue
+		}
+
+		deleteErr := pvcClient.Delete(context.TODO(), val.Name, metav1.DeleteOptions{})
+		if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+			log.Errorf("deleteMembers %v failed, delete pvc %s error:%s", serviceInfo, val.Name, deleteErr.Error())
+		}
+	}
+}
+
+// reconcileService 创建Service或同步已有Service的端口与选择器
+func (s *K8s) reconcileService(servicePtr *corev1.Service) (err *cd.Result) {
+	serviceClient := s.clientSet.CoreV1().Services(s.getNamespace())
+	curService, curErr := serviceClient.Get(context.TODO(), servicePtr.Name, metav1.GetOptions{})
+	if curErr != nil {
+		if !errors.IsNotFound(curErr) {
+			err = cd.NewError(cd.UnExpected, curErr.Error())
+			log.Errorf("reconcileService %s failed, get service error:%s", servicePtr.Name, curErr.Error())
+			return
+		}
+
+		_, createErr := serviceClient.Create(context.TODO(), servicePtr, metav1.CreateOptions{})
+		if createErr != nil {
+			err = cd.NewError(cd.UnExpected, createErr.Error())
+			log.Errorf("reconcileService %s failed, create service error:%s", servicePtr.Name, createErr.Error())
+		}
+		return
+	}
+
+	curService.Labels = servicePtr.Labels
+	curService.Spec.Ports = servicePtr.Spec.Ports
+	curService.Spec.Selector = servicePtr.Spec.Selector
+	_, updateErr := serviceClient.Update(context.TODO(), curService, metav1.UpdateOptions{})
+	if updateErr != nil {
+		err = cd.NewError(cd.UnExpected, updateErr.Error())
+		log.Errorf("reconcileService %s failed, update service error:%s", servicePtr.Name, updateErr.Error())
+	}
+	return
+}
+
+func (s *K8s) deleteService(name string) {
+	deleteErr := s.clientSet.CoreV1().Services(s.getNamespace()).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+		log.Errorf("deleteService %s failed, error:%s", name, deleteErr.Error())
+	}
+}
@@ -0,0 +1,365 @@
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+const defaultTimeout = 30 * time.Second
+
+const maxTimeout = 30 * time.Minute
+
+// ApplicationName 操作数据库时使用的application_name，用于区分operator自身的连接
+const ApplicationName = "database-operator"
+
+var nameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$-]{0,62}$`)
+
+// Context 构造命令所需的实例信息
+type Context struct {
+	DataPath string
+}
+
+// Operation 操作目录中的一项，目录只包含命名的操作，参数经校验转义后代入固定的语句
+// Granted 为true时只允许持有脚本凭证的调用方执行，见common.ScriptGrant
+type Operation struct {
+	Type    string
+	Name    string
+	Timeout time.Duration
+	Granted bool
+	build   func(cmdInfo *common.CmdInfo, ctx *Context) ([]string, error)
+	// input 通过标准输入传递给命令的内容，脚本不出现在命令参数中
+	input func(cmdInfo *common.CmdInfo) string
+}
+
+type catalog map[string]*Operation
+
+var catalog2Operations = map[string]catalog{
+	common.PostgreSQL: newCatalog(postgresqlOperations, sqlOperations),
+}
+
+func newCatalog(operationsList ...[]*Operation) catalog {
+	ret := catalog{}
+	for _, operations := range operationsList {
+		for _, val := range operations {
+			ret[operationKey(val.Type, val.Name)] = val
+		}
+	}
+
+	return ret
+}
+
+func operationKey(typ, name string) string {
+	return fmt.Sprintf("%s/%s", typ, name)
+}
+
+// Lookup 查询操作
+func Lookup(cmdInfo *common.CmdInfo) (ret *Operation, err error) {
+	operations, ok := catalog2Operations[cmdInfo.Catalog]
+	if !ok {
+		err = fmt.Errorf("illegal catalog %s", cmdInfo.Catalog)
+		return
+	}
+
+	ret, ok = operations[operationKey(cmdInfo.Type, cmdInfo.Operation)]
+	if !ok {
+		err = fmt.Errorf("illegal operation %s/%s", cmdInfo.Type, cmdInfo.Operation)
+		return
+	}
+
+	return
+}
+
+// IsAllowed 判断是否允许执行该操作，事件声明的来源不作为依据，需要凭证的操作只校验命令携带的凭证
+func (s *Operation) IsAllowed(cmdInfo *common.CmdInfo) bool {
+	if !s.Granted {
+		return true
+	}
+
+	return cmdInfo.Grant.IsValid()
+}
+
+// Build 构造在容器内直接执行的命令参数，不经过shell
+func (s *Operation) Build(cmdInfo *common.CmdInfo, ctx *Context) ([]string, error) {
+	return s.build(cmdInfo, ctx)
+}
+
+// Input 通过标准输入传递给命令的内容，为空时不使用标准输入
+func (s *Operation) Input(cmdInfo *common.CmdInfo) string {
+	if s.input == nil {
+		return ""
+	}
+
+	return s.input(cmdInfo)
+}
+
+// GetTimeout 返回本次执行的超时时间
+func (s *Operation) GetTimeout(cmdInfo *common.CmdInfo) time.Duration {
+	timeout := s.Timeout
+	if cmdInfo.Timeout > 0 {
+		timeout = time.Duration(cmdInfo.Timeout) * time.Second
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	return timeout
+}
+
+// quoteConnValue 转义libpq连接串中的值
+func quoteConnValue(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	val = strings.ReplaceAll(val, `'`, `\'`)
+	return fmt.Sprintf("'%s'", val)
+}
+
+func psql(database string, singleTransaction bool, statement string) []string {
+	return append(psqlArgs(database, singleTransaction), "-c", statement)
+}
+
+// psqlStdin 从标准输入读取脚本，脚本中的psql元命令同样会被执行，仅用于只允许数据库模块调用的脚本操作
+func psqlStdin(database string, singleTransaction bool) []string {
+	return append(psqlArgs(database, singleTransaction), "-f", "-")
+}
+
+func psqlArgs(database string, singleTransaction bool) []string {
+	if database == "" {
+		database = "postgres"
+	}
+
+	connInfo := fmt.Sprintf("dbname=%s user=%s application_name=%s",
+		quoteConnValue(database),
+		quoteConnValue(common.DefaultPostgreSQLRoot),
+		ApplicationName)
+	ret := []string{"psql", "-X", "-q", "-A", "-t", "-v", "ON_ERROR_STOP=1", "-d", connInfo}
+	if singleTransaction {
+		ret = append(ret, "--single-transaction")
+	}
+
+	return ret
+}
+
+func checkDatabase(cmdInfo *common.CmdInfo) error {
+	if cmdInfo.Database != "" && !nameRegexp.MatchString(cmdInfo.Database) {
+		return fmt.Errorf("illegal database %s", cmdInfo.Database)
+	}
+
+	return nil
+}
+
+func checkArgs(cmdInfo *common.CmdInfo, size int) error {
+	if len(cmdInfo.Args) != size {
+		return fmt.Errorf("%s/%s expect %d args", cmdInfo.Type, cmdInfo.Operation, size)
+	}
+
+	return nil
+}
+
+func sqlOperation(name string, timeout time.Duration, statement string) *Operation {
+	return &Operation{
+		Type:    common.AdminCommand,
+		Name:    name,
+		Timeout: timeout,
+		build: func(cmdInfo *common.CmdInfo, _ *Context) ([]string, error) {
+			if err := checkDatabase(cmdInfo); err != nil {
+				return nil, err
+			}
+			if err := checkArgs(cmdInfo, 0); err != nil {
+				return nil, err
+			}
+
+			return psql(cmdInfo.Database, false, statement), nil
+		},
+	}
+}
+
+func backendOperation(name, funcName string) *Operation {
+	return &Operation{
+		Type:    common.AdminCommand,
+		Name:    name,
+		Timeout: defaultTimeout,
+		build: func(cmdInfo *common.CmdInfo, _ *Context) ([]string, error) {
+			if err := checkArgs(cmdInfo, 1); err != nil {
+				return nil, err
+			}
+
+			pid, pidErr := strconv.ParseInt(cmdInfo.Args[0], 10, 32)
+			if pidErr != nil || pid <= 0 {
+				return nil, fmt.Errorf("illegal pid %s", cmdInfo.Args[0])
+			}
+
+			return psql("", false, fmt.Sprintf("SELECT %s(%d)", funcName, pid)), nil
+		},
+	}
+}
+
+// snapshotWaitSeconds 快照备份会话等待结束标记的最长时间，超时后会话自行结束备份
+const snapshotWaitSeconds = 1500
+
+// backupSessionScript 在同一会话中开始非排他的基础备份，等待结束标记后结束备份，依次输出开始与结束的LSN
+// PostgreSQL 15起使用pg_backup_start与pg_backup_stop，之前的版本使用pg_start_backup与pg_stop_backup
+// 参数依次为数据目录与备份标签，会话结束后将psql的退出码写入status文件
+const backupSessionScript = `prefix="$1/.backup-$2"
+status=0
+psql -X -q -A -t -v ON_ERROR_STOP=1 -d "dbname=postgres user=$PGUSER application_name=$APP_NAME" <<EOF || status=$?
+SELECT current_setting('server_version_num')::int >= 150000 AS pg15 \gset
+\if :pg15
+SELECT pg_backup_start('$2', true);
+\else
+SELECT pg_start_backup('$2', true, false);
+\endif
+\! i=0; while [ ! -f "$prefix.done" ] && [ \$i -lt $WAIT_SECONDS ]; do sleep 1; i=\$((i + 1)); done
+\if :pg15
+SELECT lsn FROM pg_backup_stop(false);
+\else
+SELECT lsn FROM pg_stop_backup(false, false);
+\endif
+EOF
+echo "$status" > "$prefix.status.tmp"
+mv "$prefix.status.tmp" "$prefix.status"
+`
+
+// backupStartScript 在后台开启快照备份会话后立即返回，会话不随命令或operator退出而中断
+// 会话的输出与退出码保存在数据目录下、PGDATA之外，由backup-result读取
+const backupStartScript = `set -eu
+prefix="$1/.backup-$2"
+rm -f "$prefix.done" "$prefix.out" "$prefix.status" "$prefix.status.tmp"
+nohup sh -c "$SESSION_SCRIPT" sh "$1" "$2" > "$prefix.out" 2>&1 < /dev/null &
+`
+
+// backupStopScript 写入结束标记，快照备份会话随后结束备份
+const backupStopScript = `touch "$1/.backup-$2.done"`
+
+// backupResultScript 会话结束后首行输出退出码，其后为会话的输出，会话未结束时无输出
+const backupResultScript = `prefix="$1/.backup-$2"
+if [ -f "$prefix.status" ]; then
+  cat "$prefix.status" "$prefix.out"
+fi
+`
+
+// backupCleanScript 备份结束后删除会话的结束标记、输出与退出码文件
+const backupCleanScript = `rm -f "$1/.backup-$2.done" "$1/.backup-$2.out" "$1/.backup-$2.status" "$1/.backup-$2.status.tmp"`
+
+func snapshotOperation(name string, timeout time.Duration, script string) *Operation {
+	return &Operation{
+		Type:    common.AdminCommand,
+		Name:    name,
+		Timeout: timeout,
+		build: func(cmdInfo *common.CmdInfo, ctx *Context) ([]string, error) {
+			if err := checkArgs(cmdInfo, 1); err != nil {
+				return nil, err
+			}
+			if !nameRegexp.MatchString(cmdInfo.Args[0]) {
+				return nil, fmt.Errorf("illegal backup label %s", cmdInfo.Args[0])
+			}
+			if ctx == nil || ctx.DataPath == "" {
+				return nil, fmt.Errorf("missing data path")
+			}
+
+			return []string{"env",
+				"PGUSER=" + common.DefaultPostgreSQLRoot,
+				"APP_NAME=" + common.SnapshotApplicationName,
+				"WAIT_SECONDS=" + strconv.Itoa(snapshotWaitSeconds),
+				"SESSION_SCRIPT=" + backupSessionScript,
+				"sh", "-c", script, "sh", ctx.DataPath, cmdInfo.Args[0]}, nil
+		},
+	}
+}
+
+func diagnosticOperation(name, statement string) *Operation {
+	ptr := sqlOperation(name, defaultTimeout, statement)
+	ptr.Type = common.DiagnosticCommand
+	return ptr
+}
+
+var postgresqlOperations = []*Operation{
+	sqlOperation("reload", defaultTimeout, "SELECT pg_reload_conf()"),
+	sqlOperation("checkpoint", 10*time.Minute, "CHECKPOINT"),
+	// promote 提升备节点，等待提升完成后返回t
+	sqlOperation("promote", 90*time.Second, "SELECT pg_promote(true, 60)"),
+	// terminate-clients 结束主节点上的客户端连接，已打开的读写事务随之回滚
+	sqlOperation("terminate-clients", defaultTimeout, "SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()"),
+	{
+		// fast-shutdown 以fast模式停止数据库，回滚客户端事务并写入关闭检查点，WAL发送进程在备节点接收完检查点后退出
+		// 只发送停止信号不等待，仅用于已隔离、Pod终止中的成员，否则容器会被重启
+		Type:    common.AdminCommand,
+		Name:    "fast-shutdown",
+		Timeout: defaultTimeout,
+		build: func(cmdInfo *common.CmdInfo, _ *Context) ([]string, error) {
+			if err := checkArgs(cmdInfo, 0); err != nil {
+				return nil, err
+			}
+
+			return []string{"pg_ctl", "stop", "-m", "fast", "-W"}, nil
+		},
+	},
+	snapshotOperation("backup-start", defaultTimeout, backupStartScript),
+	snapshotOperation("backup-stop", defaultTimeout, backupStopScript),
+	snapshotOperation("backup-result", defaultTimeout, backupResultScript),
+	snapshotOperation("backup-clean", defaultTimeout, backupCleanScript),
+	{
+		// amcheck 使用pg_amcheck校验全部数据库的表与索引，缺少amcheck扩展时自动安装，仅用于恢复校验的临时实例
+		Type:    common.AdminCommand,
+		Name:    "amcheck",
+		Timeout: maxTimeout,
+		build: func(cmdInfo *common.CmdInfo, _ *Context) ([]string, error) {
+			if err := checkArgs(cmdInfo, 0); err != nil {
+				return nil, err
+			}
+
+			return []string{"env", "PGAPPNAME=" + ApplicationName,
+				"pg_amcheck", "-U", common.DefaultPostgreSQLRoot, "--no-password", "--all", "--install-missing"}, nil
+		},
+	},
+	backendOperation("cancel-backend", "pg_cancel_backend"),
+	backendOperation("terminate-backend", "pg_terminate_backend"),
+	{
+		Type:    common.DiagnosticCommand,
+		Name:    "ready",
+		Timeout: 10 * time.Second,
+		build: func(cmdInfo *common.CmdInfo, _ *Context) ([]string, error) {
+			if err := checkArgs(cmdInfo, 0); err != nil {
+				return nil, err
+			}
+
+			return []string{"pg_isready", "-U", common.DefaultPostgreSQLRoot}, nil
+		},
+	},
+	{
+		Type:    common.DiagnosticCommand,
+		Name:    "disk-usage",
+		Timeout: 10 * time.Second,
+		build: func(cmdInfo *common.CmdInfo, ctx *Context) ([]string, error) {
+			if err := checkArgs(cmdInfo, 0); err != nil {
+				return nil, err
+			}
+			if ctx == nil || ctx.DataPath == "" {
+				return nil, fmt.Errorf("missing data path")
+			}
+
+			return []string{"df", "-P", "-k", ctx.DataPath}, nil
+		},
+	},
+	diagnosticOperation("version", "SELECT version()"),
+	diagnosticOperation("replay-lsn", "SELECT pg_last_wal_replay_lsn()"),
+	diagnosticOperation("receive-lsn", "SELECT pg_last_wal_receive_lsn()"),
+	diagnosticOperation("in-recovery", "SELECT pg_is_in_recovery()"),
+	diagnosticOperation("activity", "SELECT pid, usename, datname, application_name, state, backend_start FROM pg_stat_activity WHERE backend_type = 'client backend'"),
+	// client-count 客户端连接数，不包含operator自身的会话
+	diagnosticOperation("client-count", fmt.Sprintf("SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend' AND pid <> pg_backend_pid() AND application_name NOT IN (%s, %s)",
+		common.QuoteLiteral(ApplicationName), common.QuoteLiteral(common.SnapshotApplicationName))),
+	// backup-session 快照备份会话执行完开始备份的语句后处于idle状态，参数为备份标签，会话存在时返回1
+	namedOperation(common.DiagnosticCommand, "backup-session", defaultTimeout, false, []argKind{identifierArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("SELECT count(*) FROM pg_stat_activity WHERE application_name = %s AND state = 'idle' AND (query LIKE %s OR query LIKE %s)",
+				common.QuoteLiteral(common.SnapshotApplicationName),
+				common.QuoteLiteral(fmt.Sprintf("SELECT pg_backup_start('%s'%%", args[0])),
+				common.QuoteLiteral(fmt.Sprintf("SELECT pg_start_backup('%s'%%", args[0])))}
+		}),
+	diagnosticOperation("table-count", "SELECT count(*) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind IN ('r', 'p') AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'"),
+	diagnosticOperation("database-size", "SELECT datname, pg_database_size(datname) FROM pg_database WHERE datallowconn"),
+}
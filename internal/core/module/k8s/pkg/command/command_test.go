@@ -0,0 +1,144 @@
+package command
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+func TestLookup(t *testing.T) {
+	cases := []struct {
+		catalog   string
+		typ       string
+		operation string
+		expectErr bool
+	}{
+		{common.PostgreSQL, common.AdminCommand, "reload", false},
+		{common.PostgreSQL, common.SQLCommand, "role-ensure", false},
+		{common.PostgreSQL, common.DiagnosticCommand, "version", false},
+		{common.PostgreSQL, common.DiagnosticCommand, "reload", true},
+		{common.PostgreSQL, common.AdminCommand, "rm -rf /", true},
+		{"mysql", common.AdminCommand, "reload", true},
+	}
+	for _, c := range cases {
+		_, err := Lookup(&common.CmdInfo{Catalog: c.catalog, Type: c.typ, Operation: c.operation})
+		if (err != nil) != c.expectErr {
+			t.Errorf("Lookup(%s, %s/%s) error %v, expect error %v", c.catalog, c.typ, c.operation, err, c.expectErr)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	verifier, _ := common.NewScramVerifier("secret")
+	dataCtx := &Context{DataPath: "/var/lib/postgresql"}
+	cases := []struct {
+		name      string
+		typ       string
+		operation string
+		database  string
+		args      []string
+		statement string
+		ctx       *Context
+		expectErr bool
+		contains  string
+	}{
+		{name: "reload", typ: common.AdminCommand, operation: "reload", contains: "SELECT pg_reload_conf()"},
+		{name: "unexpected args", typ: common.AdminCommand, operation: "reload", args: []string{"x"}, expectErr: true},
+		{name: "illegal database", typ: common.DiagnosticCommand, operation: "version", database: "db; DROP", expectErr: true},
+		{name: "pid", typ: common.AdminCommand, operation: "cancel-backend", args: []string{"123"}, contains: "SELECT pg_cancel_backend(123)"},
+		{name: "illegal pid", typ: common.AdminCommand, operation: "cancel-backend", args: []string{"1 OR 1=1"}, expectErr: true},
+		{name: "negative pid", typ: common.AdminCommand, operation: "terminate-backend", args: []string{"-1"}, expectErr: true},
+		{name: "backup label", typ: common.AdminCommand, operation: "backup-start", args: []string{"b1"}, ctx: dataCtx, contains: "/var/lib/postgresql"},
+		{name: "illegal backup label", typ: common.AdminCommand, operation: "backup-start", args: []string{"b1;reboot"}, ctx: dataCtx, expectErr: true},
+		{name: "missing data path", typ: common.AdminCommand, operation: "backup-stop", args: []string{"b1"}, expectErr: true},
+		{name: "role ensure", typ: common.SQLCommand, operation: "role-ensure", args: []string{"app", "true", "false", "false", "-1"}, contains: `ALTER ROLE "app" WITH LOGIN NOCREATEDB NOCREATEROLE CONNECTION LIMIT -1`},
+		{name: "illegal boolean", typ: common.SQLCommand, operation: "role-ensure", args: []string{"app", "yes please", "false", "false", "-1"}, expectErr: true},
+		{name: "illegal integer", typ: common.SQLCommand, operation: "role-ensure", args: []string{"app", "true", "false", "false", "1; DROP"}, expectErr: true},
+		{name: "identifier too long", typ: common.SQLCommand, operation: "role-drop", args: []string{strings.Repeat("r", 64)}, expectErr: true},
+		{name: "quoted identifier", typ: common.SQLCommand, operation: "role-grant", args: []string{`a"b`, "app"}, contains: `GRANT "a""b" TO "app"`},
+		{name: "missing args", typ: common.SQLCommand, operation: "role-grant", args: []string{"app"}, expectErr: true},
+		{name: "privileges", typ: common.SQLCommand, operation: "database-grant", args: []string{"db", "app", "CONNECT", "temp"}},
+		{name: "illegal privilege", typ: common.SQLCommand, operation: "database-grant", args: []string{"db", "app", "SUPERUSER"}, expectErr: true},
+		{name: "password verifier", typ: common.SQLCommand, operation: "role-password", args: []string{"app", verifier}, contains: common.ScramPrefix},
+		{name: "plain password", typ: common.SQLCommand, operation: "role-password", args: []string{"app", "secret"}, expectErr: true},
+		{name: "quoted literal", typ: common.DiagnosticCommand, operation: "extension-version", args: []string{"it's"}, contains: `extname = 'it''s'`},
+		{name: "script", typ: common.SQLCommand, operation: "clone-script", statement: "UPDATE users SET email = NULL", contains: "--single-transaction"},
+		{name: "empty script", typ: common.SQLCommand, operation: "clone-script", statement: " \n", expectErr: true},
+	}
+	for _, c := range cases {
+		cmdInfo := &common.CmdInfo{
+			Catalog:   common.PostgreSQL,
+			Type:      c.typ,
+			Operation: c.operation,
+			Database:  c.database,
+			Args:      c.args,
+			Statement: c.statement,
+		}
+		operationPtr, operationErr := Lookup(cmdInfo)
+		if operationErr != nil {
+			t.Errorf("%s: lookup failed, error:%s", c.name, operationErr.Error())
+			continue
+		}
+
+		cmd, cmdErr := operationPtr.Build(cmdInfo, c.ctx)
+		if c.expectErr {
+			if cmdErr == nil {
+				t.Errorf("%s: expect error, cmd:%v", c.name, cmd)
+			}
+			continue
+		}
+		if cmdErr != nil {
+			t.Errorf("%s: build failed, error:%s", c.name, cmdErr.Error())
+			continue
+		}
+		if !strings.Contains(strings.Join(cmd, " "), c.contains) {
+			t.Errorf("%s: cmd %v, expect to contain %s", c.name, cmd, c.contains)
+		}
+	}
+}
+
+// TestIsAllowed 脚本类操作只校验命令携带的凭证，伪造的凭证与第二次领取均无效
+func TestIsAllowed(t *testing.T) {
+	grant := common.ClaimScriptGrant()
+	if grant == nil || common.ClaimScriptGrant() != nil {
+		t.Fatalf("script grant should be claimed only once")
+	}
+
+	cases := []struct {
+		name      string
+		operation string
+		grant     *common.ScriptGrant
+		expect    bool
+	}{
+		{name: "script with grant", operation: "migration-apply", grant: grant, expect: true},
+		{name: "script without grant", operation: "migration-apply", expect: false},
+		{name: "script with forged grant", operation: "clone-script", grant: &common.ScriptGrant{}, expect: false},
+		{name: "named operation", operation: "role-drop", expect: true},
+	}
+	for _, c := range cases {
+		cmdInfo := &common.CmdInfo{Catalog: common.PostgreSQL, Type: common.SQLCommand, Operation: c.operation, Grant: c.grant}
+		operationPtr, _ := Lookup(cmdInfo)
+		if ret := operationPtr.IsAllowed(cmdInfo); ret != c.expect {
+			t.Errorf("%s: allowed %v, expect %v", c.name, ret, c.expect)
+		}
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	operationPtr, _ := Lookup(&common.CmdInfo{Catalog: common.PostgreSQL, Type: common.AdminCommand, Operation: "reload"})
+	cases := []struct {
+		timeout int
+		expect  time.Duration
+	}{
+		{0, defaultTimeout},
+		{5, 5 * time.Second},
+		{7200, maxTimeout},
+	}
+	for _, c := range cases {
+		if ret := operationPtr.GetTimeout(&common.CmdInfo{Timeout: c.timeout}); ret != c.expect {
+			t.Errorf("timeout %d: %s, expect %s", c.timeout, ret, c.expect)
+		}
+	}
+}
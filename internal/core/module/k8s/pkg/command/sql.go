@@ -0,0 +1,296 @@
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+// argKind 命名SQL操作的参数类型，构造语句前按类型校验参数
+type argKind int
+
+const (
+	// identifierArg 非空的对象名称，语句中按标识符转义
+	identifierArg argKind = iota
+	// optionalArg 可为空的对象名称或字符串，为空时语句中省略对应子句
+	optionalArg
+	// literalArg 字符串，语句中按字面量转义
+	literalArg
+	integerArg
+	booleanArg
+	// privilegeArg 数据库权限，只允许固定的权限名称
+	privilegeArg
+	// verifierArg SCRAM-SHA-256口令校验值，不接受明文口令
+	verifierArg
+)
+
+// maxIdentifierLength PostgreSQL标识符的最大字节数
+const maxIdentifierLength = 63
+
+var databasePrivileges = map[string]bool{
+	"CONNECT": true, "CREATE": true, "TEMPORARY": true, "TEMP": true, "ALL": true, "ALL PRIVILEGES": true,
+}
+
+func checkArg(kind argKind, val string) error {
+	switch kind {
+	case identifierArg:
+		if val == "" || len(val) > maxIdentifierLength {
+			return fmt.Errorf("illegal identifier %s", val)
+		}
+	case optionalArg:
+		if len(val) > maxIdentifierLength {
+			return fmt.Errorf("illegal identifier %s", val)
+		}
+	case integerArg:
+		if _, err := strconv.ParseInt(val, 10, 32); err != nil {
+			return fmt.Errorf("illegal integer %s", val)
+		}
+	case booleanArg:
+		if _, err := strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("illegal boolean %s", val)
+		}
+	case privilegeArg:
+		if !databasePrivileges[strings.ToUpper(strings.TrimSpace(val))] {
+			return fmt.Errorf("illegal database privilege %s", val)
+		}
+	case verifierArg:
+		if !common.IsScramVerifier(val) {
+			return fmt.Errorf("illegal password verifier")
+		}
+	}
+
+	return nil
+}
+
+// checkKinds 按类型校验参数，variadic为true时最后一种类型的参数可出现0到多次
+func checkKinds(cmdInfo *common.CmdInfo, kinds []argKind, variadic bool) error {
+	size := len(kinds)
+	if variadic {
+		size--
+		if len(cmdInfo.Args) < size {
+			return fmt.Errorf("%s/%s expect at least %d args", cmdInfo.Type, cmdInfo.Operation, size)
+		}
+	} else if err := checkArgs(cmdInfo, size); err != nil {
+		return err
+	}
+
+	for idx, val := range cmdInfo.Args {
+		kind := kinds[len(kinds)-1]
+		if idx < len(kinds) {
+			kind = kinds[idx]
+		}
+		if err := checkArg(kind, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// namedOperation 命名SQL操作，参数校验通过后由build生成语句，build负责转义参数，transaction为true时在单个事务中执行
+func namedOperation(typ, name string, timeout time.Duration, transaction bool, kinds []argKind, variadic bool, build func(args []string) []string) *Operation {
+	return &Operation{
+		Type:    typ,
+		Name:    name,
+		Timeout: timeout,
+		build: func(cmdInfo *common.CmdInfo, _ *Context) ([]string, error) {
+			if err := checkDatabase(cmdInfo); err != nil {
+				return nil, err
+			}
+			if err := checkKinds(cmdInfo, kinds, variadic); err != nil {
+				return nil, err
+			}
+
+			return psql(cmdInfo.Database, transaction, strings.Join(build(cmdInfo.Args), ";\n")), nil
+		},
+	}
+}
+
+// queryOperation 只读查询，参数均按字面量转义后依次代入format
+func queryOperation(name, format string, argc int) *Operation {
+	kinds := make([]argKind, argc)
+	for idx := range kinds {
+		kinds[idx] = literalArg
+	}
+
+	return namedOperation(common.DiagnosticCommand, name, defaultTimeout, false, kinds, false, func(args []string) []string {
+		values := []interface{}{}
+		for _, val := range args {
+			values = append(values, common.QuoteLiteral(val))
+		}
+		return []string{fmt.Sprintf(format, values...)}
+	})
+}
+
+// scriptOperation 执行声明式资源中的SQL脚本，脚本来自Statement并通过标准输入传递，仅允许持有脚本凭证的数据库模块调用
+func scriptOperation(name string, timeout time.Duration, kinds []argKind, build func(script string, args []string) string) *Operation {
+	return &Operation{
+		Type:    common.SQLCommand,
+		Name:    name,
+		Timeout: timeout,
+		Granted: true,
+		build: func(cmdInfo *common.CmdInfo, _ *Context) ([]string, error) {
+			if err := checkDatabase(cmdInfo); err != nil {
+				return nil, err
+			}
+			if err := checkKinds(cmdInfo, kinds, false); err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(cmdInfo.Statement) == "" {
+				return nil, fmt.Errorf("empty script")
+			}
+
+			return psqlStdin(cmdInfo.Database, true), nil
+		},
+		input: func(cmdInfo *common.CmdInfo) string {
+			return build(cmdInfo.Statement, cmdInfo.Args)
+		},
+	}
+}
+
+func roleOption(val, option string) string {
+	if enable, _ := strconv.ParseBool(val); enable {
+		return option
+	}
+
+	return "NO" + option
+}
+
+// MigrationTable 记录已执行迁移的版本与校验和
+const MigrationTable = "public.database_operator_schema_migrations"
+
+// sqlOperations 管理角色、数据库、扩展、复制槽与迁移的命名SQL操作
+var sqlOperations = []*Operation{
+	// role-ensure 创建不存在的角色并设置属性，参数依次为角色、LOGIN、CREATEDB、CREATEROLE与连接数上限
+	namedOperation(common.SQLCommand, "role-ensure", defaultTimeout, true,
+		[]argKind{identifierArg, booleanArg, booleanArg, booleanArg, integerArg}, false,
+		func(args []string) []string {
+			return []string{
+				fmt.Sprintf("DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = %s) THEN CREATE ROLE %s; END IF; END $$",
+					common.QuoteLiteral(args[0]), common.QuoteIdentifier(args[0])),
+				fmt.Sprintf("ALTER ROLE %s WITH %s %s %s CONNECTION LIMIT %s", common.QuoteIdentifier(args[0]),
+					roleOption(args[1], "LOGIN"), roleOption(args[2], "CREATEDB"), roleOption(args[3], "CREATEROLE"), args[4]),
+			}
+		}),
+	// role-grant与role-revoke 参数依次为所属角色与角色
+	namedOperation(common.SQLCommand, "role-grant", defaultTimeout, false, []argKind{identifierArg, identifierArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("GRANT %s TO %s", common.QuoteIdentifier(args[0]), common.QuoteIdentifier(args[1]))}
+		}),
+	namedOperation(common.SQLCommand, "role-revoke", defaultTimeout, false, []argKind{identifierArg, identifierArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("REVOKE %s FROM %s", common.QuoteIdentifier(args[0]), common.QuoteIdentifier(args[1]))}
+		}),
+	// role-password 参数依次为角色与口令的SCRAM-SHA-256校验值，调用方需标记为敏感操作
+	namedOperation(common.SQLCommand, "role-password", defaultTimeout, false, []argKind{identifierArg, verifierArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("ALTER ROLE %s WITH PASSWORD %s", common.QuoteIdentifier(args[0]), common.QuoteLiteral(args[1]))}
+		}),
+	namedOperation(common.SQLCommand, "role-drop", defaultTimeout, false, []argKind{identifierArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("DROP ROLE IF EXISTS %s", common.QuoteIdentifier(args[0]))}
+		}),
+	// database-create 参数依次为数据库、编码、连接数上限与属主，属主为空时为root，CREATE DATABASE不能在事务中执行
+	namedOperation(common.SQLCommand, "database-create", defaultTimeout, false,
+		[]argKind{identifierArg, literalArg, integerArg, optionalArg}, false,
+		func(args []string) []string {
+			statement := fmt.Sprintf("CREATE DATABASE %s ENCODING %s TEMPLATE template0 CONNECTION LIMIT %s",
+				common.QuoteIdentifier(args[0]), common.QuoteLiteral(args[1]), args[2])
+			if args[3] != "" {
+				statement = fmt.Sprintf("%s OWNER %s", statement, common.QuoteIdentifier(args[3]))
+			}
+			return []string{statement}
+		}),
+	// database-alter 参数依次为数据库、连接数上限与属主，属主为空时不修改
+	namedOperation(common.SQLCommand, "database-alter", defaultTimeout, true,
+		[]argKind{identifierArg, integerArg, optionalArg}, false,
+		func(args []string) []string {
+			ret := []string{fmt.Sprintf("ALTER DATABASE %s CONNECTION LIMIT %s", common.QuoteIdentifier(args[0]), args[1])}
+			if args[2] != "" {
+				ret = append(ret, fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", common.QuoteIdentifier(args[0]), common.QuoteIdentifier(args[2])))
+			}
+			return ret
+		}),
+	// database-grant 收回角色在数据库上的全部权限后授予声明的权限，参数依次为数据库、角色与权限，未声明权限时仅收回
+	namedOperation(common.SQLCommand, "database-grant", defaultTimeout, true,
+		[]argKind{identifierArg, identifierArg, privilegeArg}, true,
+		func(args []string) []string {
+			ret := []string{fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", common.QuoteIdentifier(args[0]), common.QuoteIdentifier(args[1]))}
+			privileges := []string{}
+			for _, val := range args[2:] {
+				privileges = append(privileges, strings.ToUpper(strings.TrimSpace(val)))
+			}
+			if len(privileges) > 0 {
+				ret = append(ret, fmt.Sprintf("GRANT %s ON DATABASE %s TO %s",
+					strings.Join(privileges, ", "), common.QuoteIdentifier(args[0]), common.QuoteIdentifier(args[1])))
+			}
+			return ret
+		}),
+	namedOperation(common.SQLCommand, "database-drop", defaultTimeout, false, []argKind{identifierArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", common.QuoteIdentifier(args[0]))}
+		}),
+	// extension-create与extension-update 参数依次为扩展与版本，版本为空时使用默认版本或升级到最新版本
+	namedOperation(common.SQLCommand, "extension-create", 5*time.Minute, false, []argKind{identifierArg, literalArg}, false,
+		func(args []string) []string {
+			if args[1] == "" {
+				return []string{fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s CASCADE", common.QuoteIdentifier(args[0]))}
+			}
+			return []string{fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s VERSION %s CASCADE", common.QuoteIdentifier(args[0]), common.QuoteLiteral(args[1]))}
+		}),
+	namedOperation(common.SQLCommand, "extension-update", 5*time.Minute, false, []argKind{identifierArg, literalArg}, false,
+		func(args []string) []string {
+			if args[1] == "" {
+				return []string{fmt.Sprintf("ALTER EXTENSION %s UPDATE", common.QuoteIdentifier(args[0]))}
+			}
+			return []string{fmt.Sprintf("ALTER EXTENSION %s UPDATE TO %s", common.QuoteIdentifier(args[0]), common.QuoteLiteral(args[1]))}
+		}),
+	namedOperation(common.SQLCommand, "slot-create", defaultTimeout, false, []argKind{literalArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("SELECT pg_create_physical_replication_slot(%s, true)", common.QuoteLiteral(args[0]))}
+		}),
+	namedOperation(common.SQLCommand, "slot-drop", defaultTimeout, false, []argKind{literalArg}, false,
+		func(args []string) []string {
+			return []string{fmt.Sprintf("SELECT pg_drop_replication_slot(%s)", common.QuoteLiteral(args[0]))}
+		}),
+	namedOperation(common.SQLCommand, "migration-init", defaultTimeout, false, nil, false,
+		func(_ []string) []string {
+			return []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version text PRIMARY KEY, checksum text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())", MigrationTable)}
+		}),
+	// migration-apply 在单个事务中执行迁移脚本并记录版本，参数依次为版本与校验和
+	scriptOperation("migration-apply", maxTimeout, []argKind{literalArg, literalArg},
+		func(script string, args []string) string {
+			// 脚本末行可能是注释，结束符另起一行
+			return fmt.Sprintf("%s\n;\nINSERT INTO %s (version, checksum) VALUES (%s, %s);\n",
+				script, MigrationTable, common.QuoteLiteral(args[0]), common.QuoteLiteral(args[1]))
+		}),
+	// clone-script 克隆恢复完成后在单个事务中执行脱敏脚本
+	scriptOperation("clone-script", maxTimeout, nil,
+		func(script string, _ []string) string {
+			return script
+		}),
+	queryOperation("migration-list", fmt.Sprintf("SELECT version, checksum FROM %s ORDER BY version", MigrationTable), 0),
+	queryOperation("database-encoding", "SELECT pg_encoding_to_char(encoding) FROM pg_database WHERE datname = %s", 1),
+	queryOperation("preload-libraries", "SHOW shared_preload_libraries", 0),
+	// extension-available 参数依次为扩展与版本，版本为空时不限版本，可用时返回1
+	namedOperation(common.DiagnosticCommand, "extension-available", defaultTimeout, false, []argKind{literalArg, literalArg}, false,
+		func(args []string) []string {
+			statement := fmt.Sprintf("SELECT 1 FROM pg_available_extension_versions WHERE name = %s", common.QuoteLiteral(args[0]))
+			if args[1] != "" {
+				statement = fmt.Sprintf("%s AND version = %s", statement, common.QuoteLiteral(args[1]))
+			}
+			return []string{statement + " LIMIT 1"}
+		}),
+	queryOperation("extension-version", "SELECT extversion FROM pg_extension WHERE extname = %s", 1),
+	queryOperation("replication-slots", "SELECT slot_name, active FROM pg_replication_slots WHERE slot_type = 'physical'", 0),
+	queryOperation("replication-state", "SELECT application_name, state FROM pg_stat_replication", 0),
+	// replication-lag 主节点当前WAL位置与指定成员回放位置的差，成员未连接时无结果
+	queryOperation("replication-lag", "SELECT COALESCE(pg_current_wal_lsn() - replay_lsn, -1) FROM pg_stat_replication WHERE application_name = %s", 1),
+	queryOperation("current-lsn", "SELECT pg_current_wal_lsn()", 0),
+	// hba-header 受管pg_hba.conf的首行，记录内容摘要
+	queryOperation("hba-header", "SELECT split_part(pg_read_file(current_setting('hba_file')), E'\\n', 1)", 0),
+	queryOperation("hba-errors", "SELECT count(*) FROM pg_hba_file_rules WHERE error IS NOT NULL", 0),
+}
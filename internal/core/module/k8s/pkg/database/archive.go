@@ -0,0 +1,279 @@
+package database
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+const (
+	archiveVolumeName  = "archive"
+	recoveryVolumeName = "recovery"
+
+	// archiveStagingDir S3归档时WAL暂存在数据卷中，由archiver上传后删除
+	archiveStagingDir = "archive_staging"
+	// recoveryDir S3恢复时基础备份与WAL下载到数据卷中
+	recoveryDir = "recovery"
+
+	// archiveTimeout 强制切换WAL的间隔，限制归档的数据丢失窗口，单位秒
+	archiveTimeout = 60
+)
+
+// archiveCommand 参数依次为WAL路径、WAL文件名与归档目录，已归档的文件内容一致时视为成功
+const archiveCommand = `sh -c 'mkdir -p "$2" && if [ -f "$2/$1" ]; then cmp -s "$0" "$2/$1"; else cp "$0" "$2/$1.tmp" && mv "$2/$1.tmp" "$2/$1"; fi' %%p %%f %s`
+
+// archiverScript 将暂存目录中的WAL上传到S3兼容存储，上传成功后删除
+const archiverScript = `set -eu
+mc_opts="--config-dir /tmp/mc"
+if [ "$S3_INSECURE" = "true" ]; then
+  mc_opts="$mc_opts --insecure"
+fi
+mc $mc_opts alias set target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" > /dev/null
+while true; do
+  for f in "$STAGING_DIR"/*; do
+    [ -f "$f" ] || continue
+    case "$f" in
+      *.tmp) continue ;;
+    esac
+    if mc $mc_opts cp "$f" "target/$S3_BUCKET/$S3_WAL_PREFIX$(basename "$f")" > /dev/null; then
+      rm -f "$f"
+    fi
+  done
+  sleep 10
+done
+`
+
+// fetchArchiveScript 数据目录为空时从S3兼容存储下载基础备份与源实例的WAL
+const fetchArchiveScript = `set -eu
+if [ -f "$PGDATA/PG_VERSION" ]; then
+  exit 0
+fi
+mc_opts="--config-dir /tmp/mc"
+if [ "$S3_INSECURE" = "true" ]; then
+  mc_opts="$mc_opts --insecure"
+fi
+mc $mc_opts alias set target "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" > /dev/null
+mkdir -p "$RECOVERY_DIR/wal"
+mc $mc_opts cp "target/$S3_BUCKET/$S3_BASE_BACKUP" "$BASE_BACKUP" > /dev/null
+mc $mc_opts mirror --overwrite "target/$S3_BUCKET/$S3_WAL_PREFIX" "$RECOVERY_DIR/wal" > /dev/null
+`
+
+// restoreBaseScript 数据目录为空时解压基础备份并进入归档恢复，解压完成后才替换数据目录
+const restoreBaseScript = `set -eu
+if [ -f "$PGDATA/PG_VERSION" ]; then
+  exit 0
+fi
+rm -rf "$PGDATA.restore"
+mkdir -p "$PGDATA.restore"
+case "$BASE_BACKUP" in
+  *.zst) zstd -q -d -c "$BASE_BACKUP" | tar -x -C "$PGDATA.restore" ;;
+  *) tar -xzf "$BASE_BACKUP" -C "$PGDATA.restore" ;;
+esac
+touch "$PGDATA.restore/recovery.signal"
+chmod 0700 "$PGDATA.restore"
+rm -rf "$PGDATA"
+mv "$PGDATA.restore" "$PGDATA"
+if [ "$REMOVE_BASE_BACKUP" = "true" ]; then
+  rm -f "$BASE_BACKUP"
+fi
+`
+
+func getDataDir(serviceInfo *common.ServiceInfo) string {
+	return path.Join(serviceInfo.Volumes.DataPath.Value, common.PostgreSQLDataDir)
+}
+
+// getArchiveDir 数据库容器内的WAL归档目录
+func getArchiveDir(serviceInfo *common.ServiceInfo) string {
+	if serviceInfo.Archive.S3 != nil {
+		return path.Join(serviceInfo.Volumes.DataPath.Value, archiveStagingDir)
+	}
+
+	return path.Join(common.ArchivePath, serviceInfo.Archive.GetWALPath(serviceInfo.Name))
+}
+
+// getRecoveryWALDir 数据库容器内源实例的WAL目录
+func getRecoveryWALDir(serviceInfo *common.ServiceInfo) string {
+	recoveryPtr := serviceInfo.Recovery
+	if recoveryPtr.S3 != nil {
+		return path.Join(serviceInfo.Volumes.DataPath.Value, recoveryDir, "wal")
+	}
+
+	return path.Join(common.RecoveryPath, recoveryPtr.GetWALPath(recoveryPtr.Source))
+}
+
+func getBaseBackupFile(serviceInfo *common.ServiceInfo) string {
+	recoveryPtr := serviceInfo.Recovery
+	if recoveryPtr.S3 != nil {
+		return path.Join(serviceInfo.Volumes.DataPath.Value, recoveryDir, path.Base(recoveryPtr.BaseBackup))
+	}
+
+	return path.Join(common.RecoveryPath, recoveryPtr.BaseBackup)
+}
+
+// getArchiveParameters WAL归档与恢复所需的启动参数，恢复参数在恢复完成后不再生效
+func getArchiveParameters(serviceInfo *common.ServiceInfo) (ret map[string]string) {
+	ret = map[string]string{}
+	if serviceInfo.Archive != nil {
+		ret["archive_mode"] = "on"
+		ret["archive_timeout"] = strconv.Itoa(archiveTimeout)
+		ret["archive_command"] = fmt.Sprintf(archiveCommand, getArchiveDir(serviceInfo))
+	}
+	if serviceInfo.Recovery != nil {
+		ret["restore_command"] = fmt.Sprintf("cp %s/%%f %%p", getRecoveryWALDir(serviceInfo))
+		ret["recovery_target_action"] = "promote"
+		switch {
+		case serviceInfo.Recovery.TargetLSN != "":
+			ret["recovery_target_lsn"] = serviceInfo.Recovery.TargetLSN
+		case serviceInfo.Recovery.TargetTime != "":
+			ret["recovery_target_time"] = serviceInfo.Recovery.TargetTime
+		}
+	}
+
+	return
+}
+
+// getRecoveryVolumeName 恢复与归档使用同一PVC时共用数据卷
+func getRecoveryVolumeName(serviceInfo *common.ServiceInfo) string {
+	if serviceInfo.Archive != nil && serviceInfo.Archive.PVC != nil &&
+		serviceInfo.Archive.PVC.ClaimName == serviceInfo.Recovery.PVC.ClaimName {
+		return archiveVolumeName
+	}
+
+	return recoveryVolumeName
+}
+
+func getArchiveVolumes(serviceInfo *common.ServiceInfo) (ret []corev1.Volume) {
+	pvcVolume := func(name, claimName string) corev1.Volume {
+		return corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+			},
+		}
+	}
+
+	if serviceInfo.Archive != nil && serviceInfo.Archive.PVC != nil {
+		ret = append(ret, pvcVolume(archiveVolumeName, serviceInfo.Archive.PVC.ClaimName))
+	}
+	if serviceInfo.Recovery != nil && serviceInfo.Recovery.PVC != nil && getRecoveryVolumeName(serviceInfo) == recoveryVolumeName {
+		ret = append(ret, pvcVolume(recoveryVolumeName, serviceInfo.Recovery.PVC.ClaimName))
+	}
+	return
+}
+
+func getArchiveVolumeMounts(serviceInfo *common.ServiceInfo) (ret []corev1.VolumeMount) {
+	if serviceInfo.Archive != nil && serviceInfo.Archive.PVC != nil {
+		ret = append(ret, corev1.VolumeMount{Name: archiveVolumeName, MountPath: common.ArchivePath})
+	}
+	if serviceInfo.Recovery != nil && serviceInfo.Recovery.PVC != nil {
+		ret = append(ret, corev1.VolumeMount{Name: getRecoveryVolumeName(serviceInfo), MountPath: common.RecoveryPath, ReadOnly: true})
+	}
+	return
+}
+
+func secretEnv(name, secret, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+func configMapEnv(name, configMap, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMap},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+func getS3Env(storage *common.S3Storage) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "S3_ENDPOINT", Value: storage.Endpoint},
+		{Name: "S3_BUCKET", Value: storage.Bucket},
+		{Name: "S3_INSECURE", Value: strconv.FormatBool(storage.Insecure)},
+		secretEnv("S3_ACCESS_KEY", storage.Secret, "accessKey"),
+		secretEnv("S3_SECRET_KEY", storage.Secret, "secretKey"),
+	}
+}
+
+// getRecoveryInitContainers 首次启动前准备恢复所需的数据目录，S3时先下载基础备份与WAL
+func getRecoveryInitContainers(serviceInfo *common.ServiceInfo) (ret []corev1.Container) {
+	recoveryPtr := serviceInfo.Recovery
+	if recoveryPtr == nil {
+		return
+	}
+
+	baseBackup := getBaseBackupFile(serviceInfo)
+	if recoveryPtr.S3 != nil {
+		env := getS3Env(recoveryPtr.S3)
+		env = append(env,
+			corev1.EnvVar{Name: "PGDATA", Value: getDataDir(serviceInfo)},
+			corev1.EnvVar{Name: "RECOVERY_DIR", Value: path.Join(serviceInfo.Volumes.DataPath.Value, recoveryDir)},
+			corev1.EnvVar{Name: "BASE_BACKUP", Value: baseBackup},
+			corev1.EnvVar{Name: "S3_BASE_BACKUP", Value: recoveryPtr.BaseBackup},
+			corev1.EnvVar{Name: "S3_WAL_PREFIX", Value: recoveryPtr.GetWALPath(recoveryPtr.Source)},
+		)
+		ret = append(ret, corev1.Container{
+			Name:            "fetch-archive",
+			Image:           recoveryPtr.Image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"sh", "-c", fetchArchiveScript},
+			Env:             env,
+			VolumeMounts:    GetVolumeMounts(serviceInfo),
+			SecurityContext: GetContainerSecurityContext(serviceInfo),
+		})
+	}
+
+	ret = append(ret, corev1.Container{
+		Name:            "restore-base",
+		Image:           serviceInfo.Image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", restoreBaseScript},
+		Env: []corev1.EnvVar{
+			{Name: "PGDATA", Value: getDataDir(serviceInfo)},
+			{Name: "BASE_BACKUP", Value: baseBackup},
+			{Name: "REMOVE_BASE_BACKUP", Value: strconv.FormatBool(recoveryPtr.S3 != nil)},
+		},
+		VolumeMounts:    append(GetVolumeMounts(serviceInfo), getArchiveVolumeMounts(serviceInfo)...),
+		SecurityContext: GetContainerSecurityContext(serviceInfo),
+	})
+	return
+}
+
+// getArchiverContainers S3归档时上传WAL的sidecar
+func getArchiverContainers(serviceInfo *common.ServiceInfo) (ret []corev1.Container) {
+	if serviceInfo.Archive == nil || serviceInfo.Archive.S3 == nil {
+		return
+	}
+
+	env := getS3Env(serviceInfo.Archive.S3)
+	env = append(env,
+		corev1.EnvVar{Name: "STAGING_DIR", Value: getArchiveDir(serviceInfo)},
+		corev1.EnvVar{Name: "S3_WAL_PREFIX", Value: serviceInfo.Archive.GetWALPath(serviceInfo.Name)},
+	)
+	ret = []corev1.Container{
+		{
+			Name:            "archiver",
+			Image:           serviceInfo.Archive.Image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"sh", "-c", archiverScript},
+			Env:             env,
+			VolumeMounts:    GetVolumeMounts(serviceInfo),
+			SecurityContext: GetContainerSecurityContext(serviceInfo),
+		},
+	}
+	return
+}
@@ -1,6 +1,12 @@
 package database
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
 	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
@@ -10,6 +16,14 @@ import (
 	"supos.ai/operator/database/pkg/common"
 )
 
+func boolPtr(val bool) *bool {
+	return &val
+}
+
+func int64Ptr(val int64) *int64 {
+	return &val
+}
+
 func GetContainerPorts(serviceInfo *common.ServiceInfo) (ret []corev1.ContainerPort) {
 	ret = []corev1.ContainerPort{
 		{
@@ -25,6 +39,11 @@ func GetContainerPorts(serviceInfo *common.ServiceInfo) (ret []corev1.ContainerP
 func GetEnv(serviceInfo *common.ServiceInfo) (ret []corev1.EnvVar) {
 	ret = []corev1.EnvVar{}
 	for _, val := range serviceInfo.Env.Items {
+		if val.Secret != "" {
+			ret = append(ret, secretEnv(val.Name, val.Secret, val.Key))
+			continue
+		}
+
 		ret = append(ret, corev1.EnvVar{
 			Name:  val.Name,
 			Value: val.Value,
@@ -34,6 +53,7 @@ func GetEnv(serviceInfo *common.ServiceInfo) (ret []corev1.EnvVar) {
 	return
 }
 
+// GetResources 数据库容器的requests与limits，取值由数据库模块校验并补全默认值
 func GetResources(serviceInfo *common.ServiceInfo) (ret corev1.ResourceRequirements) {
 	resourceQuantity := func(quantity string) resourcev1.Quantity {
 		r, _ := resourcev1.ParseQuantity(quantity)
@@ -46,14 +66,16 @@ func GetResources(serviceInfo *common.ServiceInfo) (ret corev1.ResourceRequireme
 			corev1.ResourceMemory: resourceQuantity(serviceInfo.Spec.Memory),
 		},
 		Requests: corev1.ResourceList{
-			corev1.ResourceCPU:    resourceQuantity("100m"),
-			corev1.ResourceMemory: resourceQuantity("64Mi"),
+			corev1.ResourceCPU:    resourceQuantity(serviceInfo.Spec.RequestCPU),
+			corev1.ResourceMemory: resourceQuantity(serviceInfo.Spec.RequestMemory),
 		},
 	}
 
 	return
 }
 
+const configVolumeName = "config"
+
 func GetVolumeMounts(serviceInfo *common.ServiceInfo) (ret []corev1.VolumeMount) {
 	ret = []corev1.VolumeMount{
 		{
@@ -64,16 +86,166 @@ func GetVolumeMounts(serviceInfo *common.ServiceInfo) (ret []corev1.VolumeMount)
 	return
 }
 
+// GetContainerVolumeMounts 数据库容器额外挂载受管配置，配置内容变化不影响Pod模板
+func GetContainerVolumeMounts(serviceInfo *common.ServiceInfo) (ret []corev1.VolumeMount) {
+	ret = GetVolumeMounts(serviceInfo)
+	if len(serviceInfo.Config) > 0 {
+		ret = append(ret, corev1.VolumeMount{
+			Name:      configVolumeName,
+			MountPath: common.ConfigPath,
+			ReadOnly:  true,
+		})
+	}
+	ret = append(ret, getArchiveVolumeMounts(serviceInfo)...)
+	return
+}
+
+func GetContainerSecurityContext(serviceInfo *common.ServiceInfo) (ret *corev1.SecurityContext) {
+	if serviceInfo.Security == nil {
+		return
+	}
+
+	ret = &corev1.SecurityContext{
+		RunAsNonRoot:             boolPtr(true),
+		RunAsUser:                int64Ptr(serviceInfo.Security.RunAsUser),
+		RunAsGroup:               int64Ptr(serviceInfo.Security.RunAsGroup),
+		AllowPrivilegeEscalation: boolPtr(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+	return
+}
+
+// GetArgs 启动参数以-c形式传递给postgres，按参数名排序保证模板稳定
+func GetArgs(serviceInfo *common.ServiceInfo) (ret []string) {
+	if serviceInfo.Catalog != common.PostgreSQL {
+		return
+	}
+
+	parameters := getArchiveParameters(serviceInfo)
+	for k, v := range getReplicationParameters(serviceInfo) {
+		parameters[k] = v
+	}
+	for k, v := range serviceInfo.Parameters {
+		parameters[k] = v
+	}
+	if len(parameters) == 0 {
+		return
+	}
+
+	keys := []string{}
+	for k := range parameters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret = []string{"postgres"}
+	for _, k := range keys {
+		ret = append(ret, "-c", fmt.Sprintf("%s=%s", k, parameters[k]))
+	}
+	return
+}
+
 func GetContainer(serviceInfo *common.ServiceInfo) (ret []corev1.Container) {
 	ret = []corev1.Container{
 		{
 			Name:            serviceInfo.Name,
 			Image:           serviceInfo.Image,
 			ImagePullPolicy: corev1.PullIfNotPresent,
+			Args:            GetArgs(serviceInfo),
 			Ports:           GetContainerPorts(serviceInfo),
 			Env:             GetEnv(serviceInfo),
 			Resources:       GetResources(serviceInfo),
+			VolumeMounts:    GetContainerVolumeMounts(serviceInfo),
+			SecurityContext: GetContainerSecurityContext(serviceInfo),
+		},
+	}
+	ret = append(ret, getArchiverContainers(serviceInfo)...)
+	return
+}
+
+// prepareDataScript 将旧数据卷根目录下的数据迁移到数据子目录，并修正目录权限
+const prepareDataScript = `set -e
+cd "$DATA_ROOT"
+if [ -n "$DATA_OWNER" ]; then
+  chown -R "$DATA_OWNER" "$DATA_ROOT"
+fi
+if [ -f PG_VERSION ] && [ ! -e "$DATA_DIR" ]; then
+  mkdir "$DATA_DIR.tmp"
+  for f in *; do
+    case "$f" in
+      "$DATA_DIR.tmp"|lost+found) ;;
+      *) mv "$f" "$DATA_DIR.tmp/" ;;
+    esac
+  done
+  mv "$DATA_DIR.tmp" "$DATA_DIR"
+fi
+mkdir -p "$DATA_DIR"
+chmod 0700 "$DATA_DIR"
+`
+
+// GetInitContainers 准备数据目录，默认以非root身份运行，开启FixPermissions时以root身份修正属主
+func GetInitContainers(serviceInfo *common.ServiceInfo) (ret []corev1.Container) {
+	if serviceInfo.Security == nil {
+		return
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "DATA_ROOT", Value: serviceInfo.Volumes.DataPath.Value},
+		{Name: "DATA_DIR", Value: common.PostgreSQLDataDir},
+	}
+	securityContext := GetContainerSecurityContext(serviceInfo)
+	if serviceInfo.Security.FixPermissions {
+		env = append(env, corev1.EnvVar{
+			Name:  "DATA_OWNER",
+			Value: fmt.Sprintf("%d:%d", serviceInfo.Security.RunAsUser, serviceInfo.Security.RunAsGroup),
+		})
+		securityContext = &corev1.SecurityContext{
+			RunAsNonRoot:             boolPtr(false),
+			RunAsUser:                int64Ptr(0),
+			AllowPrivilegeEscalation: boolPtr(false),
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"CHOWN", "FOWNER", "DAC_OVERRIDE"},
+			},
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			},
+		}
+	}
+
+	ret = []corev1.Container{
+		{
+			Name:            "prepare-data",
+			Image:           serviceInfo.Image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"sh", "-c", prepareDataScript},
+			Env:             env,
 			VolumeMounts:    GetVolumeMounts(serviceInfo),
+			SecurityContext: securityContext,
+		},
+	}
+	return
+}
+
+func GetPodSecurityContext(serviceInfo *common.ServiceInfo) (ret *corev1.PodSecurityContext) {
+	if serviceInfo.Security == nil {
+		return
+	}
+
+	fsGroupChangePolicy := corev1.FSGroupChangeOnRootMismatch
+	ret = &corev1.PodSecurityContext{
+		RunAsNonRoot:        boolPtr(true),
+		RunAsUser:           int64Ptr(serviceInfo.Security.RunAsUser),
+		RunAsGroup:          int64Ptr(serviceInfo.Security.RunAsGroup),
+		FSGroup:             int64Ptr(serviceInfo.Security.FSGroup),
+		FSGroupChangePolicy: &fsGroupChangePolicy,
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
 		},
 	}
 	return
@@ -90,35 +262,108 @@ func GetVolumes(serviceInfo *common.ServiceInfo) (ret []corev1.Volume) {
 			},
 		},
 	}
+	if len(serviceInfo.Config) > 0 {
+		ret = append(ret, corev1.Volume{
+			Name: configVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: serviceInfo.GetConfigName(),
+					},
+				},
+			},
+		})
+	}
+	ret = append(ret, getArchiveVolumes(serviceInfo)...)
+	return
+}
+
+// GetConfigMap 未配置受管配置文件时返回nil
+func GetConfigMap(serviceInfo *common.ServiceInfo) (ret *corev1.ConfigMap) {
+	if len(serviceInfo.Config) == 0 {
+		return
+	}
+
+	ret = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceInfo.GetConfigName(),
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+		},
+		Data: serviceInfo.Config,
+	}
 	return
 }
 
-func GetPodTemplate(serviceInfo *common.ServiceInfo) (ret corev1.PodTemplateSpec) {
+// GetPodTemplate 成员的Pod模板，与成员的复制角色无关，主备切换不会更新模板
+// 开启流复制时各成员在启动前确认角色，备节点从主节点复制数据目录
+func GetPodTemplate(serviceInfo *common.ServiceInfo, member string) (ret corev1.PodTemplateSpec) {
+	memberInfo := getMemberInfo(serviceInfo, member)
+	initContainers := append(GetInitContainers(memberInfo), getRecoveryInitContainers(memberInfo)...)
 	ret = corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Labels: serviceInfo.Labels,
+			Labels: GetMemberLabels(serviceInfo, member),
 		},
 		Spec: corev1.PodSpec{
-			Containers: GetContainer(serviceInfo),
-			Volumes:    GetVolumes(serviceInfo),
+			InitContainers:               append(initContainers, getReplicationInitContainers(memberInfo, member)...),
+			Containers:                   GetContainer(memberInfo),
+			Volumes:                      GetVolumes(memberInfo),
+			SecurityContext:              GetPodSecurityContext(memberInfo),
+			AutomountServiceAccountToken: boolPtr(false),
+			Affinity:                     GetAffinity(serviceInfo),
+			TopologySpreadConstraints:    GetTopologySpreadConstraints(serviceInfo),
 		},
 	}
+	applyScheduling(serviceInfo, &ret.Spec)
+	if serviceInfo.Security != nil {
+		ret.Spec.ServiceAccountName = serviceInfo.Security.ServiceAccount
+	}
 	return
 }
 
-func GetDeployment(serviceInfo *common.ServiceInfo) (ret *appv1.Deployment) {
+// TemplateHashAnnotation 记录生成Pod模板时的摘要，用于判断模板是否需要更新
+const TemplateHashAnnotation = "database.supos.ai/template-hash"
+
+// FencedAnnotation 标记被隔离的成员Deployment，解除隔离时据此恢复副本数
+const FencedAnnotation = "database.supos.ai/fenced"
+
+// RoleAnnotation 记录成员Deployment当前的复制角色，运行中的Pod据此更新角色标签
+const RoleAnnotation = "database.supos.ai/role"
+
+// GetTemplateHash 计算Pod模板摘要
+func GetTemplateHash(template *corev1.PodTemplateSpec) string {
+	byteVal, _ := json.Marshal(template)
+	hashVal := sha256.Sum256(byteVal)
+	return hex.EncodeToString(hashVal[:8])
+}
+
+// GetDeployment 成员的Deployment，每个成员只运行一个Pod，多个数据库进程不能共用同一数据目录
+func GetDeployment(serviceInfo *common.ServiceInfo, member string) (ret *appv1.Deployment) {
+	template := GetPodTemplate(serviceInfo, member)
+	replicas := serviceInfo.Replicas
+	if replicas > 1 {
+		replicas = 1
+	}
+	if IsFencedMember(serviceInfo, member) {
+		replicas = 0
+	}
+
 	ret = &appv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      serviceInfo.Name,
+			Name:      member,
 			Namespace: serviceInfo.Namespace,
 			Labels:    serviceInfo.Labels,
+			Annotations: map[string]string{
+				TemplateHashAnnotation: GetTemplateHash(&template),
+				RoleAnnotation:         serviceInfo.GetRole(member),
+			},
 		},
 		Spec: appv1.DeploymentSpec{
-			Replicas: &serviceInfo.Replicas,
+			Replicas: &replicas,
 			Selector: &metav1.LabelSelector{
-				MatchLabels: serviceInfo.Labels,
+				MatchLabels: GetMemberLabels(serviceInfo, member),
 			},
-			Template: GetPodTemplate(serviceInfo),
+			Template: template,
 			Strategy: appv1.DeploymentStrategy{
 				Type: appv1.RecreateDeploymentStrategyType,
 			},
@@ -144,22 +389,17 @@ func GetServicePorts(serviceInfo *common.ServiceInfo) (ret []corev1.ServicePort)
 	return
 }
 
+// GetService 实例同名Service，与读写Service一致只选择主节点
 func GetService(serviceInfo *common.ServiceInfo) (ret *corev1.Service) {
-	ret = &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      serviceInfo.Name,
-			Namespace: serviceInfo.Namespace,
-			Labels:    serviceInfo.Labels,
-		},
-		Spec: corev1.ServiceSpec{
-			Ports: GetServicePorts(serviceInfo),
-			Type:  corev1.ServiceTypeClusterIP,
-		},
-	}
+	ret = getRoleService(serviceInfo, serviceInfo.Name, common.RolePrimary)
 	return
 }
 
-func GetPersistentVolumeClaims(serviceInfo *common.ServiceInfo) (ret *corev1.PersistentVolumeClaim) {
+// SnapshotGroup VolumeSnapshot所在的API组
+const SnapshotGroup = "snapshot.storage.k8s.io"
+
+// GetPersistentVolumeClaims 成员的数据卷，local-path存储绑定同名PV，其他存储类动态创建，指定快照时以快照作为数据来源
+func GetPersistentVolumeClaims(serviceInfo *common.ServiceInfo, member string) (ret *corev1.PersistentVolumeClaim) {
 	resourceQuantity := func(quantity string) resourcev1.Quantity {
 		r, _ := resourcev1.ParseQuantity(quantity)
 		return r
@@ -173,26 +413,42 @@ func GetPersistentVolumeClaims(serviceInfo *common.ServiceInfo) (ret *corev1.Per
 		return &volumeVal
 	}
 
+	serviceInfo = getMemberInfo(serviceInfo, member)
+	dataSize := serviceInfo.Volumes.DataSize
+	if dataSize == "" {
+		dataSize = common.DefaultDataSize
+	}
+
 	ret = &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      serviceInfo.Name,
+			Name:      member,
 			Namespace: serviceInfo.Namespace,
 			Labels:    serviceInfo.Labels,
 		},
 		Spec: corev1.PersistentVolumeClaimSpec{
 			AccessModes: []corev1.PersistentVolumeAccessMode{
-				corev1.ReadWriteMany,
+				corev1.ReadWriteOnce,
 			},
 			Resources: corev1.VolumeResourceRequirements{
 				Requests: corev1.ResourceList{
-					corev1.ResourceStorage: resourceQuantity("10Gi"),
+					corev1.ResourceStorage: resourceQuantity(dataSize),
 				},
 			},
 			StorageClassName: storageClassName(serviceInfo.Volumes.DataPath.Type),
-			VolumeName:       serviceInfo.Name,
 			VolumeMode:       volumeModeFileSystem(),
 		},
 	}
+	if serviceInfo.Volumes.DataPath.Type == common.LocalPath {
+		ret.Spec.VolumeName = member
+	}
+	if serviceInfo.Volumes.DataSnapshot != "" {
+		apiGroup := SnapshotGroup
+		ret.Spec.DataSource = &corev1.TypedLocalObjectReference{
+			APIGroup: &apiGroup,
+			Kind:     "VolumeSnapshot",
+			Name:     serviceInfo.Volumes.DataSnapshot,
+		}
+	}
 
 	return
 }
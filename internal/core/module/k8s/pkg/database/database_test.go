@@ -0,0 +1,69 @@
+package database
+
+import (
+	"sort"
+	"testing"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+func TestGetResources(t *testing.T) {
+	cases := []struct {
+		name   string
+		spec   common.Spec
+		expect []string
+	}{
+		{name: "default", spec: common.PostgreSQLDefaultSpec, expect: []string{"2", "4Gi", "100m", "64Mi"}},
+		{name: "custom", spec: common.Spec{CPU: "500m", Memory: "1Gi", RequestCPU: "250m", RequestMemory: "512Mi"}, expect: []string{"500m", "1Gi", "250m", "512Mi"}},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		serviceInfo.Spec = &c.spec
+		resources := GetResources(serviceInfo)
+		values := []string{
+			resources.Limits.Cpu().String(),
+			resources.Limits.Memory().String(),
+			resources.Requests.Cpu().String(),
+			resources.Requests.Memory().String(),
+		}
+		for idx := range values {
+			if values[idx] != c.expect[idx] {
+				t.Errorf("%s: resources %v, expect %v", c.name, values, c.expect)
+				break
+			}
+		}
+
+		containers := GetContainer(serviceInfo)
+		if !containers[0].Resources.Limits.Memory().Equal(*resources.Limits.Memory()) {
+			t.Errorf("%s: container resources %+v, expect %+v", c.name, containers[0].Resources, resources)
+		}
+	}
+}
+
+// TestGetArgs 启动参数按名称排序，实例定义的参数覆盖流复制所需的默认值
+func TestGetArgs(t *testing.T) {
+	serviceInfo := common.NewPostgreSQLService("db", "default")
+	serviceInfo.Replication = &common.Replication{Standbys: 1}
+	serviceInfo.Parameters = map[string]string{"wal_log_hints": "off", "max_connections": "200"}
+	args := GetArgs(serviceInfo)
+	if len(args) == 0 || args[0] != "postgres" {
+		t.Fatalf("illegal args %v", args)
+	}
+
+	parameters := []string{}
+	for idx := 1; idx < len(args); idx += 2 {
+		if args[idx] != "-c" || idx+1 == len(args) {
+			t.Fatalf("illegal args %v", args)
+		}
+		parameters = append(parameters, args[idx+1])
+	}
+	if !sort.StringsAreSorted(parameters) {
+		t.Fatalf("args not sorted, args:%v", args)
+	}
+	for _, val := range []string{"max_connections=200", "wal_log_hints=off"} {
+		idx := sort.SearchStrings(parameters, val)
+		if idx == len(parameters) || parameters[idx] != val {
+			t.Errorf("args %v missing %s", args, val)
+		}
+	}
+}
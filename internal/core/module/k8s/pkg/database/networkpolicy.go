@@ -0,0 +1,99 @@
+package database
+
+import (
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+)
+
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+func namespacePeer(namespace string, podLabels map[string]string) networkingv1.NetworkPolicyPeer {
+	ret := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{namespaceNameLabel: namespace},
+		},
+	}
+	if len(podLabels) > 0 {
+		ret.PodSelector = &metav1.LabelSelector{MatchLabels: podLabels}
+	}
+
+	return ret
+}
+
+// GetNetworkPolicyPeers 允许访问实例的来源，operator、备份任务与监控采集端始终允许，开启流复制时允许实例成员之间互相访问
+// 部署连接池时允许连接池访问数据库
+func GetNetworkPolicyPeers(serviceInfo *common.ServiceInfo, operatorNamespace string) (ret []networkingv1.NetworkPolicyPeer) {
+	policyConfig := config.GetNetworkPolicyConfig()
+	ret = append(ret, namespacePeer(operatorNamespace, policyConfig.OperatorLabels))
+	ret = append(ret, networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{common.BackupLabel: serviceInfo.Name},
+		},
+	})
+	if serviceInfo.Replication != nil && serviceInfo.Replication.Standbys > 0 {
+		ret = append(ret, networkingv1.NetworkPolicyPeer{
+			PodSelector: &metav1.LabelSelector{MatchLabels: serviceInfo.Labels},
+		})
+	}
+	if serviceInfo.Pooler != nil {
+		ret = append(ret, networkingv1.NetworkPolicyPeer{
+			PodSelector: &metav1.LabelSelector{MatchLabels: GetPoolerLabels(serviceInfo)},
+		})
+	}
+	if policyConfig.ScraperNamespace != "" {
+		ret = append(ret, namespacePeer(policyConfig.ScraperNamespace, policyConfig.ScraperLabels))
+	}
+
+	for _, val := range serviceInfo.Access.Namespaces {
+		ret = append(ret, namespacePeer(val, nil))
+	}
+	for _, val := range serviceInfo.Access.PodSelectors {
+		ret = append(ret, networkingv1.NetworkPolicyPeer{
+			PodSelector: &metav1.LabelSelector{MatchLabels: val},
+		})
+	}
+	for _, val := range serviceInfo.Access.CIDRs {
+		ret = append(ret, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: val},
+		})
+	}
+
+	return
+}
+
+func hasAccessRules(access *common.Access) bool {
+	return len(access.Namespaces) > 0 || len(access.PodSelectors) > 0 || len(access.CIDRs) > 0
+}
+
+// GetNetworkPolicy 未配置访问控制时返回nil，表示不限制访问
+func GetNetworkPolicy(serviceInfo *common.ServiceInfo, operatorNamespace string) (ret *networkingv1.NetworkPolicy) {
+	if serviceInfo.Access == nil || (!serviceInfo.Access.DefaultDeny && !hasAccessRules(serviceInfo.Access)) {
+		return
+	}
+
+	ret = &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceInfo.Name,
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: serviceInfo.Labels,
+			},
+			PolicyTypes: []networkingv1.PolicyType{
+				networkingv1.PolicyTypeIngress,
+			},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: GetNetworkPolicyPeers(serviceInfo, operatorNamespace),
+				},
+			},
+		},
+	}
+
+	return
+}
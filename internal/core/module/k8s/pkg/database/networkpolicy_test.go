@@ -0,0 +1,99 @@
+package database
+
+import (
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+// peerKind 便于比较的来源描述，依次为命名空间、Pod标签与CIDR
+func peerKind(peer networkingv1.NetworkPolicyPeer) (namespace string, podLabels map[string]string, cidr string) {
+	if peer.NamespaceSelector != nil {
+		namespace = peer.NamespaceSelector.MatchLabels[namespaceNameLabel]
+	}
+	if peer.PodSelector != nil {
+		podLabels = peer.PodSelector.MatchLabels
+	}
+	if peer.IPBlock != nil {
+		cidr = peer.IPBlock.CIDR
+	}
+	return
+}
+
+func TestGetNetworkPolicy(t *testing.T) {
+	cases := []struct {
+		name      string
+		access    *common.Access
+		expectNil bool
+		peers     int
+	}{
+		{name: "without access", expectNil: true},
+		{name: "empty access", access: &common.Access{}, expectNil: true},
+		{name: "default deny", access: &common.Access{DefaultDeny: true}, peers: 3},
+		{name: "namespaces", access: &common.Access{Namespaces: []string{"app", "qa"}}, peers: 5},
+		{name: "all rules", access: &common.Access{
+			Namespaces:   []string{"app"},
+			PodSelectors: []common.Labels{{"app": "web"}},
+			CIDRs:        []string{"10.0.0.0/8"},
+		}, peers: 6},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		serviceInfo.Access = c.access
+		policyPtr := GetNetworkPolicy(serviceInfo, "operator")
+		if c.expectNil {
+			if policyPtr != nil {
+				t.Errorf("%s: expect nil policy, got %+v", c.name, policyPtr)
+			}
+			continue
+		}
+		if policyPtr == nil || len(policyPtr.Spec.Ingress) != 1 {
+			t.Errorf("%s: expect one ingress rule, got %+v", c.name, policyPtr)
+			continue
+		}
+		if peers := policyPtr.Spec.Ingress[0].From; len(peers) != c.peers {
+			t.Errorf("%s: peers %d, expect %d", c.name, len(peers), c.peers)
+		}
+	}
+}
+
+// TestGetNetworkPolicyPeers operator、备份任务与监控采集端始终允许，其后依次为命名空间、Pod与CIDR规则
+func TestGetNetworkPolicyPeers(t *testing.T) {
+	serviceInfo := common.NewPostgreSQLService("db", "default")
+	serviceInfo.Access = &common.Access{
+		Namespaces:   []string{"app"},
+		PodSelectors: []common.Labels{{"app": "web"}},
+		CIDRs:        []string{"10.0.0.0/8"},
+	}
+	peers := GetNetworkPolicyPeers(serviceInfo, "operator")
+	expects := []struct {
+		namespace string
+		podLabel  [2]string
+		cidr      string
+	}{
+		{namespace: "operator", podLabel: [2]string{"app.kubernetes.io/name", "database-operator"}},
+		{podLabel: [2]string{common.BackupLabel, "db"}},
+		{namespace: "monitoring", podLabel: [2]string{"app.kubernetes.io/name", "prometheus"}},
+		{namespace: "app"},
+		{podLabel: [2]string{"app", "web"}},
+		{cidr: "10.0.0.0/8"},
+	}
+	if len(peers) != len(expects) {
+		t.Fatalf("peers %d, expect %d, peers:%+v", len(peers), len(expects), peers)
+	}
+	for idx, expect := range expects {
+		namespace, podLabels, cidr := peerKind(peers[idx])
+		if namespace != expect.namespace || cidr != expect.cidr {
+			t.Errorf("peer %d: namespace %s cidr %s, expect %s %s", idx, namespace, cidr, expect.namespace, expect.cidr)
+		}
+		if expect.podLabel[0] != "" && podLabels[expect.podLabel[0]] != expect.podLabel[1] {
+			t.Errorf("peer %d: pod labels %v, expect %s=%s", idx, podLabels, expect.podLabel[0], expect.podLabel[1])
+		}
+		// 只允许命名空间的规则不能限制Pod，否则命名空间内的其他Pod无法访问
+		if expect.podLabel[0] == "" && podLabels != nil {
+			t.Errorf("peer %d: unexpected pod labels %v", idx, podLabels)
+		}
+	}
+}
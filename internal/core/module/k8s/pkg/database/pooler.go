@@ -0,0 +1,182 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	appv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+const (
+	poolerConfigFile   = "pgbouncer.ini"
+	poolerConfigPath   = "/etc/pgbouncer"
+	poolerUserListPath = "/etc/pgbouncer/auth"
+	poolerConfigVolume = "config"
+	poolerAuthVolume   = "auth"
+)
+
+// ConfigHashAnnotation 连接池Pod模板中记录配置与用户列表的摘要，内容变化时滚动重启连接池
+const ConfigHashAnnotation = "database.supos.ai/config-hash"
+
+// GetPoolerLabels 连接池Pod的标签，包含实例标签使实例的NetworkPolicy同样作用于连接池
+func GetPoolerLabels(serviceInfo *common.ServiceInfo) common.Labels {
+	labels := common.Labels{}
+	for k, v := range serviceInfo.Labels {
+		labels[k] = v
+	}
+	labels[common.PoolerLabel] = serviceInfo.GetPoolerName()
+	return labels
+}
+
+// getPoolerConfig pgbouncer.ini，所有数据库都转发到实例的读写Service，口令从用户列表读取
+func getPoolerConfig(serviceInfo *common.ServiceInfo) string {
+	poolerPtr := serviceInfo.Pooler
+	return fmt.Sprintf(`[databases]
+* = host=%s port=%d
+
+[pgbouncer]
+listen_addr = 0.0.0.0
+listen_port = %d
+unix_socket_dir =
+auth_type = scram-sha-256
+auth_file = %s/%s
+pool_mode = %s
+default_pool_size = %d
+max_client_conn = %d
+ignore_startup_parameters = extra_float_digits
+`, serviceInfo.Name, serviceInfo.Svc.Port, serviceInfo.Svc.Port,
+		poolerUserListPath, common.PoolerUserList,
+		poolerPtr.Mode, poolerPtr.PoolSize, poolerPtr.MaxClientConn)
+}
+
+// GetPoolerConfigMap 连接池配置
+func GetPoolerConfigMap(serviceInfo *common.ServiceInfo) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceInfo.GetPoolerName(),
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+		},
+		Data: map[string]string{poolerConfigFile: getPoolerConfig(serviceInfo)},
+	}
+}
+
+func getPoolerConfigHash(serviceInfo *common.ServiceInfo) string {
+	hashVal := sha256.Sum256([]byte(getPoolerConfig(serviceInfo) + serviceInfo.Pooler.UserListHash))
+	return hex.EncodeToString(hashVal[:8])
+}
+
+// GetPoolerPodTemplate 连接池Pod模板，用户列表Secret由数据库模块维护
+func GetPoolerPodTemplate(serviceInfo *common.ServiceInfo) (ret corev1.PodTemplateSpec) {
+	poolerName := serviceInfo.GetPoolerName()
+	ret = corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: GetPoolerLabels(serviceInfo),
+			Annotations: map[string]string{
+				ConfigHashAnnotation: getPoolerConfigHash(serviceInfo),
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:            "pgbouncer",
+					Image:           serviceInfo.Pooler.Image,
+					ImagePullPolicy: corev1.PullIfNotPresent,
+					Command:         []string{"pgbouncer", poolerConfigPath + "/" + poolerConfigFile},
+					Ports:           GetContainerPorts(serviceInfo),
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							TCPSocket: &corev1.TCPSocketAction{
+								Port: intstr.FromInt32(serviceInfo.Svc.Port),
+							},
+						},
+						PeriodSeconds: 10,
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: poolerConfigVolume, MountPath: poolerConfigPath + "/" + poolerConfigFile, SubPath: poolerConfigFile, ReadOnly: true},
+						{Name: poolerAuthVolume, MountPath: poolerUserListPath, ReadOnly: true},
+					},
+					SecurityContext: GetContainerSecurityContext(serviceInfo),
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: poolerConfigVolume,
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: poolerName},
+						},
+					},
+				},
+				{
+					Name: poolerAuthVolume,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{SecretName: poolerName},
+					},
+				},
+			},
+			AutomountServiceAccountToken: boolPtr(false),
+		},
+	}
+	applyScheduling(serviceInfo, &ret.Spec)
+	if serviceInfo.Security != nil {
+		ret.Spec.SecurityContext = &corev1.PodSecurityContext{
+			RunAsNonRoot: boolPtr(true),
+			RunAsUser:    int64Ptr(serviceInfo.Security.RunAsUser),
+			RunAsGroup:   int64Ptr(serviceInfo.Security.RunAsGroup),
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			},
+		}
+	}
+	return
+}
+
+// GetPoolerDeployment 连接池Deployment，对象标签不含连接池标签，实例监听按名称忽略该Deployment
+func GetPoolerDeployment(serviceInfo *common.ServiceInfo) (ret *appv1.Deployment) {
+	template := GetPoolerPodTemplate(serviceInfo)
+	replicas := serviceInfo.Pooler.Replicas
+	ret = &appv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceInfo.GetPoolerName(),
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+			Annotations: map[string]string{
+				TemplateHashAnnotation: GetTemplateHash(&template),
+			},
+		},
+		Spec: appv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: GetPoolerLabels(serviceInfo),
+			},
+			Template: template,
+			Strategy: appv1.DeploymentStrategy{
+				Type: appv1.RollingUpdateDeploymentStrategyType,
+			},
+		},
+	}
+	return
+}
+
+// GetPoolerService 连接池Service
+func GetPoolerService(serviceInfo *common.ServiceInfo) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceInfo.GetPoolerName(),
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports:    GetServicePorts(serviceInfo),
+			Selector: GetPoolerLabels(serviceInfo),
+			Type:     corev1.ServiceTypeClusterIP,
+		},
+	}
+}
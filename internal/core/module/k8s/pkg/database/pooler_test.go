@@ -0,0 +1,118 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+func newPoolerService() *common.ServiceInfo {
+	serviceInfo := common.NewPostgreSQLService("db", "default")
+	serviceInfo.Pooler = &common.Pooler{
+		Image:         "pgbouncer:1.22",
+		Mode:          common.PoolModeTransaction,
+		PoolSize:      20,
+		MaxClientConn: 200,
+		Replicas:      2,
+		UserListHash:  "hash-1",
+	}
+	return serviceInfo
+}
+
+func TestGetPoolerConfig(t *testing.T) {
+	config := getPoolerConfig(newPoolerService())
+	for _, val := range []string{
+		"* = host=db port=5432",
+		"listen_port = 5432",
+		"auth_type = scram-sha-256",
+		"auth_file = " + poolerUserListPath + "/" + common.PoolerUserList,
+		"pool_mode = transaction",
+		"default_pool_size = 20",
+		"max_client_conn = 200",
+	} {
+		if !strings.Contains(config, val+"\n") {
+			t.Errorf("pooler config missing %q:\n%s", val, config)
+		}
+	}
+
+	configMap := GetPoolerConfigMap(newPoolerService())
+	if configMap.Name != "db-pooler" || configMap.Data[poolerConfigFile] != config {
+		t.Fatalf("illegal pooler configmap %+v", configMap)
+	}
+}
+
+func TestGetPoolerLabels(t *testing.T) {
+	serviceInfo := newPoolerService()
+	labels := GetPoolerLabels(serviceInfo)
+	if labels[common.PoolerLabel] != "db-pooler" {
+		t.Fatalf("illegal pooler labels %v", labels)
+	}
+	// 连接池Pod不能被成员的选择器选中
+	if _, memberOK := labels[common.MemberLabel]; memberOK {
+		t.Fatalf("pooler labels contain member label, labels:%v", labels)
+	}
+	if _, poolerOK := serviceInfo.Labels[common.PoolerLabel]; poolerOK {
+		t.Fatalf("instance labels modified, labels:%v", serviceInfo.Labels)
+	}
+}
+
+// TestGetPoolerDeployment 配置或用户列表变化时模板摘要随之变化，触发连接池滚动重启
+func TestGetPoolerDeployment(t *testing.T) {
+	deploymentPtr := GetPoolerDeployment(newPoolerService())
+	if deploymentPtr.Name != "db-pooler" || *deploymentPtr.Spec.Replicas != 2 {
+		t.Fatalf("illegal pooler deployment, name:%s, replicas:%d", deploymentPtr.Name, *deploymentPtr.Spec.Replicas)
+	}
+	if _, poolerOK := deploymentPtr.Labels[common.PoolerLabel]; poolerOK {
+		t.Fatalf("pooler deployment labels contain pooler label, labels:%v", deploymentPtr.Labels)
+	}
+
+	cases := []struct {
+		name   string
+		update func(serviceInfo *common.ServiceInfo)
+		change bool
+	}{
+		{name: "unchanged", update: func(*common.ServiceInfo) {}, change: false},
+		{name: "replicas", update: func(serviceInfo *common.ServiceInfo) { serviceInfo.Pooler.Replicas = 3 }, change: false},
+		{name: "pool size", update: func(serviceInfo *common.ServiceInfo) { serviceInfo.Pooler.PoolSize = 30 }, change: true},
+		{name: "user list", update: func(serviceInfo *common.ServiceInfo) { serviceInfo.Pooler.UserListHash = "hash-2" }, change: true},
+	}
+	for _, c := range cases {
+		serviceInfo := newPoolerService()
+		c.update(serviceInfo)
+		updatePtr := GetPoolerDeployment(serviceInfo)
+		changed := updatePtr.Annotations[TemplateHashAnnotation] != deploymentPtr.Annotations[TemplateHashAnnotation]
+		if changed != c.change {
+			t.Errorf("%s: template changed %v, expect %v", c.name, changed, c.change)
+		}
+	}
+}
+
+// TestPoolerNetworkPolicyPeer 部署连接池时允许连接池访问数据库
+func TestPoolerNetworkPolicyPeer(t *testing.T) {
+	cases := []struct {
+		name   string
+		pooler bool
+		expect bool
+	}{
+		{name: "without pooler", pooler: false, expect: false},
+		{name: "with pooler", pooler: true, expect: true},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		if c.pooler {
+			serviceInfo = newPoolerService()
+		}
+		serviceInfo.Access = &common.Access{DefaultDeny: true}
+		poolerLabels := GetPoolerLabels(newPoolerService())
+		poolerOK := false
+		for _, val := range GetNetworkPolicyPeers(serviceInfo, "operator") {
+			namespace, podLabels, _ := peerKind(val)
+			poolerOK = poolerOK || (namespace == "" && reflect.DeepEqual(podLabels, map[string]string(poolerLabels)))
+		}
+		if poolerOK != c.expect {
+			t.Errorf("%s: pooler peer %v, expect %v", c.name, poolerOK, c.expect)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+const (
+	// ReadWriteSuffix 选择主节点的Service后缀
+	ReadWriteSuffix = "-rw"
+	// ReadOnlySuffix 选择备节点的Service后缀
+	ReadOnlySuffix = "-ro"
+)
+
+// joinPrimaryScript 成员启动前按复制配置中记录的主节点确认角色，主节点直接启动
+// 备节点等待主节点及其复制槽就绪，已是备节点的数据目录直接启动
+// 数据目录为空时以pg_basebackup复制数据目录并生成备节点配置，复制完成后才替换数据目录
+// 原主节点重新加入时以新主节点为源执行pg_rewind回退分叉的WAL，回退失败时保留数据目录等待人工处理
+// 复制连接配置中不保存口令，WAL接收进程使用容器的PGPASSWORD，超级用户口令轮换后无需修改数据目录
+const joinPrimaryScript = `set -eu
+if [ "$MEMBER" = "$PRIMARY_MEMBER" ]; then
+  exit 0
+fi
+strip_password() {
+  sed -i "/^primary_conninfo/s/ *password=[^ ']*//" "$1/postgresql.auto.conf"
+}
+if [ -f "$PGDATA/PG_VERSION" ] && [ -f "$PGDATA/standby.signal" ]; then
+  strip_password "$PGDATA"
+  exit 0
+fi
+conn="host=$PRIMARY_HOST port=$PRIMARY_PORT user=$PGUSER application_name=$MEMBER"
+until pg_isready -q -d "$conn"; do
+  sleep 5
+done
+until [ "$(psql -X -A -t -d "$conn dbname=postgres" -c "SELECT 1 FROM pg_replication_slots WHERE slot_name = '$SLOT_NAME'")" = "1" ]; do
+  sleep 5
+done
+if [ -f "$PGDATA/PG_VERSION" ]; then
+  pg_rewind -D "$PGDATA" --source-server="$conn dbname=postgres" -R
+  echo "primary_slot_name = '$SLOT_NAME'" >> "$PGDATA/postgresql.auto.conf"
+  strip_password "$PGDATA"
+  exit 0
+fi
+rm -rf "$PGDATA.join"
+pg_basebackup -d "$conn" -D "$PGDATA.join" -X stream -c fast -R -S "$SLOT_NAME"
+strip_password "$PGDATA.join"
+chmod 0700 "$PGDATA.join"
+rm -rf "$PGDATA"
+mv "$PGDATA.join" "$PGDATA"
+`
+
+// getReplicationParameters 流复制所需的启动参数，pg_rewind要求开启wal_log_hints
+func getReplicationParameters(serviceInfo *common.ServiceInfo) (ret map[string]string) {
+	ret = map[string]string{}
+	if serviceInfo.Replication != nil {
+		ret["wal_log_hints"] = "on"
+	}
+
+	return
+}
+
+// GetReadWriteName 选择主节点的Service名称
+func GetReadWriteName(serviceInfo *common.ServiceInfo) string {
+	return serviceInfo.Name + ReadWriteSuffix
+}
+
+// GetReadOnlyName 选择备节点的Service名称
+func GetReadOnlyName(serviceInfo *common.ServiceInfo) string {
+	return serviceInfo.Name + ReadOnlySuffix
+}
+
+// GetMemberLabels 成员Deployment的选择器与Pod模板的标签，与成员的角色无关，主备切换时不需要重建Deployment与Pod
+// 角色标签由operator直接设置在运行中的Pod上
+func GetMemberLabels(serviceInfo *common.ServiceInfo, member string) common.Labels {
+	labels := common.Labels{}
+	for k, v := range serviceInfo.Labels {
+		labels[k] = v
+	}
+	labels[common.MemberLabel] = member
+	return labels
+}
+
+// GetRoleSelector 选择实例中指定角色的Pod
+func GetRoleSelector(serviceInfo *common.ServiceInfo, role string) common.Labels {
+	labels := common.Labels{}
+	for k, v := range serviceInfo.Labels {
+		labels[k] = v
+	}
+	labels[common.RoleLabel] = role
+	return labels
+}
+
+// getMemberInfo 成员使用各自的数据卷，只有实例同名成员从备份或快照初始化，其他成员从主节点复制
+func getMemberInfo(serviceInfo *common.ServiceInfo, member string) *common.ServiceInfo {
+	memberInfo := *serviceInfo
+	dataPath := *serviceInfo.Volumes.DataPath
+	dataPath.Name = member
+	volumes := *serviceInfo.Volumes
+	volumes.DataPath = &dataPath
+	memberInfo.Volumes = &volumes
+	if member != serviceInfo.Name {
+		memberInfo.Volumes.DataSnapshot = ""
+		memberInfo.Recovery = nil
+	}
+
+	return &memberInfo
+}
+
+// ReplicationPrimaryKey 复制配置中记录主节点成员名称的键
+const ReplicationPrimaryKey = "primary"
+
+// GetReplicationConfigName 记录当前主节点的ConfigMap名称
+func GetReplicationConfigName(serviceInfo *common.ServiceInfo) string {
+	return serviceInfo.Name + "-replication"
+}
+
+// GetReplicationConfigMap 开启流复制时记录当前主节点，成员启动时读取，未开启时返回nil
+func GetReplicationConfigMap(serviceInfo *common.ServiceInfo) (ret *corev1.ConfigMap) {
+	if serviceInfo.Replication == nil {
+		return
+	}
+
+	ret = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      GetReplicationConfigName(serviceInfo),
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+		},
+		Data: map[string]string{ReplicationPrimaryKey: serviceInfo.GetPrimary()},
+	}
+	return
+}
+
+// getReplicationInitContainers 开启流复制时各成员均在启动前确认角色，备节点首次启动前从主节点复制数据目录
+// 主节点从复制配置中读取，成员的Pod模板不随主备切换变化
+func getReplicationInitContainers(serviceInfo *common.ServiceInfo, member string) (ret []corev1.Container) {
+	if serviceInfo.Replication == nil {
+		return
+	}
+
+	ret = []corev1.Container{
+		{
+			Name:            "join-primary",
+			Image:           serviceInfo.Image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"sh", "-c", joinPrimaryScript},
+			Env: []corev1.EnvVar{
+				{Name: "PGDATA", Value: getDataDir(serviceInfo)},
+				{Name: "PGUSER", Value: common.DefaultPostgreSQLRoot},
+				secretEnv("PGPASSWORD", common.GetSuperuserSecretName(serviceInfo.Name), common.SuperuserPasswordKey),
+				{Name: "MEMBER", Value: member},
+				configMapEnv("PRIMARY_MEMBER", GetReplicationConfigName(serviceInfo), ReplicationPrimaryKey),
+				{Name: "SLOT_NAME", Value: common.GetSlotName(member)},
+				{Name: "PRIMARY_HOST", Value: GetReadWriteName(serviceInfo)},
+				{Name: "PRIMARY_PORT", Value: strconv.Itoa(int(serviceInfo.Svc.Port))},
+			},
+			VolumeMounts:    GetVolumeMounts(serviceInfo),
+			SecurityContext: GetContainerSecurityContext(serviceInfo),
+		},
+	}
+	return
+}
+
+func getRoleService(serviceInfo *common.ServiceInfo, name, role string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports:    GetServicePorts(serviceInfo),
+			Selector: GetRoleSelector(serviceInfo, role),
+			Type:     corev1.ServiceTypeClusterIP,
+		},
+	}
+}
+
+// GetReplicationServices 开启流复制时的读写与只读Service，未开启时返回nil
+func GetReplicationServices(serviceInfo *common.ServiceInfo) (ret []*corev1.Service) {
+	if serviceInfo.Replication == nil || serviceInfo.Replication.Standbys == 0 {
+		return
+	}
+
+	ret = []*corev1.Service{
+		getRoleService(serviceInfo, GetReadWriteName(serviceInfo), common.RolePrimary),
+		getRoleService(serviceInfo, GetReadOnlyName(serviceInfo), common.RoleReplica),
+	}
+	return
+}
+
+// IsStandbyMember 名称为<name>-<序号>的成员
+func IsStandbyMember(serviceInfo *common.ServiceInfo, name string) bool {
+	var idx int
+	_, err := fmt.Sscanf(name, serviceInfo.Name+"-%d", &idx)
+	return err == nil && idx > 0 && name == fmt.Sprintf("%s-%d", serviceInfo.Name, idx)
+}
+
+// IsFencedMember 故障切换期间被隔离的原主节点
+func IsFencedMember(serviceInfo *common.ServiceInfo, member string) bool {
+	return serviceInfo.Replication != nil && serviceInfo.Replication.Fenced == member
+}
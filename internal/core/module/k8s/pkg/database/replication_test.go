@@ -0,0 +1,204 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+func newReplicatedService(standbys int32, primary, fenced string) *common.ServiceInfo {
+	serviceInfo := common.NewPostgreSQLService("db", "default")
+	serviceInfo.Replicas = 1
+	serviceInfo.Replication = &common.Replication{Standbys: standbys, Primary: primary, Fenced: fenced}
+	return serviceInfo
+}
+
+func TestGetReplicationConfigMap(t *testing.T) {
+	cases := []struct {
+		name        string
+		replication *common.Replication
+		expectNil   bool
+		expect      string
+	}{
+		{name: "without replication", expectNil: true},
+		{name: "default primary", replication: &common.Replication{Standbys: 1}, expect: "db"},
+		{name: "switched primary", replication: &common.Replication{Standbys: 2, Primary: "db-2"}, expect: "db-2"},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		serviceInfo.Replication = c.replication
+		configMap := GetReplicationConfigMap(serviceInfo)
+		if c.expectNil {
+			if configMap != nil {
+				t.Errorf("%s: expect nil configmap, got %+v", c.name, configMap)
+			}
+			continue
+		}
+		if configMap == nil || configMap.Name != "db-replication" || configMap.Data[ReplicationPrimaryKey] != c.expect {
+			t.Errorf("%s: illegal configmap %+v, expect primary %s", c.name, configMap, c.expect)
+		}
+	}
+}
+
+func TestGetReplicationServices(t *testing.T) {
+	if services := GetReplicationServices(newReplicatedService(0, "", "")); services != nil {
+		t.Fatalf("expect no services without standbys, got %d", len(services))
+	}
+
+	services := GetReplicationServices(newReplicatedService(1, "", ""))
+	if len(services) != 2 {
+		t.Fatalf("expect read-write and read-only services, got %d", len(services))
+	}
+	cases := []struct {
+		name string
+		role string
+	}{
+		{"db-rw", common.RolePrimary},
+		{"db-ro", common.RoleReplica},
+	}
+	for idx, c := range cases {
+		servicePtr := services[idx]
+		if servicePtr.Name != c.name || servicePtr.Spec.Selector[common.RoleLabel] != c.role {
+			t.Errorf("service %s selector %v, expect %s with role %s", servicePtr.Name, servicePtr.Spec.Selector, c.name, c.role)
+		}
+		if _, memberOK := servicePtr.Spec.Selector[common.MemberLabel]; memberOK {
+			t.Errorf("service %s should not select a fixed member", servicePtr.Name)
+		}
+	}
+}
+
+func TestIsStandbyMember(t *testing.T) {
+	serviceInfo := newReplicatedService(2, "", "")
+	cases := []struct {
+		name   string
+		expect bool
+	}{
+		{"db", false},
+		{"db-1", true},
+		{"db-12", true},
+		{"db-0", false},
+		{"db-01", false},
+		{"db-1x", false},
+		{"dbx-1", false},
+		{"other-1", false},
+	}
+	for _, c := range cases {
+		if ret := IsStandbyMember(serviceInfo, c.name); ret != c.expect {
+			t.Errorf("IsStandbyMember(%s) = %v, expect %v", c.name, ret, c.expect)
+		}
+	}
+}
+
+func TestGetMemberLabels(t *testing.T) {
+	serviceInfo := newReplicatedService(1, "db-1", "")
+	for _, member := range []string{"db", "db-1"} {
+		labels := GetMemberLabels(serviceInfo, member)
+		if labels[common.MemberLabel] != member {
+			t.Errorf("member %s labels %v", member, labels)
+		}
+		// 角色标签不在选择器与模板中，主备切换不需要重建Deployment
+		if _, roleOK := labels[common.RoleLabel]; roleOK {
+			t.Errorf("member %s labels should not contain role, labels:%v", member, labels)
+		}
+		for k, v := range serviceInfo.Labels {
+			if labels[k] != v {
+				t.Errorf("member %s labels %v lost instance label %s", member, labels, k)
+			}
+		}
+	}
+	if _, memberOK := serviceInfo.Labels[common.MemberLabel]; memberOK {
+		t.Fatalf("instance labels modified, labels:%v", serviceInfo.Labels)
+	}
+}
+
+func TestGetDeploymentReplicas(t *testing.T) {
+	cases := []struct {
+		name     string
+		replicas int32
+		fenced   string
+		member   string
+		expect   int32
+		role     string
+	}{
+		{name: "primary", replicas: 1, member: "db", expect: 1, role: common.RolePrimary},
+		{name: "standby", replicas: 1, member: "db-1", expect: 1, role: common.RoleReplica},
+		{name: "at most one pod", replicas: 3, member: "db", expect: 1, role: common.RolePrimary},
+		{name: "stopped", replicas: 0, member: "db-1", expect: 0, role: common.RoleReplica},
+		{name: "fenced", replicas: 1, fenced: "db", member: "db", expect: 0, role: common.RolePrimary},
+		{name: "other member fenced", replicas: 1, fenced: "db", member: "db-1", expect: 1, role: common.RoleReplica},
+	}
+	for _, c := range cases {
+		serviceInfo := newReplicatedService(1, "", c.fenced)
+		serviceInfo.Replicas = c.replicas
+		deploymentPtr := GetDeployment(serviceInfo, c.member)
+		if *deploymentPtr.Spec.Replicas != c.expect {
+			t.Errorf("%s: replicas %d, expect %d", c.name, *deploymentPtr.Spec.Replicas, c.expect)
+		}
+		if deploymentPtr.Annotations[RoleAnnotation] != c.role {
+			t.Errorf("%s: role %s, expect %s", c.name, deploymentPtr.Annotations[RoleAnnotation], c.role)
+		}
+	}
+}
+
+// TestGetPodTemplateRole 主备切换后成员的Pod模板不变，只有角色注解变化
+func TestGetPodTemplateRole(t *testing.T) {
+	before := GetDeployment(newReplicatedService(1, "db", ""), "db-1")
+	after := GetDeployment(newReplicatedService(1, "db-1", ""), "db-1")
+	if before.Annotations[TemplateHashAnnotation] != after.Annotations[TemplateHashAnnotation] {
+		t.Fatalf("template changed after switchover")
+	}
+	if before.Annotations[RoleAnnotation] == after.Annotations[RoleAnnotation] {
+		t.Fatalf("role not changed after switchover")
+	}
+}
+
+func TestReplicationTemplate(t *testing.T) {
+	cases := []struct {
+		name        string
+		replication *common.Replication
+		expect      bool
+	}{
+		{name: "without replication", expect: false},
+		{name: "with replication", replication: &common.Replication{Standbys: 1}, expect: true},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		serviceInfo.Replication = c.replication
+		template := GetPodTemplate(serviceInfo, "db")
+		joinOK := false
+		for _, val := range template.Spec.InitContainers {
+			joinOK = joinOK || val.Name == "join-primary"
+		}
+		if joinOK != c.expect {
+			t.Errorf("%s: join-primary %v, expect %v", c.name, joinOK, c.expect)
+		}
+		if _, hintsOK := getReplicationParameters(serviceInfo)["wal_log_hints"]; hintsOK != c.expect {
+			t.Errorf("%s: wal_log_hints %v, expect %v", c.name, hintsOK, c.expect)
+		}
+	}
+}
+
+// TestReplicationNetworkPolicyPeer 开启流复制时实例成员之间允许互相访问
+func TestReplicationNetworkPolicyPeer(t *testing.T) {
+	cases := []struct {
+		name     string
+		standbys int32
+		expect   bool
+	}{
+		{name: "without standby", standbys: 0, expect: false},
+		{name: "with standby", standbys: 1, expect: true},
+	}
+	for _, c := range cases {
+		serviceInfo := newReplicatedService(c.standbys, "", "")
+		serviceInfo.Access = &common.Access{DefaultDeny: true}
+		memberOK := false
+		for _, val := range GetNetworkPolicyPeers(serviceInfo, "operator") {
+			namespace, podLabels, _ := peerKind(val)
+			memberOK = memberOK || (namespace == "" && reflect.DeepEqual(podLabels, map[string]string(serviceInfo.Labels)))
+		}
+		if memberOK != c.expect {
+			t.Errorf("%s: member peer %v, expect %v", c.name, memberOK, c.expect)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+const (
+	hostnameTopologyKey = "kubernetes.io/hostname"
+	zoneTopologyKey     = "topology.kubernetes.io/zone"
+)
+
+// getMembersSelector 选择实例的全部成员Pod，不包含连接池与备份任务
+func getMembersSelector(serviceInfo *common.ServiceInfo) *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchLabels: serviceInfo.Labels,
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: common.MemberLabel, Operator: metav1.LabelSelectorOpExists},
+		},
+	}
+}
+
+func isReplicated(serviceInfo *common.ServiceInfo) bool {
+	return serviceInfo.Replication != nil && serviceInfo.Replication.Standbys > 0
+}
+
+// GetAffinity 优先使用实例定义的affinity，未定义时开启流复制的实例优先将成员调度到不同节点
+func GetAffinity(serviceInfo *common.ServiceInfo) *corev1.Affinity {
+	if serviceInfo.Scheduling != nil && serviceInfo.Scheduling.Affinity != nil {
+		return serviceInfo.Scheduling.Affinity
+	}
+	if !isReplicated(serviceInfo) {
+		return nil
+	}
+
+	return &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: getMembersSelector(serviceInfo),
+						TopologyKey:   hostnameTopologyKey,
+					},
+				},
+			},
+		},
+	}
+}
+
+// GetTopologySpreadConstraints 开启流复制的实例尽量将成员均匀分布到各可用区，无法满足时仍允许调度
+func GetTopologySpreadConstraints(serviceInfo *common.ServiceInfo) (ret []corev1.TopologySpreadConstraint) {
+	if !isReplicated(serviceInfo) {
+		return
+	}
+
+	ret = []corev1.TopologySpreadConstraint{
+		{
+			MaxSkew:           1,
+			TopologyKey:       zoneTopologyKey,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector:     getMembersSelector(serviceInfo),
+		},
+	}
+	return
+}
+
+// applyScheduling 设置Pod的节点选择与容忍，亲和性与拓扑分布只用于数据库成员
+func applyScheduling(serviceInfo *common.ServiceInfo, podSpec *corev1.PodSpec) {
+	if serviceInfo.Scheduling == nil {
+		return
+	}
+
+	podSpec.NodeSelector = serviceInfo.Scheduling.NodeSelector
+	podSpec.Tolerations = serviceInfo.Scheduling.Tolerations
+}
+
+// GetPodDisruptionBudget 开启流复制的实例每次只驱逐一个成员，主节点被驱逐时由故障切换提升备节点
+// 单节点实例至少保留一个Pod，节点排空会阻塞到实例停止或迁移完成，设置AllowDisruption时不设置驱逐策略，返回nil
+func GetPodDisruptionBudget(serviceInfo *common.ServiceInfo) *policyv1.PodDisruptionBudget {
+	if serviceInfo.Scheduling != nil && serviceInfo.Scheduling.AllowDisruption {
+		return nil
+	}
+
+	ret := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceInfo.Name,
+			Namespace: serviceInfo.Namespace,
+			Labels:    serviceInfo.Labels,
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: getMembersSelector(serviceInfo),
+		},
+	}
+	if isReplicated(serviceInfo) {
+		maxUnavailable := intstr.FromInt32(1)
+		ret.Spec.MaxUnavailable = &maxUnavailable
+	} else {
+		minAvailable := intstr.FromInt32(1)
+		ret.Spec.MinAvailable = &minAvailable
+	}
+	return ret
+}
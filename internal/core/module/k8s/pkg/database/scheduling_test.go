@@ -0,0 +1,142 @@
+package database
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+func TestGetAffinity(t *testing.T) {
+	customAffinity := &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{}}
+	cases := []struct {
+		name         string
+		replication  *common.Replication
+		scheduling   *common.Scheduling
+		expectNil    bool
+		expectCustom bool
+	}{
+		{name: "single member", expectNil: true},
+		{name: "without standbys", replication: &common.Replication{}, expectNil: true},
+		{name: "replicated", replication: &common.Replication{Standbys: 1}},
+		{name: "custom", replication: &common.Replication{Standbys: 1}, scheduling: &common.Scheduling{Affinity: customAffinity}, expectCustom: true},
+		{name: "custom single member", scheduling: &common.Scheduling{Affinity: customAffinity}, expectCustom: true},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		serviceInfo.Replication = c.replication
+		serviceInfo.Scheduling = c.scheduling
+		affinity := GetAffinity(serviceInfo)
+		switch {
+		case c.expectNil:
+			if affinity != nil {
+				t.Errorf("%s: expect nil affinity, got %+v", c.name, affinity)
+			}
+		case c.expectCustom:
+			if affinity != customAffinity {
+				t.Errorf("%s: custom affinity ignored", c.name)
+			}
+		default:
+			if affinity == nil || affinity.PodAntiAffinity == nil || len(affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution) != 1 {
+				t.Errorf("%s: expect preferred anti affinity, got %+v", c.name, affinity)
+				continue
+			}
+			term := affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].PodAffinityTerm
+			if term.TopologyKey != hostnameTopologyKey || term.LabelSelector.MatchExpressions[0].Key != common.MemberLabel {
+				t.Errorf("%s: illegal anti affinity term %+v", c.name, term)
+			}
+		}
+	}
+}
+
+func TestGetTopologySpreadConstraints(t *testing.T) {
+	cases := []struct {
+		name        string
+		replication *common.Replication
+		expect      int
+	}{
+		{name: "single member", expect: 0},
+		{name: "without standbys", replication: &common.Replication{}, expect: 0},
+		{name: "replicated", replication: &common.Replication{Standbys: 2}, expect: 1},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		serviceInfo.Replication = c.replication
+		constraints := GetTopologySpreadConstraints(serviceInfo)
+		if len(constraints) != c.expect {
+			t.Errorf("%s: constraints %d, expect %d", c.name, len(constraints), c.expect)
+			continue
+		}
+		if c.expect > 0 && (constraints[0].TopologyKey != zoneTopologyKey || constraints[0].WhenUnsatisfiable != corev1.ScheduleAnyway) {
+			t.Errorf("%s: illegal constraint %+v", c.name, constraints[0])
+		}
+	}
+}
+
+// TestGetPodDisruptionBudget 单节点实例至少保留一个Pod，开启流复制的实例每次驱逐一个成员，允许驱逐时不设置驱逐策略
+func TestGetPodDisruptionBudget(t *testing.T) {
+	cases := []struct {
+		name           string
+		replication    *common.Replication
+		scheduling     *common.Scheduling
+		expectNil      bool
+		minAvailable   int
+		maxUnavailable int
+	}{
+		{name: "single member", minAvailable: 1},
+		{name: "without standbys", replication: &common.Replication{}, minAvailable: 1},
+		{name: "replicated", replication: &common.Replication{Standbys: 1}, maxUnavailable: 1},
+		{name: "scheduling without opt-out", scheduling: &common.Scheduling{NodeSelector: map[string]string{"disk": "ssd"}}, minAvailable: 1},
+		{name: "single member allow disruption", scheduling: &common.Scheduling{AllowDisruption: true}, expectNil: true},
+		{name: "replicated allow disruption", replication: &common.Replication{Standbys: 1}, scheduling: &common.Scheduling{AllowDisruption: true}, expectNil: true},
+	}
+	for _, c := range cases {
+		serviceInfo := common.NewPostgreSQLService("db", "default")
+		serviceInfo.Replication = c.replication
+		serviceInfo.Scheduling = c.scheduling
+		budgetPtr := GetPodDisruptionBudget(serviceInfo)
+		if c.expectNil {
+			if budgetPtr != nil {
+				t.Errorf("%s: expect nil budget, got %+v", c.name, budgetPtr)
+			}
+			continue
+		}
+		if budgetPtr == nil {
+			t.Errorf("%s: expect budget, got nil", c.name)
+			continue
+		}
+		minAvailable, maxUnavailable := 0, 0
+		if budgetPtr.Spec.MinAvailable != nil {
+			minAvailable = budgetPtr.Spec.MinAvailable.IntValue()
+		}
+		if budgetPtr.Spec.MaxUnavailable != nil {
+			maxUnavailable = budgetPtr.Spec.MaxUnavailable.IntValue()
+		}
+		if minAvailable != c.minAvailable || maxUnavailable != c.maxUnavailable {
+			t.Errorf("%s: minAvailable %d maxUnavailable %d, expect %d %d", c.name, minAvailable, maxUnavailable, c.minAvailable, c.maxUnavailable)
+		}
+	}
+}
+
+// TestApplyScheduling 节点选择与容忍同时作用于成员与连接池，亲和性只用于成员
+func TestApplyScheduling(t *testing.T) {
+	serviceInfo := common.NewPostgreSQLService("db", "default")
+	serviceInfo.Replication = &common.Replication{Standbys: 1}
+	serviceInfo.Pooler = &common.Pooler{Image: "pgbouncer", Mode: common.PoolModeTransaction, PoolSize: 10, MaxClientConn: 100, Replicas: 1}
+	serviceInfo.Scheduling = &common.Scheduling{
+		NodeSelector: map[string]string{"disk": "ssd"},
+		Tolerations:  []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}},
+	}
+
+	memberSpec := GetPodTemplate(serviceInfo, "db").Spec
+	poolerSpec := GetPoolerPodTemplate(serviceInfo).Spec
+	for name, podSpec := range map[string]corev1.PodSpec{"member": memberSpec, "pooler": poolerSpec} {
+		if podSpec.NodeSelector["disk"] != "ssd" || len(podSpec.Tolerations) != 1 {
+			t.Errorf("%s: scheduling not applied, nodeSelector:%v, tolerations:%v", name, podSpec.NodeSelector, podSpec.Tolerations)
+		}
+	}
+	if memberSpec.Affinity == nil || poolerSpec.Affinity != nil {
+		t.Fatalf("affinity should only apply to members, member:%+v, pooler:%+v", memberSpec.Affinity, poolerSpec.Affinity)
+	}
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"context"
+	"net/http"
+
+	engine "github.com/muidea/magicEngine/http"
+
+	cd "github.com/muidea/magicCommon/def"
+	fn "github.com/muidea/magicCommon/foundation/net"
+
+	"supos.ai/operator/database/internal/core/module/k8s/biz"
+	"supos.ai/operator/database/pkg/common"
+)
+
+type userInfoKey struct{}
+
+// authFilter 认证中间件，认证通过后将用户信息写入请求上下文
+type authFilter struct {
+	bizPtr *biz.K8s
+}
+
+func (s *authFilter) MiddleWareHandle(ctx engine.RequestContext, res http.ResponseWriter, req *http.Request) {
+	userInfo, userErr := s.bizPtr.Authenticate(req)
+	if userErr != nil {
+		res.WriteHeader(http.StatusUnauthorized)
+		fn.PackageHTTPResponse(res, &cd.Result{ErrorCode: cd.InvalidAuthority, Reason: "未授权访问"})
+		return
+	}
+
+	ctx.Update(context.WithValue(ctx.Context(), userInfoKey{}, userInfo))
+	ctx.Next()
+}
+
+func getUserInfo(ctx context.Context) *common.UserInfo {
+	userVal := ctx.Value(userInfoKey{})
+	if userVal == nil {
+		return nil
+	}
+
+	return userVal.(*common.UserInfo)
+}
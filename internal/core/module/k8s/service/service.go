@@ -20,6 +20,7 @@ type K8s struct {
 	bizPtr *biz.K8s
 
 	endpointName string
+	authFilter   *authFilter
 }
 
 // New create base
@@ -27,6 +28,7 @@ func New(endpointName string, bizPtr *biz.K8s) *K8s {
 	ptr := &K8s{
 		endpointName: endpointName,
 		bizPtr:       bizPtr,
+		authFilter:   &authFilter{bizPtr: bizPtr},
 	}
 
 	return ptr
@@ -43,22 +45,37 @@ func (s *K8s) BindRegistry(
 // RegisterRoute 注册路由
 func (s *K8s) RegisterRoute() {
 	createRoute := engine.CreateRoute(common.CreateService, engine.POST, s.CreateHandle)
-	s.routeRegistry.AddRoute(createRoute)
+	s.routeRegistry.AddRoute(createRoute, s.authFilter)
+
+	cloneRoute := engine.CreateRoute(common.CloneService, engine.POST, s.CloneHandle)
+	s.routeRegistry.AddRoute(cloneRoute, s.authFilter)
+
+	switchoverRoute := engine.CreateRoute(common.SwitchoverService, engine.POST, s.SwitchoverHandle)
+	s.routeRegistry.AddRoute(switchoverRoute, s.authFilter)
+
+	keepRunningRoute := engine.CreateRoute(common.KeepRunningService, engine.POST, s.KeepRunningHandle)
+	s.routeRegistry.AddRoute(keepRunningRoute, s.authFilter)
+
+	resizeRoute := engine.CreateRoute(common.ResizeService, engine.POST, s.ResizeHandle)
+	s.routeRegistry.AddRoute(resizeRoute, s.authFilter)
 
 	destroyRoute := engine.CreateRoute(common.DestroyService, engine.POST, s.DestroyHandle)
-	s.routeRegistry.AddRoute(destroyRoute)
+	s.routeRegistry.AddRoute(destroyRoute, s.authFilter)
 
 	startRoute := engine.CreateRoute(common.StartService, engine.POST, s.StartHandle)
-	s.routeRegistry.AddRoute(startRoute)
+	s.routeRegistry.AddRoute(startRoute, s.authFilter)
 
 	stopRoute := engine.CreateRoute(common.StopService, engine.POST, s.StopHandle)
-	s.routeRegistry.AddRoute(stopRoute)
+	s.routeRegistry.AddRoute(stopRoute, s.authFilter)
 
 	queryRoute := engine.CreateRoute(common.QueryService, engine.POST, s.QueryHandle)
-	s.routeRegistry.AddRoute(queryRoute)
+	s.routeRegistry.AddRoute(queryRoute, s.authFilter)
+
+	healthRoute := engine.CreateRoute(common.CheckHealth, engine.GET, s.HealthHandle)
+	s.routeRegistry.AddRoute(healthRoute)
 }
 
-func (s *K8s) CreateHandle(_ context.Context, res http.ResponseWriter, req *http.Request) {
+func (s *K8s) CreateHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	result := &common.CreateServiceResult{}
 	for {
 		param := &common.ServiceParam{}
@@ -68,7 +85,12 @@ func (s *K8s) CreateHandle(_ context.Context, res http.ResponseWriter, req *http
 			result.Reason = "非法参数"
 			break
 		}
-		createErr := s.bizPtr.Create(param.Name, param.Catalog)
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.CreateService, param.Catalog, param.Namespace, param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
+		createErr := s.bizPtr.Create(param)
 		if createErr != nil {
 			result.Result = *createErr
 			break
@@ -80,7 +102,124 @@ func (s *K8s) CreateHandle(_ context.Context, res http.ResponseWriter, req *http
 	fn.PackageHTTPResponse(res, result)
 }
 
-func (s *K8s) DestroyHandle(_ context.Context, res http.ResponseWriter, req *http.Request) {
+// CloneHandle 克隆需要新实例的创建权限与源实例的查询权限，源实例与新实例均位于operator所在的命名空间
+func (s *K8s) CloneHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	result := &common.CloneServiceResult{}
+	for {
+		param := &common.CloneParam{}
+		err := fn.ParseJSONBody(req, nil, param)
+		if err != nil {
+			result.ErrorCode = cd.IllegalParam
+			result.Reason = "非法参数"
+			break
+		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.CreateService, param.Catalog, "", param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
+		authErr = s.bizPtr.Authorize(getUserInfo(ctx), common.QueryService, param.Catalog, "", param.Source.Instance)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
+		cloneErr := s.bizPtr.Clone(param)
+		if cloneErr != nil {
+			result.Result = *cloneErr
+			break
+		}
+
+		break
+	}
+
+	fn.PackageHTTPResponse(res, result)
+}
+
+// SwitchoverHandle 计划内切换主节点，返回时切换尚未完成
+func (s *K8s) SwitchoverHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	result := &common.SwitchoverServiceResult{}
+	for {
+		param := &common.SwitchoverParam{}
+		err := fn.ParseJSONBody(req, nil, param)
+		if err != nil {
+			result.ErrorCode = cd.IllegalParam
+			result.Reason = "非法参数"
+			break
+		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.SwitchoverService, param.Catalog, "", param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
+		switchoverErr := s.bizPtr.Switchover(param)
+		if switchoverErr != nil {
+			result.Result = *switchoverErr
+			break
+		}
+
+		break
+	}
+
+	fn.PackageHTTPResponse(res, result)
+}
+
+// KeepRunningHandle 临时保持实例运行，不受运行时段影响
+func (s *K8s) KeepRunningHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	result := &common.KeepRunningServiceResult{}
+	for {
+		param := &common.KeepRunningParam{}
+		err := fn.ParseJSONBody(req, nil, param)
+		if err != nil {
+			result.ErrorCode = cd.IllegalParam
+			result.Reason = "非法参数"
+			break
+		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.KeepRunningService, param.Catalog, "", param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
+		keepRunningErr := s.bizPtr.KeepRunning(param)
+		if keepRunningErr != nil {
+			result.Result = *keepRunningErr
+			break
+		}
+
+		break
+	}
+
+	fn.PackageHTTPResponse(res, result)
+}
+
+// ResizeHandle 调整实例的CPU与内存，返回时成员Pod尚未完成重建
+func (s *K8s) ResizeHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	result := &common.ResizeServiceResult{}
+	for {
+		param := &common.ResizeParam{}
+		err := fn.ParseJSONBody(req, nil, param)
+		if err != nil {
+			result.ErrorCode = cd.IllegalParam
+			result.Reason = "非法参数"
+			break
+		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.ResizeService, param.Catalog, "", param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
+		resizeErr := s.bizPtr.Resize(param)
+		if resizeErr != nil {
+			result.Result = *resizeErr
+			break
+		}
+
+		break
+	}
+
+	fn.PackageHTTPResponse(res, result)
+}
+
+func (s *K8s) DestroyHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	result := &common.DestroyServiceResult{}
 	for {
 		param := &common.ServiceParam{}
@@ -90,6 +229,11 @@ func (s *K8s) DestroyHandle(_ context.Context, res http.ResponseWriter, req *htt
 			result.Reason = "非法参数"
 			break
 		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.DestroyService, param.Catalog, param.Namespace, param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
 		destroyErr := s.bizPtr.Destroy(param.Name, param.Catalog)
 		if destroyErr != nil {
 			result.Result = *destroyErr
@@ -101,7 +245,7 @@ func (s *K8s) DestroyHandle(_ context.Context, res http.ResponseWriter, req *htt
 	fn.PackageHTTPResponse(res, result)
 }
 
-func (s *K8s) StartHandle(_ context.Context, res http.ResponseWriter, req *http.Request) {
+func (s *K8s) StartHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	result := &common.StartServiceResult{}
 	for {
 		param := &common.ServiceParam{}
@@ -111,6 +255,11 @@ func (s *K8s) StartHandle(_ context.Context, res http.ResponseWriter, req *http.
 			result.Reason = "非法参数"
 			break
 		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.StartService, param.Catalog, param.Namespace, param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
 		startErr := s.bizPtr.Start(param.Name, param.Catalog)
 		if startErr != nil {
 			result.Result = *startErr
@@ -123,7 +272,7 @@ func (s *K8s) StartHandle(_ context.Context, res http.ResponseWriter, req *http.
 	fn.PackageHTTPResponse(res, result)
 }
 
-func (s *K8s) StopHandle(_ context.Context, res http.ResponseWriter, req *http.Request) {
+func (s *K8s) StopHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	result := &common.StopServiceResult{}
 	for {
 		param := &common.ServiceParam{}
@@ -133,6 +282,11 @@ func (s *K8s) StopHandle(_ context.Context, res http.ResponseWriter, req *http.R
 			result.Reason = "非法参数"
 			break
 		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.StopService, param.Catalog, param.Namespace, param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
 		stopErr := s.bizPtr.Stop(param.Name, param.Catalog)
 		if stopErr != nil {
 			result.Result = *stopErr
@@ -144,7 +298,7 @@ func (s *K8s) StopHandle(_ context.Context, res http.ResponseWriter, req *http.R
 	fn.PackageHTTPResponse(res, result)
 }
 
-func (s *K8s) QueryHandle(_ context.Context, res http.ResponseWriter, req *http.Request) {
+func (s *K8s) QueryHandle(ctx context.Context, res http.ResponseWriter, req *http.Request) {
 	result := &common.QueryServiceResult{}
 	for {
 		param := &common.ServiceParam{}
@@ -154,6 +308,11 @@ func (s *K8s) QueryHandle(_ context.Context, res http.ResponseWriter, req *http.
 			result.Reason = "非法参数"
 			break
 		}
+		authErr := s.bizPtr.Authorize(getUserInfo(ctx), common.QueryService, param.Catalog, param.Namespace, param.Name)
+		if authErr != nil {
+			result.Result = *authErr
+			break
+		}
 		serviceInfo, serviceErr := s.bizPtr.Query(param.Name, param.Catalog)
 		if serviceErr != nil {
 			result.Result = *serviceErr
@@ -166,3 +325,15 @@ func (s *K8s) QueryHandle(_ context.Context, res http.ResponseWriter, req *http.
 
 	fn.PackageHTTPResponse(res, result)
 }
+
+// HealthHandle 健康检查，同时报告operator缺失的API权限
+func (s *K8s) HealthHandle(_ context.Context, res http.ResponseWriter, _ *http.Request) {
+	result := &common.HealthResult{}
+	missingPermissions := s.bizPtr.GetMissingPermissions()
+	if len(missingPermissions) > 0 {
+		result.Result = *cd.NewWarn(cd.Warned, "missing permissions")
+		result.MissingPermissions = missingPermissions
+	}
+
+	fn.PackageHTTPResponse(res, result)
+}
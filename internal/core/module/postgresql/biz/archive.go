@@ -0,0 +1,224 @@
+package biz
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// archivePathReg 归档目录与前缀会拼接到archive_command等shell命令中，只允许安全字符
+var archivePathReg = regexp.MustCompile(`^[A-Za-z0-9/_.-]*$`)
+
+func validateArchive(archivePtr *pgv1.ArchiveSpec) error {
+	storage := archivePtr.Storage
+	switch {
+	case storage.PVC != nil && storage.S3 != nil:
+		return fmt.Errorf("archive storage can only specify one of pvc and s3")
+	case storage.PVC != nil:
+		if storage.PVC.ClaimName == "" || !archivePathReg.MatchString(storage.PVC.Path) {
+			return fmt.Errorf("illegal archive pvc storage %s:%s", storage.PVC.ClaimName, storage.PVC.Path)
+		}
+	case storage.S3 != nil:
+		if storage.S3.Bucket == "" || !archivePathReg.MatchString(storage.S3.Prefix) {
+			return fmt.Errorf("illegal archive s3 storage %s:%s", storage.S3.Bucket, storage.S3.Prefix)
+		}
+	default:
+		return fmt.Errorf("archive storage must specify one of pvc and s3")
+	}
+
+	return nil
+}
+
+func newArchive(storage pgv1.BackupStorage) *common.Archive {
+	return &common.Archive{
+		PVC:   storage.PVC,
+		S3:    storage.S3,
+		Image: config.GetBackupConfig().UploaderImage,
+	}
+}
+
+// getArchive 归档定义非法时不开启归档，错误记录在实例状态中
+func getArchive(pgPtr *pgv1.PostgreSQL) *common.Archive {
+	if pgPtr.Spec.Archive == nil || validateArchive(pgPtr.Spec.Archive) != nil {
+		return nil
+	}
+
+	return newArchive(pgPtr.Spec.Archive.Storage)
+}
+
+// parseLSN 解析"X/Y"格式的LSN
+func parseLSN(lsn string) (ret uint64, err error) {
+	items := strings.Split(lsn, "/")
+	if len(items) != 2 {
+		err = fmt.Errorf("illegal lsn %s", lsn)
+		return
+	}
+
+	hi, hiErr := strconv.ParseUint(items[0], 16, 32)
+	if hiErr != nil {
+		err = fmt.Errorf("illegal lsn %s", lsn)
+		return
+	}
+	lo, loErr := strconv.ParseUint(items[1], 16, 32)
+	if loErr != nil {
+		err = fmt.Errorf("illegal lsn %s", lsn)
+		return
+	}
+
+	ret = hi<<32 | lo
+	return
+}
+
+// selectBaseBackup 选择恢复目标之前完成的最新基础备份，目标为空时选择最新的基础备份
+func selectBaseBackup(sourcePtr *common.ArchiveSource, backups []pgv1.PostgreSQLBackup) (ret *pgv1.PostgreSQLBackup, err *cd.Result) {
+	var targetTime time.Time
+	var targetLSN uint64
+	switch {
+	case sourcePtr.TargetLSN != "":
+		lsnVal, lsnErr := parseLSN(sourcePtr.TargetLSN)
+		if lsnErr != nil {
+			err = cd.NewError(cd.IllegalParam, lsnErr.Error())
+			return
+		}
+		targetLSN = lsnVal
+	case sourcePtr.TargetTime != "":
+		timeVal, timeErr := time.Parse(time.RFC3339, sourcePtr.TargetTime)
+		if timeErr != nil {
+			err = cd.NewError(cd.IllegalParam, fmt.Sprintf("illegal target time %s", sourcePtr.TargetTime))
+			return
+		}
+		targetTime = timeVal
+	}
+
+	found := false
+	for idx := range backups {
+		backupPtr := &backups[idx]
+		if backupPtr.Labels[common.ArchiveLabel] != sourcePtr.Instance || !backupPtr.Spec.IsBaseBackup() ||
+			backupPtr.Status.Phase != pgv1.BackupPhaseSucceeded || backupPtr.Status.CompletionTime == nil {
+			continue
+		}
+		found = true
+
+		switch {
+		case sourcePtr.TargetLSN != "":
+			stopLSN, lsnErr := parseLSN(backupPtr.Status.StopLSN)
+			if lsnErr != nil || stopLSN > targetLSN {
+				continue
+			}
+		case sourcePtr.TargetTime != "":
+			if backupPtr.Status.CompletionTime.Time.After(targetTime) {
+				continue
+			}
+		}
+
+		if ret == nil || ret.Status.CompletionTime.Before(backupPtr.Status.CompletionTime) {
+			ret = backupPtr
+		}
+	}
+	if ret != nil {
+		return
+	}
+
+	if !found {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("waiting for base backup of instance %s", sourcePtr.Instance))
+		return
+	}
+
+	err = cd.NewError(cd.IllegalParam, fmt.Sprintf("no base backup of instance %s completed before recovery target", sourcePtr.Instance))
+	return
+}
+
+// prepareRecovery 从WAL归档初始化的实例在部署前选定基础备份，已选定时沿用状态中记录的基础备份
+func (s *PostgreSQL) prepareRecovery(pairPtr *serviceInfoPair) (err *cd.Result) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pairPtr.recovery != nil {
+		return
+	}
+
+	sourcePtr := pgPtr.GetBootstrap().FromArchive
+	var backupList pgv1.PostgreSQLBackupList
+	err = s.listResource(pgv1.Backup, pgPtr.Namespace, &backupList)
+	if err != nil {
+		return
+	}
+
+	var backupPtr *pgv1.PostgreSQLBackup
+	restorePtr := pgPtr.Status.Restore
+	if restorePtr != nil && restorePtr.Backup != "" {
+		for idx := range backupList.Items {
+			if backupList.Items[idx].Name == restorePtr.Backup {
+				backupPtr = &backupList.Items[idx]
+				break
+			}
+		}
+		if backupPtr == nil {
+			err = cd.NewError(cd.NoExist, fmt.Sprintf("base backup %s not exist", restorePtr.Backup))
+			return
+		}
+	} else {
+		backupPtr, err = selectBaseBackup(sourcePtr, backupList.Items)
+		if err != nil {
+			if err.Fail() {
+				log.Errorf("prepareRecovery %s failed, error:%s", pgPtr.Name, err.Error())
+				pgPtr.Status.Restore = &pgv1.RestoreStatus{}
+				s.completeRestore(pgPtr, common.RestoreFailed, err.Reason)
+				_ = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+			}
+			return
+		}
+
+		now := metav1.Now()
+		pgPtr.Status.Phase = pgv1.InstancePhaseRestoring
+		pgPtr.Status.Restore = &pgv1.RestoreStatus{
+			Backup:    backupPtr.Name,
+			Phase:     common.RestoreRunning,
+			StartTime: &now,
+		}
+		err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+		if err != nil {
+			return
+		}
+	}
+
+	pairPtr.recovery = &common.Recovery{
+		Archive:    *newArchive(backupPtr.Spec.Storage),
+		Source:     sourcePtr.Instance,
+		BaseBackup: backupPtr.GetLocationKey(),
+		TargetTime: sourcePtr.TargetTime,
+		TargetLSN:  sourcePtr.TargetLSN,
+	}
+	log.Infof("prepareRecovery %s, source:%s, base backup:%s", pgPtr.Name, sourcePtr.Instance, backupPtr.Name)
+	return
+}
+
+// reconcileArchiveRestore 实例结束归档恢复并提升为主库后恢复完成
+func (s *PostgreSQL) reconcileArchiveRestore(pgPtr *pgv1.PostgreSQL) {
+	restorePtr := pgPtr.Status.Restore
+	if restorePtr == nil {
+		return
+	}
+
+	recoveryVal, recoveryErr := s.executeCommand(pgPtr.Name, common.DiagnosticCommand, "in-recovery", nil)
+	if recoveryErr != nil {
+		restorePtr.Message = recoveryErr.Reason
+		return
+	}
+	if recoveryVal != "f" {
+		restorePtr.Message = "replaying archived wal"
+		return
+	}
+
+	s.completeRestore(pgPtr, common.RestoreSucceeded, "")
+	log.Infof("reconcileArchiveRestore %s succeeded, base backup:%s", pgPtr.Name, restorePtr.Backup)
+}
@@ -2,12 +2,22 @@ package biz
 
 import (
 	"context"
-
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
 	cd "github.com/muidea/magicCommon/def"
@@ -25,13 +35,58 @@ import (
 type serviceInfoPair struct {
 	serviceInfo   *common.ServiceInfo
 	postgreSQLPtr *pgv1.PostgreSQL
+
+	// reconciledHash 已同步到k8s资源的服务信息摘要
+	reconciledHash string
+	// hbaConfig 最近一次校验通过的pg_hba.conf，规则非法时继续使用
+	hbaConfig string
+	// recovery 从WAL归档初始化时选定的基础备份与恢复目标
+	recovery *common.Recovery
+	// dataSnapshot 从快照初始化时数据卷的来源
+	dataSnapshot *dataSnapshot
+	// primaryFailedAt 首次检测到主节点故障的时间，主节点恢复后清空
+	primaryFailedAt time.Time
+	// failover 进行中的故障切换
+	failover *failoverState
+	// userListHash 已同步的连接池用户列表摘要
+	userListHash string
+	// activityTime 最近一次统计客户端连接的时间
+	activityTime time.Time
+	// spec 最近一次校验通过的容器资源，定义非法时继续使用
+	spec *common.Spec
+	// storageTime 最近一次统计数据卷使用率的时间
+	storageTime time.Time
+	// storageWarned 已发出数据卷使用率告警，使用率回落后清除
+	storageWarned bool
+	// superuserHash 超级用户Secret中口令的摘要
+	superuserHash string
+	// switchoverTo k8s模块返回的已按新资源就绪的备节点，主节点调整资源前先切换到该备节点
+	switchoverTo string
+}
+
+// serviceNotice k8s模块通知的服务变化，removed表示服务已删除
+type serviceNotice struct {
+	serviceInfo *common.ServiceInfo
+	removed     bool
 }
 
+// PostgreSQL 实例缓存及其中的serviceInfoPair只在同步协程中读写，事件处理只记录通知，由同步协程应用
 type PostgreSQL struct {
 	biz.Base
 
 	postgresqlCache cache.KVCache
 	client          dynamic.Interface
+	clientSet       kubernetes.Interface
+
+	// serviceNotices 尚未应用到实例缓存的服务变化
+	serviceNotices []serviceNotice
+	noticeLock     sync.Mutex
+	// reconcileTime 最近一次同步实例与数据库资源的时间
+	reconcileTime time.Time
+
+	// databasePreload 各实例下数据库扩展所需的预加载库
+	databasePreload map[string][]string
+	preloadLock     sync.RWMutex
 }
 
 func New(
@@ -43,24 +98,59 @@ func New(
 		postgresqlCache: cache.NewKVCache(nil),
 	}
 
-	ptr.SubscribeFunc(common.NotifyTimer, ptr.timerCheck)
 	ptr.SubscribeFunc(common.NotifyService, ptr.serviceNotify)
+	ptr.SubscribeFunc(common.CreateInstance, ptr.createInstance)
+	ptr.SubscribeFunc(common.SwitchoverInstance, ptr.switchoverInstance)
+	ptr.SubscribeFunc(common.HibernateInstance, ptr.hibernateInstance)
+	ptr.SubscribeFunc(common.KeepRunningInstance, ptr.keepRunningInstance)
+	ptr.SubscribeFunc(common.ResizeInstance, ptr.resizeInstance)
 	return ptr
 }
 
-func (s *PostgreSQL) timerCheck(_ event.Event, _ event.Result) {
-	s.List("default")
-
-	s.serviceVerify()
+func (s *PostgreSQL) getNamespace() string {
+	namespace, found := os.LookupEnv("NAMESPACE")
+	if !found {
+		namespace = corev1.NamespaceDefault
+	}
+	return namespace
 }
 
+// serviceNotify 在事件协程中只记录服务变化，避免与同步协程同时修改实例缓存
 func (s *PostgreSQL) serviceNotify(ev event.Event, _ event.Result) {
 	serviceInfoPtr, serviceInfoOK := ev.Data().(*common.ServiceInfo)
 	if !serviceInfoOK {
 		return
 	}
 
+	s.noticeLock.Lock()
+	defer s.noticeLock.Unlock()
+
+	s.serviceNotices = append(s.serviceNotices, serviceNotice{
+		serviceInfo: serviceInfoPtr,
+		removed:     ev.Header().GetString(event.Action) == event.Del,
+	})
+}
+
+// applyServiceNotices 按通知顺序更新实例缓存中的服务信息
+func (s *PostgreSQL) applyServiceNotices() {
+	s.noticeLock.Lock()
+	notices := s.serviceNotices
+	s.serviceNotices = nil
+	s.noticeLock.Unlock()
+
+	for _, val := range notices {
+		s.applyServiceNotice(val)
+	}
+}
+
+func (s *PostgreSQL) applyServiceNotice(notice serviceNotice) {
+	serviceInfoPtr := notice.serviceInfo
 	curPtr := s.postgresqlCache.Fetch(serviceInfoPtr.Name)
+	// 实例定义已删除的服务不再跟踪
+	if notice.removed && (curPtr == nil || curPtr.(*serviceInfoPair).postgreSQLPtr == nil) {
+		s.postgresqlCache.Remove(serviceInfoPtr.Name)
+		return
+	}
 	if curPtr == nil {
 		pairPtr := &serviceInfoPair{
 			serviceInfo: serviceInfoPtr,
@@ -82,31 +172,282 @@ func (s *PostgreSQL) serviceVerify() {
 		if !serviceInfoOK {
 			continue
 		}
+		if !s.isNameAccepted(serviceInfoPtr) {
+			continue
+		}
+		if !s.isRecoveryPrepared(serviceInfoPtr) {
+			continue
+		}
+		// 实例的环境变量引用超级用户Secret，Secret就绪后才部署
+		if pgPtr := serviceInfoPtr.postgreSQLPtr; pgPtr != nil {
+			superuserHash, superuserErr := s.applySuperuserSecret(pgPtr)
+			if superuserErr != nil {
+				continue
+			}
+			serviceInfoPtr.superuserHash = superuserHash
+		}
 		if serviceInfoPtr.serviceInfo == nil {
 			// create postgresql k8s deployment...
-			s.createK8sDeployment(serviceInfoPtr.postgreSQLPtr)
+			s.createK8sDeployment(serviceInfoPtr)
 			continue
 		}
 		if serviceInfoPtr.postgreSQLPtr == nil {
 			// create postgresql crd instance...
 			continue
 		}
+		s.updateK8sDeployment(serviceInfoPtr)
+	}
+}
+
+// getServiceInfo 根据PostgreSQL定义生成k8s服务信息
+func (s *PostgreSQL) getServiceInfo(pairPtr *serviceInfoPair) *common.ServiceInfo {
+	pgPtr := pairPtr.postgreSQLPtr
+	pgServicePtr := common.NewPostgreSQLService(pgPtr.GetName(), pgPtr.GetNamespace())
+	if pgPtr.Spec.Image != "" {
+		pgServicePtr.Image = pgPtr.Spec.Image
+	}
+	pgServicePtr.Access = pgPtr.Spec.Access
+	pgServicePtr.Scheduling = pgPtr.Spec.Scheduling
+	if pgPtr.Spec.Security != nil {
+		pgServicePtr.Security.ServiceAccount = pgPtr.Spec.Security.ServiceAccount
+		pgServicePtr.Security.FixPermissions = pgPtr.Spec.Security.FixPermissions
+	}
+	if pgPtr.Spec.Storage != nil && pgPtr.Spec.Storage.ClassName != "" {
+		pgServicePtr.Volumes.DataPath.Type = pgPtr.Spec.Storage.ClassName
+	}
+	pgServicePtr.Volumes.DataSize = getStorageSize(pgPtr)
+	pgServicePtr.Parameters = s.getParameters(pgPtr)
+	if pairPtr.spec == nil || validateResources(pgPtr.Spec.Resources) == nil {
+		pairPtr.spec = getSpec(pgPtr.Spec.Resources)
+	}
+	pgServicePtr.Spec = pairPtr.spec
+	// 未设置resources的实例使用镜像默认的内存参数
+	if pgPtr.Spec.Resources != nil {
+		if pgServicePtr.Parameters == nil {
+			pgServicePtr.Parameters = map[string]string{}
+		}
+		for k, v := range getMemoryParameters(pairPtr.spec) {
+			pgServicePtr.Parameters[k] = v
+		}
+	}
+	pgServicePtr.Archive = getArchive(pgPtr)
+	pgServicePtr.Replication = getReplication(pgPtr)
+	if failoverPtr := pairPtr.failover; failoverPtr != nil && pgServicePtr.Replication != nil {
+		pgServicePtr.Replication.Fenced = failoverPtr.from
+		if failoverPtr.promoted {
+			pgServicePtr.Replication.Primary = failoverPtr.to
+		}
+	}
+	// 计划内切换隔离原主节点期间停止其Deployment，读写Service不再选择原主节点
+	if isSwitchoverFenced(pgPtr) && pgServicePtr.Replication != nil {
+		pgServicePtr.Replication.Fenced = pgPtr.GetPrimary()
+	}
+	// 用户列表Secret就绪后才部署连接池，休眠的实例恢复到可连接后才恢复连接池
+	if pairPtr.userListHash != "" {
+		pgServicePtr.Pooler = getPooler(pgPtr)
+		if pgServicePtr.Pooler != nil {
+			pgServicePtr.Pooler.UserListHash = pairPtr.userListHash
+			if isHibernated(pgPtr) || pgPtr.Status.Phase == pgv1.InstancePhaseResuming {
+				pgServicePtr.Pooler.Replicas = 0
+			}
+		}
+	}
+	if isHibernated(pgPtr) {
+		pgServicePtr.Replicas = 0
+	}
+	if pgPtr.IsRestorePending() {
+		pgServicePtr.Recovery = pairPtr.recovery
+		if pairPtr.dataSnapshot != nil {
+			pgServicePtr.Volumes.DataPath.Type = pairPtr.dataSnapshot.className
+			pgServicePtr.Volumes.DataSize = pairPtr.dataSnapshot.size
+			pgServicePtr.Volumes.DataSnapshot = pairPtr.dataSnapshot.name
+		}
+	}
+
+	hbaRules := getHBARules(pgPtr)
+	if len(hbaRules) == 0 {
+		pairPtr.hbaConfig = ""
+	} else if content, _, hbaErr := renderHBA(hbaRules); hbaErr == nil {
+		pairPtr.hbaConfig = content
+	}
+	if pairPtr.hbaConfig != "" {
+		pgServicePtr.Config = map[string]string{hbaFile: pairPtr.hbaConfig}
+		if pgServicePtr.Parameters == nil {
+			pgServicePtr.Parameters = map[string]string{}
+		}
+		pgServicePtr.Parameters[hbaParameter] = common.ConfigPath + "/" + hbaFile
+	}
+
+	return pgServicePtr
+}
+
+// isMemberOf 名称是否为实例的成员，包括声明的备节点与当前主节点
+func isMemberOf(pgPtr *pgv1.PostgreSQL, name string) bool {
+	if pgPtr.Spec.Replication == nil {
+		return false
+	}
+	if instance, index, ok := common.SplitMemberName(name); ok && instance == pgPtr.Name && index <= pgPtr.Spec.Replication.Standbys {
+		return true
 	}
+
+	return pgPtr.GetPrimary() == name
 }
 
-func (s *PostgreSQL) createK8sDeployment(pgPtr *pgv1.PostgreSQL) {
-	pgName := pgPtr.GetName()
-	pgNamespace := pgPtr.GetNamespace()
-	pgServicePtr := common.NewPostgreSQLService(pgName, pgNamespace)
+// getNameConflict 实例名称与其他实例的成员名称相同时，两者的Deployment与数据卷名称冲突，先创建的实例保留名称
+// 实例名称形如<name>-<序号>且实例<name>拥有该成员，或实例自身的备节点成员与其他实例同名时返回冲突说明
+func (s *PostgreSQL) getNameConflict(pgPtr *pgv1.PostgreSQL) string {
+	if instance, _, ok := common.SplitMemberName(pgPtr.Name); ok {
+		if ownerVal := s.postgresqlCache.Fetch(instance); ownerVal != nil {
+			ownerPtr := ownerVal.(*serviceInfoPair).postgreSQLPtr
+			if ownerPtr != nil && isMemberOf(ownerPtr, pgPtr.Name) && !pgPtr.CreationTimestamp.Before(&ownerPtr.CreationTimestamp) {
+				return fmt.Sprintf("name %s is used by a standby member of instance %s", pgPtr.Name, instance)
+			}
+		}
+	}
+	if pgPtr.Spec.Replication == nil {
+		return ""
+	}
+
+	for index := int32(1); index <= pgPtr.Spec.Replication.Standbys; index++ {
+		member := fmt.Sprintf("%s-%d", pgPtr.Name, index)
+		otherVal := s.postgresqlCache.Fetch(member)
+		if otherVal == nil {
+			continue
+		}
+		otherPtr := otherVal.(*serviceInfoPair).postgreSQLPtr
+		if otherPtr != nil && otherPtr.CreationTimestamp.Before(&pgPtr.CreationTimestamp) {
+			return fmt.Sprintf("standby member %s conflicts with an existing instance of the same name", member)
+		}
+	}
+	return ""
+}
+
+// isNameAccepted 与先创建的实例存在成员名称冲突时不予部署，已部署的实例不再更新，直到冲突消除
+func (s *PostgreSQL) isNameAccepted(pairPtr *serviceInfoPair) bool {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pgPtr == nil || pgPtr.DeletionTimestamp != nil {
+		return true
+	}
+
+	conflict := s.getNameConflict(pgPtr)
+	if conflict == "" {
+		return true
+	}
+
+	// 已部署的实例只记录冲突，保持原有状态
+	if pgPtr.Status.Message != conflict || (pairPtr.serviceInfo == nil && pgPtr.Status.Phase != pgv1.PhaseFailed) {
+		log.Warnf("isNameAccepted %s failed, %s", pgPtr.Name, conflict)
+		if pairPtr.serviceInfo == nil {
+			pgPtr.Status.Phase = pgv1.PhaseFailed
+		}
+		pgPtr.Status.Message = conflict
+		_ = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+	}
+	return false
+}
+
+// isRecoveryPrepared 从WAL归档初始化的实例需先选定基础备份，从快照初始化的实例需先确认快照，克隆的实例需先完成源实例的备份，之后才能部署
+func (s *PostgreSQL) isRecoveryPrepared(pairPtr *serviceInfoPair) bool {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pgPtr == nil || !pgPtr.IsRestorePending() {
+		return true
+	}
+	if pgPtr.Status.Restore != nil && pgPtr.Status.Restore.Phase == common.RestoreFailed {
+		return false
+	}
+	if pgPtr.Spec.Bootstrap.CloneFrom != nil && s.prepareClone(pairPtr) != nil {
+		return false
+	}
+
+	bootstrap := pgPtr.GetBootstrap()
+	switch {
+	case bootstrap.FromArchive != nil:
+		return s.prepareRecovery(pairPtr) == nil
+	case bootstrap.FromSnapshot != nil:
+		return s.prepareSnapshot(pairPtr) == nil
+	}
+	return true
+}
+
+func getServiceHash(serviceInfo *common.ServiceInfo) string {
+	byteVal, _ := json.Marshal(serviceInfo)
+	hashVal := sha256.Sum256(byteVal)
+	return hex.EncodeToString(hashVal[:])
+}
+
+func (s *PostgreSQL) createK8sDeployment(pairPtr *serviceInfoPair) {
+	pgServicePtr := s.getServiceInfo(pairPtr)
 
 	createEvent := event.NewEvent(common.CreateService, s.ID(), common.K8sModule, nil, pgServicePtr)
 	s.PostEvent(createEvent)
 }
 
+// updateK8sDeployment 服务信息变化时同步到k8s资源，包括实例定义与数据库扩展引起的启动参数变化
+func (s *PostgreSQL) updateK8sDeployment(pairPtr *serviceInfoPair) (err *cd.Result) {
+	pgServicePtr := s.getServiceInfo(pairPtr)
+	serviceHash := getServiceHash(pgServicePtr)
+	if pairPtr.reconciledHash == serviceHash {
+		return
+	}
+
+	updateEvent := event.NewEvent(common.UpdateService, s.ID(), common.K8sModule, nil, pgServicePtr)
+	result := s.SendEvent(updateEvent)
+	resultVal, resultErr := result.Get()
+	pairPtr.switchoverTo = ""
+	if updateResult, updateOK := resultVal.(*common.UpdateResult); updateOK && updateResult != nil {
+		pairPtr.switchoverTo = updateResult.SwitchoverTo
+	}
+	if resultErr != nil {
+		// 告警表示主节点等待备节点滚动或等待切换，不记录摘要，下一周期继续同步
+		if resultErr.Warn() {
+			log.Infof("updateK8sDeployment %s, %s", pgServicePtr, resultErr.Reason)
+			return
+		}
+
+		err = resultErr
+		log.Errorf("updateK8sDeployment %s failed, error:%s", pgServicePtr, err.Error())
+		return
+	}
+
+	pairPtr.reconciledHash = serviceHash
+	return
+}
+
+const (
+	// refreshInterval 刷新实例定义并部署k8s资源的周期
+	refreshInterval = 2 * time.Second
+	// reconcileInterval 数据库与角色资源的同步周期
+	reconcileInterval = 10 * time.Second
+)
+
 func (s *PostgreSQL) Run() {
 	s.AsyncTask(func() {
 
 	})
+
+	s.Timer(refreshInterval, 0, s.reconcile)
+}
+
+// reconcile 同步协程，刷新实例缓存、部署与同步实例均在此顺序执行，故障切换等状态不会被并发修改
+func (s *PostgreSQL) reconcile() {
+	s.applyServiceNotices()
+	s.List(s.getNamespace())
+	s.serviceVerify()
+
+	if time.Since(s.reconcileTime) < reconcileInterval {
+		return
+	}
+
+	s.reconcileResources()
+	s.reconcileTime = time.Now()
+}
+
+// reconcileResources 先同步实例扩展与角色再同步数据库，数据库owner与授权依赖角色已存在，迁移依赖数据库已存在
+func (s *PostgreSQL) reconcileResources() {
+	s.reconcileInstances()
+	s.reconcileRoles()
+	s.reconcileDatabases()
+	s.reconcileMigrations()
 }
 
 func (s *PostgreSQL) getGVR() schema.GroupVersionResource {
@@ -155,7 +496,9 @@ func (s *PostgreSQL) List(namespace string) {
 	}
 
 	log.Infof("%s, count:%v", pgList.Kind, len(pgList.Items))
+	nameSet := map[string]bool{}
 	for _, val := range pgList.Items {
+		nameSet[val.Name] = true
 
 		curPtr := s.postgresqlCache.Fetch(val.Name)
 		if curPtr == nil {
@@ -171,6 +514,20 @@ func (s *PostgreSQL) List(namespace string) {
 		pairPtr.postgreSQLPtr = &val
 		s.postgresqlCache.Put(val.Name, pairPtr, cache.ForeverAgeValue)
 	}
+
+	// 实例定义已删除时停止同步，k8s资源由删除方负责清理
+	for _, val := range s.postgresqlCache.GetAll() {
+		pairPtr, pairOK := val.(*serviceInfoPair)
+		if !pairOK || pairPtr.postgreSQLPtr == nil || nameSet[pairPtr.postgreSQLPtr.Name] {
+			continue
+		}
+
+		if pairPtr.serviceInfo == nil {
+			s.postgresqlCache.Remove(pairPtr.postgreSQLPtr.Name)
+			continue
+		}
+		s.postgresqlCache.Put(pairPtr.postgreSQLPtr.Name, &serviceInfoPair{serviceInfo: pairPtr.serviceInfo}, cache.ForeverAgeValue)
+	}
 }
 
 func (s *PostgreSQL) Get(namespace, name string) (ret *pgv1.PostgreSQL, err *cd.Result) {
@@ -203,27 +560,70 @@ func (s *PostgreSQL) Get(namespace, name string) (ret *pgv1.PostgreSQL, err *cd.
 func (s *PostgreSQL) Create(namespace string, pgPtr *pgv1.PostgreSQL) (ret *pgv1.PostgreSQL, err *cd.Result) {
 	res := s.getGVR()
 	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
 
 	unstructuredPtr, unstructuredErr := runtime.DefaultUnstructuredConverter.ToUnstructured(pgPtr)
 	if unstructuredErr != nil {
-		log.Errorf("json.Unmarshal failed, error:%s", err.Error())
+		err = cd.NewError(cd.UnExpected, unstructuredErr.Error())
+		log.Errorf("runtime.DefaultUnstructuredConverter.ToUnstructured failed, error:%s", unstructuredErr.Error())
 		return
 	}
 
-	resVal, resErr := client.Resource(res).Create(context.TODO(), &unstructured.Unstructured{
+	resVal, resErr := client.Resource(res).Namespace(namespace).Create(context.TODO(), &unstructured.Unstructured{
 		Object: unstructuredPtr,
 	}, metav1.CreateOptions{})
 	if resErr != nil {
+		if errors.IsAlreadyExists(resErr) {
+			err = cd.NewError(cd.Duplicated, resErr.Error())
+			return
+		}
+
+		err = cd.NewError(cd.UnExpected, resErr.Error())
 		log.Errorf("s.client.Resource(res).Namespace(namespace).Create Postgresql failed, namespace:%s, error:%s", namespace, resErr.Error())
 		return
 	}
 
-	var pgVal pgv1.PostgreSQL
-	convertErr := runtime.DefaultUnstructuredConverter.FromUnstructured(resVal.UnstructuredContent(), &pgVal)
+	pgVal := &pgv1.PostgreSQL{}
+	convertErr := runtime.DefaultUnstructuredConverter.FromUnstructured(resVal.UnstructuredContent(), pgVal)
 	if convertErr != nil {
+		err = cd.NewError(cd.UnExpected, convertErr.Error())
 		log.Errorf("runtime.DefaultUnstructuredConverter.FromUnstructured failed, error:%s", convertErr.Error())
 		return
 	}
 
+	ret = pgVal
 	return
 }
+
+// createInstance 根据REST接口参数创建实例定义，k8s资源由serviceVerify部署
+func (s *PostgreSQL) createInstance(ev event.Event, re event.Result) {
+	paramPtr, paramOK := ev.Data().(*common.ServiceParam)
+	if !paramOK {
+		log.Warnf("createInstance failed, illegal param")
+		if re != nil {
+			re.Set(nil, cd.NewError(cd.IllegalParam, "illegal param"))
+		}
+		return
+	}
+
+	pgPtr := &pgv1.PostgreSQL{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: pgv1.Group + "/" + pgv1.Version,
+			Kind:       pgv1.PostgreSQLKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      paramPtr.Name,
+			Namespace: s.getNamespace(),
+		},
+		Spec: pgv1.Spec{
+			Bootstrap: paramPtr.Bootstrap,
+		},
+	}
+	ret, err := s.Create(pgPtr.Namespace, pgPtr)
+	if re != nil {
+		re.Set(ret, err)
+	}
+}
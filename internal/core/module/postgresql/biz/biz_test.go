@@ -0,0 +1,95 @@
+package biz
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/muidea/magicCommon/foundation/cache"
+
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func newInstance(name string, standbys int32, createdAt time.Time) *pgv1.PostgreSQL {
+	pgPtr := &pgv1.PostgreSQL{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", CreationTimestamp: metav1.NewTime(createdAt)},
+	}
+	if standbys > 0 {
+		pgPtr.Spec.Replication = &pgv1.ReplicationSpec{Standbys: standbys}
+	}
+	return pgPtr
+}
+
+// TestGetNameConflict 只有实例名称与另一实例的成员名称相同时冲突，先创建的实例保留名称
+func TestGetNameConflict(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	cases := []struct {
+		name      string
+		instances []*pgv1.PostgreSQL
+		expect    map[string]bool
+	}{
+		{
+			name:      "names ending with numbers",
+			instances: []*pgv1.PostgreSQL{newInstance("pg-16", 0, older), newInstance("app-2024", 1, older)},
+			expect:    map[string]bool{"pg-16": false, "app-2024": false},
+		},
+		{
+			name:      "owner without the member",
+			instances: []*pgv1.PostgreSQL{newInstance("orders", 1, older), newInstance("orders-2", 0, newer)},
+			expect:    map[string]bool{"orders": false, "orders-2": false},
+		},
+		{
+			name:      "owner without replication",
+			instances: []*pgv1.PostgreSQL{newInstance("db", 0, older), newInstance("db-1", 0, newer)},
+			expect:    map[string]bool{"db": false, "db-1": false},
+		},
+		{
+			name:      "member name taken later",
+			instances: []*pgv1.PostgreSQL{newInstance("db", 2, older), newInstance("db-2", 0, newer)},
+			expect:    map[string]bool{"db": false, "db-2": true},
+		},
+		{
+			name:      "standby added later",
+			instances: []*pgv1.PostgreSQL{newInstance("db-1", 0, older), newInstance("db", 1, newer)},
+			expect:    map[string]bool{"db-1": false, "db": true},
+		},
+		{
+			name:      "created together",
+			instances: []*pgv1.PostgreSQL{newInstance("db", 1, older), newInstance("db-1", 0, older)},
+			expect:    map[string]bool{"db": false, "db-1": true},
+		},
+	}
+	for _, c := range cases {
+		pgModule := &PostgreSQL{postgresqlCache: cache.NewKVCache(nil)}
+		for _, val := range c.instances {
+			pgModule.postgresqlCache.Put(val.Name, &serviceInfoPair{postgreSQLPtr: val}, cache.ForeverAgeValue)
+		}
+		for _, val := range c.instances {
+			if conflict := pgModule.getNameConflict(val); (conflict != "") != c.expect[val.Name] {
+				t.Errorf("%s: instance %s conflict %q, expect conflict %v", c.name, val.Name, conflict, c.expect[val.Name])
+			}
+		}
+	}
+}
+
+// TestIsMemberOf 切换后的主节点同样属于实例的成员
+func TestIsMemberOf(t *testing.T) {
+	pgPtr := newInstance("db", 1, time.Now())
+	pgPtr.Status.Replication = &pgv1.ReplicationStatus{Primary: "db-3"}
+	cases := []struct {
+		name   string
+		expect bool
+	}{
+		{"db-1", true},
+		{"db-2", false},
+		{"db-3", true},
+		{"other-1", false},
+	}
+	for _, c := range cases {
+		if ret := isMemberOf(pgPtr, c.name); ret != c.expect {
+			t.Errorf("isMemberOf(%s) = %v, expect %v", c.name, ret, c.expect)
+		}
+	}
+}
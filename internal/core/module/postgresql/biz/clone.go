@@ -0,0 +1,216 @@
+package biz
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// getCloneBackupName 克隆使用的备份名称，同名实例重新创建后不会复用之前的备份
+func getCloneBackupName(pgPtr *pgv1.PostgreSQL) string {
+	uid := string(pgPtr.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+
+	return fmt.Sprintf("%s-clone-%s", pgPtr.Name, uid)
+}
+
+// selectCloneMethod 数据卷支持快照时使用快照，源实例开启WAL归档时使用基础备份，否则使用逻辑备份
+func selectCloneMethod(sourcePgPtr *pgv1.PostgreSQL, sourcePtr *common.CloneSource) (ret string, err *cd.Result) {
+	storagePtr := sourcePgPtr.Spec.Storage
+	switch {
+	case storagePtr != nil && storagePtr.ClassName != "" && storagePtr.ClassName != common.LocalPath:
+		ret = pgv1.BackupMethodSnapshot
+	case sourcePgPtr.Spec.Archive != nil:
+		ret = pgv1.BackupMethodBase
+	case sourcePtr.Storage != nil:
+		ret = pgv1.BackupMethodLogical
+	default:
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("instance %s supports neither snapshot nor archive, cloneFrom requires storage", sourcePgPtr.Name))
+	}
+
+	return
+}
+
+// newCloneBackup 对源实例创建的备份，快照与逻辑备份随克隆实例一同删除，基础备份属于源实例的WAL归档
+func newCloneBackup(pgPtr, sourcePgPtr *pgv1.PostgreSQL, sourcePtr *common.CloneSource, method string) *pgv1.PostgreSQLBackup {
+	backupPtr := &pgv1.PostgreSQLBackup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: pgv1.Group + "/" + pgv1.Version,
+			Kind:       pgv1.BackupKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getCloneBackupName(pgPtr),
+			Namespace: pgPtr.Namespace,
+			Labels:    map[string]string{common.CloneLabel: pgPtr.Name},
+		},
+		Spec: pgv1.BackupSpec{
+			Instance: sourcePgPtr.Name,
+			Method:   method,
+		},
+	}
+
+	switch method {
+	case pgv1.BackupMethodBase:
+		backupPtr.Labels[common.ArchiveLabel] = sourcePgPtr.Name
+		backupPtr.Spec.Storage = sourcePgPtr.Spec.Archive.Storage
+		return backupPtr
+	case pgv1.BackupMethodLogical:
+		backupPtr.Spec.Storage = *sourcePtr.Storage
+	}
+
+	backupPtr.OwnerReferences = []metav1.OwnerReference{
+		{
+			APIVersion: pgv1.Group + "/" + pgv1.Version,
+			Kind:       pgv1.PostgreSQLKind,
+			Name:       pgPtr.Name,
+			UID:        pgPtr.UID,
+		},
+	}
+	return backupPtr
+}
+
+// failClone 克隆无法继续，实例需要删除后重新创建
+func (s *PostgreSQL) failClone(pgPtr *pgv1.PostgreSQL, err *cd.Result) {
+	log.Errorf("prepareClone %s failed, error:%s", pgPtr.Name, err.Error())
+	backupName := ""
+	if pgPtr.Status.Clone != nil {
+		backupName = pgPtr.Status.Clone.Backup
+	}
+
+	pgPtr.Status.Restore = &pgv1.RestoreStatus{Backup: backupName}
+	s.completeRestore(pgPtr, common.RestoreFailed, err.Reason)
+	_ = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+}
+
+// startClone 选定复制方式并对运行中的源实例创建备份，实例以标签记录源实例
+func (s *PostgreSQL) startClone(pgPtr *pgv1.PostgreSQL) (err *cd.Result) {
+	sourcePtr := pgPtr.Spec.Bootstrap.CloneFrom
+	var sourcePgPtr *pgv1.PostgreSQL
+	if sourceVal := s.postgresqlCache.Fetch(sourcePtr.Instance); sourceVal != nil && sourcePtr.Instance != pgPtr.Name {
+		sourcePgPtr = sourceVal.(*serviceInfoPair).postgreSQLPtr
+	}
+	if sourcePgPtr == nil || sourcePgPtr.DeletionTimestamp != nil {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("instance %s not exist", sourcePtr.Instance))
+		return
+	}
+	if sourcePgPtr.Status.Phase != pgv1.InstancePhaseRunning {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("waiting for instance %s to be running", sourcePtr.Instance))
+		return
+	}
+
+	method, methodErr := selectCloneMethod(sourcePgPtr, sourcePtr)
+	if methodErr != nil {
+		err = methodErr
+		return
+	}
+
+	backupPtr := newCloneBackup(pgPtr, sourcePgPtr, sourcePtr, method)
+	err = s.createResource(pgv1.Backup, pgPtr.Namespace, backupPtr)
+	if err != nil {
+		if err.ErrorCode != cd.Duplicated {
+			return
+		}
+		err = nil
+	}
+
+	if pgPtr.Labels[common.CloneLabel] != sourcePtr.Instance {
+		if pgPtr.Labels == nil {
+			pgPtr.Labels = map[string]string{}
+		}
+		pgPtr.Labels[common.CloneLabel] = sourcePtr.Instance
+		err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, false)
+		if err != nil {
+			return
+		}
+	}
+
+	pgPtr.Status.Phase = pgv1.InstancePhaseRestoring
+	pgPtr.Status.Clone = &pgv1.CloneStatus{
+		Source: sourcePtr.Instance,
+		Method: method,
+		Backup: backupPtr.Name,
+	}
+	err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+	if err != nil {
+		return
+	}
+
+	log.Infof("startClone %s, source:%s, method:%s, backup:%s", pgPtr.Name, sourcePtr.Instance, method, backupPtr.Name)
+	return
+}
+
+// prepareClone 克隆的实例在部署前等待源实例的备份完成，之后按对应的初始化方式恢复，恢复开始后不再检查
+func (s *PostgreSQL) prepareClone(pairPtr *serviceInfoPair) (err *cd.Result) {
+	pgPtr := pairPtr.postgreSQLPtr
+	clonePtr := pgPtr.Status.Clone
+	if clonePtr != nil && pgPtr.Status.Restore != nil {
+		return
+	}
+	if clonePtr == nil || clonePtr.Backup == "" {
+		err = s.startClone(pgPtr)
+		if err != nil {
+			if err.Fail() {
+				s.failClone(pgPtr, err)
+			}
+			return
+		}
+
+		clonePtr = pgPtr.Status.Clone
+	}
+
+	var backupList pgv1.PostgreSQLBackupList
+	err = s.listResource(pgv1.Backup, pgPtr.Namespace, &backupList)
+	if err != nil {
+		return
+	}
+
+	var backupPtr *pgv1.PostgreSQLBackup
+	for idx := range backupList.Items {
+		if backupList.Items[idx].Name == clonePtr.Backup {
+			backupPtr = &backupList.Items[idx]
+			break
+		}
+	}
+	switch {
+	case backupPtr == nil:
+		err = cd.NewError(cd.NoExist, fmt.Sprintf("backup %s not exist", clonePtr.Backup))
+		s.failClone(pgPtr, err)
+	case backupPtr.Status.Phase == pgv1.PhaseFailed:
+		err = cd.NewError(cd.UnExpected, fmt.Sprintf("backup %s failed, %s", clonePtr.Backup, backupPtr.Status.Message))
+		s.failClone(pgPtr, err)
+	case backupPtr.Status.Phase != pgv1.BackupPhaseSucceeded:
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("waiting for backup %s to complete", clonePtr.Backup))
+	}
+
+	return
+}
+
+// reconcileCloneScript 恢复完成后在单个事务中执行脱敏脚本，失败时保留恢复中状态并重试
+func (s *PostgreSQL) reconcileCloneScript(pgPtr *pgv1.PostgreSQL) {
+	sourcePtr := pgPtr.Spec.Bootstrap.CloneFrom
+	clonePtr := pgPtr.Status.Clone
+	restorePtr := pgPtr.Status.Restore
+	if sourcePtr.Script == "" || clonePtr == nil || clonePtr.ScriptApplied ||
+		restorePtr == nil || restorePtr.Phase != common.RestoreSucceeded {
+		return
+	}
+
+	_, err := s.executeScript(pgPtr.Name, sourcePtr.Database, "clone-script", sourcePtr.Script, nil, false)
+	if err != nil {
+		log.Errorf("reconcileCloneScript %s failed, error:%s", pgPtr.Name, err.Error())
+		clonePtr.Message = err.Reason
+		return
+	}
+
+	clonePtr.ScriptApplied = true
+	clonePtr.Message = ""
+	log.Infof("reconcileCloneScript %s, script applied", pgPtr.Name)
+}
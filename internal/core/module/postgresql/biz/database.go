@@ -0,0 +1,182 @@
+package biz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const defaultEncoding = "UTF8"
+
+func (s *PostgreSQL) reconcileDatabases() {
+	var databaseList pgv1.PostgreSQLDatabaseList
+	listErr := s.listResource(pgv1.PostgresqlDatabase, s.getNamespace(), &databaseList)
+	if listErr != nil {
+		return
+	}
+
+	preload := map[string][]string{}
+	for idx := range databaseList.Items {
+		databasePtr := &databaseList.Items[idx]
+		if databasePtr.DeletionTimestamp == nil {
+			instance := databasePtr.Spec.Instance
+			preload[instance] = append(preload[instance], getPreloadLibraries(databasePtr.Spec.Extensions)...)
+		}
+	}
+	s.setDatabasePreload(preload)
+
+	for idx := range databaseList.Items {
+		databasePtr := &databaseList.Items[idx]
+		if databasePtr.DeletionTimestamp != nil {
+			s.deleteDatabase(databasePtr)
+			continue
+		}
+
+		extensions := mergeExtensions(s.getInstanceExtensions(databasePtr.Spec.Instance), databasePtr.Spec.Extensions)
+		if databasePtr.Status.Phase == pgv1.PhaseReady && databasePtr.Status.ObservedGeneration == databasePtr.Generation &&
+			isExtensionsSynced(extensions, databasePtr.Status.Extensions) {
+			continue
+		}
+
+		s.reconcileDatabase(databasePtr)
+	}
+}
+
+func (s *PostgreSQL) reconcileDatabase(databasePtr *pgv1.PostgreSQLDatabase) {
+	if !hasFinalizer(&databasePtr.ObjectMeta) {
+		databasePtr.Finalizers = append(databasePtr.Finalizers, pgv1.Finalizer)
+		if updateErr := s.updateResource(pgv1.PostgresqlDatabase, databasePtr.Namespace, databasePtr, false); updateErr != nil {
+			return
+		}
+		// 更新后resourceVersion已变化，下个周期继续处理
+		return
+	}
+
+	grantedRoles, err := s.applyDatabase(databasePtr)
+	if err == nil {
+		databasePtr.Status.GrantedRoles = grantedRoles
+
+		extensions := mergeExtensions(s.getInstanceExtensions(databasePtr.Spec.Instance), databasePtr.Spec.Extensions)
+		databasePtr.Status.Extensions, err = s.applyExtensions(databasePtr.Spec.Instance, databasePtr.GetDatabaseName(), extensions)
+	}
+
+	databasePtr.Status.ObservedGeneration = databasePtr.Generation
+	databasePtr.Status.Phase, databasePtr.Status.Message = getPhase(err)
+
+	_ = s.updateResource(pgv1.PostgresqlDatabase, databasePtr.Namespace, databasePtr, true)
+}
+
+func (s *PostgreSQL) getInstanceExtensions(instance string) []pgv1.Extension {
+	curPtr := s.postgresqlCache.Fetch(instance)
+	if curPtr == nil || curPtr.(*serviceInfoPair).postgreSQLPtr == nil {
+		return nil
+	}
+
+	return curPtr.(*serviceInfoPair).postgreSQLPtr.Spec.Extensions
+}
+
+func (s *PostgreSQL) applyDatabase(databasePtr *pgv1.PostgreSQLDatabase) (grantedRoles []string, err *cd.Result) {
+	instance := databasePtr.Spec.Instance
+	if !s.isInstanceReady(instance) {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("instance %s not ready", instance))
+		return
+	}
+
+	databaseName := databasePtr.GetDatabaseName()
+	encoding := databasePtr.Spec.Encoding
+	if encoding == "" {
+		encoding = defaultEncoding
+	}
+
+	// 数据库不存在时编码为空
+	curEncoding, encodingErr := s.querySQL(instance, "", "database-encoding", databaseName)
+	if encodingErr != nil {
+		err = encodingErr
+		return
+	}
+
+	connectionLimit := strconv.Itoa(-1)
+	if databasePtr.Spec.ConnectionLimit != nil {
+		connectionLimit = strconv.Itoa(int(*databasePtr.Spec.ConnectionLimit))
+	}
+
+	if curEncoding == "" {
+		_, err = s.executeSQL(instance, "", "database-create", databaseName, encoding, connectionLimit, databasePtr.Spec.Owner)
+		if err != nil {
+			return
+		}
+	} else if !strings.EqualFold(curEncoding, encoding) {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("database %s encoding is %s, can not change to %s", databaseName, curEncoding, encoding))
+		return
+	}
+
+	_, err = s.executeSQL(instance, "", "database-alter", databaseName, connectionLimit, databasePtr.Spec.Owner)
+	if err != nil {
+		return
+	}
+
+	// 先收回已不再声明的角色权限，再按声明重新授予
+	declaredRoles := map[string]bool{}
+	for _, val := range databasePtr.Spec.Privileges {
+		declaredRoles[val.Role] = true
+	}
+	for _, val := range databasePtr.Status.GrantedRoles {
+		if declaredRoles[val] {
+			continue
+		}
+		_, err = s.executeSQL(instance, "", "database-grant", databaseName, val)
+		if err != nil {
+			return
+		}
+	}
+	for _, val := range databasePtr.Spec.Privileges {
+		args := append([]string{databaseName, val.Role}, val.Privileges...)
+		_, err = s.executeSQL(instance, "", "database-grant", args...)
+		if err != nil {
+			return
+		}
+		grantedRoles = append(grantedRoles, val.Role)
+	}
+
+	return
+}
+
+func (s *PostgreSQL) deleteDatabase(databasePtr *pgv1.PostgreSQLDatabase) {
+	if !hasFinalizer(&databasePtr.ObjectMeta) {
+		return
+	}
+
+	// 删除数据库成功前保留finalizer，下个周期继续删除
+	if databasePtr.Spec.ReclaimPolicy == pgv1.ReclaimDrop {
+		dropErr := s.dropDatabase(databasePtr)
+		if dropErr != nil {
+			log.Warnf("deleteDatabase %s pending, reason:%s", databasePtr.Name, dropErr.Reason)
+			databasePtr.Status.Phase, databasePtr.Status.Message = getPhase(dropErr)
+			_ = s.updateResource(pgv1.PostgresqlDatabase, databasePtr.Namespace, databasePtr, true)
+			return
+		}
+	}
+
+	removeFinalizer(&databasePtr.ObjectMeta)
+	_ = s.updateResource(pgv1.PostgresqlDatabase, databasePtr.Namespace, databasePtr, false)
+}
+
+// dropDatabase 实例未就绪时等待，实例已删除时不再删除数据库
+func (s *PostgreSQL) dropDatabase(databasePtr *pgv1.PostgreSQLDatabase) (err *cd.Result) {
+	instance := databasePtr.Spec.Instance
+	if s.isInstanceRemoved(instance) {
+		return
+	}
+	if !s.isInstanceReady(instance) {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("instance %s not ready, waiting to drop database", instance))
+		return
+	}
+
+	_, err = s.executeSQL(instance, "", "database-drop", databasePtr.GetDatabaseName())
+	return
+}
@@ -0,0 +1,167 @@
+package biz
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	sharedPreloadLibraries = "shared_preload_libraries"
+	defaultDatabase        = "postgres"
+)
+
+// preloadExtensions 需要通过shared_preload_libraries加载的扩展
+var preloadExtensions = map[string]bool{
+	"pg_stat_statements": true,
+	"pg_stat_monitor":    true,
+	"pgaudit":            true,
+	"timescaledb":        true,
+}
+
+func getPreloadLibraries(extensions []pgv1.Extension) (ret []string) {
+	for _, val := range extensions {
+		if preloadExtensions[val.Name] {
+			ret = append(ret, val.Name)
+		}
+	}
+
+	return
+}
+
+// mergeExtensions 数据库声明的扩展优先于实例声明
+func mergeExtensions(instanceExtensions, databaseExtensions []pgv1.Extension) (ret []pgv1.Extension) {
+	declared := map[string]bool{}
+	for _, val := range databaseExtensions {
+		declared[val.Name] = true
+		ret = append(ret, val)
+	}
+	for _, val := range instanceExtensions {
+		if !declared[val.Name] {
+			ret = append(ret, val)
+		}
+	}
+
+	return
+}
+
+// isExtensionsSynced 判断声明的扩展是否均已按版本安装
+func isExtensionsSynced(extensions []pgv1.Extension, statusList []pgv1.ExtensionStatus) bool {
+	installed := map[string]string{}
+	for _, val := range statusList {
+		installed[val.Name] = val.Version
+	}
+	for _, val := range extensions {
+		version, ok := installed[val.Name]
+		if !ok || (val.Version != "" && val.Version != version) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setDatabasePreload 记录各实例下数据库扩展所需的预加载库
+func (s *PostgreSQL) setDatabasePreload(preload map[string][]string) {
+	s.preloadLock.Lock()
+	defer s.preloadLock.Unlock()
+	s.databasePreload = preload
+}
+
+// getParameters 实例启动参数，shared_preload_libraries为实例与数据库声明扩展的并集
+func (s *PostgreSQL) getParameters(pgPtr *pgv1.PostgreSQL) (ret map[string]string) {
+	libraries := map[string]bool{}
+	for _, val := range getPreloadLibraries(pgPtr.Spec.Extensions) {
+		libraries[val] = true
+	}
+
+	s.preloadLock.RLock()
+	for _, val := range s.databasePreload[pgPtr.Name] {
+		libraries[val] = true
+	}
+	s.preloadLock.RUnlock()
+
+	if len(libraries) == 0 {
+		return
+	}
+
+	items := []string{}
+	for k := range libraries {
+		items = append(items, k)
+	}
+	sort.Strings(items)
+
+	ret = map[string]string{sharedPreloadLibraries: strings.Join(items, ",")}
+	return
+}
+
+// applyExtensions 在指定数据库中安装或升级扩展，返回声明扩展的已安装版本
+func (s *PostgreSQL) applyExtensions(instance, database string, extensions []pgv1.Extension) (ret []pgv1.ExtensionStatus, err *cd.Result) {
+	if len(extensions) == 0 {
+		return
+	}
+
+	loadedVal, loadedErr := s.querySQL(instance, database, "preload-libraries")
+	if loadedErr != nil {
+		err = loadedErr
+		return
+	}
+	loaded := map[string]bool{}
+	for _, val := range strings.Split(loadedVal, ",") {
+		loaded[strings.TrimSpace(val)] = true
+	}
+
+	for _, val := range extensions {
+		availableVal, availableErr := s.querySQL(instance, "", "extension-available", val.Name, val.Version)
+		if availableErr != nil {
+			err = availableErr
+			return
+		}
+		if availableVal != "1" {
+			err = cd.NewError(cd.IllegalParam, fmt.Sprintf("extension %s %s not available in image", val.Name, val.Version))
+			return
+		}
+
+		// 预加载库在实例重启后生效，期间保持等待
+		if preloadExtensions[val.Name] && !loaded[val.Name] {
+			err = cd.NewWarn(cd.Warned, fmt.Sprintf("extension %s waiting for instance restart to load %s", val.Name, sharedPreloadLibraries))
+			return
+		}
+
+		curVersion, versionErr := s.querySQL(instance, database, "extension-version", val.Name)
+		if versionErr != nil {
+			err = versionErr
+			return
+		}
+
+		operation := ""
+		switch {
+		case curVersion == "":
+			operation = "extension-create"
+		case val.Version == "" || val.Version != curVersion:
+			// 未指定版本时升级到镜像中的默认版本
+			operation = "extension-update"
+		}
+		if operation != "" {
+			_, err = s.executeSQL(instance, database, operation, val.Name, val.Version)
+			if err != nil {
+				log.Errorf("applyExtensions %s failed, instance:%s, database:%s, error:%s", val.Name, instance, database, err.Error())
+				return
+			}
+
+			curVersion, err = s.querySQL(instance, database, "extension-version", val.Name)
+			if err != nil {
+				return
+			}
+		}
+
+		ret = append(ret, pgv1.ExtensionStatus{Name: val.Name, Version: curVersion})
+	}
+
+	return
+}
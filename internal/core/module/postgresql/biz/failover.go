@@ -0,0 +1,245 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/internal/core/base/record"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	// failoverDelay 主节点持续故障超过该时长才切换，避免Pod重启或短暂抖动引起切换
+	failoverDelay = time.Minute
+	// maxFailoverHistory status中保留的切换记录数量
+	maxFailoverHistory = 10
+)
+
+const (
+	failoverPodGone      = "PodGone"
+	failoverNodeNotReady = "NodeNotReady"
+	failoverNotReady     = "NotReady"
+)
+
+// failoverState 进行中的故障切换，from为被隔离的原主节点，to为提升的备节点
+type failoverState struct {
+	from     string
+	to       string
+	reason   string
+	lsn      string
+	time     metav1.Time
+	promoted bool
+}
+
+// reconcileFailover 主节点故障持续超过failoverDelay后隔离原主节点并提升回放位置最新的备节点
+// 新主节点记录到status后解除隔离，原主节点以备节点身份重新加入
+func (s *PostgreSQL) reconcileFailover(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if failoverPtr := pairPtr.failover; failoverPtr != nil {
+		if pgPtr.GetPrimary() == failoverPtr.to {
+			pairPtr.failover = nil
+			pairPtr.primaryFailedAt = time.Time{}
+			_ = s.updateK8sDeployment(pairPtr)
+			log.Infof("reconcileFailover %s, failover to %s completed, %s unfenced", pgPtr.Name, failoverPtr.to, failoverPtr.from)
+			return
+		}
+
+		// status未能保存时重新记录
+		s.applyFailover(pairPtr)
+		return
+	}
+
+	// 计划内切换隔离的原主节点停止属于预期，由切换超时处理
+	replicationPtr := getReplication(pgPtr)
+	if replicationPtr == nil || replicationPtr.Standbys == 0 || pairPtr.serviceInfo == nil || pairPtr.serviceInfo.Replicas == 0 ||
+		pgPtr.Status.Phase != pgv1.InstancePhaseRunning || isSwitchoverFenced(pgPtr) {
+		pairPtr.primaryFailedAt = time.Time{}
+		return
+	}
+
+	primary := pgPtr.GetPrimary()
+	reason := s.checkPrimary(pgPtr, primary)
+	if reason == "" {
+		pairPtr.primaryFailedAt = time.Time{}
+		return
+	}
+	if pairPtr.primaryFailedAt.IsZero() {
+		pairPtr.primaryFailedAt = time.Now()
+		log.Warnf("reconcileFailover %s, primary %s failed, reason:%s", pgPtr.Name, primary, reason)
+		return
+	}
+	if time.Since(pairPtr.primaryFailedAt) < failoverDelay {
+		return
+	}
+
+	s.failover(pairPtr, primary, reason)
+}
+
+// checkPrimary 检查主节点的Pod、所在节点与服务状态，返回故障原因，正常时返回空
+func (s *PostgreSQL) checkPrimary(pgPtr *pgv1.PostgreSQL, primary string) string {
+	clientSet := s.getClientSet()
+	if clientSet != nil {
+		labels := common.NewInstanceLabels(pgPtr.Name)
+		labels[common.MemberLabel] = primary
+		podList, podErr := clientSet.CoreV1().Pods(pgPtr.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labels.String()})
+		if podErr != nil {
+			log.Errorf("checkPrimary %s failed, list pod error:%s", pgPtr.Name, podErr.Error())
+		} else {
+			var podPtr *corev1.Pod
+			for idx := range podList.Items {
+				if podList.Items[idx].Status.Phase == corev1.PodRunning && podList.Items[idx].DeletionTimestamp == nil {
+					podPtr = &podList.Items[idx]
+					break
+				}
+			}
+			if podPtr == nil {
+				return failoverPodGone
+			}
+
+			// 命名空间模式下无法读取节点
+			if !config.IsNamespaceScope() && podPtr.Spec.NodeName != "" && !s.isNodeReady(podPtr.Spec.NodeName) {
+				return failoverNodeNotReady
+			}
+		}
+	}
+
+	if !s.isServerReady(pgPtr.Name) {
+		return failoverNotReady
+	}
+	return ""
+}
+
+// isNodeReady 读取节点失败时按就绪处理，由服务状态判断是否故障
+func (s *PostgreSQL) isNodeReady(nodeName string) bool {
+	nodePtr, nodeErr := s.getClientSet().CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if nodeErr != nil {
+		log.Errorf("isNodeReady %s failed, error:%s", nodeName, nodeErr.Error())
+		return true
+	}
+
+	for _, val := range nodePtr.Status.Conditions {
+		if val.Type == corev1.NodeReady {
+			return val.Status == corev1.ConditionTrue
+		}
+	}
+	return true
+}
+
+// selectCandidate 选择回放位置最新的备节点，无法查询回放位置的备节点不参与选择
+func (s *PostgreSQL) selectCandidate(pgPtr *pgv1.PostgreSQL, primary string) (ret, lsn string) {
+	serviceInfo := &common.ServiceInfo{Name: pgPtr.Name, Replication: getReplication(pgPtr)}
+	maxLSN := uint64(0)
+	for _, member := range serviceInfo.GetMembers() {
+		if member == primary {
+			continue
+		}
+
+		lsnVal, lsnErr := s.executeMemberCommand(pgPtr.Name, member, common.DiagnosticCommand, "replay-lsn")
+		if lsnErr != nil {
+			log.Warnf("selectCandidate %s, query member %s replay lsn error:%s", pgPtr.Name, member, lsnErr.Error())
+			continue
+		}
+		lsnPos, parseErr := parseLSN(lsnVal)
+		if parseErr != nil {
+			log.Warnf("selectCandidate %s, member %s replay lsn %s illegal", pgPtr.Name, member, lsnVal)
+			continue
+		}
+		if ret == "" || lsnPos > maxLSN {
+			ret = member
+			lsn = lsnVal
+			maxLSN = lsnPos
+		}
+	}
+	return
+}
+
+// failover 先隔离原主节点再提升备节点，提升失败时解除隔离，下一周期重新选择备节点
+func (s *PostgreSQL) failover(pairPtr *serviceInfoPair, primary, reason string) {
+	pgPtr := pairPtr.postgreSQLPtr
+	candidate, lsn := s.selectCandidate(pgPtr, primary)
+	if candidate == "" {
+		log.Errorf("failover %s failed, primary %s failed, no available standby", pgPtr.Name, primary)
+		return
+	}
+
+	pairPtr.failover = &failoverState{from: primary, to: candidate, reason: reason, lsn: lsn, time: metav1.Now().Rfc3339Copy()}
+	err := s.updateK8sDeployment(pairPtr)
+	if err != nil {
+		log.Errorf("failover %s failed, fence %s error:%s", pgPtr.Name, primary, err.Error())
+		pairPtr.failover = nil
+		return
+	}
+
+	_, err = s.executeMemberCommand(pgPtr.Name, candidate, common.AdminCommand, "promote")
+	if err != nil {
+		log.Errorf("failover %s failed, promote %s error:%s", pgPtr.Name, candidate, err.Error())
+		pairPtr.failover = nil
+		_ = s.updateK8sDeployment(pairPtr)
+		return
+	}
+
+	pairPtr.failover.promoted = true
+	s.applyFailover(pairPtr)
+
+	message := fmt.Sprintf("primary %s failed, reason:%s, promoted %s at lsn %s", primary, reason, candidate, lsn)
+	record.Event(s.getClientSet(), record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.PostgreSQLKind, pgPtr),
+		corev1.EventTypeWarning, "Failover", message)
+	log.Warnf("failover %s, %s", pgPtr.Name, message)
+}
+
+// applyFailover 记录新主节点与切换记录并将读写Service指向新主节点，status由reconcileInstances保存
+func (s *PostgreSQL) applyFailover(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	failoverPtr := pairPtr.failover
+	statusPtr := pgPtr.Status.Replication
+	if statusPtr == nil {
+		statusPtr = &pgv1.ReplicationStatus{}
+	}
+
+	historyLen := len(statusPtr.History)
+	if historyLen == 0 || !statusPtr.History[historyLen-1].Time.Equal(&failoverPtr.time) {
+		statusPtr.History = append(statusPtr.History, pgv1.FailoverRecord{
+			Time:   failoverPtr.time,
+			From:   failoverPtr.from,
+			To:     failoverPtr.to,
+			Reason: failoverPtr.reason,
+			LSN:    failoverPtr.lsn,
+		})
+		if len(statusPtr.History) > maxFailoverHistory {
+			statusPtr.History = statusPtr.History[len(statusPtr.History)-maxFailoverHistory:]
+		}
+	}
+	statusPtr.Primary = failoverPtr.to
+	if statusPtr.Switchover.IsRunning() {
+		now := metav1.Now()
+		statusPtr.Switchover.Phase = pgv1.SwitchoverPhaseFailed
+		statusPtr.Switchover.Message = "interrupted by failover"
+		statusPtr.Switchover.TransitionTime = &now
+	}
+	pgPtr.Status.Replication = statusPtr
+
+	_ = s.updateK8sDeployment(pairPtr)
+}
+
+// executeMemberCommand 在实例指定成员的Pod中执行目录中的命令
+func (s *PostgreSQL) executeMemberCommand(instance, member, cmdType, operation string) (ret string, err *cd.Result) {
+	cmdInfo := &common.CmdInfo{
+		Service:   instance,
+		Member:    member,
+		Catalog:   common.PostgreSQL,
+		Type:      cmdType,
+		Operation: operation,
+	}
+
+	ret, err = s.sendCommand(cmdInfo)
+	return
+}
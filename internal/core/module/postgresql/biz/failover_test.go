@@ -0,0 +1,246 @@
+package biz
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/task"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// fakeAPIServer 保存实例定义，其余资源的列举返回空列表，查询返回不存在，创建原样返回
+type fakeAPIServer struct {
+	lock     sync.Mutex
+	instance map[string]interface{}
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	items := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	resource := items[len(items)-1]
+	// /api/v1与/apis/group/version之后为namespaces/<ns>/<resource>[/<name>]
+	prefixLen := 3
+	if items[0] == "api" {
+		prefixLen = 2
+	}
+	isList := (len(items)-prefixLen)%2 == 1
+	isInstance := strings.Contains(r.URL.Path, "/"+pgv1.Postgresql)
+	switch {
+	case r.Method == http.MethodPut && isInstance:
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &s.instance)
+		_, _ = w.Write(body)
+	case r.Method == http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+	case r.Method == http.MethodGet && resource == pgv1.Postgresql:
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"apiVersion": pgv1.Group + "/" + pgv1.Version,
+			"kind":       "PostgreSQLList",
+			"metadata":   map[string]interface{}{},
+			"items":      []interface{}{s.instance},
+		})
+	case r.Method == http.MethodGet && isList:
+		kind := map[string]string{"pods": "PodList", "secrets": "SecretList"}[resource]
+		if kind == "" {
+			kind = "List"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       kind,
+			"metadata":   map[string]interface{}{},
+			"items":      []interface{}{},
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}
+}
+
+// syncHub 在调用方协程内同步分发事件，测试只检查本模块的并发访问
+type syncHub struct {
+	lock      sync.RWMutex
+	observers map[string]event.Observer
+}
+
+func newSyncHub() *syncHub {
+	return &syncHub{observers: map[string]event.Observer{}}
+}
+
+func (s *syncHub) Subscribe(_ string, observer event.Observer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.observers[observer.ID()] = observer
+}
+
+func (s *syncHub) Unsubscribe(_ string, _ event.Observer) {
+}
+
+func (s *syncHub) Post(ev event.Event) {
+	s.Send(ev)
+}
+
+func (s *syncHub) Send(ev event.Event) event.Result {
+	s.lock.RLock()
+	observer, observerOK := s.observers[ev.Destination()]
+	s.lock.RUnlock()
+
+	result := event.NewResult(ev.ID(), ev.Source(), ev.Destination())
+	if observerOK {
+		observer.Notify(ev, result)
+	}
+	return result
+}
+
+func (s *syncHub) Call(ev event.Event) event.Result {
+	return s.Send(ev)
+}
+
+func (s *syncHub) Terminate() {
+}
+
+func (s *fakeAPIServer) getInstance(t *testing.T) *pgv1.PostgreSQL {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	byteVal, _ := json.Marshal(s.instance)
+	pgPtr := &pgv1.PostgreSQL{}
+	if err := json.Unmarshal(byteVal, pgPtr); err != nil {
+		t.Fatalf("unmarshal instance failed, error:%s", err.Error())
+	}
+	return pgPtr
+}
+
+// TestFailoverRace 故障切换期间k8s模块持续通知服务变化，以-race运行时实例缓存不应出现数据竞争
+func TestFailoverRace(t *testing.T) {
+	pgPtr := &pgv1.PostgreSQL{
+		TypeMeta:   metav1.TypeMeta{APIVersion: pgv1.Group + "/" + pgv1.Version, Kind: pgv1.PostgreSQLKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", ResourceVersion: "1"},
+		Spec:       pgv1.Spec{Replication: &pgv1.ReplicationSpec{Standbys: 1}},
+		Status: pgv1.Status{
+			Phase:       pgv1.InstancePhaseRunning,
+			Replication: &pgv1.ReplicationStatus{Primary: "db"},
+		},
+	}
+	byteVal, _ := json.Marshal(pgPtr)
+	apiServer := &fakeAPIServer{}
+	_ = json.Unmarshal(byteVal, &apiServer.instance)
+	httpServer := httptest.NewServer(apiServer)
+	defer httpServer.Close()
+
+	cfg := &rest.Config{Host: httpServer.URL}
+	clientSet, clientErr := kubernetes.NewForConfig(cfg)
+	if clientErr != nil {
+		t.Fatalf("new clientset failed, error:%s", clientErr.Error())
+	}
+	dynamicClient, dynamicErr := dynamic.NewForConfig(cfg)
+	if dynamicErr != nil {
+		t.Fatalf("new dynamic client failed, error:%s", dynamicErr.Error())
+	}
+
+	hub := newSyncHub()
+
+	// k8s模块：主节点Pod已不存在，备节点可以查询回放位置并提升
+	var promoteCount atomic.Int32
+	k8sObserver := event.NewSimpleObserver(common.K8sModule, hub)
+	k8sObserver.Subscribe(common.ExecuteCommand, func(ev event.Event, re event.Result) {
+		cmdInfo := ev.Data().(*common.CmdInfo)
+		var output []byte
+		switch cmdInfo.Operation {
+		case "replay-lsn":
+			output = []byte("0/3000000")
+		case "promote":
+			promoteCount.Add(1)
+			output = []byte("t")
+		}
+		if re != nil {
+			re.Set(output, nil)
+		}
+	})
+	k8sObserver.Subscribe(common.UpdateService, func(_ event.Event, re event.Result) {
+		if re != nil {
+			re.Set(nil, nil)
+		}
+	})
+
+	pgModule := New(hub, task.NewBackgroundRoutine(10))
+	pgModule.clientSet = clientSet
+	pgModule.client = dynamicClient
+
+	notify := func() {
+		values := event.NewValues()
+		values.Set(event.Action, event.Add)
+		serviceInfo := &common.ServiceInfo{Name: "db", Namespace: "default", Catalog: common.PostgreSQL, Replicas: 1}
+		pgModule.serviceNotify(event.NewEvent(common.NotifyService, common.K8sModule, common.PostgreSQLModule, values, serviceInfo), nil)
+	}
+
+	// 首次同步记录主节点故障，将故障时间提前以立即切换
+	notify()
+	pgModule.reconcile()
+	pairPtr := pgModule.postgresqlCache.Fetch("db").(*serviceInfoPair)
+	if pairPtr.primaryFailedAt.IsZero() {
+		t.Fatalf("primary failure not detected, pair:%+v", pairPtr)
+	}
+	pairPtr.primaryFailedAt = time.Now().Add(-2 * failoverDelay)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				notify()
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		pgModule.reconcileTime = time.Time{}
+		pgModule.reconcile()
+		if pgModule.postgresqlCache.Fetch("db").(*serviceInfoPair).failover == nil && promoteCount.Load() > 0 {
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if promoteCount.Load() != 1 {
+		t.Fatalf("promote count %d, expect 1", promoteCount.Load())
+	}
+	statusPtr := apiServer.getInstance(t).Status.Replication
+	if statusPtr == nil || statusPtr.Primary != "db-1" {
+		t.Fatalf("primary not switched, status:%+v", statusPtr)
+	}
+	if len(statusPtr.History) != 1 || statusPtr.History[0].From != "db" || statusPtr.History[0].To != "db-1" {
+		t.Fatalf("illegal failover history %+v", statusPtr.History)
+	}
+}
@@ -0,0 +1,170 @@
+package biz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/config"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	hbaFile      = "pg_hba.conf"
+	hbaHeader    = "# managed by database-operator, hash:"
+	hbaParameter = "hba_file"
+)
+
+// getOperatorHBARules operator通过本地socket以root身份执行命令，备份与恢复任务通过网络以root身份连接，基础备份与备节点使用复制协议，始终位于首位
+// 网络连接只允许来自配置的Pod网段，并使用scram-sha-256认证，root的口令位于实例的超级用户Secret，其他来源的root连接均拒绝
+func getOperatorHBARules() []string {
+	ret := []string{fmt.Sprintf("local all %s trust", common.DefaultPostgreSQLRoot)}
+	for _, val := range config.GetPostgreSQLConfig().SuperuserCIDRs {
+		if _, _, err := net.ParseCIDR(val); err != nil {
+			log.Warnf("getOperatorHBARules ignore illegal superuser cidr %s", val)
+			continue
+		}
+
+		ret = append(ret,
+			fmt.Sprintf("host all %s %s scram-sha-256", common.DefaultPostgreSQLRoot, val),
+			fmt.Sprintf("host replication %s %s scram-sha-256", common.DefaultPostgreSQLRoot, val))
+	}
+	ret = append(ret,
+		fmt.Sprintf("host all %s all reject", common.DefaultPostgreSQLRoot),
+		fmt.Sprintf("host replication %s all reject", common.DefaultPostgreSQLRoot))
+
+	return ret
+}
+
+// defaultHBARules 未声明规则时使用的规则，与镜像默认的远程访问规则一致
+var defaultHBARules = []pgv1.HBARule{
+	{Type: "host", Database: "all", User: "all", Address: "all", Method: "scram-sha-256"},
+}
+
+// getHBARules 镜像默认的pg_hba.conf允许root从任意地址连接且不允许远程复制连接，实例始终使用受管配置
+func getHBARules(pgPtr *pgv1.PostgreSQL) []pgv1.HBARule {
+	if len(pgPtr.Spec.HBA) == 0 {
+		return defaultHBARules
+	}
+
+	return pgPtr.Spec.HBA
+}
+
+var (
+	hbaTypes   = map[string]bool{"local": true, "host": true, "hostssl": true, "hostnossl": true}
+	hbaMethods = map[string]bool{"scram-sha-256": true, "md5": true, "cert": true, "reject": true}
+	hbaNameReg = regexp.MustCompile(`^[A-Za-z0-9_$+-]+(,[A-Za-z0-9_$+-]+)*$`)
+	hbaAddress = map[string]bool{"all": true, "samehost": true, "samenet": true}
+)
+
+func validateHBARule(rule *pgv1.HBARule) error {
+	if !hbaTypes[rule.Type] {
+		return fmt.Errorf("illegal hba type %s", rule.Type)
+	}
+	if !hbaMethods[rule.Method] {
+		return fmt.Errorf("illegal hba method %s", rule.Method)
+	}
+	if !hbaNameReg.MatchString(rule.Database) {
+		return fmt.Errorf("illegal hba database %s", rule.Database)
+	}
+	if !hbaNameReg.MatchString(rule.User) {
+		return fmt.Errorf("illegal hba user %s", rule.User)
+	}
+	if rule.Method == "cert" && rule.Type != "hostssl" {
+		return fmt.Errorf("hba method cert requires type hostssl")
+	}
+
+	if rule.Type == "local" {
+		if rule.Address != "" {
+			return fmt.Errorf("local hba rule can not specify address")
+		}
+		return nil
+	}
+
+	if hbaAddress[rule.Address] {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(rule.Address); err != nil {
+		return fmt.Errorf("illegal hba address %s", rule.Address)
+	}
+
+	return nil
+}
+
+// renderHBA 校验并生成pg_hba.conf，首行记录内容摘要用于确认文件已同步到Pod
+func renderHBA(rules []pgv1.HBARule) (content, hash string, err *cd.Result) {
+	lines := getOperatorHBARules()
+	for idx := range rules {
+		rulePtr := &rules[idx]
+		if ruleErr := validateHBARule(rulePtr); ruleErr != nil {
+			err = cd.NewError(cd.IllegalParam, fmt.Sprintf("hba rule %d: %s", idx, ruleErr.Error()))
+			return
+		}
+
+		fields := []string{rulePtr.Type, rulePtr.Database, rulePtr.User}
+		if rulePtr.Type != "local" {
+			fields = append(fields, rulePtr.Address)
+		}
+		fields = append(fields, rulePtr.Method)
+		lines = append(lines, strings.Join(fields, " "))
+	}
+
+	body := strings.Join(lines, "\n") + "\n"
+	hashVal := sha256.Sum256([]byte(body))
+	hash = hex.EncodeToString(hashVal[:8])
+	content = hbaHeader + hash + "\n" + body
+	return
+}
+
+// applyHBA 受管pg_hba.conf同步到Pod后reload，文件尚未同步时保持等待
+func (s *PostgreSQL) applyHBA(pgPtr *pgv1.PostgreSQL) (ret string, err *cd.Result) {
+	hbaRules := getHBARules(pgPtr)
+	if len(hbaRules) == 0 {
+		return
+	}
+
+	_, hash, hbaErr := renderHBA(hbaRules)
+	if hbaErr != nil {
+		err = hbaErr
+		return
+	}
+	if pgPtr.Status.HBAHash == hash {
+		ret = hash
+		return
+	}
+
+	headerVal, headerErr := s.querySQL(pgPtr.Name, "", "hba-header")
+	if headerErr != nil {
+		err = headerErr
+		return
+	}
+	if headerVal != hbaHeader+hash {
+		err = cd.NewWarn(cd.Warned, "waiting for pg_hba.conf to be synced")
+		return
+	}
+
+	_, err = s.executeCommand(pgPtr.Name, common.AdminCommand, "reload", nil)
+	if err != nil {
+		return
+	}
+
+	errorVal, errorErr := s.querySQL(pgPtr.Name, "", "hba-errors")
+	if errorErr != nil {
+		err = errorErr
+		return
+	}
+	if errorVal != "0" {
+		err = cd.NewError(cd.UnExpected, "pg_hba.conf contains invalid rules")
+		return
+	}
+
+	ret = hash
+	return
+}
@@ -0,0 +1,95 @@
+package biz
+
+import (
+	"strings"
+	"testing"
+
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func TestValidateHBARule(t *testing.T) {
+	cases := []struct {
+		name      string
+		rule      pgv1.HBARule
+		expectErr bool
+	}{
+		{name: "host cidr", rule: pgv1.HBARule{Type: "host", Database: "app", User: "app", Address: "10.1.0.0/16", Method: "scram-sha-256"}},
+		{name: "host all", rule: pgv1.HBARule{Type: "host", Database: "all", User: "all", Address: "all", Method: "md5"}},
+		{name: "name list", rule: pgv1.HBARule{Type: "host", Database: "app,report", User: "+readers", Address: "samenet", Method: "reject"}},
+		{name: "local", rule: pgv1.HBARule{Type: "local", Database: "all", User: "app", Method: "scram-sha-256"}},
+		{name: "cert over ssl", rule: pgv1.HBARule{Type: "hostssl", Database: "all", User: "app", Address: "all", Method: "cert"}},
+		{name: "illegal type", rule: pgv1.HBARule{Type: "hostgssenc", Database: "all", User: "all", Address: "all", Method: "md5"}, expectErr: true},
+		{name: "trust", rule: pgv1.HBARule{Type: "host", Database: "all", User: "all", Address: "all", Method: "trust"}, expectErr: true},
+		{name: "cert without ssl", rule: pgv1.HBARule{Type: "host", Database: "all", User: "app", Address: "all", Method: "cert"}, expectErr: true},
+		{name: "local address", rule: pgv1.HBARule{Type: "local", Database: "all", User: "app", Address: "all", Method: "md5"}, expectErr: true},
+		{name: "illegal address", rule: pgv1.HBARule{Type: "host", Database: "all", User: "all", Address: "10.0.0.1", Method: "md5"}, expectErr: true},
+		{name: "missing address", rule: pgv1.HBARule{Type: "host", Database: "all", User: "all", Method: "md5"}, expectErr: true},
+		{name: "injected line", rule: pgv1.HBARule{Type: "host", Database: "all\nlocal all all trust", User: "all", Address: "all", Method: "md5"}, expectErr: true},
+		{name: "empty user", rule: pgv1.HBARule{Type: "host", Database: "all", Address: "all", Method: "md5"}, expectErr: true},
+	}
+	for _, c := range cases {
+		err := validateHBARule(&c.rule)
+		if (err != nil) != c.expectErr {
+			t.Errorf("%s: validateHBARule error %v, expect error %v", c.name, err, c.expectErr)
+		}
+	}
+}
+
+// TestRenderHBA operator的规则始终在前，声明的规则按顺序追加，首行记录内容摘要
+func TestRenderHBA(t *testing.T) {
+	rules := []pgv1.HBARule{
+		{Type: "local", Database: "all", User: "app", Method: "scram-sha-256"},
+		{Type: "host", Database: "app", User: "app", Address: "10.1.0.0/16", Method: "scram-sha-256"},
+	}
+	content, hash, err := renderHBA(rules)
+	if err != nil {
+		t.Fatalf("renderHBA failed, error:%s", err.Error())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if lines[0] != hbaHeader+hash || len(hash) != 16 {
+		t.Fatalf("illegal header %s", lines[0])
+	}
+	operatorRules := getOperatorHBARules()
+	if len(lines) != 1+len(operatorRules)+len(rules) {
+		t.Fatalf("illegal line count %d:\n%s", len(lines), content)
+	}
+	for idx, val := range operatorRules {
+		if lines[1+idx] != val {
+			t.Errorf("line %d: %s, expect operator rule %s", 1+idx, lines[1+idx], val)
+		}
+	}
+	expects := []string{"local all app scram-sha-256", "host app app 10.1.0.0/16 scram-sha-256"}
+	for idx, val := range expects {
+		if line := lines[1+len(operatorRules)+idx]; line != val {
+			t.Errorf("rule %d: %s, expect %s", idx, line, val)
+		}
+	}
+	// root的网络连接只允许来自Pod网段，其余来源在声明的规则之前拒绝
+	if operatorRules[0] != "local all root trust" || operatorRules[len(operatorRules)-2] != "host all root all reject" {
+		t.Errorf("illegal operator rules %v", operatorRules)
+	}
+
+	_, sameHash, _ := renderHBA(rules)
+	_, otherHash, _ := renderHBA(rules[:1])
+	if sameHash != hash || otherHash == hash {
+		t.Fatalf("hash should only change with the rules, hash:%s, same:%s, other:%s", hash, sameHash, otherHash)
+	}
+
+	_, _, err = renderHBA([]pgv1.HBARule{rules[0], {Type: "host", Database: "all", User: "all", Address: "all", Method: "trust"}})
+	if err == nil || !strings.Contains(err.Reason, "hba rule 1") {
+		t.Fatalf("expect error on rule 1, error:%v", err)
+	}
+}
+
+func TestGetHBARules(t *testing.T) {
+	pgPtr := &pgv1.PostgreSQL{}
+	if rules := getHBARules(pgPtr); len(rules) != 1 || rules[0].Method != "scram-sha-256" {
+		t.Fatalf("illegal default rules %+v", rules)
+	}
+
+	pgPtr.Spec.HBA = []pgv1.HBARule{{Type: "local", Database: "all", User: "all", Method: "reject"}}
+	if rules := getHBARules(pgPtr); len(rules) != 1 || rules[0].Method != "reject" {
+		t.Fatalf("declared rules ignored, rules:%+v", rules)
+	}
+}
@@ -0,0 +1,148 @@
+package biz
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/base/record"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// hibernateInstance 设置实例的休眠状态，由reconcileHibernation执行休眠与恢复
+func (s *PostgreSQL) hibernateInstance(ev event.Event, re event.Result) {
+	paramPtr, paramOK := ev.Data().(*common.HibernateParam)
+	if !paramOK {
+		log.Warnf("hibernateInstance failed, illegal param")
+		if re != nil {
+			re.Set(nil, cd.NewError(cd.IllegalParam, "illegal param"))
+		}
+		return
+	}
+
+	err := s.setHibernate(paramPtr)
+	if re != nil {
+		re.Set(nil, err)
+	}
+}
+
+func (s *PostgreSQL) setHibernate(paramPtr *common.HibernateParam) (err *cd.Result) {
+	pgPtr := &pgv1.PostgreSQL{}
+	err = s.getResource(pgv1.Postgresql, s.getNamespace(), paramPtr.Name, pgPtr)
+	if err != nil {
+		return
+	}
+	// 启动因空闲休眠的实例时记录唤醒时间
+	wake := !paramPtr.Hibernate && isIdle(pgPtr, time.Now())
+	if pgPtr.Spec.Hibernate == paramPtr.Hibernate && !wake {
+		if !paramPtr.Hibernate && isOutsideSchedule(pgPtr.Spec.Schedule, time.Now()) {
+			err = cd.NewError(cd.IllegalParam, fmt.Sprintf("instance %s is outside running schedule, keep it running instead", pgPtr.Name))
+		}
+		return
+	}
+	if paramPtr.Hibernate && pgPtr.Status.Replication != nil && pgPtr.Status.Replication.Switchover.IsRunning() {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("switchover to %s is running", pgPtr.Status.Replication.Switchover.Target))
+		return
+	}
+
+	pgPtr.Spec.Hibernate = paramPtr.Hibernate
+	if wake {
+		if pgPtr.Annotations == nil {
+			pgPtr.Annotations = map[string]string{}
+		}
+		pgPtr.Annotations[pgv1.WakeAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	}
+	err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, false)
+	if err != nil {
+		return
+	}
+
+	log.Infof("setHibernate %s, hibernate:%v, wake:%v", pgPtr.Name, paramPtr.Hibernate, wake)
+	return
+}
+
+// isHibernated 休眠的实例不运行任何Pod
+func isHibernated(pgPtr *pgv1.PostgreSQL) bool {
+	return pgPtr.Status.Phase == pgv1.InstancePhaseHibernated
+}
+
+// reconcileHibernation 按实例定义与运行时段休眠或恢复实例，返回true时实例未运行，跳过其余的同步
+func (s *PostgreSQL) reconcileHibernation(pairPtr *serviceInfoPair) bool {
+	pgPtr := pairPtr.postgreSQLPtr
+	reason := getHibernateReason(pgPtr, time.Now())
+	switch {
+	case reason != "" && isHibernated(pgPtr):
+		pgPtr.Status.HibernationReason = reason
+		return true
+	case reason != "":
+		return s.hibernate(pairPtr, reason)
+	case isHibernated(pgPtr):
+		s.resume(pairPtr)
+		return true
+	}
+
+	return false
+}
+
+// hibernate 等待恢复、故障切换与计划内切换结束后，在主节点执行checkpoint缩短下次启动的恢复时间，再停止全部Pod
+// 主节点已无法连接时直接停止，checkpoint失败时下一周期重试
+func (s *PostgreSQL) hibernate(pairPtr *serviceInfoPair, reason string) bool {
+	pgPtr := pairPtr.postgreSQLPtr
+	switchoverRunning := pgPtr.Status.Replication != nil && pgPtr.Status.Replication.Switchover.IsRunning()
+	if pgPtr.IsRestorePending() || pairPtr.failover != nil || switchoverRunning {
+		return false
+	}
+
+	if pgPtr.Status.Phase != pgv1.InstancePhaseHibernating {
+		pgPtr.Status.Phase = pgv1.InstancePhaseHibernating
+		pgPtr.Status.Message = ""
+		log.Infof("hibernate %s, hibernating, reason:%s", pgPtr.Name, reason)
+	}
+	pgPtr.Status.HibernationReason = reason
+	if pairPtr.serviceInfo != nil && pairPtr.serviceInfo.Replicas > 0 && s.isServerReady(pgPtr.Name) {
+		_, err := s.executeCommand(pgPtr.Name, common.AdminCommand, "checkpoint", nil)
+		if err != nil {
+			log.Errorf("hibernate %s failed, checkpoint error:%s", pgPtr.Name, err.Error())
+			pgPtr.Status.Message = err.Reason
+			return true
+		}
+	}
+
+	now := metav1.Now()
+	pgPtr.Status.Phase = pgv1.InstancePhaseHibernated
+	pgPtr.Status.Message = ""
+	pgPtr.Status.HibernatedTime = &now
+	// 同步失败时由serviceVerify继续缩容
+	_ = s.updateK8sDeployment(pairPtr)
+
+	record.Event(s.getClientSet(), record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.PostgreSQLKind, pgPtr),
+		corev1.EventTypeNormal, "Hibernated", fmt.Sprintf("instance checkpointed and scaled to zero, reason:%s", reason))
+	log.Infof("hibernate %s, hibernated", pgPtr.Name)
+	return true
+}
+
+// resume 恢复全部成员的Pod，数据库可连接后由reconcileInstance进入Running，连接池在此之后恢复
+func (s *PostgreSQL) resume(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	pgPtr.Status.Phase = pgv1.InstancePhaseResuming
+	pgPtr.Status.Message = "waiting for instance ready"
+	pgPtr.Status.HibernatedTime = nil
+	pgPtr.Status.HibernationReason = ""
+	if pgPtr.Spec.AutoPause != nil {
+		// 空闲计时从恢复时开始
+		now := metav1.Now()
+		pgPtr.Status.LastActiveTime = &now
+	}
+	_ = s.updateK8sDeployment(pairPtr)
+
+	record.Event(s.getClientSet(), record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.PostgreSQLKind, pgPtr),
+		corev1.EventTypeNormal, "Resuming", "instance scaled up")
+	log.Infof("resume %s, resuming", pgPtr.Name)
+}
@@ -0,0 +1,115 @@
+package biz
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// activityInterval 统计客户端连接的间隔
+const activityInterval = time.Minute
+
+func validateAutoPause(autoPausePtr *pgv1.AutoPauseSpec) error {
+	if autoPausePtr.IdleMinutes <= 0 {
+		return fmt.Errorf("illegal idle minutes %d", autoPausePtr.IdleMinutes)
+	}
+
+	return nil
+}
+
+// getLastActiveTime 取status.lastActiveTime与WakeAnnotation中较晚的时间
+func getLastActiveTime(pgPtr *pgv1.PostgreSQL) (ret time.Time) {
+	if pgPtr.Status.LastActiveTime != nil {
+		ret = pgPtr.Status.LastActiveTime.Time
+	}
+
+	wakeVal, wakeOK := pgPtr.Annotations[pgv1.WakeAnnotation]
+	if !wakeOK {
+		return
+	}
+	wakeTime, wakeErr := time.Parse(time.RFC3339, wakeVal)
+	if wakeErr == nil && wakeTime.After(ret) {
+		ret = wakeTime
+	}
+	return
+}
+
+// isIdle 配置了AutoPause且最近一次活动已超过IdleMinutes，从未记录过活动时不视为空闲
+func isIdle(pgPtr *pgv1.PostgreSQL, now time.Time) bool {
+	autoPausePtr := pgPtr.Spec.AutoPause
+	if autoPausePtr == nil || validateAutoPause(autoPausePtr) != nil {
+		return false
+	}
+
+	lastActive := getLastActiveTime(pgPtr)
+	if lastActive.IsZero() {
+		return false
+	}
+	return now.Sub(lastActive) >= time.Duration(autoPausePtr.IdleMinutes)*time.Minute
+}
+
+// getClientCount 统计主节点与正常复制的备节点上的客户端连接数
+func (s *PostgreSQL) getClientCount(pgPtr *pgv1.PostgreSQL) (ret int64, err *cd.Result) {
+	members := []string{""}
+	if replicationPtr := pgPtr.Status.Replication; replicationPtr != nil {
+		for _, val := range replicationPtr.Members {
+			if val.Name != replicationPtr.Primary && val.State == "streaming" {
+				members = append(members, val.Name)
+			}
+		}
+	}
+
+	for _, member := range members {
+		countVal, countErr := s.executeMemberCommand(pgPtr.Name, member, common.DiagnosticCommand, "client-count")
+		if countErr != nil {
+			err = countErr
+			return
+		}
+
+		count, parseErr := strconv.ParseInt(countVal, 10, 64)
+		if parseErr != nil {
+			err = cd.NewError(cd.UnExpected, fmt.Sprintf("illegal client count %s", countVal))
+			return
+		}
+		ret += count
+	}
+
+	return
+}
+
+// reconcileActivity 每分钟统计一次客户端连接，有连接、统计失败或实例尚未运行时将lastActiveTime更新为当前时间，精确到分钟
+// 经连接池访问时，连接池在server_idle_timeout后才关闭空闲的服务端连接
+func (s *PostgreSQL) reconcileActivity(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pgPtr.Spec.AutoPause == nil {
+		pgPtr.Status.LastActiveTime = nil
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(pairPtr.activityTime) < activityInterval {
+		return
+	}
+	pairPtr.activityTime = now
+
+	active := pgPtr.Status.Phase != pgv1.InstancePhaseRunning || pgPtr.Status.LastActiveTime == nil
+	if !active {
+		count, err := s.getClientCount(pgPtr)
+		if err != nil {
+			log.Errorf("reconcileActivity %s failed, error:%s", pgPtr.Name, err.Error())
+		}
+		active = err != nil || count > 0
+	}
+	if active {
+		lastActive := metav1.NewTime(now.Truncate(time.Minute))
+		pgPtr.Status.LastActiveTime = &lastActive
+	}
+}
@@ -0,0 +1,137 @@
+package biz
+
+import (
+	"encoding/json"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func getStatusHash(statusPtr *pgv1.Status) string {
+	byteVal, _ := json.Marshal(statusPtr)
+	return string(byteVal)
+}
+
+// reconcileInstances 实例可连接后先从备份恢复，再安装扩展、同步超级用户口令并加载受管的pg_hba.conf，休眠的实例不做其余同步
+func (s *PostgreSQL) reconcileInstances() {
+	for _, val := range s.postgresqlCache.GetAll() {
+		pairPtr, pairOK := val.(*serviceInfoPair)
+		if !pairOK || pairPtr.postgreSQLPtr == nil || pairPtr.postgreSQLPtr.DeletionTimestamp != nil {
+			continue
+		}
+
+		pgPtr := pairPtr.postgreSQLPtr
+		statusHash := getStatusHash(&pgPtr.Status)
+		if !s.reconcileHibernation(pairPtr) {
+			s.reconcileInstance(pairPtr)
+			s.reconcileFailover(pairPtr)
+			s.reconcileSwitchover(pairPtr)
+			s.reconcileReplication(pairPtr)
+			s.reconcilePooler(pairPtr)
+			s.reconcileActivity(pairPtr)
+			s.reconcileStorage(pairPtr)
+		}
+		if getStatusHash(&pgPtr.Status) == statusHash {
+			continue
+		}
+
+		_ = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+	}
+}
+
+func (s *PostgreSQL) reconcileInstance(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pgPtr.Status.Phase == pgv1.InstancePhaseRunning &&
+		pgPtr.Status.ObservedGeneration == pgPtr.Generation &&
+		pgPtr.Status.SuperuserHash == pairPtr.superuserHash &&
+		isExtensionsSynced(pgPtr.Spec.Extensions, pgPtr.Status.Extensions) {
+		return
+	}
+
+	if pgPtr.Status.Phase == "" {
+		pgPtr.Status.Phase = pgv1.InstancePhaseCreating
+	}
+	// 恢复失败的实例需要删除后重新创建
+	if pgPtr.Status.Restore != nil && pgPtr.Status.Restore.Phase == common.RestoreFailed {
+		pgPtr.Status.Phase = pgv1.PhaseFailed
+		return
+	}
+	if pairPtr.serviceInfo == nil || !s.isServerReady(pgPtr.Name) {
+		return
+	}
+
+	if pgPtr.IsRestorePending() {
+		pgPtr.Status.Phase = pgv1.InstancePhaseRestoring
+		s.reconcileRestore(pgPtr)
+		if pgPtr.IsRestorePending() {
+			return
+		}
+	}
+
+	var err *cd.Result
+	if pgPtr.Spec.Archive != nil {
+		if archiveErr := validateArchive(pgPtr.Spec.Archive); archiveErr != nil {
+			err = cd.NewError(cd.IllegalParam, archiveErr.Error())
+		}
+	}
+	if err == nil && pgPtr.Spec.Resources != nil {
+		if resourcesErr := validateResources(pgPtr.Spec.Resources); resourcesErr != nil {
+			err = cd.NewError(cd.IllegalParam, resourcesErr.Error())
+		}
+	}
+	if err == nil && pgPtr.Spec.Storage != nil && pgPtr.Spec.Storage.AutoGrow != nil {
+		if autoGrowErr := validateAutoGrow(pgPtr.Spec.Storage.AutoGrow); autoGrowErr != nil {
+			err = cd.NewError(cd.IllegalParam, autoGrowErr.Error())
+		}
+	}
+	if err == nil && pgPtr.Spec.Schedule != nil {
+		if scheduleErr := validateSchedule(pgPtr.Spec.Schedule); scheduleErr != nil {
+			err = cd.NewError(cd.IllegalParam, scheduleErr.Error())
+		}
+	}
+	if err == nil && pgPtr.Spec.AutoPause != nil {
+		if autoPauseErr := validateAutoPause(pgPtr.Spec.AutoPause); autoPauseErr != nil {
+			err = cd.NewError(cd.IllegalParam, autoPauseErr.Error())
+		}
+	}
+	if err == nil && pgPtr.Spec.Pooler != nil {
+		if poolerErr := validatePooler(pgPtr.Spec.Pooler); poolerErr != nil {
+			err = cd.NewError(cd.IllegalParam, poolerErr.Error())
+		}
+	}
+	if err == nil {
+		var extensions []pgv1.ExtensionStatus
+		extensions, err = s.applyExtensions(pgPtr.Name, defaultDatabase, pgPtr.Spec.Extensions)
+		if err == nil {
+			pgPtr.Status.Extensions = extensions
+		}
+	}
+	if err == nil {
+		var superuserHash string
+		superuserHash, err = s.applySuperuserPassword(pgPtr)
+		if err == nil {
+			pgPtr.Status.SuperuserHash = superuserHash
+		}
+	}
+	if err == nil {
+		var hbaHash string
+		hbaHash, err = s.applyHBA(pgPtr)
+		if err == nil {
+			pgPtr.Status.HBAHash = hbaHash
+		}
+	}
+	if err != nil {
+		if err.Fail() {
+			log.Errorf("reconcileInstances %s failed, error:%s", pgPtr.Name, err.Error())
+		}
+		pgPtr.Status.Message = err.Reason
+		return
+	}
+
+	pgPtr.Status.Phase = pgv1.InstancePhaseRunning
+	pgPtr.Status.Message = ""
+	pgPtr.Status.ObservedGeneration = pgPtr.Generation
+}
@@ -0,0 +1,227 @@
+package biz
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const migrationSuffix = ".sql"
+
+type migrationFile struct {
+	version  string
+	checksum string
+	content  string
+}
+
+// splitVersion 拆分版本号开头的数字与其余部分，数字去掉前导0
+func splitVersion(version string) (number, rest string) {
+	idx := 0
+	for idx < len(version) && version[idx] >= '0' && version[idx] <= '9' {
+		idx++
+	}
+
+	number = strings.TrimLeft(version[:idx], "0")
+	if number == "" && idx > 0 {
+		number = "0"
+	}
+	rest = version[idx:]
+	return
+}
+
+// lessVersion 版本号按开头的数字比较，10_x排在2_x之后，数字相同或没有数字前缀时按字符串比较，没有数字前缀的排在最后
+func lessVersion(left, right string) bool {
+	leftNumber, leftRest := splitVersion(left)
+	rightNumber, rightRest := splitVersion(right)
+	switch {
+	case leftNumber == "" && rightNumber == "":
+		return left < right
+	case leftNumber == "" || rightNumber == "":
+		return rightNumber == ""
+	case len(leftNumber) != len(rightNumber):
+		return len(leftNumber) < len(rightNumber)
+	case leftNumber != rightNumber:
+		return leftNumber < rightNumber
+	case leftRest != rightRest:
+		return leftRest < rightRest
+	}
+
+	return left < right
+}
+
+func getChecksum(content string) string {
+	hashVal := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hashVal[:])
+}
+
+// getMigrationFiles 读取迁移脚本，按版本号开头的数字排序
+func (s *PostgreSQL) getMigrationFiles(migrationPtr *pgv1.SchemaMigration) (ret []*migrationFile, sourceHash string, err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	source := migrationPtr.Spec.Source
+	items := map[string]string{}
+	switch {
+	case source.ConfigMap != "" && source.Secret != "":
+		err = cd.NewError(cd.IllegalParam, "only one of configMap and secret can be specified")
+		return
+	case source.ConfigMap != "":
+		configPtr, configErr := clientSet.CoreV1().ConfigMaps(migrationPtr.Namespace).Get(context.TODO(), source.ConfigMap, metav1.GetOptions{})
+		if configErr != nil {
+			err = cd.NewError(cd.UnExpected, configErr.Error())
+			return
+		}
+		items = configPtr.Data
+	case source.Secret != "":
+		secretPtr, secretErr := clientSet.CoreV1().Secrets(migrationPtr.Namespace).Get(context.TODO(), source.Secret, metav1.GetOptions{})
+		if secretErr != nil {
+			err = cd.NewError(cd.UnExpected, secretErr.Error())
+			return
+		}
+		for k, v := range secretPtr.Data {
+			items[k] = string(v)
+		}
+	default:
+		err = cd.NewError(cd.IllegalParam, "migration source is required")
+		return
+	}
+
+	for k, v := range items {
+		if !strings.HasSuffix(k, migrationSuffix) {
+			continue
+		}
+
+		ret = append(ret, &migrationFile{
+			version:  strings.TrimSuffix(k, migrationSuffix),
+			checksum: getChecksum(v),
+			content:  v,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return lessVersion(ret[i].version, ret[j].version)
+	})
+
+	checksums := []string{}
+	for _, val := range ret {
+		checksums = append(checksums, val.version+":"+val.checksum)
+	}
+	sourceHash = getChecksum(strings.Join(checksums, "\n"))
+	return
+}
+
+func (s *PostgreSQL) reconcileMigrations() {
+	var migrationList pgv1.SchemaMigrationList
+	listErr := s.listResource(pgv1.Migration, s.getNamespace(), &migrationList)
+	if listErr != nil {
+		return
+	}
+
+	for idx := range migrationList.Items {
+		migrationPtr := &migrationList.Items[idx]
+		if migrationPtr.DeletionTimestamp != nil {
+			continue
+		}
+
+		files, sourceHash, err := s.getMigrationFiles(migrationPtr)
+		if err == nil && migrationPtr.Status.Phase == pgv1.PhaseReady &&
+			migrationPtr.Status.ObservedGeneration == migrationPtr.Generation && migrationPtr.Status.SourceHash == sourceHash {
+			continue
+		}
+		// 失败需要人工处理，脚本与定义均未变化时不再重试
+		if err == nil && migrationPtr.Status.Phase == pgv1.PhaseFailed &&
+			migrationPtr.Status.ObservedGeneration == migrationPtr.Generation && migrationPtr.Status.SourceHash == sourceHash {
+			continue
+		}
+
+		if err == nil {
+			migrationPtr.Status.AppliedVersions, err = s.applyMigrations(migrationPtr, files)
+		}
+
+		migrationPtr.Status.ObservedGeneration = migrationPtr.Generation
+		migrationPtr.Status.SourceHash = sourceHash
+		migrationPtr.Status.Phase, migrationPtr.Status.Message = getPhase(err)
+		_ = s.updateResource(pgv1.Migration, migrationPtr.Namespace, migrationPtr, true)
+	}
+}
+
+// applyMigrations 校验已执行迁移的校验和，依次在独立事务中执行待执行的迁移
+func (s *PostgreSQL) applyMigrations(migrationPtr *pgv1.SchemaMigration, files []*migrationFile) (ret []string, err *cd.Result) {
+	instance := migrationPtr.Spec.Instance
+	database := migrationPtr.Spec.Database
+	if !s.isInstanceReady(instance) {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("instance %s not ready", instance))
+		return
+	}
+
+	_, err = s.executeSQL(instance, database, "migration-init")
+	if err != nil {
+		return
+	}
+
+	appliedVal, appliedErr := s.querySQL(instance, database, "migration-list")
+	if appliedErr != nil {
+		err = appliedErr
+		return
+	}
+
+	applied := map[string]string{}
+	for _, line := range strings.Split(appliedVal, "\n") {
+		items := strings.SplitN(strings.TrimSpace(line), "|", 2)
+		if len(items) != 2 {
+			continue
+		}
+		applied[items[0]] = items[1]
+		ret = append(ret, items[0])
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return lessVersion(ret[i], ret[j])
+	})
+
+	fileMap := map[string]*migrationFile{}
+	for _, val := range files {
+		fileMap[val.version] = val
+	}
+	for _, version := range ret {
+		filePtr, ok := fileMap[version]
+		if !ok {
+			err = cd.NewError(cd.IllegalParam, fmt.Sprintf("applied migration %s is missing from source", version))
+			return
+		}
+		if filePtr.checksum != applied[version] {
+			err = cd.NewError(cd.IllegalParam, fmt.Sprintf("checksum of applied migration %s has changed", version))
+			return
+		}
+	}
+
+	sensitive := migrationPtr.Spec.Source.Secret != ""
+	for _, val := range files {
+		if _, ok := applied[val.version]; ok {
+			continue
+		}
+
+		_, err = s.executeScript(instance, database, "migration-apply", val.content, []string{val.version, val.checksum}, sensitive)
+		if err != nil {
+			log.Errorf("applyMigrations %s failed, version:%s, error:%s", migrationPtr.Name, val.version, err.Error())
+			err = cd.NewError(cd.UnExpected, fmt.Sprintf("migration %s failed: %s", val.version, err.Reason))
+			return
+		}
+
+		log.Infof("applyMigrations %s, version:%s applied", migrationPtr.Name, val.version)
+		ret = append(ret, val.version)
+	}
+
+	return
+}
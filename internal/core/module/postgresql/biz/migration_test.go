@@ -0,0 +1,55 @@
+package biz
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestLessVersion(t *testing.T) {
+	cases := []struct {
+		left   string
+		right  string
+		expect bool
+	}{
+		{"1_init.sql", "2_users.sql", true},
+		{"2_users.sql", "10_orders.sql", true},
+		{"10_orders.sql", "2_users.sql", false},
+		{"002_users.sql", "10_orders.sql", true},
+		{"01_a.sql", "1_b.sql", true},
+		{"1_b.sql", "01_a.sql", false},
+		{"0_a.sql", "000_b.sql", true},
+		{"1_a.sql", "1_a.sql", false},
+		{"9_x.sql", "init.sql", true},
+		{"init.sql", "9_x.sql", false},
+		{"a.sql", "b.sql", true},
+	}
+	for _, c := range cases {
+		if ret := lessVersion(c.left, c.right); ret != c.expect {
+			t.Errorf("lessVersion(%s, %s) = %v, expect %v", c.left, c.right, ret, c.expect)
+		}
+	}
+
+	versions := []string{"seed.sql", "10_c.sql", "2_b.sql", "1_a.sql"}
+	sort.Slice(versions, func(i, j int) bool { return lessVersion(versions[i], versions[j]) })
+	expect := []string{"1_a.sql", "2_b.sql", "10_c.sql", "seed.sql"}
+	for idx := range expect {
+		if versions[idx] != expect[idx] {
+			t.Fatalf("sorted versions %v, expect %v", versions, expect)
+		}
+	}
+}
+
+func TestGetChecksum(t *testing.T) {
+	cases := []struct {
+		content string
+		expect  string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, c := range cases {
+		if ret := getChecksum(c.content); ret != c.expect {
+			t.Errorf("getChecksum(%q) = %s, expect %s", c.content, ret, c.expect)
+		}
+	}
+}
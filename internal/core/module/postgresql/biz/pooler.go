@@ -0,0 +1,168 @@
+package biz
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	defaultPoolSize      = 20
+	defaultMaxClientConn = 200
+	defaultPoolerReplica = 1
+)
+
+func validatePooler(poolerPtr *pgv1.PoolerSpec) error {
+	switch poolerPtr.Mode {
+	case "", common.PoolModeSession, common.PoolModeTransaction, common.PoolModeStatement:
+	default:
+		return fmt.Errorf("illegal pooler mode %s", poolerPtr.Mode)
+	}
+	if poolerPtr.PoolSize < 0 || poolerPtr.MaxClientConn < 0 || poolerPtr.Replicas < 0 {
+		return fmt.Errorf("illegal pooler size %d/%d/%d", poolerPtr.PoolSize, poolerPtr.MaxClientConn, poolerPtr.Replicas)
+	}
+
+	return nil
+}
+
+// getPooler 连接池定义非法时不部署连接池，错误记录在实例状态中
+func getPooler(pgPtr *pgv1.PostgreSQL) *common.Pooler {
+	specPtr := pgPtr.Spec.Pooler
+	if specPtr == nil || validatePooler(specPtr) != nil {
+		return nil
+	}
+
+	poolerPtr := &common.Pooler{
+		Image:         specPtr.Image,
+		Mode:          specPtr.Mode,
+		PoolSize:      specPtr.PoolSize,
+		MaxClientConn: specPtr.MaxClientConn,
+		Replicas:      specPtr.Replicas,
+	}
+	if poolerPtr.Image == "" {
+		poolerPtr.Image = common.DefaultPoolerImage
+	}
+	if poolerPtr.Mode == "" {
+		poolerPtr.Mode = common.PoolModeTransaction
+	}
+	if poolerPtr.PoolSize == 0 {
+		poolerPtr.PoolSize = defaultPoolSize
+	}
+	if poolerPtr.MaxClientConn == 0 {
+		poolerPtr.MaxClientConn = defaultMaxClientConn
+	}
+	if poolerPtr.Replicas == 0 {
+		poolerPtr.Replicas = defaultPoolerReplica
+	}
+	return poolerPtr
+}
+
+// quoteUserList 转义userlist.txt中的字段，字段内的双引号写作两个双引号
+func quoteUserList(val string) string {
+	return `"` + strings.ReplaceAll(val, `"`, `""`) + `"`
+}
+
+// getUserList 由实例下可登录角色的凭证Secret生成连接池用户列表，按用户名排序保证内容稳定
+func (s *PostgreSQL) getUserList(pgPtr *pgv1.PostgreSQL) (ret string, err *cd.Result) {
+	var roleList pgv1.PostgreSQLRoleList
+	err = s.listResource(pgv1.PostgresqlRole, pgPtr.Namespace, &roleList)
+	if err != nil {
+		return
+	}
+
+	secretClient := s.getClientSet().CoreV1().Secrets(pgPtr.Namespace)
+	lines := []string{}
+	for idx := range roleList.Items {
+		rolePtr := &roleList.Items[idx]
+		if rolePtr.Spec.Instance != pgPtr.Name || !rolePtr.Spec.Login || rolePtr.DeletionTimestamp != nil || rolePtr.Status.SecretName == "" {
+			continue
+		}
+
+		secretPtr, secretErr := secretClient.Get(context.TODO(), rolePtr.Status.SecretName, metav1.GetOptions{})
+		if secretErr != nil {
+			if errors.IsNotFound(secretErr) {
+				continue
+			}
+			err = cd.NewError(cd.UnExpected, secretErr.Error())
+			log.Errorf("getUserList %s failed, get secret %s error:%s", pgPtr.Name, rolePtr.Status.SecretName, secretErr.Error())
+			return
+		}
+
+		username := string(secretPtr.Data[CredentialUsername])
+		password := string(secretPtr.Data[CredentialPassword])
+		if username == "" || password == "" {
+			continue
+		}
+		lines = append(lines, quoteUserList(username)+" "+quoteUserList(password)+"\n")
+	}
+
+	sort.Strings(lines)
+	ret = strings.Join(lines, "")
+	return
+}
+
+// reconcilePooler 同步连接池用户列表Secret，Secret被删除时重新创建，摘要变化后由updateK8sDeployment滚动重启连接池
+func (s *PostgreSQL) reconcilePooler(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if getPooler(pgPtr) == nil {
+		pairPtr.userListHash = ""
+		return
+	}
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		return
+	}
+
+	userList, err := s.getUserList(pgPtr)
+	if err != nil {
+		return
+	}
+
+	secretName := common.GetPoolerName(pgPtr.Name)
+	secretClient := clientSet.CoreV1().Secrets(pgPtr.Namespace)
+	secretPtr, secretErr := secretClient.Get(context.TODO(), secretName, metav1.GetOptions{})
+	if secretErr != nil && !errors.IsNotFound(secretErr) {
+		log.Errorf("reconcilePooler %s failed, get secret error:%s", pgPtr.Name, secretErr.Error())
+		return
+	}
+	if secretErr != nil {
+		secretPtr = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: pgPtr.Namespace,
+				Labels:    common.NewInstanceLabels(pgPtr.Name),
+			},
+			Type:       corev1.SecretTypeOpaque,
+			StringData: map[string]string{common.PoolerUserList: userList},
+		}
+		_, secretErr = secretClient.Create(context.TODO(), secretPtr, metav1.CreateOptions{})
+	} else if string(secretPtr.Data[common.PoolerUserList]) != userList {
+		secretPtr.Data = nil
+		secretPtr.StringData = map[string]string{common.PoolerUserList: userList}
+		_, secretErr = secretClient.Update(context.TODO(), secretPtr, metav1.UpdateOptions{})
+	}
+	if secretErr != nil {
+		log.Errorf("reconcilePooler %s failed, save secret error:%s", pgPtr.Name, secretErr.Error())
+		return
+	}
+
+	hashVal := sha256.Sum256([]byte(userList))
+	userListHash := hex.EncodeToString(hashVal[:8])
+	if pairPtr.userListHash != userListHash {
+		pairPtr.userListHash = userListHash
+		log.Infof("reconcilePooler %s, userlist updated, hash:%s", pgPtr.Name, userListHash)
+	}
+}
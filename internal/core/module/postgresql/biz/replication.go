@@ -0,0 +1,160 @@
+package biz
+
+import (
+	"fmt"
+	"strings"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// maxStandbys 备节点数量上限，备节点与基础备份共用主节点默认的max_wal_senders与max_replication_slots
+const maxStandbys = 5
+
+// getReplication 实例的流复制定义，主节点不是实例同名成员时即使关闭流复制也保留主节点
+func getReplication(pgPtr *pgv1.PostgreSQL) *common.Replication {
+	primary := ""
+	if pgPtr.Status.Replication != nil {
+		primary = pgPtr.Status.Replication.Primary
+	}
+
+	specPtr := pgPtr.Spec.Replication
+	if specPtr == nil || specPtr.Standbys <= 0 {
+		if primary == "" || primary == pgPtr.Name {
+			return nil
+		}
+		return &common.Replication{Primary: primary}
+	}
+
+	standbys := specPtr.Standbys
+	if standbys > maxStandbys {
+		standbys = maxStandbys
+	}
+	return &common.Replication{Standbys: standbys, Primary: primary}
+}
+
+// isManagedSlot 实例成员使用的复制槽，名称为实例名称或实例名称加序号
+func isManagedSlot(instance, slotName string) bool {
+	prefix := common.GetSlotName(instance)
+	if slotName == prefix {
+		return true
+	}
+	if !strings.HasPrefix(slotName, prefix+"_") {
+		return false
+	}
+
+	var idx int
+	_, err := fmt.Sscanf(strings.TrimPrefix(slotName, prefix+"_"), "%d", &idx)
+	return err == nil && slotName == fmt.Sprintf("%s_%d", prefix, idx)
+}
+
+// queryRows 查询结果按行拆分为字段，psql以|分隔字段
+func (s *PostgreSQL) queryRows(instance, operation string) (ret [][]string, err *cd.Result) {
+	resultVal, resultErr := s.querySQL(instance, "", operation)
+	if resultErr != nil {
+		err = resultErr
+		return
+	}
+
+	for _, line := range strings.Split(resultVal, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ret = append(ret, strings.Split(line, "|"))
+	}
+	return
+}
+
+// reconcileSlots 在主节点上为各备节点创建物理复制槽，删除已移除成员的空闲复制槽
+func (s *PostgreSQL) reconcileSlots(pgPtr *pgv1.PostgreSQL, serviceInfo *common.ServiceInfo) (err *cd.Result) {
+	rows, rowsErr := s.queryRows(pgPtr.Name, "replication-slots")
+	if rowsErr != nil {
+		err = rowsErr
+		return
+	}
+
+	expected := map[string]bool{}
+	for _, member := range serviceInfo.GetMembers() {
+		if member != serviceInfo.GetPrimary() {
+			expected[common.GetSlotName(member)] = true
+		}
+	}
+
+	for _, row := range rows {
+		slotName := row[0]
+		if expected[slotName] {
+			delete(expected, slotName)
+			continue
+		}
+		if !isManagedSlot(pgPtr.Name, slotName) || len(row) < 2 || row[1] != "f" {
+			continue
+		}
+
+		_, err = s.executeSQL(pgPtr.Name, "", "slot-drop", slotName)
+		if err != nil {
+			return
+		}
+		log.Infof("reconcileSlots %s, slot %s dropped", pgPtr.Name, slotName)
+	}
+	for slotName := range expected {
+		_, err = s.executeSQL(pgPtr.Name, "", "slot-create", slotName)
+		if err != nil {
+			return
+		}
+		log.Infof("reconcileSlots %s, slot %s created", pgPtr.Name, slotName)
+	}
+
+	return
+}
+
+// reconcileReplication 实例运行后同步复制槽，并以主节点pg_stat_replication记录成员的复制状态
+func (s *PostgreSQL) reconcileReplication(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	replicationPtr := getReplication(pgPtr)
+	if (replicationPtr == nil && pgPtr.Status.Replication == nil) ||
+		pairPtr.serviceInfo == nil || pgPtr.Status.Phase != pgv1.InstancePhaseRunning {
+		return
+	}
+
+	serviceInfo := &common.ServiceInfo{Name: pgPtr.Name, Replication: replicationPtr}
+	err := s.reconcileSlots(pgPtr, serviceInfo)
+	if err != nil {
+		log.Errorf("reconcileReplication %s failed, error:%s", pgPtr.Name, err.Error())
+		return
+	}
+	if replicationPtr == nil {
+		pgPtr.Status.Replication = nil
+		return
+	}
+
+	rows, rowsErr := s.queryRows(pgPtr.Name, "replication-state")
+	if rowsErr != nil {
+		log.Errorf("reconcileReplication %s failed, error:%s", pgPtr.Name, rowsErr.Error())
+		return
+	}
+
+	states := map[string]string{}
+	for _, row := range rows {
+		if len(row) == 2 {
+			states[row[0]] = row[1]
+		}
+	}
+
+	statusPtr := &pgv1.ReplicationStatus{Primary: serviceInfo.GetPrimary()}
+	if pgPtr.Status.Replication != nil {
+		statusPtr.History = pgPtr.Status.Replication.History
+		statusPtr.Switchover = pgPtr.Status.Replication.Switchover
+	}
+	for _, member := range serviceInfo.GetMembers() {
+		statusPtr.Members = append(statusPtr.Members, pgv1.MemberStatus{
+			Name:  member,
+			Role:  serviceInfo.GetRole(member),
+			State: states[member],
+		})
+	}
+	pgPtr.Status.Replication = statusPtr
+}
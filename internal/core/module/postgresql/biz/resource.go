@@ -0,0 +1,322 @@
+package biz
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func (s *PostgreSQL) getResourceGVR(resource string) schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: pgv1.Group, Version: pgv1.Version, Resource: resource}
+}
+
+func (s *PostgreSQL) getClientSet() (ret kubernetes.Interface) {
+	if s.clientSet != nil {
+		ret = s.clientSet
+		return
+	}
+
+	ev := event.NewEvent(common.GetK8sConfig, s.ID(), common.K8sModule, nil, nil)
+	result := s.SendEvent(ev)
+	cfgVal, cfgErr := result.Get()
+	if cfgErr != nil {
+		log.Errorf("getClientSet failed, error:%s", cfgErr.Error())
+		return
+	}
+
+	clientSet, clientErr := kubernetes.NewForConfig(cfgVal.(*rest.Config))
+	if clientErr != nil {
+		log.Errorf("getClientSet failed, kubernetes.NewForConfig error:%s", clientErr.Error())
+		return
+	}
+
+	s.clientSet = clientSet
+	ret = s.clientSet
+	return
+}
+
+// listResource 查询命名空间下的自定义资源，listPtr为对应的List类型
+func (s *PostgreSQL) listResource(resource, namespace string, listPtr interface{}) (err *cd.Result) {
+	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	resList, resErr := client.Resource(s.getResourceGVR(resource)).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if resErr != nil {
+		err = cd.NewError(cd.UnExpected, resErr.Error())
+		log.Errorf("listResource %s failed, namespace:%s, error:%s", resource, namespace, resErr.Error())
+		return
+	}
+
+	convertErr := runtime.DefaultUnstructuredConverter.FromUnstructured(resList.UnstructuredContent(), listPtr)
+	if convertErr != nil {
+		err = cd.NewError(cd.UnExpected, convertErr.Error())
+		log.Errorf("listResource %s failed, runtime.DefaultUnstructuredConverter.FromUnstructured error:%s", resource, convertErr.Error())
+		return
+	}
+
+	return
+}
+
+// getResource 查询自定义资源，不存在时返回NoExist
+func (s *PostgreSQL) getResource(resource, namespace, name string, objPtr interface{}) (err *cd.Result) {
+	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	resVal, resErr := client.Resource(s.getResourceGVR(resource)).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if resErr != nil {
+		if errors.IsNotFound(resErr) {
+			err = cd.NewError(cd.NoExist, resErr.Error())
+			return
+		}
+
+		err = cd.NewError(cd.UnExpected, resErr.Error())
+		log.Errorf("getResource %s failed, namespace:%s, name:%s, error:%s", resource, namespace, name, resErr.Error())
+		return
+	}
+
+	convertErr := runtime.DefaultUnstructuredConverter.FromUnstructured(resVal.UnstructuredContent(), objPtr)
+	if convertErr != nil {
+		err = cd.NewError(cd.UnExpected, convertErr.Error())
+		log.Errorf("getResource %s failed, runtime.DefaultUnstructuredConverter.FromUnstructured error:%s", resource, convertErr.Error())
+		return
+	}
+
+	return
+}
+
+// createResource 创建自定义资源，已存在时返回Duplicated
+func (s *PostgreSQL) createResource(resource, namespace string, objPtr interface{}) (err *cd.Result) {
+	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	objVal, objErr := runtime.DefaultUnstructuredConverter.ToUnstructured(objPtr)
+	if objErr != nil {
+		err = cd.NewError(cd.UnExpected, objErr.Error())
+		log.Errorf("createResource %s failed, runtime.DefaultUnstructuredConverter.ToUnstructured error:%s", resource, objErr.Error())
+		return
+	}
+
+	_, createErr := client.Resource(s.getResourceGVR(resource)).Namespace(namespace).Create(context.TODO(), &unstructured.Unstructured{Object: objVal}, metav1.CreateOptions{})
+	if createErr != nil {
+		if errors.IsAlreadyExists(createErr) {
+			err = cd.NewError(cd.Duplicated, createErr.Error())
+			return
+		}
+
+		err = cd.NewError(cd.UnExpected, createErr.Error())
+		log.Errorf("createResource %s failed, namespace:%s, error:%s", resource, namespace, createErr.Error())
+		return
+	}
+
+	return
+}
+
+// updateResource 更新自定义资源，status为true时仅更新status子资源
+func (s *PostgreSQL) updateResource(resource, namespace string, objPtr interface{}, status bool) (err *cd.Result) {
+	client := s.getK8sClient()
+	if client == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	objVal, objErr := runtime.DefaultUnstructuredConverter.ToUnstructured(objPtr)
+	if objErr != nil {
+		err = cd.NewError(cd.UnExpected, objErr.Error())
+		log.Errorf("updateResource %s failed, runtime.DefaultUnstructuredConverter.ToUnstructured error:%s", resource, objErr.Error())
+		return
+	}
+
+	resClient := client.Resource(s.getResourceGVR(resource)).Namespace(namespace)
+	unstructuredPtr := &unstructured.Unstructured{Object: objVal}
+	var resVal *unstructured.Unstructured
+	var resErr error
+	if status {
+		resVal, resErr = resClient.UpdateStatus(context.TODO(), unstructuredPtr, metav1.UpdateOptions{})
+	} else {
+		resVal, resErr = resClient.Update(context.TODO(), unstructuredPtr, metav1.UpdateOptions{})
+	}
+	if resErr != nil {
+		err = cd.NewError(cd.UnExpected, resErr.Error())
+		log.Errorf("updateResource %s failed, namespace:%s, name:%s, error:%s", resource, namespace, unstructuredPtr.GetName(), resErr.Error())
+		return
+	}
+
+	// 同步resourceVersion，下一次列举前的再次更新不会冲突
+	if accessor, accessorErr := meta.Accessor(objPtr); accessorErr == nil {
+		accessor.SetResourceVersion(resVal.GetResourceVersion())
+	}
+	return
+}
+
+// getPhase 告警表示等待条件满足，失败表示需要人工处理
+func getPhase(err *cd.Result) (phase, message string) {
+	switch {
+	case err == nil:
+		phase = pgv1.PhaseReady
+	case err.Warn():
+		phase = pgv1.PhasePending
+		message = err.Reason
+	default:
+		phase = pgv1.PhaseFailed
+		message = err.Reason
+	}
+
+	return
+}
+
+func hasFinalizer(objectMeta *metav1.ObjectMeta) bool {
+	for _, val := range objectMeta.Finalizers {
+		if val == pgv1.Finalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeFinalizer(objectMeta *metav1.ObjectMeta) {
+	finalizers := []string{}
+	for _, val := range objectMeta.Finalizers {
+		if val != pgv1.Finalizer {
+			finalizers = append(finalizers, val)
+		}
+	}
+
+	objectMeta.Finalizers = finalizers
+}
+
+// isInstanceReady 实例的k8s服务已存在时才能执行SQL，从备份恢复完成前不操作实例，避免与恢复的数据冲突
+func (s *PostgreSQL) isInstanceReady(name string) bool {
+	curPtr := s.postgresqlCache.Fetch(name)
+	if curPtr == nil {
+		return false
+	}
+
+	pairPtr := curPtr.(*serviceInfoPair)
+	if pairPtr.serviceInfo == nil {
+		return false
+	}
+
+	return pairPtr.postgreSQLPtr == nil || !pairPtr.postgreSQLPtr.IsRestorePending()
+}
+
+// isInstanceRemoved 实例资源已删除或正在删除，实例中的角色与数据库随实例一起删除
+func (s *PostgreSQL) isInstanceRemoved(name string) bool {
+	pgPtr := &pgv1.PostgreSQL{}
+	err := s.getResource(pgv1.Postgresql, s.getNamespace(), name, pgPtr)
+	if err != nil {
+		return err.ErrorCode == cd.NoExist
+	}
+
+	return pgPtr.DeletionTimestamp != nil
+}
+
+// isServerReady 数据库服务已可接受连接
+func (s *PostgreSQL) isServerReady(name string) bool {
+	_, err := s.executeCommand(name, common.DiagnosticCommand, "ready", nil)
+	return err == nil
+}
+
+// executeCommand 通过k8s模块在实例中执行目录中的命令
+func (s *PostgreSQL) executeCommand(instance, cmdType, operation string, args []string) (ret string, err *cd.Result) {
+	cmdInfo := &common.CmdInfo{
+		Service:   instance,
+		Catalog:   common.PostgreSQL,
+		Type:      cmdType,
+		Operation: operation,
+		Args:      args,
+	}
+
+	ret, err = s.sendCommand(cmdInfo)
+	return
+}
+
+// executeSQL 通过k8s模块在实例的数据库中执行目录中的命名SQL操作，database为空时使用postgres库
+func (s *PostgreSQL) executeSQL(instance, database, operation string, args ...string) (ret string, err *cd.Result) {
+	cmdInfo := &common.CmdInfo{
+		Service:   instance,
+		Catalog:   common.PostgreSQL,
+		Type:      common.SQLCommand,
+		Operation: operation,
+		Database:  database,
+		Args:      args,
+	}
+
+	ret, err = s.sendCommand(cmdInfo)
+	return
+}
+
+// querySQL 通过k8s模块在实例的数据库中执行目录中的只读查询
+func (s *PostgreSQL) querySQL(instance, database, operation string, args ...string) (ret string, err *cd.Result) {
+	cmdInfo := &common.CmdInfo{
+		Service:   instance,
+		Catalog:   common.PostgreSQL,
+		Type:      common.DiagnosticCommand,
+		Operation: operation,
+		Database:  database,
+		Args:      args,
+	}
+
+	ret, err = s.sendCommand(cmdInfo)
+	return
+}
+
+// scriptGrant 脚本类操作的凭证，在包初始化时领取，其他模块无法再领取
+var scriptGrant = common.ClaimScriptGrant()
+
+// executeScript 通过k8s模块在单个事务中执行声明式资源中的SQL脚本，sensitive为true时审计记录不保存脚本与参数
+func (s *PostgreSQL) executeScript(instance, database, operation, script string, args []string, sensitive bool) (ret string, err *cd.Result) {
+	cmdInfo := &common.CmdInfo{
+		Service:   instance,
+		Catalog:   common.PostgreSQL,
+		Type:      common.SQLCommand,
+		Operation: operation,
+		Database:  database,
+		Statement: script,
+		Args:      args,
+		Sensitive: sensitive,
+		Grant:     scriptGrant,
+	}
+
+	ret, err = s.sendCommand(cmdInfo)
+	return
+}
+
+func (s *PostgreSQL) sendCommand(cmdInfo *common.CmdInfo) (ret string, err *cd.Result) {
+	ev := event.NewEvent(common.ExecuteCommand, s.ID(), common.K8sModule, nil, cmdInfo)
+	result := s.SendEvent(ev)
+	resultVal, resultErr := result.Get()
+	if resultErr != nil {
+		err = resultErr
+		return
+	}
+
+	if byteVal, byteOK := resultVal.([]byte); byteOK {
+		ret = strings.TrimSpace(string(byteVal))
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package biz
+
+import (
+	"fmt"
+
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	// minMemory 内存limits的下限，过小时数据库无法启动
+	minMemory = 256 * 1024 * 1024
+	// minWorkMem work_mem的下限，与PostgreSQL默认值相同，单位MB
+	minWorkMem = 4
+	// defaultMaxConnections PostgreSQL默认的max_connections，用于估算work_mem
+	defaultMaxConnections = 100
+)
+
+// getSpec 合并实例定义与默认值得到容器的requests与limits
+func getSpec(resourcesPtr *common.Resources) *common.Spec {
+	ret := common.PostgreSQLDefaultSpec
+	if resourcesPtr == nil {
+		return &ret
+	}
+
+	if resourcesPtr.Limits.CPU != "" {
+		ret.CPU = resourcesPtr.Limits.CPU
+	}
+	if resourcesPtr.Limits.Memory != "" {
+		ret.Memory = resourcesPtr.Limits.Memory
+	}
+	if resourcesPtr.Requests.CPU != "" {
+		ret.RequestCPU = resourcesPtr.Requests.CPU
+	}
+	if resourcesPtr.Requests.Memory != "" {
+		ret.RequestMemory = resourcesPtr.Requests.Memory
+	}
+	return &ret
+}
+
+// validateResources 校验资源数量格式，requests不能大于limits，内存limits不能小于minMemory
+func validateResources(resourcesPtr *common.Resources) error {
+	specPtr := getSpec(resourcesPtr)
+	quantities := map[string]resourcev1.Quantity{}
+	for name, val := range map[string]string{
+		"limits.cpu":      specPtr.CPU,
+		"limits.memory":   specPtr.Memory,
+		"requests.cpu":    specPtr.RequestCPU,
+		"requests.memory": specPtr.RequestMemory,
+	} {
+		quantity, quantityErr := resourcev1.ParseQuantity(val)
+		if quantityErr != nil || quantity.Sign() <= 0 {
+			return fmt.Errorf("illegal %s %s", name, val)
+		}
+		quantities[name] = quantity
+	}
+
+	limitsCPU, limitsMemory := quantities["limits.cpu"], quantities["limits.memory"]
+	requestsCPU, requestsMemory := quantities["requests.cpu"], quantities["requests.memory"]
+	if requestsCPU.Cmp(limitsCPU) > 0 {
+		return fmt.Errorf("requests.cpu %s exceeds limits.cpu %s", specPtr.RequestCPU, specPtr.CPU)
+	}
+	if requestsMemory.Cmp(limitsMemory) > 0 {
+		return fmt.Errorf("requests.memory %s exceeds limits.memory %s", specPtr.RequestMemory, specPtr.Memory)
+	}
+	if limitsMemory.Value() < minMemory {
+		return fmt.Errorf("limits.memory %s less than 256Mi", specPtr.Memory)
+	}
+
+	return nil
+}
+
+// getMemoryParameters 按内存limits计算内存相关参数，shared_buffers为1/4，effective_cache_size为3/4，
+// 其余内存按每个连接3个排序或哈希操作分配给work_mem
+func getMemoryParameters(specPtr *common.Spec) (ret map[string]string) {
+	memory, memoryErr := resourcev1.ParseQuantity(specPtr.Memory)
+	if memoryErr != nil {
+		return
+	}
+
+	memoryMB := memory.Value() / (1024 * 1024)
+	sharedBuffers := memoryMB / 4
+	workMem := (memoryMB - sharedBuffers) / (defaultMaxConnections * 3)
+	if workMem < minWorkMem {
+		workMem = minWorkMem
+	}
+
+	ret = map[string]string{
+		"shared_buffers":       fmt.Sprintf("%dMB", sharedBuffers),
+		"effective_cache_size": fmt.Sprintf("%dMB", memoryMB*3/4),
+		"work_mem":             fmt.Sprintf("%dMB", workMem),
+	}
+	return
+}
+
+// resizeInstance 修改实例的CPU与内存定义，由updateK8sDeployment滚动重建成员
+// 开启流复制的实例先重建备节点，再切换到已重建的备节点，原主节点随后以备节点身份重建
+func (s *PostgreSQL) resizeInstance(ev event.Event, re event.Result) {
+	paramPtr, paramOK := ev.Data().(*common.ResizeParam)
+	if !paramOK {
+		log.Warnf("resizeInstance failed, illegal param")
+		if re != nil {
+			re.Set(nil, cd.NewError(cd.IllegalParam, "illegal param"))
+		}
+		return
+	}
+
+	err := s.setResources(paramPtr)
+	if re != nil {
+		re.Set(nil, err)
+	}
+}
+
+func (s *PostgreSQL) setResources(paramPtr *common.ResizeParam) (err *cd.Result) {
+	resourcesErr := validateResources(&paramPtr.Resources)
+	if resourcesErr != nil {
+		err = cd.NewError(cd.IllegalParam, resourcesErr.Error())
+		return
+	}
+
+	pgPtr := &pgv1.PostgreSQL{}
+	err = s.getResource(pgv1.Postgresql, s.getNamespace(), paramPtr.Name, pgPtr)
+	if err != nil {
+		return
+	}
+	if pgPtr.Status.Replication != nil && pgPtr.Status.Replication.Switchover.IsRunning() {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("switchover to %s is running", pgPtr.Status.Replication.Switchover.Target))
+		return
+	}
+
+	resources := paramPtr.Resources
+	pgPtr.Spec.Resources = &resources
+	err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, false)
+	if err != nil {
+		return
+	}
+
+	specPtr := getSpec(pgPtr.Spec.Resources)
+	log.Infof("setResources %s, cpu:%s/%s, memory:%s/%s", pgPtr.Name, specPtr.RequestCPU, specPtr.CPU, specPtr.RequestMemory, specPtr.Memory)
+	return
+}
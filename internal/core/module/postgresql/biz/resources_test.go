@@ -0,0 +1,53 @@
+package biz
+
+import (
+	"testing"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+func TestValidateResources(t *testing.T) {
+	cases := []struct {
+		name      string
+		resources *common.Resources
+		expectErr bool
+	}{
+		{name: "default", resources: nil},
+		{name: "limits only", resources: &common.Resources{Limits: common.ResourceList{CPU: "1", Memory: "1Gi"}}},
+		{name: "illegal quantity", resources: &common.Resources{Limits: common.ResourceList{CPU: "one"}}, expectErr: true},
+		{name: "zero cpu", resources: &common.Resources{Limits: common.ResourceList{CPU: "0"}}, expectErr: true},
+		{name: "requests exceed limits", resources: &common.Resources{Requests: common.ResourceList{CPU: "4"}}, expectErr: true},
+		{name: "memory requests exceed limits", resources: &common.Resources{Requests: common.ResourceList{Memory: "8Gi"}}, expectErr: true},
+		{name: "memory too small", resources: &common.Resources{Limits: common.ResourceList{Memory: "128Mi"}, Requests: common.ResourceList{Memory: "64Mi"}}, expectErr: true},
+	}
+	for _, c := range cases {
+		err := validateResources(c.resources)
+		if (err != nil) != c.expectErr {
+			t.Errorf("%s: validateResources error %v, expect error %v", c.name, err, c.expectErr)
+		}
+	}
+}
+
+func TestGetMemoryParameters(t *testing.T) {
+	cases := []struct {
+		memory string
+		expect map[string]string
+	}{
+		{"4Gi", map[string]string{"shared_buffers": "1024MB", "effective_cache_size": "3072MB", "work_mem": "10MB"}},
+		{"1Gi", map[string]string{"shared_buffers": "256MB", "effective_cache_size": "768MB", "work_mem": "4MB"}},
+		{"illegal", nil},
+	}
+	for _, c := range cases {
+		ret := getMemoryParameters(&common.Spec{Memory: c.memory})
+		if len(ret) != len(c.expect) {
+			t.Errorf("getMemoryParameters(%s) = %v, expect %v", c.memory, ret, c.expect)
+			continue
+		}
+		for k, v := range c.expect {
+			if ret[k] != v {
+				t.Errorf("getMemoryParameters(%s) = %v, expect %v", c.memory, ret, c.expect)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package biz
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func (s *PostgreSQL) sendRestoreEvent(eventID string, infoPtr *common.RestoreInfo) (ret *common.RestoreResult, err *cd.Result) {
+	ev := event.NewEvent(eventID, s.ID(), common.BackupModule, nil, infoPtr)
+	result := s.SendEvent(ev)
+	resultVal, resultErr := result.Get()
+	if resultErr != nil {
+		err = resultErr
+		return
+	}
+
+	resultPtr, resultOK := resultVal.(*common.RestoreResult)
+	if !resultOK {
+		err = cd.NewError(cd.UnExpected, "illegal restore result")
+		return
+	}
+
+	ret = resultPtr
+	return
+}
+
+// reconcileRestore 按初始化方式跟踪恢复进度，恢复状态记录在实例status中，克隆的实例恢复完成后执行脱敏脚本
+func (s *PostgreSQL) reconcileRestore(pgPtr *pgv1.PostgreSQL) {
+	// 恢复失败是最终状态，不再查询恢复进度，实例需要删除后重新创建
+	if pgPtr.Status.Restore != nil && pgPtr.Status.Restore.Phase == common.RestoreFailed {
+		return
+	}
+	if pgPtr.Status.Restore == nil || pgPtr.Status.Restore.Phase != common.RestoreSucceeded {
+		bootstrap := pgPtr.GetBootstrap()
+		switch {
+		case bootstrap.FromArchive != nil:
+			s.reconcileArchiveRestore(pgPtr)
+		case bootstrap.FromSnapshot != nil:
+			s.reconcileSnapshotRestore(pgPtr)
+		case bootstrap.FromBackup != nil:
+			s.reconcileBackupRestore(pgPtr, bootstrap.FromBackup)
+		}
+	}
+	if pgPtr.Spec.Bootstrap.CloneFrom != nil {
+		s.reconcileCloneScript(pgPtr)
+	}
+}
+
+// reconcileBackupRestore 由备份模块创建恢复任务并跟踪进度
+func (s *PostgreSQL) reconcileBackupRestore(pgPtr *pgv1.PostgreSQL, sourcePtr *common.BackupSource) {
+	infoPtr := &common.RestoreInfo{
+		Instance:  pgPtr.Name,
+		Namespace: pgPtr.Namespace,
+		UID:       string(pgPtr.UID),
+		Backup:    sourcePtr.Backup,
+	}
+
+	restorePtr := pgPtr.Status.Restore
+	if restorePtr == nil || restorePtr.Backup != infoPtr.Backup {
+		restorePtr = &pgv1.RestoreStatus{Backup: infoPtr.Backup}
+		pgPtr.Status.Restore = restorePtr
+	}
+	if restorePtr.Phase == common.RestoreSucceeded || restorePtr.Phase == common.RestoreFailed {
+		return
+	}
+
+	var result *common.RestoreResult
+	var err *cd.Result
+	if restorePtr.Phase == "" {
+		result, err = s.sendRestoreEvent(common.StartRestore, infoPtr)
+		if err == nil {
+			now := metav1.Now()
+			restorePtr.StartTime = &now
+		}
+	} else {
+		result, err = s.sendRestoreEvent(common.QueryRestore, infoPtr)
+	}
+	if err != nil {
+		if err.Fail() {
+			log.Errorf("reconcileRestore %s failed, backup:%s, error:%s", pgPtr.Name, infoPtr.Backup, err.Error())
+			s.completeRestore(pgPtr, common.RestoreFailed, err.Reason)
+			return
+		}
+
+		restorePtr.Message = err.Reason
+		return
+	}
+
+	restorePtr.Phase = result.Phase
+	restorePtr.Message = result.Message
+	restorePtr.JobName = result.JobName
+	switch result.Phase {
+	case common.RestoreSucceeded:
+		restorePtr.Checksum = result.Checksum
+		restorePtr.Tables = result.Tables
+		restorePtr.Rows = result.Rows
+		s.completeRestore(pgPtr, common.RestoreSucceeded, "")
+		log.Infof("reconcileRestore %s succeeded, backup:%s, tables:%d, rows:%d", pgPtr.Name, infoPtr.Backup, result.Tables, result.Rows)
+	case common.RestoreFailed:
+		s.completeRestore(pgPtr, common.RestoreFailed, result.Message)
+	}
+}
+
+// completeRestore 记录恢复的最终状态，完成时间只记录一次
+func (s *PostgreSQL) completeRestore(pgPtr *pgv1.PostgreSQL, phase, message string) {
+	restorePtr := pgPtr.Status.Restore
+	restorePtr.Phase = phase
+	restorePtr.Message = message
+	if restorePtr.CompletionTime == nil {
+		now := metav1.Now()
+		restorePtr.CompletionTime = &now
+	}
+	if phase == common.RestoreFailed {
+		pgPtr.Status.Phase = pgv1.PhaseFailed
+		pgPtr.Status.Message = message
+	}
+}
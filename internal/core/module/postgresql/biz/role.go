@@ -0,0 +1,312 @@
+package biz
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	CredentialUsername = "username"
+	CredentialPassword = "password"
+	CredentialHost     = "host"
+	CredentialPort     = "port"
+
+	passwordLength = 24
+)
+
+func generatePassword() (ret string, err error) {
+	byteVal := make([]byte, passwordLength)
+	_, err = rand.Read(byteVal)
+	if err != nil {
+		return
+	}
+
+	ret = base64.RawURLEncoding.EncodeToString(byteVal)
+	return
+}
+
+// getPasswordHash 口令摘要记录在status中，用于发现凭证Secret中的口令已被修改
+func getPasswordHash(password string) string {
+	hashVal := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hashVal[:8])
+}
+
+// getSecretPasswordHashes 按名称返回各角色凭证Secret中口令的摘要
+func (s *PostgreSQL) getSecretPasswordHashes() (ret map[string]string, err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	secretList, secretErr := clientSet.CoreV1().Secrets(s.getNamespace()).List(context.TODO(), metav1.ListOptions{LabelSelector: common.RoleLabel})
+	if secretErr != nil {
+		err = cd.NewError(cd.UnExpected, secretErr.Error())
+		log.Errorf("getSecretPasswordHashes failed, error:%s", secretErr.Error())
+		return
+	}
+
+	ret = map[string]string{}
+	for idx := range secretList.Items {
+		secretPtr := &secretList.Items[idx]
+		ret[secretPtr.Name] = getPasswordHash(string(secretPtr.Data[CredentialPassword]))
+	}
+	return
+}
+
+func (s *PostgreSQL) reconcileRoles() {
+	var roleList pgv1.PostgreSQLRoleList
+	listErr := s.listResource(pgv1.PostgresqlRole, s.getNamespace(), &roleList)
+	if listErr != nil {
+		return
+	}
+
+	passwordHashes, hashErr := s.getSecretPasswordHashes()
+	if hashErr != nil {
+		return
+	}
+
+	for idx := range roleList.Items {
+		rolePtr := &roleList.Items[idx]
+		if rolePtr.DeletionTimestamp != nil {
+			s.deleteRole(rolePtr)
+			continue
+		}
+
+		// 凭证Secret中的口令被修改或Secret被删除后重新同步，修改Secret即可轮换口令
+		if rolePtr.Status.Phase == pgv1.PhaseReady && rolePtr.Status.ObservedGeneration == rolePtr.Generation &&
+			(!rolePtr.Spec.Login || passwordHashes[rolePtr.GetSecretName()] == rolePtr.Status.PasswordHash) {
+			continue
+		}
+
+		s.reconcileRole(rolePtr)
+	}
+}
+
+func (s *PostgreSQL) reconcileRole(rolePtr *pgv1.PostgreSQLRole) {
+	if !hasFinalizer(&rolePtr.ObjectMeta) {
+		rolePtr.Finalizers = append(rolePtr.Finalizers, pgv1.Finalizer)
+		_ = s.updateResource(pgv1.PostgresqlRole, rolePtr.Namespace, rolePtr, false)
+		return
+	}
+
+	secretName, passwordHash, memberOf, err := s.applyRole(rolePtr)
+	rolePtr.Status.ObservedGeneration = rolePtr.Generation
+	rolePtr.Status.Phase, rolePtr.Status.Message = getPhase(err)
+	if err == nil {
+		rolePtr.Status.SecretName = secretName
+		rolePtr.Status.PasswordHash = passwordHash
+		rolePtr.Status.MemberOf = memberOf
+	}
+
+	_ = s.updateResource(pgv1.PostgresqlRole, rolePtr.Namespace, rolePtr, true)
+}
+
+func (s *PostgreSQL) applyRole(rolePtr *pgv1.PostgreSQLRole) (secretName, passwordHash string, memberOf []string, err *cd.Result) {
+	instance := rolePtr.Spec.Instance
+	if !s.isInstanceReady(instance) {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("instance %s not ready", instance))
+		return
+	}
+
+	roleName := rolePtr.GetRoleName()
+	connectionLimit := int32(-1)
+	if rolePtr.Spec.ConnectionLimit != nil {
+		connectionLimit = *rolePtr.Spec.ConnectionLimit
+	}
+	_, err = s.executeSQL(instance, "", "role-ensure", roleName,
+		strconv.FormatBool(rolePtr.Spec.Login),
+		strconv.FormatBool(rolePtr.Spec.CreateDB),
+		strconv.FormatBool(rolePtr.Spec.CreateRole),
+		strconv.Itoa(int(connectionLimit)))
+	if err != nil {
+		return
+	}
+
+	// 先收回已不再声明的成员关系
+	declaredMembers := map[string]bool{}
+	for _, val := range rolePtr.Spec.MemberOf {
+		declaredMembers[val] = true
+	}
+	for _, val := range rolePtr.Status.MemberOf {
+		if declaredMembers[val] {
+			continue
+		}
+		_, err = s.executeSQL(instance, "", "role-revoke", val, roleName)
+		if err != nil {
+			return
+		}
+	}
+	for _, val := range rolePtr.Spec.MemberOf {
+		_, err = s.executeSQL(instance, "", "role-grant", val, roleName)
+		if err != nil {
+			return
+		}
+		memberOf = append(memberOf, val)
+	}
+
+	if !rolePtr.Spec.Login {
+		return
+	}
+
+	password, passwordErr := s.applyRoleSecret(rolePtr)
+	if passwordErr != nil {
+		err = passwordErr
+		return
+	}
+
+	// 口令以Secret为准，只向实例传递SCRAM-SHA-256校验值
+	verifier, verifierErr := common.NewScramVerifier(password)
+	if verifierErr != nil {
+		err = cd.NewError(cd.UnExpected, verifierErr.Error())
+		return
+	}
+	_, err = s.sendCommand(&common.CmdInfo{
+		Service:   instance,
+		Catalog:   common.PostgreSQL,
+		Type:      common.SQLCommand,
+		Operation: "role-password",
+		Args:      []string{roleName, verifier},
+		Sensitive: true,
+	})
+	if err != nil {
+		return
+	}
+
+	secretName = rolePtr.GetSecretName()
+	passwordHash = getPasswordHash(password)
+	return
+}
+
+// applyRoleSecret 确保角色凭证Secret存在，返回其中的密码
+func (s *PostgreSQL) applyRoleSecret(rolePtr *pgv1.PostgreSQLRole) (ret string, err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	secretName := rolePtr.GetSecretName()
+	secretPtr, secretErr := clientSet.CoreV1().Secrets(rolePtr.Namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
+	if secretErr != nil && !errors.IsNotFound(secretErr) {
+		err = cd.NewError(cd.UnExpected, secretErr.Error())
+		log.Errorf("applyRoleSecret failed, get secret %s error:%s", secretName, secretErr.Error())
+		return
+	}
+
+	credentials := map[string]string{
+		CredentialUsername: rolePtr.GetRoleName(),
+		CredentialHost:     fmt.Sprintf("%s.%s.svc", rolePtr.Spec.Instance, rolePtr.Namespace),
+		CredentialPort:     strconv.Itoa(common.DefaultPostgreSQLPort),
+	}
+	if secretErr == nil {
+		if password, ok := secretPtr.Data[CredentialPassword]; ok && len(password) > 0 {
+			credentials[CredentialPassword] = string(password)
+		}
+	}
+	if credentials[CredentialPassword] == "" {
+		password, passwordErr := generatePassword()
+		if passwordErr != nil {
+			err = cd.NewError(cd.UnExpected, passwordErr.Error())
+			return
+		}
+		credentials[CredentialPassword] = password
+	}
+
+	labels := common.NewInstanceLabels(rolePtr.Spec.Instance)
+	labels[common.RoleLabel] = rolePtr.Name
+	if secretErr != nil {
+		secretPtr = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: rolePtr.Namespace,
+				Labels:    labels,
+			},
+			Type:       corev1.SecretTypeOpaque,
+			StringData: credentials,
+		}
+		_, secretErr = clientSet.CoreV1().Secrets(rolePtr.Namespace).Create(context.TODO(), secretPtr, metav1.CreateOptions{})
+	} else {
+		for k, v := range labels {
+			if secretPtr.Labels == nil {
+				secretPtr.Labels = map[string]string{}
+			}
+			secretPtr.Labels[k] = v
+		}
+		secretPtr.StringData = credentials
+		_, secretErr = clientSet.CoreV1().Secrets(rolePtr.Namespace).Update(context.TODO(), secretPtr, metav1.UpdateOptions{})
+	}
+	if secretErr != nil {
+		err = cd.NewError(cd.UnExpected, secretErr.Error())
+		log.Errorf("applyRoleSecret failed, save secret %s error:%s", secretName, secretErr.Error())
+		return
+	}
+
+	ret = credentials[CredentialPassword]
+	return
+}
+
+func (s *PostgreSQL) deleteRole(rolePtr *pgv1.PostgreSQLRole) {
+	if !hasFinalizer(&rolePtr.ObjectMeta) {
+		return
+	}
+
+	if rolePtr.Spec.ReclaimPolicy == pgv1.ReclaimDrop {
+		// 删除角色成功前保留finalizer，下个周期继续删除
+		err := s.dropRole(rolePtr)
+		if err != nil {
+			log.Warnf("deleteRole %s pending, reason:%s", rolePtr.Name, err.Reason)
+			rolePtr.Status.Phase, rolePtr.Status.Message = getPhase(err)
+			_ = s.updateResource(pgv1.PostgresqlRole, rolePtr.Namespace, rolePtr, true)
+			return
+		}
+	}
+
+	removeFinalizer(&rolePtr.ObjectMeta)
+	_ = s.updateResource(pgv1.PostgresqlRole, rolePtr.Namespace, rolePtr, false)
+}
+
+// dropRole 角色仍拥有对象时删除失败，需要先转移或删除相关对象，实例未就绪时等待，实例已删除时不再删除角色
+func (s *PostgreSQL) dropRole(rolePtr *pgv1.PostgreSQLRole) (err *cd.Result) {
+	instance := rolePtr.Spec.Instance
+	if !s.isInstanceRemoved(instance) {
+		if !s.isInstanceReady(instance) {
+			err = cd.NewWarn(cd.Warned, fmt.Sprintf("instance %s not ready, waiting to drop role", instance))
+			return
+		}
+
+		_, err = s.executeSQL(instance, "", "role-drop", rolePtr.GetRoleName())
+		if err != nil {
+			return
+		}
+	}
+
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	deleteErr := clientSet.CoreV1().Secrets(rolePtr.Namespace).Delete(context.TODO(), rolePtr.GetSecretName(), metav1.DeleteOptions{})
+	if deleteErr != nil && !errors.IsNotFound(deleteErr) {
+		err = cd.NewError(cd.UnExpected, deleteErr.Error())
+		return
+	}
+
+	return
+}
@@ -0,0 +1,133 @@
+package biz
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/base/cron"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// maxKeepRunning 临时保持运行的最长时长
+const maxKeepRunning = 7 * 24 * time.Hour
+
+// 实例休眠的原因
+const (
+	hibernateRequested = "Requested"
+	hibernateSchedule  = "Schedule"
+	hibernateIdle      = "Idle"
+)
+
+func validateSchedule(schedulePtr *pgv1.RunningSchedule) error {
+	for _, val := range schedulePtr.Running {
+		if _, err := cron.Parse(val.Start); err != nil {
+			return fmt.Errorf("illegal running window start, %s", err.Error())
+		}
+		if _, err := cron.Parse(val.Stop); err != nil {
+			return fmt.Errorf("illegal running window stop, %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// isInWindow 下一次停止早于下一次启动时处于运行时段内，不再停止的时段视为不在运行时段内
+func isInWindow(window pgv1.RunningWindow, now time.Time) bool {
+	startPtr, startErr := cron.Parse(window.Start)
+	stopPtr, stopErr := cron.Parse(window.Stop)
+	if startErr != nil || stopErr != nil {
+		return false
+	}
+
+	nextStart := startPtr.Next(now)
+	nextStop := stopPtr.Next(now)
+	return !nextStop.IsZero() && (nextStart.IsZero() || nextStop.Before(nextStart))
+}
+
+// isOutsideSchedule 配置了运行时段且当前不在任何运行时段内，临时保持运行期间返回false，运行时段非法时不按计划休眠
+func isOutsideSchedule(schedulePtr *pgv1.RunningSchedule, now time.Time) bool {
+	if schedulePtr == nil || len(schedulePtr.Running) == 0 || validateSchedule(schedulePtr) != nil {
+		return false
+	}
+	if schedulePtr.KeepRunningUntil != nil && now.Before(schedulePtr.KeepRunningUntil.Time) {
+		return false
+	}
+
+	now = now.UTC()
+	for _, val := range schedulePtr.Running {
+		if isInWindow(val, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// getHibernateReason 实例应当休眠时返回原因，依次为手动休眠、运行时段与空闲
+func getHibernateReason(pgPtr *pgv1.PostgreSQL, now time.Time) string {
+	if pgPtr.Spec.Hibernate {
+		return hibernateRequested
+	}
+	if isOutsideSchedule(pgPtr.Spec.Schedule, now) {
+		return hibernateSchedule
+	}
+	if isIdle(pgPtr, now) {
+		return hibernateIdle
+	}
+
+	return ""
+}
+
+// keepRunningInstance 设置实例临时保持运行的截止时间，休眠中的实例随之恢复
+func (s *PostgreSQL) keepRunningInstance(ev event.Event, re event.Result) {
+	paramPtr, paramOK := ev.Data().(*common.KeepRunningParam)
+	if !paramOK {
+		log.Warnf("keepRunningInstance failed, illegal param")
+		if re != nil {
+			re.Set(nil, cd.NewError(cd.IllegalParam, "illegal param"))
+		}
+		return
+	}
+
+	err := s.setKeepRunning(paramPtr)
+	if re != nil {
+		re.Set(nil, err)
+	}
+}
+
+func (s *PostgreSQL) setKeepRunning(paramPtr *common.KeepRunningParam) (err *cd.Result) {
+	duration, durationErr := time.ParseDuration(paramPtr.Duration)
+	if durationErr != nil || duration < 0 || duration > maxKeepRunning {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("illegal duration %s, max %s", paramPtr.Duration, maxKeepRunning))
+		return
+	}
+
+	pgPtr := &pgv1.PostgreSQL{}
+	err = s.getResource(pgv1.Postgresql, s.getNamespace(), paramPtr.Name, pgPtr)
+	if err != nil {
+		return
+	}
+	if pgPtr.Spec.Schedule == nil || len(pgPtr.Spec.Schedule.Running) == 0 {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("instance %s has no running schedule", pgPtr.Name))
+		return
+	}
+
+	pgPtr.Spec.Schedule.KeepRunningUntil = nil
+	if duration > 0 {
+		until := metav1.NewTime(time.Now().Add(duration).Truncate(time.Second))
+		pgPtr.Spec.Schedule.KeepRunningUntil = &until
+	}
+	err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, false)
+	if err != nil {
+		return
+	}
+
+	log.Infof("setKeepRunning %s, duration:%s", pgPtr.Name, duration)
+	return
+}
@@ -0,0 +1,123 @@
+package biz
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// dataSnapshot 从快照创建数据卷所需的快照名称、容量与存储类
+type dataSnapshot struct {
+	name      string
+	size      string
+	className string
+}
+
+// getDataSize 数据卷容量不能小于快照恢复所需的容量
+func getDataSize(specSize string, snapshotSize int64) string {
+	snapshotQuantity := resource.NewQuantity(snapshotSize, resource.BinarySI)
+	specQuantity, specErr := resource.ParseQuantity(specSize)
+	if specErr == nil && specQuantity.Cmp(*snapshotQuantity) >= 0 {
+		return specQuantity.String()
+	}
+
+	return snapshotQuantity.String()
+}
+
+// prepareSnapshot 从快照初始化的实例在部署前确认快照备份已完成，未指定存储类时沿用源实例的存储类
+func (s *PostgreSQL) prepareSnapshot(pairPtr *serviceInfoPair) (err *cd.Result) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pairPtr.dataSnapshot != nil {
+		return
+	}
+
+	backupName := pgPtr.GetBootstrap().FromSnapshot.Backup
+	var backupList pgv1.PostgreSQLBackupList
+	err = s.listResource(pgv1.Backup, pgPtr.Namespace, &backupList)
+	if err != nil {
+		return
+	}
+
+	var backupPtr *pgv1.PostgreSQLBackup
+	for idx := range backupList.Items {
+		if backupList.Items[idx].Name == backupName {
+			backupPtr = &backupList.Items[idx]
+			break
+		}
+	}
+	switch {
+	case backupPtr == nil:
+		err = cd.NewWarn(cd.NoExist, fmt.Sprintf("backup %s not found", backupName))
+	case !backupPtr.Spec.IsSnapshot():
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("backup %s is not a snapshot backup", backupName))
+	case backupPtr.Status.Phase == pgv1.PhaseFailed:
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("backup %s failed", backupName))
+	case backupPtr.Status.Phase != pgv1.BackupPhaseSucceeded || backupPtr.Status.Snapshot == "":
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("waiting for backup %s to complete", backupName))
+	}
+	if err != nil {
+		if err.Fail() {
+			log.Errorf("prepareSnapshot %s failed, error:%s", pgPtr.Name, err.Error())
+			pgPtr.Status.Restore = &pgv1.RestoreStatus{Backup: backupName}
+			s.completeRestore(pgPtr, common.RestoreFailed, err.Reason)
+			_ = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+		}
+		return
+	}
+
+	snapshotPtr := &dataSnapshot{name: backupPtr.Status.Snapshot}
+	specSize := ""
+	if pgPtr.Spec.Storage != nil {
+		specSize = pgPtr.Spec.Storage.Size
+		snapshotPtr.className = pgPtr.Spec.Storage.ClassName
+	}
+	snapshotPtr.size = getDataSize(specSize, backupPtr.Status.Size)
+	if snapshotPtr.className == "" {
+		if sourcePtr := s.postgresqlCache.Fetch(backupPtr.Spec.Instance); sourcePtr != nil {
+			sourcePgPtr := sourcePtr.(*serviceInfoPair).postgreSQLPtr
+			if sourcePgPtr != nil && sourcePgPtr.Spec.Storage != nil {
+				snapshotPtr.className = sourcePgPtr.Spec.Storage.ClassName
+			}
+		}
+	}
+	if snapshotPtr.className == "" {
+		err = cd.NewWarn(cd.Warned, fmt.Sprintf("storage class of source instance %s unknown, specify spec.storage.className", backupPtr.Spec.Instance))
+		return
+	}
+
+	restorePtr := pgPtr.Status.Restore
+	if restorePtr == nil || restorePtr.Backup != backupName {
+		now := metav1.Now()
+		pgPtr.Status.Phase = pgv1.InstancePhaseRestoring
+		pgPtr.Status.Restore = &pgv1.RestoreStatus{
+			Backup:    backupName,
+			Phase:     common.RestoreRunning,
+			StartTime: &now,
+		}
+		err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+		if err != nil {
+			return
+		}
+	}
+
+	pairPtr.dataSnapshot = snapshotPtr
+	log.Infof("prepareSnapshot %s, backup:%s, snapshot:%s, size:%s", pgPtr.Name, backupName, snapshotPtr.name, snapshotPtr.size)
+	return
+}
+
+// reconcileSnapshotRestore 数据卷从快照创建，实例可连接后即完成崩溃恢复
+func (s *PostgreSQL) reconcileSnapshotRestore(pgPtr *pgv1.PostgreSQL) {
+	if pgPtr.Status.Restore == nil {
+		return
+	}
+
+	s.completeRestore(pgPtr, common.RestoreSucceeded, "")
+	log.Infof("reconcileSnapshotRestore %s succeeded, backup:%s", pgPtr.Name, pgPtr.Status.Restore.Backup)
+}
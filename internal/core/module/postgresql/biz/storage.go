@@ -0,0 +1,264 @@
+package biz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/base/record"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	// storageInterval 检查数据卷使用率的间隔
+	storageInterval      = time.Minute
+	defaultGrowThreshold = 80
+	defaultGrowStep      = "10Gi"
+	// expandSettledPercent 文件系统容量达到申请容量的该百分比后视为上次扩容已生效
+	expandSettledPercent = 90
+	// expandTimeout 超过该时长扩容仍未生效时告警
+	expandTimeout = 10 * time.Minute
+)
+
+// diskUsage 数据卷文件系统的使用情况，单位字节
+type diskUsage struct {
+	member   string
+	capacity int64
+	used     int64
+	percent  int32
+}
+
+func validateAutoGrow(autoGrowPtr *pgv1.AutoGrowSpec) error {
+	if autoGrowPtr.Threshold < 0 || autoGrowPtr.Threshold > 99 {
+		return fmt.Errorf("illegal auto grow threshold %d", autoGrowPtr.Threshold)
+	}
+	if autoGrowPtr.Step != "" {
+		stepQuantity, stepErr := resource.ParseQuantity(autoGrowPtr.Step)
+		if stepErr != nil || stepQuantity.Sign() <= 0 {
+			return fmt.Errorf("illegal auto grow step %s", autoGrowPtr.Step)
+		}
+	}
+	maxQuantity, maxErr := resource.ParseQuantity(autoGrowPtr.MaxSize)
+	if maxErr != nil || maxQuantity.Sign() <= 0 {
+		return fmt.Errorf("illegal auto grow max size %s", autoGrowPtr.MaxSize)
+	}
+
+	return nil
+}
+
+func getAutoGrow(pgPtr *pgv1.PostgreSQL) *pgv1.AutoGrowSpec {
+	if pgPtr.Spec.Storage == nil || pgPtr.Spec.Storage.AutoGrow == nil || validateAutoGrow(pgPtr.Spec.Storage.AutoGrow) != nil {
+		return nil
+	}
+
+	return pgPtr.Spec.Storage.AutoGrow
+}
+
+func getGrowThreshold(pgPtr *pgv1.PostgreSQL) int32 {
+	if autoGrowPtr := getAutoGrow(pgPtr); autoGrowPtr != nil && autoGrowPtr.Threshold > 0 {
+		return autoGrowPtr.Threshold
+	}
+
+	return defaultGrowThreshold
+}
+
+// getStorageSize 数据卷容量取实例定义与自动扩容后容量中较大者，均未设置时返回空
+func getStorageSize(pgPtr *pgv1.PostgreSQL) string {
+	specSize := ""
+	if pgPtr.Spec.Storage != nil {
+		specSize = pgPtr.Spec.Storage.Size
+	}
+	if pgPtr.Status.Storage == nil || pgPtr.Status.Storage.Size == "" {
+		return specSize
+	}
+
+	statusQuantity, statusErr := resource.ParseQuantity(pgPtr.Status.Storage.Size)
+	if statusErr != nil {
+		return specSize
+	}
+	specQuantity, specErr := resource.ParseQuantity(specSize)
+	if specErr == nil && specQuantity.Cmp(statusQuantity) >= 0 {
+		return specSize
+	}
+	return pgPtr.Status.Storage.Size
+}
+
+// parseDiskUsage 解析df -P -k的输出，使用率按已用与可用之和计算并向上取整，与df一致
+func parseDiskUsage(val string) (ret *diskUsage, err error) {
+	lines := strings.Split(strings.TrimSpace(val), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 6 {
+		err = fmt.Errorf("illegal disk usage %s", val)
+		return
+	}
+
+	values := make([]int64, 3)
+	for idx := range values {
+		values[idx], err = strconv.ParseInt(fields[idx+1], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("illegal disk usage %s", val)
+			return
+		}
+	}
+
+	ret = &diskUsage{capacity: values[0] * 1024, used: values[1] * 1024}
+	if total := values[1] + values[2]; total > 0 {
+		ret.percent = int32((values[1]*100 + total - 1) / total)
+	}
+	return
+}
+
+// getDiskUsage 统计各成员数据卷的使用情况，返回使用率最高的成员，部分成员无法统计时忽略
+func (s *PostgreSQL) getDiskUsage(pgPtr *pgv1.PostgreSQL) (ret *diskUsage, err *cd.Result) {
+	members := []string{""}
+	if replicationPtr := pgPtr.Status.Replication; replicationPtr != nil && len(replicationPtr.Members) > 0 {
+		members = []string{}
+		for _, val := range replicationPtr.Members {
+			members = append(members, val.Name)
+		}
+	}
+
+	for _, member := range members {
+		usageVal, usageErr := s.executeMemberCommand(pgPtr.Name, member, common.DiagnosticCommand, "disk-usage")
+		if usageErr != nil {
+			err = usageErr
+			continue
+		}
+
+		usagePtr, parseErr := parseDiskUsage(usageVal)
+		if parseErr != nil {
+			err = cd.NewError(cd.UnExpected, parseErr.Error())
+			continue
+		}
+		usagePtr.member = member
+		if ret == nil || usagePtr.percent > ret.percent {
+			ret = usagePtr
+		}
+	}
+	if ret != nil {
+		err = nil
+	}
+	return
+}
+
+func formatBytes(val int64) string {
+	return fmt.Sprintf("%dMi", val/(1024*1024))
+}
+
+// reconcileStorage 每分钟统计一次数据卷使用率并记录到status，超过阈值时发出告警事件，配置了AutoGrow时扩容
+func (s *PostgreSQL) reconcileStorage(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pairPtr.serviceInfo == nil || pgPtr.Status.Phase != pgv1.InstancePhaseRunning {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(pairPtr.storageTime) < storageInterval {
+		return
+	}
+	pairPtr.storageTime = now
+
+	usagePtr, err := s.getDiskUsage(pgPtr)
+	if err != nil {
+		log.Errorf("reconcileStorage %s failed, error:%s", pgPtr.Name, err.Error())
+		return
+	}
+
+	if pgPtr.Status.Storage == nil {
+		pgPtr.Status.Storage = &pgv1.StorageStatus{}
+	}
+	pgPtr.Status.Storage.Capacity = formatBytes(usagePtr.capacity)
+	pgPtr.Status.Storage.Used = formatBytes(usagePtr.used)
+	pgPtr.Status.Storage.UsedPercent = usagePtr.percent
+
+	threshold := getGrowThreshold(pgPtr)
+	if usagePtr.percent < threshold {
+		pairPtr.storageWarned = false
+		return
+	}
+
+	s.growStorage(pairPtr, usagePtr, threshold)
+}
+
+// growStorage 按Step扩容全部成员的数据卷，上次扩容尚未生效或已达到MaxSize时只发出告警
+func (s *PostgreSQL) growStorage(pairPtr *serviceInfoPair, usagePtr *diskUsage, threshold int32) {
+	pgPtr := pairPtr.postgreSQLPtr
+	usageMsg := fmt.Sprintf("data volume usage %d%% exceeds %d%%", usagePtr.percent, threshold)
+	autoGrowPtr := getAutoGrow(pgPtr)
+	if autoGrowPtr == nil {
+		s.warnStorage(pairPtr, "StorageUsageHigh", usageMsg)
+		return
+	}
+
+	storageSize := getStorageSize(pgPtr)
+	if storageSize == "" {
+		storageSize = common.DefaultDataSize
+	}
+	sizeQuantity, sizeErr := resource.ParseQuantity(storageSize)
+	if sizeErr != nil {
+		log.Errorf("growStorage %s failed, illegal size %s", pgPtr.Name, storageSize)
+		return
+	}
+	if usagePtr.capacity*100 < sizeQuantity.Value()*expandSettledPercent {
+		expandTime := pgPtr.Status.Storage.LastExpandTime
+		if expandTime != nil && time.Since(expandTime.Time) > expandTimeout {
+			s.warnStorage(pairPtr, "StorageExpandPending", fmt.Sprintf("%s, data volume of %s not expanded to %s, check whether the storage class allows volume expansion",
+				usageMsg, usagePtr.member, storageSize))
+			return
+		}
+		log.Infof("growStorage %s, waiting for data volume of %s expanded to %s", pgPtr.Name, usagePtr.member, storageSize)
+		return
+	}
+
+	maxQuantity := resource.MustParse(autoGrowPtr.MaxSize)
+	if sizeQuantity.Cmp(maxQuantity) >= 0 {
+		s.warnStorage(pairPtr, "StorageMaxSizeReached", fmt.Sprintf("%s, max size %s reached", usageMsg, autoGrowPtr.MaxSize))
+		return
+	}
+
+	step := autoGrowPtr.Step
+	if step == "" {
+		step = defaultGrowStep
+	}
+	// 文件系统大于申请容量时以文件系统容量为基准
+	newQuantity := sizeQuantity.DeepCopy()
+	if capacityQuantity := resource.NewQuantity(usagePtr.capacity, resource.BinarySI); capacityQuantity.Cmp(newQuantity) > 0 {
+		newQuantity = *capacityQuantity
+	}
+	newQuantity.Add(resource.MustParse(step))
+	if newQuantity.Cmp(maxQuantity) > 0 {
+		newQuantity = maxQuantity
+	}
+
+	now := metav1.Now()
+	pgPtr.Status.Storage.Size = newQuantity.String()
+	pgPtr.Status.Storage.LastExpandTime = &now
+	pairPtr.storageWarned = false
+	_ = s.updateK8sDeployment(pairPtr)
+
+	msg := fmt.Sprintf("%s, expanding from %s to %s", usageMsg, storageSize, pgPtr.Status.Storage.Size)
+	record.Event(s.getClientSet(), record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.PostgreSQLKind, pgPtr),
+		corev1.EventTypeWarning, "StorageExpanding", msg)
+	log.Warnf("growStorage %s, %s", pgPtr.Name, msg)
+}
+
+// warnStorage 使用率回落到阈值以下之前同一告警只发出一次
+func (s *PostgreSQL) warnStorage(pairPtr *serviceInfoPair, reason, msg string) {
+	if pairPtr.storageWarned {
+		return
+	}
+
+	pairPtr.storageWarned = true
+	record.Event(s.getClientSet(), record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.PostgreSQLKind, pairPtr.postgreSQLPtr),
+		corev1.EventTypeWarning, reason, msg)
+	log.Warnf("reconcileStorage %s, %s", pairPtr.postgreSQLPtr.Name, msg)
+}
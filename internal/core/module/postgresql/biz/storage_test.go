@@ -0,0 +1,124 @@
+package biz
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/task"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+func TestParseDiskUsage(t *testing.T) {
+	header := "Filesystem     1024-blocks    Used Available Capacity Mounted on\n"
+	cases := []struct {
+		name      string
+		val       string
+		capacity  int64
+		used      int64
+		percent   int32
+		expectErr bool
+	}{
+		{name: "normal", val: header + "/dev/sdb 10485760 5242880 5242880 50% /var/lib/postgresql/data\n", capacity: 10485760 * 1024, used: 5242880 * 1024, percent: 50},
+		{name: "round up", val: header + "/dev/sdb 1000 1 999 1% /data", capacity: 1000 * 1024, used: 1024, percent: 1},
+		// 保留块不计入可用空间，使用率按已用与可用之和计算
+		{name: "reserved blocks", val: header + "/dev/sdb 1000 800 100 89% /data", capacity: 1000 * 1024, used: 800 * 1024, percent: 89},
+		{name: "empty filesystem", val: header + "/dev/sdb 0 0 0 - /data", percent: 0},
+		{name: "wrapped line", val: header + "/dev/mapper/vg-data\n 2048 1024 1024 50% /data", expectErr: true},
+		{name: "without header", val: "/dev/sdb 1000 500 500 50% /data", expectErr: true},
+		{name: "illegal number", val: header + "/dev/sdb 1000 used 500 50% /data", expectErr: true},
+		{name: "empty", val: "", expectErr: true},
+	}
+	for _, c := range cases {
+		usagePtr, err := parseDiskUsage(c.val)
+		if (err != nil) != c.expectErr {
+			t.Errorf("%s: parseDiskUsage error %v, expect error %v", c.name, err, c.expectErr)
+			continue
+		}
+		if c.expectErr {
+			continue
+		}
+		if usagePtr.capacity != c.capacity || usagePtr.used != c.used || usagePtr.percent != c.percent {
+			t.Errorf("%s: usage %+v, expect capacity %d used %d percent %d", c.name, *usagePtr, c.capacity, c.used, c.percent)
+		}
+	}
+}
+
+func TestGrowStorage(t *testing.T) {
+	const gi = int64(1024 * 1024 * 1024)
+	expired := metav1.NewTime(time.Now().Add(-2 * expandTimeout))
+	cases := []struct {
+		name       string
+		size       string
+		statusSize string
+		expandTime *metav1.Time
+		autoGrow   *pgv1.AutoGrowSpec
+		capacity   int64
+		expectSize string
+		warned     bool
+	}{
+		{name: "without auto grow", size: "10Gi", capacity: 10 * gi, warned: true},
+		{name: "illegal auto grow", size: "10Gi", autoGrow: &pgv1.AutoGrowSpec{MaxSize: "none"}, capacity: 10 * gi, warned: true},
+		{name: "grow", size: "10Gi", autoGrow: &pgv1.AutoGrowSpec{Step: "5Gi", MaxSize: "100Gi"}, capacity: 10 * gi, expectSize: "15Gi"},
+		{name: "default step", size: "10Gi", autoGrow: &pgv1.AutoGrowSpec{MaxSize: "100Gi"}, capacity: 10 * gi, expectSize: "20Gi"},
+		{name: "capped at max size", size: "10Gi", autoGrow: &pgv1.AutoGrowSpec{Step: "10Gi", MaxSize: "15Gi"}, capacity: 10 * gi, expectSize: "15Gi"},
+		{name: "filesystem larger than size", size: "10Gi", autoGrow: &pgv1.AutoGrowSpec{Step: "5Gi", MaxSize: "100Gi"}, capacity: 12 * gi, expectSize: "17Gi"},
+		{name: "grow from status size", size: "10Gi", statusSize: "20Gi", autoGrow: &pgv1.AutoGrowSpec{Step: "5Gi", MaxSize: "100Gi"}, capacity: 20 * gi, expectSize: "25Gi"},
+		{name: "max size reached", size: "10Gi", statusSize: "15Gi", autoGrow: &pgv1.AutoGrowSpec{MaxSize: "15Gi"}, capacity: 15 * gi, expectSize: "15Gi", warned: true},
+		// 上次扩容尚未生效时等待，超时后告警
+		{name: "expand pending", size: "10Gi", statusSize: "20Gi", expandTime: &metav1.Time{Time: time.Now()}, autoGrow: &pgv1.AutoGrowSpec{MaxSize: "100Gi"}, capacity: 10 * gi, expectSize: "20Gi"},
+		{name: "expand timeout", size: "10Gi", statusSize: "20Gi", expandTime: &expired, autoGrow: &pgv1.AutoGrowSpec{MaxSize: "100Gi"}, capacity: 10 * gi, expectSize: "20Gi", warned: true},
+	}
+
+	httpServer := httptest.NewServer(&fakeAPIServer{})
+	defer httpServer.Close()
+	clientSet, clientErr := kubernetes.NewForConfig(&rest.Config{Host: httpServer.URL})
+	if clientErr != nil {
+		t.Fatalf("new clientset failed, error:%s", clientErr.Error())
+	}
+
+	hub := newSyncHub()
+	var updateCount atomic.Int32
+	k8sObserver := event.NewSimpleObserver(common.K8sModule, hub)
+	k8sObserver.Subscribe(common.UpdateService, func(_ event.Event, re event.Result) {
+		updateCount.Add(1)
+		if re != nil {
+			re.Set(nil, nil)
+		}
+	})
+	pgModule := New(hub, task.NewBackgroundRoutine(10))
+	pgModule.clientSet = clientSet
+
+	for _, c := range cases {
+		pgPtr := &pgv1.PostgreSQL{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec:       pgv1.Spec{Storage: &pgv1.StorageSpec{Size: c.size, AutoGrow: c.autoGrow}},
+			Status:     pgv1.Status{Storage: &pgv1.StorageStatus{Size: c.statusSize, LastExpandTime: c.expandTime}},
+		}
+		pairPtr := &serviceInfoPair{postgreSQLPtr: pgPtr}
+		updateCount.Store(0)
+		pgModule.growStorage(pairPtr, &diskUsage{capacity: c.capacity, percent: 90}, 80)
+
+		if pgPtr.Status.Storage.Size != c.expectSize {
+			t.Errorf("%s: size %s, expect %s", c.name, pgPtr.Status.Storage.Size, c.expectSize)
+		}
+		if pairPtr.storageWarned != c.warned {
+			t.Errorf("%s: warned %v, expect %v", c.name, pairPtr.storageWarned, c.warned)
+		}
+		expanded := c.expectSize != "" && c.expectSize != c.statusSize
+		if (updateCount.Load() > 0) != expanded {
+			t.Errorf("%s: update count %d, expect expanded %v", c.name, updateCount.Load(), expanded)
+		}
+		if expanded && pgPtr.Status.Storage.LastExpandTime == nil {
+			t.Errorf("%s: last expand time not set", c.name)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package biz
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+// applySuperuserSecret 实例部署前生成超级用户口令，Secret随实例定义一起删除，返回口令的摘要
+func (s *PostgreSQL) applySuperuserSecret(pgPtr *pgv1.PostgreSQL) (ret string, err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	secretName := common.GetSuperuserSecretName(pgPtr.Name)
+	secretClient := clientSet.CoreV1().Secrets(pgPtr.Namespace)
+	secretPtr, secretErr := secretClient.Get(context.TODO(), secretName, metav1.GetOptions{})
+	if secretErr == nil && len(secretPtr.Data[common.SuperuserPasswordKey]) > 0 {
+		ret = getPasswordHash(string(secretPtr.Data[common.SuperuserPasswordKey]))
+		return
+	}
+	if secretErr != nil && !errors.IsNotFound(secretErr) {
+		err = cd.NewError(cd.UnExpected, secretErr.Error())
+		log.Errorf("applySuperuserSecret %s failed, get secret error:%s", pgPtr.Name, secretErr.Error())
+		return
+	}
+
+	password, passwordErr := generatePassword()
+	if passwordErr != nil {
+		err = cd.NewError(cd.UnExpected, passwordErr.Error())
+		return
+	}
+	credentials := map[string]string{
+		CredentialUsername:          common.DefaultPostgreSQLRoot,
+		common.SuperuserPasswordKey: password,
+	}
+
+	if secretErr != nil {
+		secretPtr = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: pgPtr.Namespace,
+				Labels:    common.NewInstanceLabels(pgPtr.Name),
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: pgv1.Group + "/" + pgv1.Version,
+						Kind:       pgv1.PostgreSQLKind,
+						Name:       pgPtr.Name,
+						UID:        pgPtr.UID,
+					},
+				},
+			},
+			Type:       corev1.SecretTypeOpaque,
+			StringData: credentials,
+		}
+		_, secretErr = secretClient.Create(context.TODO(), secretPtr, metav1.CreateOptions{})
+	} else {
+		secretPtr.StringData = credentials
+		_, secretErr = secretClient.Update(context.TODO(), secretPtr, metav1.UpdateOptions{})
+	}
+	if secretErr != nil {
+		err = cd.NewError(cd.UnExpected, secretErr.Error())
+		log.Errorf("applySuperuserSecret %s failed, save secret error:%s", pgPtr.Name, secretErr.Error())
+		return
+	}
+
+	log.Infof("applySuperuserSecret %s, superuser password generated", pgPtr.Name)
+	ret = getPasswordHash(password)
+	return
+}
+
+// applySuperuserPassword 以Secret中的口令设置root口令，从备份或其他实例恢复的数据目录及修改过的Secret均在此同步
+func (s *PostgreSQL) applySuperuserPassword(pgPtr *pgv1.PostgreSQL) (ret string, err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "illegal k8s client")
+		return
+	}
+
+	secretPtr, secretErr := clientSet.CoreV1().Secrets(pgPtr.Namespace).Get(context.TODO(), common.GetSuperuserSecretName(pgPtr.Name), metav1.GetOptions{})
+	if secretErr != nil {
+		err = cd.NewError(cd.UnExpected, secretErr.Error())
+		return
+	}
+	password := string(secretPtr.Data[common.SuperuserPasswordKey])
+	if password == "" {
+		err = cd.NewWarn(cd.Warned, "waiting for superuser password")
+		return
+	}
+
+	hash := getPasswordHash(password)
+	if pgPtr.Status.SuperuserHash == hash {
+		ret = hash
+		return
+	}
+
+	verifier, verifierErr := common.NewScramVerifier(password)
+	if verifierErr != nil {
+		err = cd.NewError(cd.UnExpected, verifierErr.Error())
+		return
+	}
+	_, err = s.sendCommand(&common.CmdInfo{
+		Service:   pgPtr.Name,
+		Catalog:   common.PostgreSQL,
+		Type:      common.SQLCommand,
+		Operation: "role-password",
+		Args:      []string{common.DefaultPostgreSQLRoot, verifier},
+		Sensitive: true,
+	})
+	if err != nil {
+		return
+	}
+
+	ret = hash
+	return
+}
@@ -0,0 +1,363 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cd "github.com/muidea/magicCommon/def"
+	"github.com/muidea/magicCommon/event"
+	"github.com/muidea/magicCommon/foundation/log"
+
+	"supos.ai/operator/database/internal/core/base/record"
+	"supos.ai/operator/database/pkg/common"
+	pgv1 "supos.ai/operator/database/pkg/crds/v1"
+)
+
+const (
+	// switchoverCatchUpTimeout 等待目标备节点追上主节点的最长时间
+	switchoverCatchUpTimeout = 5 * time.Minute
+	// switchoverPromoteTimeout 隔离原主节点后等待其停止、目标备节点回放并提升的最长时间，包含Pod的终止期限，超时后解除隔离
+	switchoverPromoteTimeout = 3 * time.Minute
+	// switchoverMaxLag 目标备节点回放落后主节点不超过该字节数时才隔离原主节点
+	switchoverMaxLag = 16 * 1024 * 1024
+	// switchoverReason 计划内切换在切换记录中的原因
+	switchoverReason = "Switchover"
+)
+
+// switchoverInstance 设置实例的切换目标并清除上次的切换进度，由reconcileSwitchover执行切换
+func (s *PostgreSQL) switchoverInstance(ev event.Event, re event.Result) {
+	paramPtr, paramOK := ev.Data().(*common.SwitchoverParam)
+	if !paramOK {
+		log.Warnf("switchoverInstance failed, illegal param")
+		if re != nil {
+			re.Set(nil, cd.NewError(cd.IllegalParam, "illegal param"))
+		}
+		return
+	}
+
+	err := s.setSwitchover(paramPtr)
+	if re != nil {
+		re.Set(nil, err)
+	}
+}
+
+func (s *PostgreSQL) setSwitchover(paramPtr *common.SwitchoverParam) (err *cd.Result) {
+	pgPtr := &pgv1.PostgreSQL{}
+	err = s.getResource(pgv1.Postgresql, s.getNamespace(), paramPtr.Name, pgPtr)
+	if err != nil {
+		return
+	}
+
+	err = validateSwitchover(pgPtr, paramPtr.Target)
+	if err != nil {
+		return
+	}
+	if pgPtr.Status.Replication.Switchover.IsRunning() {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("switchover to %s is running", pgPtr.Status.Replication.Switchover.Target))
+		return
+	}
+
+	pgPtr.Spec.Replication.SwitchoverTo = paramPtr.Target
+	err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, false)
+	if err != nil {
+		return
+	}
+
+	// 清除上次的切换进度，同一目标可以再次切换
+	if pgPtr.Status.Replication.Switchover != nil {
+		pgPtr.Status.Replication.Switchover = nil
+		err = s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, true)
+		if err != nil {
+			return
+		}
+	}
+
+	log.Infof("setSwitchover %s, target:%s", pgPtr.Name, paramPtr.Target)
+	return
+}
+
+// validateSwitchover 目标须为运行中实例的备节点
+func validateSwitchover(pgPtr *pgv1.PostgreSQL, target string) (err *cd.Result) {
+	replicationPtr := getReplication(pgPtr)
+	if replicationPtr == nil || replicationPtr.Standbys == 0 || pgPtr.Status.Replication == nil {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("instance %s replication not enabled", pgPtr.Name))
+		return
+	}
+	if pgPtr.Status.Phase != pgv1.InstancePhaseRunning {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("instance %s not running", pgPtr.Name))
+		return
+	}
+	if target == pgPtr.GetPrimary() {
+		err = cd.NewError(cd.IllegalParam, fmt.Sprintf("member %s is already primary", target))
+		return
+	}
+
+	serviceInfo := &common.ServiceInfo{Name: pgPtr.Name, Replication: replicationPtr}
+	for _, member := range serviceInfo.GetMembers() {
+		if member == target {
+			return
+		}
+	}
+
+	err = cd.NewError(cd.IllegalParam, fmt.Sprintf("member %s not found", target))
+	return
+}
+
+// reconcileSwitchover 计划内切换依次等待目标备节点追上主节点、隔离并停止原主节点、等待目标回放到最终位置后提升目标
+// 任一阶段超时或失败时解除原主节点的隔离，切换进度记录在status中，operator重启后继续
+func (s *PostgreSQL) reconcileSwitchover(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	if pgPtr.Status.Replication == nil || pairPtr.serviceInfo == nil || pairPtr.failover != nil {
+		return
+	}
+
+	switchoverPtr := pgPtr.Status.Replication.Switchover
+	if !switchoverPtr.IsRunning() {
+		if s.startResizeSwitchover(pairPtr) {
+			return
+		}
+
+		target := ""
+		if pgPtr.Spec.Replication != nil {
+			target = pgPtr.Spec.Replication.SwitchoverTo
+		}
+		if target == "" || target == pgPtr.GetPrimary() || (switchoverPtr != nil && switchoverPtr.Target == target) {
+			return
+		}
+
+		s.startSwitchover(pgPtr, target)
+		return
+	}
+
+	switch switchoverPtr.Phase {
+	case pgv1.SwitchoverPhaseCatchingUp:
+		s.demotePrimary(pairPtr)
+	case pgv1.SwitchoverPhaseDemoted:
+		s.promoteTarget(pairPtr)
+	}
+}
+
+// startResizeSwitchover 调整资源时k8s模块保持主节点的原Pod模板，切换到已按新资源就绪的备节点后原主节点以备节点身份重建
+// 切换目标记录到spec中，对同一目标的切换失败后不再自动切换，可通过切换接口重试
+func (s *PostgreSQL) startResizeSwitchover(pairPtr *serviceInfoPair) bool {
+	pgPtr := pairPtr.postgreSQLPtr
+	target := pairPtr.switchoverTo
+	switchoverPtr := pgPtr.Status.Replication.Switchover
+	if target == "" || target == pgPtr.GetPrimary() || pgPtr.Spec.Replication == nil ||
+		(switchoverPtr != nil && switchoverPtr.Target == target && switchoverPtr.Phase == pgv1.SwitchoverPhaseFailed) {
+		return false
+	}
+
+	pgPtr.Spec.Replication.SwitchoverTo = target
+	err := s.updateResource(pgv1.Postgresql, pgPtr.Namespace, pgPtr, false)
+	if err != nil {
+		return true
+	}
+
+	log.Infof("startResizeSwitchover %s, primary %s waiting for switchover to resized member %s", pgPtr.Name, pgPtr.GetPrimary(), target)
+	s.startSwitchover(pgPtr, target)
+	return true
+}
+
+func (s *PostgreSQL) startSwitchover(pgPtr *pgv1.PostgreSQL, target string) {
+	now := metav1.Now()
+	switchoverPtr := &pgv1.SwitchoverStatus{
+		Target:         target,
+		Phase:          pgv1.SwitchoverPhaseCatchingUp,
+		StartTime:      &now,
+		TransitionTime: &now,
+	}
+	pgPtr.Status.Replication.Switchover = switchoverPtr
+
+	err := validateSwitchover(pgPtr, target)
+	if err != nil {
+		switchoverPtr.Phase = pgv1.SwitchoverPhaseFailed
+		switchoverPtr.Message = err.Reason
+		log.Errorf("startSwitchover %s failed, target:%s, error:%s", pgPtr.Name, target, err.Reason)
+		return
+	}
+
+	log.Infof("startSwitchover %s, from %s to %s", pgPtr.Name, pgPtr.GetPrimary(), target)
+}
+
+// demotePrimary 目标备节点的回放延迟足够小后隔离原主节点，原主节点的Deployment停止后其Pod不再被读写Service选择
+func (s *PostgreSQL) demotePrimary(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	switchoverPtr := pgPtr.Status.Replication.Switchover
+	if time.Since(switchoverPtr.TransitionTime.Time) > switchoverCatchUpTimeout {
+		s.failSwitchover(pairPtr, fmt.Sprintf("member %s not caught up in %s", switchoverPtr.Target, switchoverCatchUpTimeout))
+		return
+	}
+
+	lagVal, lagErr := s.querySQL(pgPtr.Name, "", "replication-lag", switchoverPtr.Target)
+	if lagErr != nil {
+		switchoverPtr.Message = lagErr.Reason
+		return
+	}
+	lag, parseErr := strconv.ParseFloat(lagVal, 64)
+	if parseErr != nil || lag < 0 || lag > switchoverMaxLag {
+		switchoverPtr.Message = fmt.Sprintf("waiting for member %s to catch up", switchoverPtr.Target)
+		return
+	}
+
+	now := metav1.Now()
+	switchoverPtr.Phase = pgv1.SwitchoverPhaseDemoted
+	switchoverPtr.Message = ""
+	switchoverPtr.LSN = ""
+	switchoverPtr.TransitionTime = &now
+	err := s.updateK8sDeployment(pairPtr)
+	if err != nil {
+		// 隔离由status中的切换阶段决定，下一周期重试
+		switchoverPtr.Message = err.Reason
+	}
+	log.Infof("demotePrimary %s, primary %s fenced", pgPtr.Name, pgPtr.GetPrimary())
+}
+
+// isSwitchoverFenced 计划内切换已隔离原主节点，等待目标备节点提升
+func isSwitchoverFenced(pgPtr *pgv1.PostgreSQL) bool {
+	statusPtr := pgPtr.Status.Replication
+	return statusPtr != nil && statusPtr.Switchover != nil && statusPtr.Switchover.Phase == pgv1.SwitchoverPhaseDemoted
+}
+
+// promoteTarget 原主节点以fast模式停止并写入关闭检查点，其Pod全部退出后目标备节点接收到的位置即为最终WAL位置
+// 目标回放到该位置后提升，提升后读写Service指向目标，原主节点解除隔离后以备节点身份重新加入
+func (s *PostgreSQL) promoteTarget(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	switchoverPtr := pgPtr.Status.Replication.Switchover
+	target := switchoverPtr.Target
+	if time.Since(switchoverPtr.TransitionTime.Time) > switchoverPromoteTimeout {
+		// 提升请求超时但目标已提升时不能回退，否则会出现两个可写的主节点
+		if recoveryVal, recoveryErr := s.executeMemberCommand(pgPtr.Name, target, common.DiagnosticCommand, "in-recovery"); recoveryErr == nil && recoveryVal == "f" {
+			s.completeSwitchover(pairPtr)
+			return
+		}
+
+		s.failSwitchover(pairPtr, fmt.Sprintf("member %s not promoted in %s", target, switchoverPromoteTimeout))
+		return
+	}
+
+	if switchoverPtr.LSN == "" {
+		primary := pgPtr.GetPrimary()
+		stopped, stopErr := s.isMemberStopped(pgPtr, primary)
+		if stopErr != nil {
+			switchoverPtr.Message = stopErr.Reason
+			return
+		}
+		if !stopped {
+			// Pod终止期间postgres默认以smart模式等待客户端断开，改为fast模式尽快写入关闭检查点
+			_, shutdownErr := s.executeMemberCommand(pgPtr.Name, primary, common.AdminCommand, "fast-shutdown")
+			if shutdownErr != nil {
+				log.Warnf("promoteTarget %s, shutdown member %s error:%s", pgPtr.Name, primary, shutdownErr.Reason)
+			}
+			switchoverPtr.Message = fmt.Sprintf("waiting for member %s to shut down", primary)
+			return
+		}
+
+		lsnVal, lsnErr := s.executeMemberCommand(pgPtr.Name, target, common.DiagnosticCommand, "receive-lsn")
+		if lsnErr != nil {
+			switchoverPtr.Message = lsnErr.Reason
+			return
+		}
+		if _, parseErr := parseLSN(lsnVal); parseErr != nil {
+			switchoverPtr.Message = fmt.Sprintf("member %s receive lsn %s illegal", target, lsnVal)
+			return
+		}
+
+		switchoverPtr.LSN = lsnVal
+		log.Infof("promoteTarget %s, primary %s stopped, final lsn %s", pgPtr.Name, primary, lsnVal)
+	}
+
+	lsnVal, lsnErr := s.executeMemberCommand(pgPtr.Name, target, common.DiagnosticCommand, "replay-lsn")
+	if lsnErr != nil {
+		switchoverPtr.Message = lsnErr.Reason
+		return
+	}
+	replayPos, replayErr := parseLSN(lsnVal)
+	stopPos, stopErr := parseLSN(switchoverPtr.LSN)
+	if replayErr != nil || stopErr != nil || replayPos < stopPos {
+		switchoverPtr.Message = fmt.Sprintf("waiting for member %s to replay to %s", target, switchoverPtr.LSN)
+		return
+	}
+
+	_, promoteErr := s.executeMemberCommand(pgPtr.Name, target, common.AdminCommand, "promote")
+	if promoteErr != nil {
+		switchoverPtr.Message = promoteErr.Reason
+		return
+	}
+
+	s.completeSwitchover(pairPtr)
+}
+
+// isMemberStopped 成员的Pod全部退出
+func (s *PostgreSQL) isMemberStopped(pgPtr *pgv1.PostgreSQL, member string) (ret bool, err *cd.Result) {
+	clientSet := s.getClientSet()
+	if clientSet == nil {
+		err = cd.NewError(cd.UnExpected, "kubernetes client not ready")
+		return
+	}
+
+	labels := common.NewInstanceLabels(pgPtr.Name)
+	labels[common.MemberLabel] = member
+	podList, podErr := clientSet.CoreV1().Pods(pgPtr.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labels.String()})
+	if podErr != nil {
+		err = cd.NewError(cd.UnExpected, podErr.Error())
+		log.Errorf("isMemberStopped %s failed, list pod error:%s", pgPtr.Name, podErr.Error())
+		return
+	}
+
+	ret = len(podList.Items) == 0
+	return
+}
+
+// completeSwitchover 记录新主节点与切换记录，更新后的Pod模板使原主节点以备节点身份重启
+func (s *PostgreSQL) completeSwitchover(pairPtr *serviceInfoPair) {
+	pgPtr := pairPtr.postgreSQLPtr
+	statusPtr := pgPtr.Status.Replication
+	switchoverPtr := statusPtr.Switchover
+	from := pgPtr.GetPrimary()
+
+	now := metav1.Now()
+	statusPtr.History = append(statusPtr.History, pgv1.FailoverRecord{
+		Time:   now.Rfc3339Copy(),
+		From:   from,
+		To:     switchoverPtr.Target,
+		Reason: switchoverReason,
+		LSN:    switchoverPtr.LSN,
+	})
+	if len(statusPtr.History) > maxFailoverHistory {
+		statusPtr.History = statusPtr.History[len(statusPtr.History)-maxFailoverHistory:]
+	}
+	statusPtr.Primary = switchoverPtr.Target
+	switchoverPtr.Phase = pgv1.SwitchoverPhaseSucceeded
+	switchoverPtr.Message = ""
+	switchoverPtr.TransitionTime = &now
+	_ = s.updateK8sDeployment(pairPtr)
+
+	message := fmt.Sprintf("switched primary from %s to %s at lsn %s", from, switchoverPtr.Target, switchoverPtr.LSN)
+	record.Event(s.getClientSet(), record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.PostgreSQLKind, pgPtr),
+		corev1.EventTypeNormal, switchoverReason, message)
+	log.Infof("completeSwitchover %s, %s", pgPtr.Name, message)
+}
+
+// failSwitchover 结束切换并解除原主节点的隔离，目标未提升，原主节点以主节点身份重新启动
+func (s *PostgreSQL) failSwitchover(pairPtr *serviceInfoPair, message string) {
+	pgPtr := pairPtr.postgreSQLPtr
+	switchoverPtr := pgPtr.Status.Replication.Switchover
+	fenced := isSwitchoverFenced(pgPtr)
+
+	now := metav1.Now()
+	switchoverPtr.Phase = pgv1.SwitchoverPhaseFailed
+	switchoverPtr.Message = message
+	switchoverPtr.TransitionTime = &now
+	if fenced {
+		_ = s.updateK8sDeployment(pairPtr)
+	}
+	record.Event(s.getClientSet(), record.NewReference(pgv1.Group+"/"+pgv1.Version, pgv1.PostgreSQLKind, pgPtr),
+		corev1.EventTypeWarning, "SwitchoverFailed", message)
+	log.Errorf("failSwitchover %s, target:%s, error:%s", pgPtr.Name, switchoverPtr.Target, message)
+}
@@ -37,3 +37,9 @@ func (s *PostgreSQL) BindRegistry(routeRegistry engine.RouteRegistry) {
 func (s *PostgreSQL) Setup(endpointName string, eventHub event.Hub, backgroundRoutine task.BackgroundRoutine) {
 	s.biz = biz.New(eventHub, backgroundRoutine)
 }
+
+func (s *PostgreSQL) Run() {
+	if s.biz != nil {
+		s.biz.Run()
+	}
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+	"path"
+	"strings"
+)
+
+const BackupModule = "/module/backup"
+
+const (
+	StartRestore = "/restore/start"
+	QueryRestore = "/restore/query"
+)
+
+const (
+	RestoreRunning   = "Running"
+	RestoreSucceeded = "Succeeded"
+	RestoreFailed    = "Failed"
+)
+
+// RestoreInfo 将备份恢复到实例，UID为实例资源的UID，恢复任务随实例一同删除
+type RestoreInfo struct {
+	Instance  string `json:"instance"`
+	Namespace string `json:"namespace"`
+	UID       string `json:"uid"`
+	Backup    string `json:"backup"`
+}
+
+// RestoreResult 恢复进度，Checksum为校验通过的备份文件sha256，Tables/Rows为校验过行数的表数量与总行数
+type RestoreResult struct {
+	Phase    string `json:"phase"`
+	Message  string `json:"message,omitempty"`
+	JobName  string `json:"jobName,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Tables   int64  `json:"tables,omitempty"`
+	Rows     int64  `json:"rows,omitempty"`
+}
+
+// BackupLabel 标识备份任务Pod所属的数据库实例，与InstanceLabel区分避免被实例Service选中
+const BackupLabel = "database.supos.ai/backup-of"
+
+func NewBackupLabels(instance string) Labels {
+	labels := Labels{}
+	for k, v := range DefaultLabels {
+		labels[k] = v
+	}
+	labels[BackupLabel] = instance
+
+	return labels
+}
+
+// SnapshotApplicationName 快照备份会话使用的application_name，用于确认pg_backup_start已执行
+const SnapshotApplicationName = "database-operator-snapshot"
+
+// ArchiveLabel 标识实例WAL归档的基础备份
+const ArchiveLabel = "database.supos.ai/archive-of"
+
+// CloneLabel 标识克隆实例的源实例，以及为克隆创建的备份所属的克隆实例
+const CloneLabel = "database.supos.ai/clone-of"
+
+// PVCStorage 备份写入已存在的PVC，Path为PVC内的目录
+type PVCStorage struct {
+	ClaimName string `json:"claimName"`
+	Path      string `json:"path,omitempty"`
+}
+
+// S3Storage 备份上传到S3兼容存储
+// Secret 中accessKey、secretKey保存访问凭证
+// Insecure 跳过TLS证书校验，仅用于测试环境
+type S3Storage struct {
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"`
+	Secret   string `json:"secret"`
+	Insecure bool   `json:"insecure,omitempty"`
+}
+
+const (
+	// ArchivePath 归档PVC在数据库容器内的挂载目录
+	ArchivePath = "/archive"
+	// RecoveryPath 恢复所用归档PVC在数据库容器内的挂载目录
+	RecoveryPath = "/recovery"
+)
+
+// BackupStorage 备份存储位置，PVC与S3二选一
+type BackupStorage struct {
+	PVC *PVCStorage `json:"pvc,omitempty"`
+	S3  *S3Storage  `json:"s3,omitempty"`
+}
+
+// Archive WAL归档存储，PVC与S3二选一，WAL位于存储中<path|prefix>/<instance>/wal
+// Image 上传与下载S3使用的镜像
+type Archive struct {
+	PVC   *PVCStorage `json:"pvc,omitempty"`
+	S3    *S3Storage  `json:"s3,omitempty"`
+	Image string      `json:"image,omitempty"`
+}
+
+// GetWALPath PVC时为PVC内的相对目录，S3时为对象前缀，以/结尾
+func (s *Archive) GetWALPath(instance string) string {
+	if s.S3 != nil {
+		return s.S3.Prefix + instance + "/wal/"
+	}
+
+	return strings.TrimPrefix(path.Join(s.PVC.Path, instance, "wal"), "/")
+}
+
+// Recovery 从源实例的WAL归档恢复到指定时间点或LSN，均为空时恢复到归档的末尾
+// BaseBackup 基础备份在PVC内的相对路径或S3对象名称
+type Recovery struct {
+	Archive    `json:",inline"`
+	Source     string `json:"source"`
+	BaseBackup string `json:"baseBackup"`
+	TargetTime string `json:"targetTime,omitempty"`
+	TargetLSN  string `json:"targetLSN,omitempty"`
+}
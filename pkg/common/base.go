@@ -2,8 +2,13 @@ package common
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+
 	cd "github.com/muidea/magicCommon/def"
 )
 
@@ -24,6 +29,34 @@ var DefaultLabels = map[string]string{
 	"app.kubernetes.io/created-by": "database.supos.ai",
 }
 
+// InstanceLabel 标识Pod所属的数据库实例
+const InstanceLabel = "database.supos.ai/instance"
+
+func NewInstanceLabels(name string) Labels {
+	labels := Labels{}
+	for k, v := range DefaultLabels {
+		labels[k] = v
+	}
+	labels[InstanceLabel] = name
+
+	return labels
+}
+
+// MemberLabel 标识Pod所属的实例成员，成员名称即Deployment与数据卷名称
+// RoleLabel 标识成员的复制角色，实例Service按角色选择Pod，角色凭证Secret以该标签记录对应的角色资源
+const (
+	MemberLabel = "database.supos.ai/member"
+	RoleLabel   = "database.supos.ai/role"
+)
+
+// PoolerLabel 标识连接池Pod，连接池Pod不属于任何成员，不会被实例Service选择
+const PoolerLabel = "database.supos.ai/pooler"
+
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
 func GetDefaultLabels() string {
 	str := ""
 	for k, v := range DefaultLabels {
@@ -38,15 +71,155 @@ func GetDefaultLabels() string {
 	return str
 }
 
+// BackupSource 从备份恢复，Backup为同一命名空间下已成功的备份资源名称
+type BackupSource struct {
+	Backup string `json:"backup"`
+}
+
+// ArchiveSource 从源实例的WAL归档恢复，TargetTime为RFC3339时间，与TargetLSN均为空时恢复到归档的末尾
+type ArchiveSource struct {
+	Instance   string `json:"instance"`
+	TargetTime string `json:"targetTime,omitempty"`
+	TargetLSN  string `json:"targetLSN,omitempty"`
+}
+
+// SnapshotSource 以快照备份创建数据卷，Backup为同命名空间下snapshot方式的备份名称
+type SnapshotSource struct {
+	Backup string `json:"backup"`
+}
+
+// CloneSource 复制同命名空间下运行中的实例，依次尝试快照、基础备份与逻辑备份
+// Storage 源实例不支持快照且未开启WAL归档时，逻辑备份使用的存储位置
+// Script 恢复完成后在Database中以单个事务执行的SQL，用于数据脱敏，Database为空时使用postgres库
+type CloneSource struct {
+	Instance string         `json:"instance"`
+	Storage  *BackupStorage `json:"storage,omitempty"`
+	Script   string         `json:"script,omitempty"`
+	Database string         `json:"database,omitempty"`
+}
+
+// Bootstrap 实例初始化方式，为空时创建空实例，FromBackup、FromArchive、FromSnapshot与CloneFrom只能指定一个
+type Bootstrap struct {
+	FromBackup   *BackupSource   `json:"fromBackup,omitempty"`
+	FromArchive  *ArchiveSource  `json:"fromArchive,omitempty"`
+	FromSnapshot *SnapshotSource `json:"fromSnapshot,omitempty"`
+	CloneFrom    *CloneSource    `json:"cloneFrom,omitempty"`
+}
+
+// ServiceParam REST接口参数，Bootstrap仅在创建时使用
+// Namespace 实例所在的命名空间，为空时为operator所在的命名空间，实例只能位于该命名空间
 type ServiceParam struct {
+	Name      string     `json:"name"`
+	Namespace string     `json:"namespace,omitempty"`
+	Catalog   string     `json:"catalog"`
+	Bootstrap *Bootstrap `json:"bootstrap,omitempty"`
+}
+
+// CloneParam 克隆REST接口参数，Name为新实例名称
+type CloneParam struct {
+	Name    string      `json:"name"`
+	Catalog string      `json:"catalog"`
+	Source  CloneSource `json:"source"`
+}
+
+// SwitchoverParam 计划内切换REST接口参数，Target为目标备节点的成员名称
+type SwitchoverParam struct {
 	Name    string `json:"name"`
 	Catalog string `json:"catalog"`
+	Target  string `json:"target"`
+}
+
+// UpdateResult 更新服务的结果，SwitchoverTo非空时主节点的资源需调整，先切换到已按新资源重建的该备节点，原主节点随后以备节点身份重建
+type UpdateResult struct {
+	SwitchoverTo string `json:"switchoverTo,omitempty"`
+}
+
+// ResizeParam 调整CPU与内存的REST接口参数，Resources整体替换实例当前的定义
+type ResizeParam struct {
+	Name      string    `json:"name"`
+	Catalog   string    `json:"catalog"`
+	Resources Resources `json:"resources"`
+}
+
+// HibernateParam 实例休眠参数，Hibernate为false时恢复实例
+type HibernateParam struct {
+	Name      string `json:"name"`
+	Catalog   string `json:"catalog"`
+	Hibernate bool   `json:"hibernate"`
+}
+
+// KeepRunningParam 临时保持运行REST接口参数，Duration为Go时长格式，如2h，为0时取消
+type KeepRunningParam struct {
+	Name     string `json:"name"`
+	Catalog  string `json:"catalog"`
+	Duration string `json:"duration"`
 }
 
+const (
+	SQLCommand        = "sql"
+	AdminCommand      = "admin"
+	DiagnosticCommand = "diagnostic"
+)
+
+// CmdInfo 在数据库实例中执行的操作
+// Type 操作类别，SQLCommand/AdminCommand/DiagnosticCommand
+// Operation 类别下的具体操作
+// Statement 脚本类操作执行的SQL脚本，其余操作的语句由目录根据Args生成
+// Timeout 超时时间，单位秒，为0时使用操作的默认超时
+// Sensitive 脚本或参数中包含口令等敏感信息，审计记录中不保存脚本与参数
+// Member 执行命令的实例成员，为空时在主节点执行
+// Grant 脚本类操作的调用凭证，只在进程内传递，不参与序列化
 type CmdInfo struct {
-	Service     string       `json:"service"`
-	ServiceInfo *ServiceInfo `json:"serviceInfo"`
-	Command     []string     `json:"command"`
+	Service   string   `json:"service"`
+	Member    string   `json:"member,omitempty"`
+	Catalog   string   `json:"catalog"`
+	Type      string   `json:"type"`
+	Operation string   `json:"operation"`
+	Database  string   `json:"database"`
+	Statement string   `json:"statement"`
+	Args      []string `json:"args"`
+	Timeout   int      `json:"timeout"`
+	Sensitive bool     `json:"sensitive"`
+
+	Grant *ScriptGrant `json:"-"`
+}
+
+// ScriptGrant 执行脚本类操作的凭证，事件的来源由发送方自行声明，不能用于限制脚本类操作的调用方
+// 凭证只能通过ClaimScriptGrant领取一次，k8s模块按凭证的地址判断是否有效，其他模块无法伪造
+type ScriptGrant struct {
+	owner string
+}
+
+var scriptGrant = &ScriptGrant{owner: PostgreSQLModule}
+var scriptGrantClaimed atomic.Bool
+
+// ClaimScriptGrant 领取脚本类操作的凭证，只有首次调用返回凭证，之后返回nil，由数据库模块在包初始化时领取
+func ClaimScriptGrant() *ScriptGrant {
+	if !scriptGrantClaimed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	return scriptGrant
+}
+
+// IsValid 是否为ClaimScriptGrant发放的凭证
+func (s *ScriptGrant) IsValid() bool {
+	return s != nil && s == scriptGrant
+}
+
+func (s *CmdInfo) String() string {
+	return fmt.Sprintf("%s:%s/%s:%s", s.Catalog, s.Service, s.Type, s.Operation)
+}
+
+type UserInfo struct {
+	Name   string              `json:"name"`
+	UID    string              `json:"uid"`
+	Groups []string            `json:"groups"`
+	Extra  map[string][]string `json:"extra"`
+}
+
+func (s *UserInfo) String() string {
+	return s.Name
 }
 
 type Labels map[string]string
@@ -64,9 +237,24 @@ func (s Labels) String() string {
 	return str
 }
 
+// Spec 数据库容器的资源，CPU/Memory为limits，RequestCPU/RequestMemory为requests
 type Spec struct {
-	CPU    string
-	Memory string
+	CPU           string
+	Memory        string
+	RequestCPU    string
+	RequestMemory string
+}
+
+// ResourceList 容器的CPU与内存，取值为k8s资源数量格式，如500m、2Gi
+type ResourceList struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+// Resources 数据库容器的requests与limits，未设置的项使用默认值
+type Resources struct {
+	Requests ResourceList `json:"requests,omitempty"`
+	Limits   ResourceList `json:"limits,omitempty"`
 }
 
 type Path struct {
@@ -75,14 +263,25 @@ type Path struct {
 	Type  string `json:"type"`
 }
 
+// Volumes DataPath.Type 为数据卷的存储类
+// DataSize 数据卷容量，为空时使用默认容量
+// DataSnapshot 以同命名空间的VolumeSnapshot作为数据卷的数据来源，仅在创建时生效
 type Volumes struct {
-	ConfPath *Path `json:"confPath"`
-	DataPath *Path `json:"dataPath"`
+	ConfPath     *Path  `json:"confPath"`
+	DataPath     *Path  `json:"dataPath"`
+	DataSize     string `json:"dataSize,omitempty"`
+	DataSnapshot string `json:"dataSnapshot,omitempty"`
 }
 
+// DefaultDataSize 未指定容量时的数据卷容量
+const DefaultDataSize = "10Gi"
+
+// EnvItem Secret不为空时从Secret的Key读取取值
 type EnvItem struct {
-	Name  string `json:"name"`
-	Value string `json:"value"`
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	Secret string `json:"secret,omitempty"`
+	Key    string `json:"key,omitempty"`
 }
 
 type Env struct {
@@ -93,17 +292,171 @@ type Svc struct {
 	Port int32 `json:"port"`
 }
 
+// Access 实例的访问控制，允许指定命名空间、Pod标签及CIDR访问
+// DefaultDeny 为true时即使未配置任何规则也只允许operator与监控访问
+type Access struct {
+	Namespaces   []string `json:"namespaces,omitempty"`
+	PodSelectors []Labels `json:"podSelectors,omitempty"`
+	CIDRs        []string `json:"cidrs,omitempty"`
+	DefaultDeny  bool     `json:"defaultDeny,omitempty"`
+}
+
+// Security 数据库Pod的安全配置
+// RunAsUser/RunAsGroup/FSGroup 数据库进程及数据卷的UID/GID
+// ServiceAccount 数据库Pod使用的ServiceAccount，为空时使用命名空间默认值
+// FixPermissions 以root身份修正已有数据卷的属主，不满足restricted安全级别，仅用于迁移旧数据卷
+type Security struct {
+	RunAsUser      int64  `json:"runAsUser"`
+	RunAsGroup     int64  `json:"runAsGroup"`
+	FSGroup        int64  `json:"fsGroup"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	FixPermissions bool   `json:"fixPermissions,omitempty"`
+}
+
+// Scheduling 数据库Pod的调度约束，NodeSelector与Tolerations同时作用于连接池Pod
+// Affinity 为空时开启流复制的实例默认优先将成员分散到不同节点
+// AllowDisruption 不设置驱逐策略，节点排空时直接驱逐实例的Pod，单节点实例在重新调度前停止服务
+type Scheduling struct {
+	NodeSelector    map[string]string   `json:"nodeSelector,omitempty"`
+	Tolerations     []corev1.Toleration `json:"tolerations,omitempty"`
+	Affinity        *corev1.Affinity    `json:"affinity,omitempty"`
+	AllowDisruption bool                `json:"allowDisruption,omitempty"`
+}
+
+// Replication 流复制，Standbys为备节点数量，Primary为当前主节点的成员名称，为空时为实例同名成员
+// Fenced 故障切换期间被隔离的原主节点，隔离的成员不运行Pod
+type Replication struct {
+	Standbys int32  `json:"standbys"`
+	Primary  string `json:"primary,omitempty"`
+	Fenced   string `json:"fenced,omitempty"`
+}
+
+// 连接池模式
+const (
+	PoolModeSession     = "session"
+	PoolModeTransaction = "transaction"
+	PoolModeStatement   = "statement"
+)
+
+// Pooler PgBouncer连接池，PoolSize为每个用户与数据库组合的服务端连接数，MaxClientConn为客户端连接上限
+// UserListHash 连接池用户列表Secret的摘要，用户列表变化时重启连接池
+type Pooler struct {
+	Image         string `json:"image"`
+	Mode          string `json:"mode"`
+	PoolSize      int32  `json:"poolSize"`
+	MaxClientConn int32  `json:"maxClientConn"`
+	Replicas      int32  `json:"replicas"`
+	UserListHash  string `json:"userListHash,omitempty"`
+}
+
 type ServiceInfo struct {
-	Name      string   `json:"name"`
-	Namespace string   `json:"namespace"`
-	Catalog   string   `json:"catalog"`
-	Image     string   `json:"image"`
-	Labels    Labels   `json:"labels"`
-	Spec      *Spec    `json:"spec"`
-	Volumes   *Volumes `json:"volumes"`
-	Env       *Env     `json:"env"`
-	Svc       *Svc     `json:"svc"`
-	Replicas  int32    `json:"replicas"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Catalog   string    `json:"catalog"`
+	Image     string    `json:"image"`
+	Labels    Labels    `json:"labels"`
+	Spec      *Spec     `json:"spec"`
+	Volumes   *Volumes  `json:"volumes"`
+	Env       *Env      `json:"env"`
+	Svc       *Svc      `json:"svc"`
+	Replicas  int32     `json:"replicas"`
+	Access    *Access   `json:"access,omitempty"`
+	Security  *Security `json:"security,omitempty"`
+	// Scheduling Pod调度约束
+	Scheduling *Scheduling `json:"scheduling,omitempty"`
+	// Parameters 数据库启动参数，如shared_preload_libraries
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Config 受管配置文件，文件名到内容，挂载到ConfigPath目录
+	Config map[string]string `json:"config,omitempty"`
+	// Archive WAL归档存储
+	Archive *Archive `json:"archive,omitempty"`
+	// Recovery 首次启动前从WAL归档恢复数据目录
+	Recovery *Recovery `json:"recovery,omitempty"`
+	// Replication 一主多备的流复制
+	Replication *Replication `json:"replication,omitempty"`
+	// Pooler 实例前的连接池
+	Pooler *Pooler `json:"pooler,omitempty"`
+}
+
+// ConfigPath 受管配置文件在容器内的挂载目录
+const ConfigPath = "/etc/database"
+
+// GetConfigName 受管配置文件所在ConfigMap
+func (s *ServiceInfo) GetConfigName() string {
+	return s.Name + "-config"
+}
+
+// GetPoolerName 连接池的Deployment、Service、配置与用户列表Secret名称
+func (s *ServiceInfo) GetPoolerName() string {
+	return GetPoolerName(s.Name)
+}
+
+func GetPoolerName(instance string) string {
+	return instance + "-pooler"
+}
+
+// GetMembers 实例的全部成员，实例同名成员之后依次为<name>-1至<name>-N，主节点不在其中时追加在末尾
+func (s *ServiceInfo) GetMembers() (ret []string) {
+	ret = []string{s.Name}
+	if s.Replication == nil {
+		return
+	}
+
+	primary := s.GetPrimary()
+	primaryOK := primary == s.Name
+	for idx := int32(1); idx <= s.Replication.Standbys; idx++ {
+		member := fmt.Sprintf("%s-%d", s.Name, idx)
+		primaryOK = primaryOK || member == primary
+		ret = append(ret, member)
+	}
+	if !primaryOK {
+		ret = append(ret, primary)
+	}
+	return
+}
+
+// SplitMemberName 拆分形如<name>-<序号>的名称，序号从1开始且不含前导0，这样的名称可能与实例<name>的备节点成员相同
+func SplitMemberName(name string) (instance string, index int32, ok bool) {
+	pos := strings.LastIndex(name, "-")
+	if pos <= 0 || pos == len(name)-1 || name[pos+1] == '0' {
+		return
+	}
+	for _, ch := range name[pos+1:] {
+		if ch < '0' || ch > '9' {
+			return
+		}
+	}
+
+	val, err := strconv.ParseInt(name[pos+1:], 10, 32)
+	if err != nil {
+		return
+	}
+
+	instance, index, ok = name[:pos], int32(val), true
+	return
+}
+
+// GetPrimary 当前主节点的成员名称
+func (s *ServiceInfo) GetPrimary() string {
+	if s.Replication == nil || s.Replication.Primary == "" {
+		return s.Name
+	}
+
+	return s.Replication.Primary
+}
+
+// GetRole 成员的复制角色
+func (s *ServiceInfo) GetRole(member string) string {
+	if member == s.GetPrimary() {
+		return RolePrimary
+	}
+
+	return RoleReplica
+}
+
+// GetSlotName 成员使用的物理复制槽，复制槽名称只允许小写字母、数字与下划线
+func GetSlotName(member string) string {
+	return strings.NewReplacer("-", "_", ".", "_").Replace(member)
 }
 
 func (s *ServiceInfo) String() string {
@@ -123,6 +476,22 @@ type CreateServiceResult struct {
 	cd.Result
 }
 
+type CloneServiceResult struct {
+	cd.Result
+}
+
+type SwitchoverServiceResult struct {
+	cd.Result
+}
+
+type KeepRunningServiceResult struct {
+	cd.Result
+}
+
+type ResizeServiceResult struct {
+	cd.Result
+}
+
 type DestroyServiceResult struct {
 	cd.Result
 }
@@ -139,3 +508,8 @@ type QueryServiceResult struct {
 	cd.Result
 	ServiceInfo *ServiceInfo `json:"serviceInfo"`
 }
+
+type HealthResult struct {
+	cd.Result
+	MissingPermissions []string `json:"missingPermissions"`
+}
@@ -0,0 +1,59 @@
+package common
+
+import "testing"
+
+func TestSplitMemberName(t *testing.T) {
+	cases := []struct {
+		name     string
+		instance string
+		index    int32
+		ok       bool
+	}{
+		{name: "db"},
+		{name: "db-1", instance: "db", index: 1, ok: true},
+		{name: "db-12", instance: "db", index: 12, ok: true},
+		{name: "my-db-3", instance: "my-db", index: 3, ok: true},
+		{name: "app-2024", instance: "app", index: 2024, ok: true},
+		{name: "my-db"},
+		{name: "db-0"},
+		{name: "db-01"},
+		{name: "db-1a"},
+		{name: "db-"},
+		{name: "-1"},
+		{name: "db-99999999999"},
+	}
+	for _, c := range cases {
+		instance, index, ok := SplitMemberName(c.name)
+		if instance != c.instance || index != c.index || ok != c.ok {
+			t.Errorf("SplitMemberName(%q) = %s, %d, %v, expect %s, %d, %v", c.name, instance, index, ok, c.instance, c.index, c.ok)
+		}
+	}
+}
+
+func TestGetMembers(t *testing.T) {
+	cases := []struct {
+		name        string
+		replication *Replication
+		expect      []string
+	}{
+		{name: "single member", expect: []string{"db"}},
+		{name: "standbys", replication: &Replication{Standbys: 2}, expect: []string{"db", "db-1", "db-2"}},
+		{name: "switched primary", replication: &Replication{Standbys: 2, Primary: "db-2"}, expect: []string{"db", "db-1", "db-2"}},
+		{name: "primary after scale down", replication: &Replication{Standbys: 1, Primary: "db-2"}, expect: []string{"db", "db-1", "db-2"}},
+	}
+	for _, c := range cases {
+		serviceInfo := NewPostgreSQLService("db", "default")
+		serviceInfo.Replication = c.replication
+		members := serviceInfo.GetMembers()
+		if len(members) != len(c.expect) {
+			t.Errorf("%s: members %v, expect %v", c.name, members, c.expect)
+			continue
+		}
+		for idx := range members {
+			if members[idx] != c.expect[idx] {
+				t.Errorf("%s: members %v, expect %v", c.name, members, c.expect)
+				break
+			}
+		}
+	}
+}
@@ -4,12 +4,21 @@ const (
 	ExecuteCommand = "/command/execute"
 	GetK8sConfig   = "/config/get"
 	CreateService  = "/service/create"
+	CloneService   = "/service/clone"
+	// SwitchoverService 将主节点切换到指定的备节点
+	SwitchoverService = "/service/switchover"
+	// KeepRunningService 临时保持实例运行，不受运行时段限制
+	KeepRunningService = "/service/keeprunning"
+	// ResizeService 调整实例的CPU与内存
+	ResizeService  = "/service/resize"
 	DestroyService = "/service/destroy"
+	UpdateService  = "/service/update"
 	StartService   = "/service/start"
 	StopService    = "/service/stop"
 	ListService    = "/service/list"
 	QueryService   = "/service/query"
 	NotifyService  = "/service/notify"
+	CheckHealth    = "/check/health"
 )
 
 const K8sModule = "/module/k8s"
@@ -1,26 +1,41 @@
 package common
 
+import "strings"
+
 const (
-	DefaultPostgreSQLImage    = "registry.supos.ai/jenkins/mariadb:10.6.11"
+	// DefaultPostgreSQLImage 官方PostgreSQL镜像，固定到小版本
+	DefaultPostgreSQLImage    = "registry.supos.ai/jenkins/postgres:16.4"
 	DefaultPostgreSQLDataPath = "/var/lib/postgresql/data"
 	DefaultPostgreSQLRoot     = "root"
-	DefaultPostgreSQLPassword = "rootkit"
 	DefaultPostgreSQLPort     = 5432
+	// SuperuserPasswordKey 超级用户Secret中口令的key
+	SuperuserPasswordKey = "password"
+	// DefaultPostgreSQLUID 官方镜像中postgres用户的UID/GID
+	DefaultPostgreSQLUID = 999
+	// PostgreSQLDataDir 数据目录位于数据卷的子目录，避免fsGroup修改卷根目录权限后无法启动
+	PostgreSQLDataDir = "pgdata"
+	// DefaultPoolerImage 连接池镜像
+	DefaultPoolerImage = "registry.supos.ai/jenkins/pgbouncer:1.22.1"
+	// PoolerUserList 连接池用户列表Secret中的文件名
+	PoolerUserList = "userlist.txt"
 )
 
 var PostgreSQLDefaultSpec = Spec{
-	CPU:    "2",
-	Memory: "4Gi",
+	CPU:           "2",
+	Memory:        "4Gi",
+	RequestCPU:    "100m",
+	RequestMemory: "64Mi",
 }
 
 func NewPostgreSQLService(name, namespace string) *ServiceInfo {
+	spec := PostgreSQLDefaultSpec
 	return &ServiceInfo{
 		Name:      name,
 		Namespace: namespace,
 		Catalog:   PostgreSQL,
 		Image:     DefaultPostgreSQLImage,
-		Labels:    DefaultLabels,
-		Spec:      &PostgreSQLDefaultSpec,
+		Labels:    NewInstanceLabels(name),
+		Spec:      &spec,
 		Volumes: &Volumes{
 			DataPath: &Path{
 				Name:  name,
@@ -35,11 +50,27 @@ func NewPostgreSQLService(name, namespace string) *ServiceInfo {
 					Value: DefaultPostgreSQLRoot,
 				},
 				{
-					Name:  "POSTGRES_PASSWORD",
-					Value: DefaultPostgreSQLPassword,
+					Name:   "POSTGRES_PASSWORD",
+					Secret: GetSuperuserSecretName(name),
+					Key:    SuperuserPasswordKey,
+				},
+				{
+					// 备节点的WAL接收进程以该口令连接主节点，复制连接配置中不保存口令
+					Name:   "PGPASSWORD",
+					Secret: GetSuperuserSecretName(name),
+					Key:    SuperuserPasswordKey,
+				},
+				{
+					Name:  "PGDATA",
+					Value: DefaultPostgreSQLDataPath + "/" + PostgreSQLDataDir,
 				},
 			},
 		},
+		Security: &Security{
+			RunAsUser:  DefaultPostgreSQLUID,
+			RunAsGroup: DefaultPostgreSQLUID,
+			FSGroup:    DefaultPostgreSQLUID,
+		},
 		Svc: &Svc{
 			Port: DefaultPostgreSQLPort,
 		},
@@ -47,4 +78,38 @@ func NewPostgreSQLService(name, namespace string) *ServiceInfo {
 	}
 }
 
+// GetSuperuserSecretName 实例超级用户口令所在Secret，由数据库模块在部署实例前生成
+func GetSuperuserSecretName(name string) string {
+	return name + "-superuser"
+}
+
 const PostgreSQLModule = "/module/postgresql"
+
+// CreateInstance 创建数据库实例定义，由REST接口转发给对应数据库模块
+const CreateInstance = "/instance/create"
+
+// SwitchoverInstance 指定实例的计划内主备切换，由REST接口转发给对应数据库模块
+const SwitchoverInstance = "/instance/switchover"
+
+// HibernateInstance 指定实例的休眠与恢复，由REST接口转发给对应数据库模块
+const HibernateInstance = "/instance/hibernate"
+
+// KeepRunningInstance 设置实例临时保持运行的截止时间，由REST接口转发给对应数据库模块
+const KeepRunningInstance = "/instance/keeprunning"
+
+// ResizeInstance 调整实例的CPU与内存，由REST接口转发给对应数据库模块
+const ResizeInstance = "/instance/resize"
+
+// QuoteIdentifier 转义PostgreSQL标识符
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// QuoteLiteral 转义PostgreSQL字符串常量
+func QuoteLiteral(val string) string {
+	if strings.Contains(val, `\`) {
+		return `E'` + strings.ReplaceAll(strings.ReplaceAll(val, `\`, `\\`), `'`, `''`) + `'`
+	}
+
+	return `'` + strings.ReplaceAll(val, `'`, `''`) + `'`
+}
@@ -0,0 +1,39 @@
+package common
+
+import "testing"
+
+func TestQuoteIdentifier(t *testing.T) {
+	cases := []struct {
+		name   string
+		expect string
+	}{
+		{"db", `"db"`},
+		{"My DB", `"My DB"`},
+		{`a"b`, `"a""b"`},
+		{`""`, `""""""`},
+		{"", `""`},
+	}
+	for _, c := range cases {
+		if ret := QuoteIdentifier(c.name); ret != c.expect {
+			t.Errorf("QuoteIdentifier(%q) = %s, expect %s", c.name, ret, c.expect)
+		}
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	cases := []struct {
+		val    string
+		expect string
+	}{
+		{"secret", `'secret'`},
+		{"it's", `'it''s'`},
+		{`a\b`, `E'a\\b'`},
+		{`a\'b`, `E'a\\''b'`},
+		{"", `''`},
+	}
+	for _, c := range cases {
+		if ret := QuoteLiteral(c.val); ret != c.expect {
+			t.Errorf("QuoteLiteral(%q) = %s, expect %s", c.val, ret, c.expect)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ScramPrefix PostgreSQL保存SCRAM-SHA-256口令校验值的前缀
+	ScramPrefix = "SCRAM-SHA-256$"
+	// scramIterations 与PostgreSQL默认的scram_iterations一致
+	scramIterations = 4096
+	scramSaltLength = 16
+)
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// saltedPassword PBKDF2-HMAC-SHA256，输出长度与摘要长度相同，只需计算一个分块
+func saltedPassword(password, salt []byte, iterations int) []byte {
+	block := hmacSHA256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	ret := append([]byte{}, block...)
+	for idx := 1; idx < iterations; idx++ {
+		block = hmacSHA256(password, block)
+		for pos := range ret {
+			ret[pos] ^= block[pos]
+		}
+	}
+
+	return ret
+}
+
+// NewScramVerifier 按RFC 5802计算口令的SCRAM-SHA-256校验值，格式与pg_authid.rolpassword一致
+// 设置口令时只传递校验值，明文口令不会出现在命令行与服务端日志中
+// 口令按原始字节计算，未做SASLprep规范化，仅含ASCII字符的口令与服务端的计算结果一致
+func NewScramVerifier(password string) (ret string, err error) {
+	salt := make([]byte, scramSaltLength)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+
+	ret = scramVerifier(password, salt, scramIterations)
+	return
+}
+
+func scramVerifier(password string, salt []byte, iterations int) string {
+	salted := saltedPassword([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(salted, []byte("Server Key"))
+
+	encoding := base64.StdEncoding
+	return fmt.Sprintf("%s%d:%s$%s:%s", ScramPrefix, iterations,
+		encoding.EncodeToString(salt), encoding.EncodeToString(storedKey[:]), encoding.EncodeToString(serverKey))
+}
+
+// IsScramVerifier 值为SCRAM-SHA-256校验值
+func IsScramVerifier(val string) bool {
+	if !strings.HasPrefix(val, ScramPrefix) {
+		return false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(val, ScramPrefix), "$")
+	if len(parts) != 2 {
+		return false
+	}
+	for _, part := range parts {
+		items := strings.Split(part, ":")
+		if len(items) != 2 || items[0] == "" || items[1] == "" {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,28 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScramVerifier(t *testing.T) {
+	expect := "SCRAM-SHA-256$4096:MDEyMzQ1Njc4OWFiY2RlZg==$bpSY5Ze9NUH+I35LC3gVq+DpBfK46iXBxvhAKqVu9pE=:VpYlBuxyzeCI1KnctrefdljpB1mk3Gp7sBI/t11+NkQ="
+	if ret := scramVerifier("secret", []byte("0123456789abcdef"), 4096); ret != expect {
+		t.Fatalf("scramVerifier = %s, expect %s", ret, expect)
+	}
+}
+
+// TestNewScramVerifier 每次生成随机盐，校验值格式与pg_authid.rolpassword一致
+func TestNewScramVerifier(t *testing.T) {
+	first, firstErr := NewScramVerifier("secret")
+	if firstErr != nil {
+		t.Fatalf("NewScramVerifier failed, error:%s", firstErr.Error())
+	}
+	second, _ := NewScramVerifier("secret")
+	if first == second {
+		t.Fatalf("verifier not salted, verifier:%s", first)
+	}
+	if !strings.HasPrefix(first, ScramPrefix+"4096:") || strings.Count(first, "$") != 2 || strings.Count(first, ":") != 2 {
+		t.Fatalf("illegal verifier %s", first)
+	}
+}
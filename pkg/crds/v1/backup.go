@@ -0,0 +1,186 @@
+package crds
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"supos.ai/operator/database/pkg/common"
+)
+
+const (
+	Backup         = "backups"
+	BackupSchedule = "backupschedules"
+
+	BackupKind = "Backup"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// BackupMethodBase 使用pg_basebackup的物理备份，仅用于WAL归档的时间点恢复
+// BackupMethodSnapshot 在pg_backup_start与pg_backup_stop之间创建数据卷的VolumeSnapshot，用于快速创建实例
+const (
+	BackupMethodLogical  = "logical"
+	BackupMethodBase     = "basebackup"
+	BackupMethodSnapshot = "snapshot"
+)
+
+const (
+	BackupPhaseRunning   = "Running"
+	BackupPhaseSucceeded = "Succeeded"
+)
+
+type PVCStorage = common.PVCStorage
+
+type S3Storage = common.S3Storage
+
+type BackupStorage = common.BackupStorage
+
+// VerifySpec 备份的恢复校验策略，Schedule为空时备份成功后立即校验
+// Schedule 仅用于定时备份模板，按5段cron表达式校验最近一个成功且未校验的定时备份
+type VerifySpec struct {
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// BackupSpec 备份定义
+// Database 为空时使用pg_dumpall备份整个实例，否则使用pg_dump备份指定数据库
+// Compression 取值gzip、zstd，默认gzip
+// Method 取值logical、basebackup、snapshot，默认logical
+// SnapshotClass snapshot方式使用的VolumeSnapshotClass，为空时使用集群默认值，snapshot方式不使用Storage
+// Verify 备份成功后恢复到临时实例并校验
+type BackupSpec struct {
+	Instance      string        `json:"instance"`
+	Database      string        `json:"database,omitempty"`
+	Method        string        `json:"method,omitempty"`
+	Compression   string        `json:"compression,omitempty"`
+	Storage       BackupStorage `json:"storage,omitempty"`
+	SnapshotClass string        `json:"snapshotClass,omitempty"`
+	Verify        *VerifySpec   `json:"verify,omitempty"`
+}
+
+// 恢复校验阶段，Pending表示定时校验已选中该备份
+const (
+	VerifyPhasePending   = "Pending"
+	VerifyPhaseRunning   = "Running"
+	VerifyPhaseSucceeded = "Succeeded"
+	VerifyPhaseFailed    = "Failed"
+)
+
+// VerificationStatus 恢复校验结果，Instance为恢复使用的临时实例，校验完成后删除
+// Databases/Tables 校验过的数据库与表数量
+type VerificationStatus struct {
+	Phase          string       `json:"phase,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	Instance       string       `json:"instance,omitempty"`
+	Databases      int64        `json:"databases,omitempty"`
+	Tables         int64        `json:"tables,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// SnapshotSession 快照备份持有pg_backup_start的会话，operator重启后据此继续备份
+// Volume为快照的数据卷，Stopped表示已写入结束标记，StopTime为写入的时间
+type SnapshotSession struct {
+	Instance string       `json:"instance,omitempty"`
+	Volume   string       `json:"volume,omitempty"`
+	Label    string       `json:"label,omitempty"`
+	Stopped  bool         `json:"stopped,omitempty"`
+	StopTime *metav1.Time `json:"stopTime,omitempty"`
+}
+
+// BackupStatus 备份状态，Size单位字节，Checksum为备份文件sha256
+// StartWAL/StartLSN/StopLSN 物理备份开始时的WAL文件与LSN，以及结束后的LSN
+// Snapshot snapshot方式创建的VolumeSnapshot名称，Size为其恢复所需的容量，Session为进行中的备份会话
+// Verification 最近一次恢复校验的结果
+type BackupStatus struct {
+	Phase          string              `json:"phase,omitempty"`
+	Message        string              `json:"message,omitempty"`
+	JobName        string              `json:"jobName,omitempty"`
+	Location       string              `json:"location,omitempty"`
+	Size           int64               `json:"size,omitempty"`
+	Checksum       string              `json:"checksum,omitempty"`
+	Duration       string              `json:"duration,omitempty"`
+	StartTime      *metav1.Time        `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time        `json:"completionTime,omitempty"`
+	StartWAL       string              `json:"startWal,omitempty"`
+	StartLSN       string              `json:"startLsn,omitempty"`
+	StopLSN        string              `json:"stopLsn,omitempty"`
+	Snapshot       string              `json:"snapshot,omitempty"`
+	Session        *SnapshotSession    `json:"session,omitempty"`
+	Verification   *VerificationStatus `json:"verification,omitempty"`
+}
+
+func (s *BackupSpec) IsBaseBackup() bool {
+	return s.Method == BackupMethodBase
+}
+
+func (s *BackupSpec) IsSnapshot() bool {
+	return s.Method == BackupMethodSnapshot
+}
+
+// IsVerifying 恢复校验已选中或进行中
+func (s *PostgreSQLBackup) IsVerifying() bool {
+	verificationPtr := s.Status.Verification
+	return verificationPtr != nil && (verificationPtr.Phase == VerifyPhasePending || verificationPtr.Phase == VerifyPhaseRunning)
+}
+
+// GetLocationKey 备份文件在PVC内的相对路径或S3对象名称
+func (s *PostgreSQLBackup) GetLocationKey() string {
+	storage := s.Spec.Storage
+	switch {
+	case storage.S3 != nil:
+		return strings.TrimPrefix(s.Status.Location, fmt.Sprintf("s3://%s/", storage.S3.Bucket))
+	case storage.PVC != nil:
+		return strings.TrimPrefix(s.Status.Location, fmt.Sprintf("pvc://%s/", storage.PVC.ClaimName))
+	}
+
+	return ""
+}
+
+type PostgreSQLBackup struct {
+	metav1.TypeMeta   `json:",inline,omitempty"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BackupSpec   `json:"spec"`
+	Status BackupStatus `json:"status,omitempty"`
+}
+
+type PostgreSQLBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []PostgreSQLBackup `json:"items"`
+}
+
+// ScheduleSpec 定时备份定义
+// Schedule 标准5段cron表达式，使用UTC时间
+// HistoryLimit 保留的备份资源数量，超出后删除最早完成的备份资源，备份文件不受影响
+type ScheduleSpec struct {
+	Schedule     string     `json:"schedule"`
+	Suspend      bool       `json:"suspend,omitempty"`
+	HistoryLimit int32      `json:"historyLimit,omitempty"`
+	Template     BackupSpec `json:"template"`
+}
+
+type ScheduleStatus struct {
+	Message          string       `json:"message,omitempty"`
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	LastBackup       string       `json:"lastBackup,omitempty"`
+}
+
+type PostgreSQLBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline,omitempty"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ScheduleSpec   `json:"spec"`
+	Status ScheduleStatus `json:"status,omitempty"`
+}
+
+type PostgreSQLBackupScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []PostgreSQLBackupSchedule `json:"items"`
+}
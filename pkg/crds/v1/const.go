@@ -3,3 +3,20 @@ package crds
 const Group = "database.supos.ai"
 
 const Version = "v1"
+
+// Finalizer 删除资源前需要由operator完成清理
+const Finalizer = "database.supos.ai/finalizer"
+
+// WakeAnnotation 唤醒因空闲休眠的实例，值为RFC3339时间，晚于status.lastActiveTime时视为该时间有活动
+const WakeAnnotation = "database.supos.ai/wake-time"
+
+const (
+	ReclaimKeep = "Keep"
+	ReclaimDrop = "Drop"
+)
+
+const (
+	PhasePending = "Pending"
+	PhaseReady   = "Ready"
+	PhaseFailed  = "Failed"
+)
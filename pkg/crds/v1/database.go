@@ -0,0 +1,56 @@
+package crds
+
+import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+const PostgresqlDatabase = "postgresqldatabases"
+
+// DatabasePrivilege 角色在数据库上的权限，如CONNECT、CREATE、TEMPORARY、ALL
+type DatabasePrivilege struct {
+	Role       string   `json:"role"`
+	Privileges []string `json:"privileges"`
+}
+
+// DatabaseSpec 数据库定义
+// Instance 所属PostgreSQL实例名称，与数据库资源位于同一命名空间
+// Name 数据库名称，为空时使用资源名称
+// ReclaimPolicy 删除资源时Keep保留数据库，Drop删除数据库
+type DatabaseSpec struct {
+	Instance        string              `json:"instance"`
+	Name            string              `json:"name,omitempty"`
+	Owner           string              `json:"owner,omitempty"`
+	Encoding        string              `json:"encoding,omitempty"`
+	ConnectionLimit *int32              `json:"connectionLimit,omitempty"`
+	Privileges      []DatabasePrivilege `json:"privileges,omitempty"`
+	Extensions      []Extension         `json:"extensions,omitempty"`
+	ReclaimPolicy   string              `json:"reclaimPolicy,omitempty"`
+}
+
+type DatabaseStatus struct {
+	Phase              string            `json:"phase,omitempty"`
+	Message            string            `json:"message,omitempty"`
+	ObservedGeneration int64             `json:"observedGeneration,omitempty"`
+	GrantedRoles       []string          `json:"grantedRoles,omitempty"`
+	Extensions         []ExtensionStatus `json:"extensions,omitempty"`
+}
+
+type PostgreSQLDatabase struct {
+	metav1.TypeMeta   `json:",inline,omitempty"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseSpec   `json:"spec"`
+	Status DatabaseStatus `json:"status,omitempty"`
+}
+
+func (s *PostgreSQLDatabase) GetDatabaseName() string {
+	if s.Spec.Name != "" {
+		return s.Spec.Name
+	}
+
+	return s.Name
+}
+
+type PostgreSQLDatabaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []PostgreSQLDatabase `json:"items"`
+}
@@ -0,0 +1,13 @@
+package crds
+
+// Extension 声明需要安装的扩展，Version为空时使用镜像中的默认版本
+type Extension struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// ExtensionStatus 已安装的扩展版本
+type ExtensionStatus struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
@@ -0,0 +1,44 @@
+package crds
+
+import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+const Migration = "schemamigrations"
+
+// MigrationSource 迁移脚本来源，ConfigMap与Secret二选一
+// 仅处理以.sql结尾的键，按键名排序依次执行，去掉.sql后缀作为版本号
+type MigrationSource struct {
+	ConfigMap string `json:"configMap,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+// MigrationSpec 迁移定义
+// Instance 所属PostgreSQL实例名称，Database 目标数据库
+type MigrationSpec struct {
+	Instance string          `json:"instance"`
+	Database string          `json:"database"`
+	Source   MigrationSource `json:"source"`
+}
+
+// MigrationStatus 迁移状态
+// SourceHash 最近一次执行时迁移脚本的摘要，脚本变化后重新同步
+type MigrationStatus struct {
+	Phase              string   `json:"phase,omitempty"`
+	Message            string   `json:"message,omitempty"`
+	ObservedGeneration int64    `json:"observedGeneration,omitempty"`
+	SourceHash         string   `json:"sourceHash,omitempty"`
+	AppliedVersions    []string `json:"appliedVersions,omitempty"`
+}
+
+type SchemaMigration struct {
+	metav1.TypeMeta   `json:",inline,omitempty"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MigrationSpec   `json:"spec"`
+	Status MigrationStatus `json:"status,omitempty"`
+}
+
+type SchemaMigrationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []SchemaMigration `json:"items"`
+}
@@ -1,14 +1,285 @@
 package crds
 
-import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-const Postgresql = "postgresqls"
+	"supos.ai/operator/database/pkg/common"
+)
 
+const (
+	Postgresql     = "postgresqls"
+	PostgreSQLKind = "PostgreSQL"
+)
+
+// 实例阶段，从备份初始化的实例恢复完成后才进入Running
+// 休眠的实例依次经过Hibernating、Hibernated，恢复时经过Resuming，数据库可连接后回到Running
+const (
+	InstancePhaseCreating    = "Creating"
+	InstancePhaseRestoring   = "Restoring"
+	InstancePhaseRunning     = "Running"
+	InstancePhaseHibernating = "Hibernating"
+	InstancePhaseHibernated  = "Hibernated"
+	InstancePhaseResuming    = "Resuming"
+)
+
+// Security 数据库Pod的安全选项，UID/GID由数据库类型决定
+type Security struct {
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	FixPermissions bool   `json:"fixPermissions,omitempty"`
+}
+
+// HBARule pg_hba.conf规则
+// Type 取值local、host、hostssl、hostnossl，local规则不能指定Address
+// Database、User 多个名称以逗号分隔，all表示全部
+// Method 取值scram-sha-256、md5、cert、reject，cert仅用于hostssl
+type HBARule struct {
+	Type     string `json:"type"`
+	Database string `json:"database"`
+	User     string `json:"user"`
+	Address  string `json:"address,omitempty"`
+	Method   string `json:"method"`
+}
+
+// ArchiveSpec 持续WAL归档与定时基础备份
+// Schedule 基础备份的5段cron表达式，使用UTC时间，默认每天0点
+// Retention 保留的基础备份数量，早于最早保留基础备份的WAL一并清理，默认7
+type ArchiveSpec struct {
+	Storage   BackupStorage `json:"storage"`
+	Schedule  string        `json:"schedule,omitempty"`
+	Retention int32         `json:"retention,omitempty"`
+}
+
+// StorageSpec 数据卷存储，ClassName为空时使用local-path
+// 快照备份与从快照创建实例需要使用支持VolumeSnapshot的CSI存储类
+// AutoGrow 使用率超过阈值时自动扩容，存储类需开启allowVolumeExpansion
+type StorageSpec struct {
+	ClassName string        `json:"className,omitempty"`
+	Size      string        `json:"size,omitempty"`
+	AutoGrow  *AutoGrowSpec `json:"autoGrow,omitempty"`
+}
+
+// AutoGrowSpec Threshold 触发扩容的使用率百分比，为0时使用80
+// Step 每次扩容增加的容量，为空时使用10Gi，MaxSize 扩容后的最大容量
+type AutoGrowSpec struct {
+	Threshold int32  `json:"threshold,omitempty"`
+	Step      string `json:"step,omitempty"`
+	MaxSize   string `json:"maxSize"`
+}
+
+// StorageStatus 数据卷使用情况，取各成员中使用率最高的数据卷
+// Size 自动扩容后的容量，大于spec.storage.size时作为数据卷容量
+// Capacity/Used 文件系统的容量与已用空间，UsedPercent 已用百分比
+type StorageStatus struct {
+	Size           string       `json:"size,omitempty"`
+	Capacity       string       `json:"capacity,omitempty"`
+	Used           string       `json:"used,omitempty"`
+	UsedPercent    int32        `json:"usedPercent,omitempty"`
+	LastExpandTime *metav1.Time `json:"lastExpandTime,omitempty"`
+}
+
+// ReplicationSpec 流复制，Standbys为热备节点数量，每个节点使用独立的数据卷并通过复制槽从主节点复制
+// SwitchoverTo 计划内切换的目标备节点，与当前主节点不同且未对该目标执行过切换时触发
+type ReplicationSpec struct {
+	Standbys     int32  `json:"standbys"`
+	SwitchoverTo string `json:"switchoverTo,omitempty"`
+}
+
+// PoolerSpec PgBouncer连接池，通过<name>-pooler Service访问，用户列表由实例下可登录的受管角色生成
+// Mode 取值session、transaction、statement，默认transaction
+// PoolSize 每个用户与数据库组合的服务端连接数，默认20
+// MaxClientConn 每个连接池Pod的客户端连接上限，默认200
+// Replicas 连接池Pod数量，默认1
+type PoolerSpec struct {
+	Image         string `json:"image,omitempty"`
+	Mode          string `json:"mode,omitempty"`
+	PoolSize      int32  `json:"poolSize,omitempty"`
+	MaxClientConn int32  `json:"maxClientConn,omitempty"`
+	Replicas      int32  `json:"replicas,omitempty"`
+}
+
+// RunningWindow 运行时段，Start与Stop为5段cron表达式，使用UTC时间，如工作日8点到20点为"0 8 * * 1-5"与"0 20 * * 1-5"
+type RunningWindow struct {
+	Start string `json:"start"`
+	Stop  string `json:"stop"`
+}
+
+// RunningSchedule Running 运行时段，不在任何运行时段内的实例自动休眠，进入运行时段后自动恢复
+// KeepRunningUntil 在此之前不按运行时段休眠，用于临时使用非运行时段的实例
+type RunningSchedule struct {
+	Running          []RunningWindow `json:"running,omitempty"`
+	KeepRunningUntil *metav1.Time    `json:"keepRunningUntil,omitempty"`
+}
+
+// AutoPauseSpec IdleMinutes 连续无客户端连接的分钟数，超出后自动休眠，由start接口或WakeAnnotation唤醒
+type AutoPauseSpec struct {
+	IdleMinutes int32 `json:"idleMinutes"`
+}
+
+// Spec 实例定义
+// Extensions 安装到postgres库及实例下所有受管数据库的扩展
+// HBA 为空时允许所有用户从任意地址以scram-sha-256认证连接，root只能从operator配置的Pod网段连接
+// Bootstrap 实例初始化方式，仅在创建时生效
+// Scheduling 实例Pod的nodeSelector、tolerations与affinity，修改后成员Pod按Recreate策略重建
+// Resources 数据库容器的CPU与内存，设置后按内存limits计算shared_buffers等参数，修改后先重建备节点再重建主节点
 type Spec struct {
-	Image string `json:"image"`
+	Image      string             `json:"image"`
+	Resources  *common.Resources  `json:"resources,omitempty"`
+	Access     *common.Access     `json:"access,omitempty"`
+	Scheduling *common.Scheduling `json:"scheduling,omitempty"`
+	Security   *Security          `json:"security,omitempty"`
+	Extensions []Extension        `json:"extensions,omitempty"`
+	HBA        []HBARule          `json:"hba,omitempty"`
+	Bootstrap  *common.Bootstrap  `json:"bootstrap,omitempty"`
+	Archive    *ArchiveSpec       `json:"archive,omitempty"`
+	Storage    *StorageSpec       `json:"storage,omitempty"`
+	// Replication 一主多备的流复制，为空时只有一个节点
+	Replication *ReplicationSpec `json:"replication,omitempty"`
+	// Pooler 实例前的连接池，为空时不部署
+	Pooler *PoolerSpec `json:"pooler,omitempty"`
+	// Hibernate 为true时执行checkpoint后停止实例全部成员与连接池的Pod，保留数据卷，改回false时恢复
+	Hibernate bool `json:"hibernate,omitempty"`
+	// Schedule 按运行时段自动休眠与恢复
+	Schedule *RunningSchedule `json:"schedule,omitempty"`
+	// AutoPause 无客户端连接时自动休眠，为空时不检查连接
+	AutoPause *AutoPauseSpec `json:"autoPause,omitempty"`
 }
 
+// RestoreStatus 从备份恢复的进度，Phase取值Running、Succeeded、Failed
+// Checksum 校验通过的备份文件sha256，Tables/Rows 恢复后校验过行数的表数量与总行数
+type RestoreStatus struct {
+	Backup         string       `json:"backup"`
+	Phase          string       `json:"phase,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	JobName        string       `json:"jobName,omitempty"`
+	Checksum       string       `json:"checksum,omitempty"`
+	Tables         int64        `json:"tables,omitempty"`
+	Rows           int64        `json:"rows,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// CloneStatus 克隆进度，Method为选定的复制方式，Backup为对源实例创建的备份
+// ScriptApplied 脱敏脚本已执行，未指定脚本时恢复完成即完成克隆
+type CloneStatus struct {
+	Source        string `json:"source"`
+	Method        string `json:"method,omitempty"`
+	Backup        string `json:"backup,omitempty"`
+	ScriptApplied bool   `json:"scriptApplied,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+// MemberStatus 实例成员，State为备节点在主节点pg_stat_replication中的状态，未连接时为空
+type MemberStatus struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	State string `json:"state,omitempty"`
+}
+
+// FailoverRecord 主节点切换记录，LSN为新主节点提升前的回放位置
+type FailoverRecord struct {
+	Time   metav1.Time `json:"time"`
+	From   string      `json:"from"`
+	To     string      `json:"to"`
+	Reason string      `json:"reason"`
+	LSN    string      `json:"lsn,omitempty"`
+}
+
+// 计划内切换的阶段
+const (
+	SwitchoverPhaseCatchingUp = "CatchingUp"
+	SwitchoverPhaseDemoted    = "Demoted"
+	SwitchoverPhaseSucceeded  = "Succeeded"
+	SwitchoverPhaseFailed     = "Failed"
+)
+
+// SwitchoverStatus 计划内切换的进度，Demoted阶段原主节点已隔离，LSN为原主节点停止后目标备节点接收到的最终WAL位置
+// TransitionTime 进入当前阶段的时间，用于判断各阶段是否超时
+type SwitchoverStatus struct {
+	Target         string       `json:"target"`
+	Phase          string       `json:"phase"`
+	Message        string       `json:"message,omitempty"`
+	LSN            string       `json:"lsn,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	TransitionTime *metav1.Time `json:"transitionTime,omitempty"`
+}
+
+// IsRunning 切换尚未结束
+func (s *SwitchoverStatus) IsRunning() bool {
+	return s != nil && (s.Phase == SwitchoverPhaseCatchingUp || s.Phase == SwitchoverPhaseDemoted)
+}
+
+// ReplicationStatus Primary为当前主节点的成员名称，History为最近的主节点切换记录
+// Switchover 最近一次计划内切换
+type ReplicationStatus struct {
+	Primary    string            `json:"primary"`
+	Members    []MemberStatus    `json:"members,omitempty"`
+	History    []FailoverRecord  `json:"history,omitempty"`
+	Switchover *SwitchoverStatus `json:"switchover,omitempty"`
+}
+
+// Status 实例状态，ObservedGeneration为已完成扩展与HBA同步的generation
+// HBAHash 服务端已加载的pg_hba.conf摘要
+// SuperuserHash 已设置的超级用户口令摘要，与超级用户Secret中口令的摘要不一致时重新设置口令
+// HibernatedTime 进入休眠的时间，HibernationReason 休眠原因，恢复后清空
+// LastActiveTime 最近一次检测到客户端连接的时间，仅配置AutoPause时记录
+// Storage 数据卷的使用情况与自动扩容后的容量
 type Status struct {
+	Phase              string             `json:"phase,omitempty"`
+	Message            string             `json:"message,omitempty"`
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Extensions         []ExtensionStatus  `json:"extensions,omitempty"`
+	HBAHash            string             `json:"hbaHash,omitempty"`
+	SuperuserHash      string             `json:"superuserHash,omitempty"`
+	Restore            *RestoreStatus     `json:"restore,omitempty"`
+	Clone              *CloneStatus       `json:"clone,omitempty"`
+	Replication        *ReplicationStatus `json:"replication,omitempty"`
+	HibernatedTime     *metav1.Time       `json:"hibernatedTime,omitempty"`
+	HibernationReason  string             `json:"hibernationReason,omitempty"`
+	LastActiveTime     *metav1.Time       `json:"lastActiveTime,omitempty"`
+	Storage            *StorageStatus     `json:"storage,omitempty"`
+}
+
+// IsRestorePending 从备份、WAL归档、快照或克隆初始化且尚未恢复成功，克隆指定脚本时还需脚本执行完成
+func (s *PostgreSQL) IsRestorePending() bool {
+	bootstrap := s.Spec.Bootstrap
+	if bootstrap == nil || (bootstrap.FromBackup == nil && bootstrap.FromArchive == nil && bootstrap.FromSnapshot == nil && bootstrap.CloneFrom == nil) {
+		return false
+	}
+	if s.Status.Restore == nil || s.Status.Restore.Phase != common.RestoreSucceeded {
+		return true
+	}
+
+	cloneFrom := bootstrap.CloneFrom
+	return cloneFrom != nil && cloneFrom.Script != "" && (s.Status.Clone == nil || !s.Status.Clone.ScriptApplied)
+}
+
+// GetBootstrap 克隆的实例按选定的复制方式转换为对应的初始化方式，尚未选定时返回原定义
+func (s *PostgreSQL) GetBootstrap() *common.Bootstrap {
+	bootstrap := s.Spec.Bootstrap
+	clonePtr := s.Status.Clone
+	if bootstrap == nil || bootstrap.CloneFrom == nil || clonePtr == nil || clonePtr.Backup == "" {
+		return bootstrap
+	}
+
+	switch clonePtr.Method {
+	case BackupMethodSnapshot:
+		return &common.Bootstrap{FromSnapshot: &common.SnapshotSource{Backup: clonePtr.Backup}}
+	case BackupMethodBase:
+		return &common.Bootstrap{FromArchive: &common.ArchiveSource{Instance: clonePtr.Source}}
+	case BackupMethodLogical:
+		return &common.Bootstrap{FromBackup: &common.BackupSource{Backup: clonePtr.Backup}}
+	}
+
+	return bootstrap
+}
+
+// GetPrimary 当前主节点的成员名称，未开启流复制或尚未记录时为实例同名成员
+func (s *PostgreSQL) GetPrimary() string {
+	if s.Status.Replication == nil || s.Status.Replication.Primary == "" {
+		return s.Name
+	}
+
+	return s.Status.Replication.Primary
 }
 
 type PostgreSQL struct {
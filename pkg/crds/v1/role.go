@@ -0,0 +1,59 @@
+package crds
+
+import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+const PostgresqlRole = "postgresqlroles"
+
+// RoleSpec 角色定义
+// Instance 所属PostgreSQL实例名称，与角色资源位于同一命名空间
+// Name 角色名称，为空时使用资源名称
+// ConnectionLimit 为空时不限制连接数
+// ReclaimPolicy 删除资源时Keep保留角色，Drop删除角色及凭证Secret
+type RoleSpec struct {
+	Instance        string   `json:"instance"`
+	Name            string   `json:"name,omitempty"`
+	Login           bool     `json:"login,omitempty"`
+	CreateDB        bool     `json:"createDB,omitempty"`
+	CreateRole      bool     `json:"createRole,omitempty"`
+	ConnectionLimit *int32   `json:"connectionLimit,omitempty"`
+	MemberOf        []string `json:"memberOf,omitempty"`
+	ReclaimPolicy   string   `json:"reclaimPolicy,omitempty"`
+}
+
+// RoleStatus 角色状态
+// PasswordHash 已设置口令的摘要，与凭证Secret中口令的摘要不一致时重新设置口令
+type RoleStatus struct {
+	Phase              string   `json:"phase,omitempty"`
+	Message            string   `json:"message,omitempty"`
+	ObservedGeneration int64    `json:"observedGeneration,omitempty"`
+	SecretName         string   `json:"secretName,omitempty"`
+	PasswordHash       string   `json:"passwordHash,omitempty"`
+	MemberOf           []string `json:"memberOf,omitempty"`
+}
+
+type PostgreSQLRole struct {
+	metav1.TypeMeta   `json:",inline,omitempty"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RoleSpec   `json:"spec"`
+	Status RoleStatus `json:"status,omitempty"`
+}
+
+func (s *PostgreSQLRole) GetRoleName() string {
+	if s.Spec.Name != "" {
+		return s.Spec.Name
+	}
+
+	return s.Name
+}
+
+// GetSecretName 角色凭证所在Secret，使用资源名称以满足Secret命名规则
+func (s *PostgreSQLRole) GetSecretName() string {
+	return s.Spec.Instance + "-" + s.Name + "-credentials"
+}
+
+type PostgreSQLRoleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []PostgreSQLRole `json:"items"`
+}